@@ -0,0 +1,246 @@
+// Copyright ©2025 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"time"
+)
+
+// alert is a notification of a change in the condition of the device.
+type alert struct {
+	Name   string `json:"alert"`
+	State  string `json:"state"`
+	Detail string `json:"detail,omitempty"`
+	// Message is a description of the alert
+	// in the configured language.
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+}
+
+// raise delivers a to the notification sinks configured for its event and
+// publishes the device's availability.
+func (m *mitm) raise(ctx context.Context, a alert) {
+	a.Time = m.clock.now()
+	m.publishAvailability(ctx)
+	for _, s := range m.config().Notify.sinks(a.Name) {
+		m.sinks[s].notify(ctx, a)
+	}
+}
+
+// sleepFrame is the frame sent by the controller before it stops
+// sending frames after its watchdog timeout.
+var sleepFrame = newFrame(controllerStart, 0xff, 0xff, 0xff)
+
+// controllerFrame records the arrival of a frame from the controller.
+func (m *mitm) controllerFrame(pkt []byte) {
+	m.lastFrame.Store(time.Now().UnixNano())
+	m.controllerAsleep.Store(bytes.Equal(pkt, sleepFrame))
+}
+
+// serverStartTimeout is the longest time the network and
+// Bluetooth servers wait for the controller before starting.
+const serverStartTimeout = 15 * time.Second
+
+// networkStartTimeout is the longest time spent trying to join
+// the network before the device reports itself as offline. The
+// network continues to be retried in the background.
+const networkStartTimeout = 30 * time.Second
+
+// networkRetry is the time to wait before retrying a network
+// setup that failed other than by timing out.
+const networkRetry = 10 * time.Second
+
+// awaitController waits until a height has been decoded from a controller
+// frame or timeout has elapsed. It returns whether a height was decoded.
+func (m *mitm) awaitController(ctx context.Context, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for !m.heightKnown.Load() {
+		if ctx.Err() != nil || time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return true
+}
+
+// degraded returns a description of the reason the device is unable to
+// report the desk state, or the empty string if it is able to.
+func (m *mitm) degraded() string {
+	if !m.heightKnown.Load() || m.controllerLost.Load() {
+		return "degraded: no controller"
+	}
+	return ""
+}
+
+// Health states.
+const (
+	healthOK        = "ok"
+	healthRecovered = "recovered" // The persistent state was recovered from corruption.
+	healthDegraded  = "degraded"  // The device cannot report the desk state.
+)
+
+// healthReport is the health of the device.
+type healthReport struct {
+	Status     string      `json:"status"`
+	Controller bool        `json:"controller"` // The controller is responding.
+	Network    string      `json:"network"`
+	Store      storeHealth `json:"store"`
+}
+
+// health returns the health of the device.
+func (m *mitm) health() healthReport {
+	h := healthReport{
+		Status:     healthOK,
+		Controller: !m.controllerLost.Load(),
+		Network:    m.networkStatus(),
+		Store:      m.store.status(),
+	}
+	switch {
+	case m.degraded() != "":
+		h.Status = healthDegraded
+	case !h.Store.ok():
+		h.Status = healthRecovered
+	}
+	return h
+}
+
+// probeReport is the result of a liveness or readiness probe.
+type probeReport struct {
+	OK     bool         `json:"ok"`
+	Checks []probeCheck `json:"checks"`
+}
+
+// probeCheck is the result of a single check of a probe.
+type probeCheck struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// add appends the check to the report, failing the report if the check
+// failed.
+func (r *probeReport) add(name string, ok bool, detail string) {
+	r.Checks = append(r.Checks, probeCheck{Name: name, OK: ok, Detail: detail})
+	r.OK = r.OK && ok
+}
+
+// String returns the report as text, one check per line.
+func (r probeReport) String() string {
+	var buf strings.Builder
+	for _, c := range r.Checks {
+		buf.WriteString(c.Name)
+		if c.OK {
+			buf.WriteString(" ok")
+		} else {
+			buf.WriteString(" fail")
+		}
+		if c.Detail != "" {
+			buf.WriteString(": ")
+			buf.WriteString(c.Detail)
+		}
+		buf.WriteByte('\n')
+	}
+	return buf.String()
+}
+
+// liveness returns whether the firmware is running normally; the tasks
+// the hardware watchdog depends on are making progress and no restart is
+// pending. A device that is not live will restart, or is restarting.
+func (m *mitm) liveness() probeReport {
+	r := probeReport{OK: true}
+	if t := m.tasks.stalled(m.config().Watchdog.Tasks); t != nil {
+		r.add("watchdog", false, "task stalled: "+t.name)
+	} else {
+		r.add("watchdog", true, "")
+	}
+	if m.draining.Load() {
+		r.add("restart", false, "restart pending")
+	} else {
+		r.add("restart", true, "")
+	}
+	return r
+}
+
+// readiness returns whether the device is able to serve the desk; the
+// controller is reporting the height, the network is up and the clock
+// has been synced if a time server is configured.
+func (m *mitm) readiness() probeReport {
+	r := probeReport{OK: true}
+	switch {
+	case m.controllerLost.Load():
+		r.add("controller", false, "no frames from controller")
+	case !m.heightKnown.Load():
+		r.add("controller", false, "height not known")
+	default:
+		r.add("controller", true, "")
+	}
+	if status := m.networkStatus(); status == networkOnline {
+		r.add("network", true, "")
+	} else {
+		r.add("network", false, status)
+	}
+	switch {
+	case m.clock.isSynced():
+		r.add("clock", true, "")
+	case m.config().NTP.Server == "":
+		r.add("clock", true, "no time server")
+	default:
+		r.add("clock", false, "not synced")
+	}
+	return r
+}
+
+// Network states.
+const (
+	networkDisabled = "disabled" // The firmware is built without network support.
+	networkStarting = "starting" // The network is being joined or set up.
+	networkOnline   = "online"
+	networkOffline  = "offline" // The network could not be joined and is being retried.
+)
+
+// networkStatus returns the state of the network.
+func (m *mitm) networkStatus() string {
+	switch {
+	case !useHTTP:
+		return networkDisabled
+	case m.net.Load() != nil:
+		return networkOnline
+	case m.offline.Load():
+		return networkOffline
+	default:
+		return networkStarting
+	}
+}
+
+// watchController raises an alert when the controller has been silent for
+// longer than the configured window without having announced that it is
+// going to sleep, and clears the alert when frames resume.
+func (m *mitm) watchController(ctx context.Context) {
+	m.lastFrame.Store(time.Now().UnixNano())
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		window := time.Duration(m.config().ControllerSilence)
+		quiet := time.Since(time.Unix(0, m.lastFrame.Load()))
+		silent := window > 0 && quiet > window && !m.controllerAsleep.Load()
+		switch {
+		case silent && !m.controllerLost.Load():
+			m.controllerLost.Store(true)
+			m.powerLost.Store(true)
+			m.raise(ctx, alert{Name: eventController, State: "offline", Detail: "no frames for " + quiet.Round(time.Second).String(), Message: m.text(msgControllerOffline)})
+		case !silent && m.controllerLost.Load():
+			m.controllerLost.Store(false)
+			m.raise(ctx, alert{Name: eventController, State: "online", Message: m.text(msgControllerOnline)})
+		}
+	}
+}
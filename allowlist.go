@@ -0,0 +1,152 @@
+// Copyright ©2025 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+var errAllowLockout = errors.New("allowlist does not include the client making the change")
+
+// parseAllowlist returns the CIDR prefixes in allow, or an error if any
+// entry is not a CIDR prefix.
+func parseAllowlist(allow []string) ([]netip.Prefix, error) {
+	if len(allow) == 0 {
+		return nil, nil
+	}
+	prefixes := make([]netip.Prefix, len(allow))
+	for i, p := range allow {
+		prefix, err := netip.ParsePrefix(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowlist prefix: %q", p)
+		}
+		prefixes[i] = prefix
+	}
+	return prefixes, nil
+}
+
+// allowedAddr returns whether addr is within one of the prefixes in allow.
+// All addresses are allowed if allow is empty.
+func allowedAddr(allow []netip.Prefix, addr netip.Addr) bool {
+	if len(allow) == 0 {
+		return true
+	}
+	addr = addr.Unmap()
+	for _, prefix := range allow {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowedClient returns whether addr is within the configured allowlist.
+func (m *mitm) allowedClient(addr netip.Addr) bool {
+	allow := m.allow.Load()
+	return allow == nil || allowedAddr(*allow, addr)
+}
+
+// checkAllowClient returns errAllowLockout if the allowlist in allow would
+// exclude the client at remote, the address of the client making the
+// change, so that a client cannot lock itself out.
+func checkAllowClient(allow []string, remote string) error {
+	prefixes, err := parseAllowlist(allow)
+	if err != nil || len(prefixes) == 0 {
+		return err
+	}
+	addr, err := netip.ParseAddrPort(remote)
+	if err != nil {
+		return err
+	}
+	if !allowedAddr(prefixes, addr.Addr()) {
+		return errAllowLockout
+	}
+	return nil
+}
+
+// allowListener is a net.Listener that closes connections from clients
+// outside the configured allowlist as they are accepted, so that no
+// request from them is read.
+type allowListener struct {
+	net.Listener
+	ctx context.Context
+	m   *mitm
+}
+
+// Accept returns the next connection from an allowed client. Accepted
+// connections are tracked in the connection table until they are closed.
+// While the device is draining before a restart, all connections are
+// closed as they are accepted.
+func (l allowListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return conn, err
+		}
+		if l.m.draining.Load() {
+			l.m.logFor("http").LogAttrs(l.ctx, slog.LevelDebug, "connection refused while draining", slog.String("remote", conn.RemoteAddr().String()))
+			conn.Close()
+			continue
+		}
+		addr, err := netip.ParseAddrPort(conn.RemoteAddr().String())
+		if err == nil && l.m.allowedClient(addr.Addr()) {
+			l.m.metrics.tcpConns.Add(1)
+			id := l.m.conns.add(connTCP, conn.RemoteAddr().String(), time.Now(), conn.Close)
+			return &countedConn{Conn: conn, id: id, table: &l.m.conns}, nil
+		}
+		l.m.metrics.rejected.Add(1)
+		l.m.logFor("http").LogAttrs(l.ctx, slog.LevelDebug, "connection rejected", slog.String("remote", conn.RemoteAddr().String()))
+		conn.Close()
+	}
+}
+
+// countedConn is a net.Conn that is tracked in a connection table.
+type countedConn struct {
+	net.Conn
+	id    uint32
+	table *connTable
+	once  sync.Once
+}
+
+// Close closes the connection and removes it from the table.
+func (c *countedConn) Close() error {
+	c.once.Do(func() { c.table.remove(c.id, time.Now()) })
+	return c.Conn.Close()
+}
+
+// connKey is the context key for the tracked connection ID of a request.
+type connKey struct{}
+
+// connContext returns ctx annotated with the tracked connection ID of c.
+func connContext(ctx context.Context, c net.Conn) context.Context {
+	if c, ok := c.(*countedConn); ok {
+		return context.WithValue(ctx, connKey{}, c.id)
+	}
+	return ctx
+}
+
+// connID returns the tracked connection ID of r, or zero if the
+// connection is not tracked.
+func connID(r *http.Request) uint32 {
+	id, _ := r.Context().Value(connKey{}).(uint32)
+	return id
+}
+
+// trackConns wraps h to record the endpoint being served by each tracked
+// connection.
+func (m *mitm) trackConns(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.conns.serving(connID(r), r.Method+" "+r.URL.Path)
+		h.ServeHTTP(w, r)
+	})
+}
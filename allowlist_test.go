@@ -0,0 +1,81 @@
+// Copyright ©2025 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/netip"
+	"testing"
+)
+
+var allowedAddrTests = []struct {
+	allow []string
+	addr  string
+	want  bool
+}{
+	{allow: nil, addr: "203.0.113.7", want: true},
+	{allow: []string{"192.168.1.0/24"}, addr: "192.168.1.5", want: true},
+	{allow: []string{"192.168.1.0/24"}, addr: "192.168.2.5", want: false},
+	{allow: []string{"192.168.1.0/24"}, addr: "::ffff:192.168.1.5", want: true},
+	{allow: []string{"192.168.1.5/32"}, addr: "192.168.1.5", want: true},
+	{allow: []string{"192.168.1.5/32"}, addr: "192.168.1.6", want: false},
+	{allow: []string{"10.0.0.0/8", "192.168.1.0/24"}, addr: "10.1.2.3", want: true},
+	{allow: []string{"10.0.0.0/8", "192.168.1.0/24"}, addr: "172.16.0.1", want: false},
+	{allow: []string{"fd00::/8"}, addr: "fd12::1", want: true},
+	{allow: []string{"fd00::/8"}, addr: "192.168.1.5", want: false},
+	{allow: []string{"0.0.0.0/0"}, addr: "203.0.113.7", want: true},
+}
+
+func TestAllowedAddr(t *testing.T) {
+	for _, test := range allowedAddrTests {
+		allow, err := parseAllowlist(test.allow)
+		if err != nil {
+			t.Fatalf("unexpected error parsing %q: %v", test.allow, err)
+		}
+		got := allowedAddr(allow, netip.MustParseAddr(test.addr))
+		if got != test.want {
+			t.Errorf("unexpected result for %s in %q: got:%t want:%t", test.addr, test.allow, got, test.want)
+		}
+	}
+}
+
+var parseAllowlistTests = []struct {
+	allow   []string
+	wantErr bool
+}{
+	{allow: nil},
+	{allow: []string{"192.168.1.0/24", "fd00::/8"}},
+	{allow: []string{"invalid", "192.168.1.0/24"}, wantErr: true},
+	{allow: []string{"192.168.1.5"}, wantErr: true},
+}
+
+func TestParseAllowlist(t *testing.T) {
+	for _, test := range parseAllowlistTests {
+		_, err := parseAllowlist(test.allow)
+		if (err != nil) != test.wantErr {
+			t.Errorf("unexpected error for %q: got:%v want error:%t", test.allow, err, test.wantErr)
+		}
+	}
+}
+
+var checkAllowClientTests = []struct {
+	allow  []string
+	remote string
+	want   error
+}{
+	{allow: nil, remote: "192.168.1.5:49152", want: nil},
+	{allow: []string{"192.168.1.0/24"}, remote: "192.168.1.5:49152", want: nil},
+	{allow: []string{"192.168.1.0/24"}, remote: "[::ffff:192.168.1.5]:49152", want: nil},
+	{allow: []string{"192.168.1.0/24"}, remote: "192.168.2.5:49152", want: errAllowLockout},
+	{allow: []string{"10.0.0.0/8"}, remote: "[fd12::1]:49152", want: errAllowLockout},
+}
+
+func TestCheckAllowClient(t *testing.T) {
+	for _, test := range checkAllowClientTests {
+		got := checkAllowClient(test.allow, test.remote)
+		if got != test.want {
+			t.Errorf("unexpected result for %s with %q: got:%v want:%v", test.remote, test.allow, got, test.want)
+		}
+	}
+}
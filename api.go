@@ -0,0 +1,171 @@
+// Copyright ©2025 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build http || !bluetooth
+
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// apiEndpoint is an entry in the HTTP API index.
+type apiEndpoint struct {
+	Path    string   `json:"path"`
+	Methods []string `json:"methods"`
+	Summary string   `json:"summary"`
+	// Feature is the name of the feature that the
+	// endpoint depends on, if any.
+	Feature string     `json:"feature,omitempty"`
+	Params  []apiParam `json:"params,omitempty"`
+}
+
+// apiParam is a query parameter of an endpoint.
+type apiParam struct {
+	Name string `json:"name"`
+	Type string `json:"type"` // OpenAPI schema type.
+	// Method is the method that the parameter
+	// applies to, or empty for all methods.
+	Method   string   `json:"method,omitempty"`
+	Required bool     `json:"required,omitempty"`
+	Enum     []string `json:"enum,omitempty"`
+}
+
+var (
+	// formatParam is the parameter selecting a JSON response.
+	formatParam = apiParam{Name: "format", Type: "string", Enum: []string{"json"}}
+	// presetEnum is the set of memory preset numbers.
+	presetEnum = []string{"1", "2", "3", "4"}
+)
+
+// apiRoutes registers HTTP endpoints with a mux, recording each in the
+// index used for the API index and the OpenAPI description so that the
+// two cannot diverge.
+type apiRoutes struct {
+	mux       *http.ServeMux
+	endpoints []apiEndpoint
+}
+
+// handle registers h for each of the methods of e on the mux and adds e to
+// the index. A path ending in a slash matches only that path.
+func (a *apiRoutes) handle(e apiEndpoint, h http.Handler) {
+	pattern := e.Path
+	if strings.HasSuffix(pattern, "/") {
+		pattern += "{$}"
+	}
+	for _, method := range e.Methods {
+		a.mux.Handle(method+" "+pattern, h)
+	}
+	a.endpoints = append(a.endpoints, e)
+}
+
+// alias serves requests for the unversioned path alias with the endpoint
+// registered at path, so that clients using the paths documented before
+// the API was versioned keep working. Aliases are not added to the index.
+func (a *apiRoutes) alias(alias, path string) {
+	a.mux.Handle(alias+"{$}", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u := *r.URL
+		u.Path = path
+		u.RawPath = ""
+		r2 := *r
+		r2.URL = &u
+		a.mux.ServeHTTP(w, &r2)
+	}))
+}
+
+// handleFunc is like handle for a handler function.
+func (a *apiRoutes) handleFunc(e apiEndpoint, h http.HandlerFunc) {
+	a.handle(e, h)
+}
+
+// apiIndex is the self-description of the HTTP API.
+type apiIndex struct {
+	Endpoints []apiEndpoint `json:"endpoints"`
+	// Features is the availability of optional
+	// features in the running firmware and
+	// configuration.
+	Features map[string]bool `json:"features"`
+}
+
+// features returns the availability of optional features in the running
+// firmware and configuration.
+func (m *mitm) features() map[string]bool {
+	cfg := m.config()
+	return map[string]bool{
+		"bluetooth":  useBluetooth,
+		"relay":      cfg.Relay.Pin != 0,
+		"mqtt":       cfg.MQTT.Broker != "",
+		"webhook":    cfg.Webhook != "",
+		"telemetry":  cfg.Telemetry.Collector != "",
+		"usage_ping": cfg.UsagePing.URL != "",
+		"ddns":       cfg.DDNS.URL != "",
+	}
+}
+
+// openAPIDoc is an OpenAPI 3 description of the HTTP API.
+type openAPIDoc struct {
+	OpenAPI string                                 `json:"openapi"`
+	Info    openAPIInfo                            `json:"info"`
+	Paths   map[string]map[string]openAPIOperation `json:"paths"`
+}
+
+type openAPIInfo struct {
+	Title   string `json:"title"`
+	Version string `json:"version"`
+}
+
+type openAPIOperation struct {
+	Summary    string                     `json:"summary"`
+	Parameters []openAPIParameter         `json:"parameters,omitempty"`
+	Responses  map[string]openAPIResponse `json:"responses"`
+}
+
+type openAPIParameter struct {
+	Name     string        `json:"name"`
+	In       string        `json:"in"`
+	Required bool          `json:"required,omitempty"`
+	Schema   openAPISchema `json:"schema"`
+}
+
+type openAPISchema struct {
+	Type string   `json:"type"`
+	Enum []string `json:"enum,omitempty"`
+}
+
+type openAPIResponse struct {
+	Description string `json:"description"`
+}
+
+// openAPI returns an OpenAPI description of endpoints.
+func openAPI(endpoints []apiEndpoint) openAPIDoc {
+	doc := openAPIDoc{
+		OpenAPI: "3.0.3",
+		Info:    openAPIInfo{Title: "desk", Version: "1"},
+		Paths:   make(map[string]map[string]openAPIOperation),
+	}
+	for _, e := range endpoints {
+		ops := make(map[string]openAPIOperation)
+		for _, method := range e.Methods {
+			op := openAPIOperation{
+				Summary:   e.Summary,
+				Responses: map[string]openAPIResponse{"200": {Description: "OK"}},
+			}
+			for _, p := range e.Params {
+				if p.Method != "" && p.Method != method {
+					continue
+				}
+				op.Parameters = append(op.Parameters, openAPIParameter{
+					Name:     p.Name,
+					In:       "query",
+					Required: p.Required,
+					Schema:   openAPISchema{Type: p.Type, Enum: p.Enum},
+				})
+			}
+			ops[strings.ToLower(method)] = op
+		}
+		doc.Paths[e.Path] = ops
+	}
+	return doc
+}
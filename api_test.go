@@ -0,0 +1,51 @@
+// Copyright ©2025 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build http || !bluetooth
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+var aliasTests = []struct {
+	method string
+	target string
+	want   int
+	body   string
+}{
+	{method: http.MethodPut, target: "/api/v1/move_to?position=2", want: http.StatusOK, body: "/api/v1/move_to 2"},
+	{method: http.MethodPut, target: "/move_to/?position=2", want: http.StatusOK, body: "/api/v1/move_to 2"},
+	{method: http.MethodGet, target: "/move_to/?position=2", want: http.StatusMethodNotAllowed},
+	{method: http.MethodPut, target: "/move_to/1", want: http.StatusNotFound},
+	{method: http.MethodGet, target: "/height/", want: http.StatusOK, body: "/api/v1/height "},
+}
+
+func TestAlias(t *testing.T) {
+	routes := &apiRoutes{mux: http.NewServeMux()}
+	echo := func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path + " " + r.URL.Query().Get("position")))
+	}
+	routes.handleFunc(apiEndpoint{Path: "/api/v1/move_to", Methods: []string{http.MethodPut}}, echo)
+	routes.handleFunc(apiEndpoint{Path: "/api/v1/height", Methods: []string{http.MethodGet}}, echo)
+	routes.alias("/move_to/", "/api/v1/move_to")
+	routes.alias("/height/", "/api/v1/height")
+	if len(routes.endpoints) != 2 {
+		t.Errorf("unexpected number of indexed endpoints: got:%d want:2", len(routes.endpoints))
+	}
+	for _, test := range aliasTests {
+		w := httptest.NewRecorder()
+		routes.mux.ServeHTTP(w, httptest.NewRequest(test.method, test.target, nil))
+		if w.Code != test.want {
+			t.Errorf("unexpected status for %s %s: got:%d want:%d", test.method, test.target, w.Code, test.want)
+			continue
+		}
+		if test.body != "" && w.Body.String() != test.body {
+			t.Errorf("unexpected body for %s %s: got:%q want:%q", test.method, test.target, w.Body.String(), test.body)
+		}
+	}
+}
@@ -8,7 +8,10 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"log/slog"
+	"math"
+	"strconv"
 	"strings"
 	"time"
 
@@ -28,9 +31,25 @@ var (
 	moveTo string
 	//go:embed height.uuid
 	getHeight string
+	//go:embed cycle.uuid
+	cycleRun string
+	//go:embed positions.uuid
+	namedPositions string
+	//go:embed provision.uuid
+	provisioning string
 )
 
-func (m *mitm) bluetoothServer(ctx context.Context) error {
+// bluetoothTransport is the Bluetooth server transport.
+type bluetoothTransport struct{ m *mitm }
+
+func (bluetoothTransport) name() string { return "ble" }
+
+func (t bluetoothTransport) start(ctx context.Context, commands chan<- command) error {
+	return t.m.bluetoothServer(ctx, commands)
+}
+
+func (m *mitm) bluetoothServer(ctx context.Context, commands chan<- command) error {
+	log := m.logFor("ble")
 	serviceUUID, err := bluetooth.ParseUUID(strings.TrimSpace(service))
 	if err != nil {
 		return err
@@ -43,13 +62,38 @@ func (m *mitm) bluetoothServer(ctx context.Context) error {
 	if err != nil {
 		return err
 	}
+	cycleUUID, err := bluetooth.ParseUUID(strings.TrimSpace(cycleRun))
+	if err != nil {
+		return err
+	}
+	positionsUUID, err := bluetooth.ParseUUID(strings.TrimSpace(namedPositions))
+	if err != nil {
+		return err
+	}
 
 	adapter := bluetooth.DefaultAdapter
 	adapter.Use(m.dev)
+	adapter.SetConnectHandler(func(device bluetooth.Device, connected bool) {
+		peer := device.Address.String()
+		if !connected {
+			log.LogAttrs(ctx, slog.LevelInfo, "disconnected", slog.String("peer", peer))
+			m.conns.remove(m.conns.lookup(connBLE, peer), time.Now())
+			return
+		}
+		log.LogAttrs(ctx, slog.LevelInfo, "connected", slog.String("peer", peer))
+		m.metrics.bleConns.Add(1)
+		m.conns.add(connBLE, peer, time.Now(), func() error {
+			// The adapter does not report disconnections
+			// it initiates, so forget the connection here.
+			err := device.Disconnect()
+			m.conns.remove(m.conns.lookup(connBLE, peer), time.Now())
+			return err
+		})
+	})
 
 	adv := adapter.DefaultAdvertisement()
 	err = adv.Configure(bluetooth.AdvertisementOptions{
-		LocalName: strings.TrimSpace(name),
+		LocalName: m.localName(name),
 	})
 	if err != nil {
 		return err
@@ -64,8 +108,30 @@ func (m *mitm) bluetoothServer(ctx context.Context) error {
 
 		high     bluetooth.Characteristic
 		highData [4]byte
+
+		run     bluetooth.Characteristic
+		runData [1]byte
+
+		named     bluetooth.Characteristic
+		namedData [60]byte // Longest value that can be read.
+		namedNext int      // Index of the next position to read.
+
+		leader syncSequence // Sequence of the commands from a sync leader.
 	)
-	return adapter.AddService(&bluetooth.Service{
+	remind := func(a alert) {
+		// Reminders are notified as 2 for an
+		// upcoming stand and 3 for an upcoming
+		// sit.
+		v := []byte{2}
+		if a.Detail == "sit" {
+			v[0] = 3
+		}
+		_, err := run.Write(v)
+		if err != nil {
+			log.LogAttrs(ctx, slog.LevelError, "notify reminder", slog.Any("err", err))
+		}
+	}
+	err = adapter.AddService(&bluetooth.Service{
 		UUID: serviceUUID,
 		Characteristics: []bluetooth.CharacteristicConfig{
 			{
@@ -75,40 +141,22 @@ func (m *mitm) bluetoothServer(ctx context.Context) error {
 				Flags:  bluetooth.CharacteristicReadPermission | bluetooth.CharacteristicWritePermission | bluetooth.CharacteristicWriteWithoutResponsePermission,
 				WriteEvent: func(client bluetooth.Connection, offset int, value []byte) {
 					if m.bluetoothBlocked.Load() {
-						m.log.LogAttrs(ctx, slog.LevelError, "bluetooth control disabled")
+						log.LogAttrs(ctx, slog.LevelError, "bluetooth control disabled")
 						return
 					}
-					if offset != 0 || len(value) != 1 {
+					if offset != 0 {
 						return
 					}
-					m.mu.Lock()
-					defer m.mu.Unlock()
-					if m.button.Get() {
+					log.LogAttrs(ctx, slog.LevelInfo, "set height request")
+					err := m.presetRequest(ctx, log, commands, value)
+					if err == errPermission {
+						log.LogAttrs(ctx, slog.LevelWarn, "move refused", slog.Any("err", err))
 						return
 					}
-					m.log.LogAttrs(ctx, slog.LevelInfo, "set height request")
-					h := int(value[0])
-					if h < 1 || 4 < h {
-						m.log.LogAttrs(ctx, slog.LevelError, "invalid height value", slog.Int("h", h))
+					if err != nil {
+						log.Error("move to stored height", slog.Any("err", err))
 						return
 					}
-					m.log.LogAttrs(ctx, slog.LevelInfo, "request move to stored height", slog.Int("h", h))
-
-					b := byte(1 << h)
-					pkt := []byte{0xa5, 0x00, b, 0xff - b, 0xff}
-					m.log.LogAttrs(ctx, slog.LevelInfo, "write pkt to controller", slog.Any("pkt", bytesAttr(pkt)))
-					m.act.High()
-					time.Sleep(time.Millisecond)
-					for range 5 {
-						_, err = m.controller.Write(pkt)
-						time.Sleep(10 * time.Millisecond)
-						if err != nil {
-							m.log.Error("write to controller", slog.Any("err", err))
-							return
-						}
-					}
-					m.alive()
-					m.act.Low()
 
 					posData[0] = value[0]
 				},
@@ -118,20 +166,422 @@ func (m *mitm) bluetoothServer(ctx context.Context) error {
 				Handle: &high,
 				UUID:   heightUUID,
 				Value:  highData[:],
-				Flags:  bluetooth.CharacteristicReadPermission,
+				Flags:  bluetooth.CharacteristicReadPermission | bluetooth.CharacteristicNotifyPermission,
 				ReadEvent: func(client bluetooth.Connection, offset int, value []byte) {
 					if m.bluetoothBlocked.Load() {
-						m.log.LogAttrs(ctx, slog.LevelError, "bluetooth control disabled")
+						log.LogAttrs(ctx, slog.LevelError, "bluetooth control disabled")
 						return
 					}
 					if offset != 0 || len(value) != 4 {
 						return
 					}
-					m.log.LogAttrs(ctx, slog.LevelInfo, "height report request")
+					log.LogAttrs(ctx, slog.LevelInfo, "height report request")
+					if !m.allowed(sourceBLE, permRead) {
+						log.LogAttrs(ctx, slog.LevelError, "bluetooth read not permitted")
+						return
+					}
 					clear(value)
 					copy(value, m.position.Load().(position).String())
 				},
 			},
+
+			{
+				Handle: &run,
+				UUID:   cycleUUID,
+				Value:  runData[:],
+				Flags:  bluetooth.CharacteristicReadPermission | bluetooth.CharacteristicWritePermission | bluetooth.CharacteristicNotifyPermission,
+				WriteEvent: func(client bluetooth.Connection, offset int, value []byte) {
+					if m.bluetoothBlocked.Load() {
+						log.LogAttrs(ctx, slog.LevelError, "bluetooth control disabled")
+						return
+					}
+					if offset != 0 || len(value) != 1 || value[0] > 1 {
+						return
+					}
+					log.LogAttrs(ctx, slog.LevelInfo, "set cycle request", slog.Bool("run", value[0] == 1))
+					if !m.allowed(sourceBLE, permMove) {
+						log.LogAttrs(ctx, slog.LevelError, "bluetooth move not permitted")
+						return
+					}
+					err := m.setCycle(ctx, value[0] == 1)
+					if err != nil {
+						log.LogAttrs(ctx, slog.LevelError, "set cycle", slog.Any("err", err))
+					}
+				},
+				ReadEvent: func(client bluetooth.Connection, offset int, value []byte) {
+					if offset != 0 || len(value) != 1 || !m.allowed(sourceBLE, permRead) {
+						return
+					}
+					value[0] = 0
+					if m.cycleRunning() {
+						value[0] = 1
+					}
+				},
+			},
+
+			{
+				Handle: &named,
+				UUID:   positionsUUID,
+				Value:  namedData[:],
+				Flags:  bluetooth.CharacteristicReadPermission | bluetooth.CharacteristicWritePermission | bluetooth.CharacteristicWriteWithoutResponsePermission,
+				WriteEvent: func(client bluetooth.Connection, offset int, value []byte) {
+					if m.bluetoothBlocked.Load() {
+						log.LogAttrs(ctx, slog.LevelError, "bluetooth control disabled")
+						return
+					}
+					if offset != 0 {
+						return
+					}
+					namedNext = 0
+					err := m.namedPositionCommand(ctx, log, commands, &leader, string(value))
+					if err != nil {
+						log.LogAttrs(ctx, slog.LevelError, "named position command", slog.Any("err", err))
+					}
+				},
+				ReadEvent: func(client bluetooth.Connection, offset int, value []byte) {
+					if offset != 0 || !m.allowed(sourceBLE, permRead) {
+						return
+					}
+					clear(value)
+					positions := m.positions()
+					if len(positions) == 0 {
+						copy(value, "0/0")
+						return
+					}
+					i := namedNext % len(positions)
+					p := positions[i]
+					copy(value, fmt.Sprintf("%d/%d %s %s", i+1, len(positions), p.Name, position{mantissa: p.Position.Mantissa, exponent: p.Position.Exponent}))
+					namedNext = i + 1
+				},
+			},
 		},
 	})
+	if err != nil {
+		return err
+	}
+	err = m.addDeviceInformation(adapter)
+	if err != nil {
+		return err
+	}
+	if useHTTP {
+		err = m.addProvisioning(ctx, log, adapter)
+		if err != nil {
+			return err
+		}
+	}
+	m.bleRemind.Store(&remind)
+
+	sub, err := m.events.subscribe(heightChanged)
+	if err != nil {
+		return err
+	}
+	go m.notifyHeight(ctx, log, &high, sub)
+
+	sub, err = m.events.subscribe(moveCommanded)
+	if err != nil {
+		return err
+	}
+	uuids := followUUIDs{service: serviceUUID, moveTo: moveToUUID, positions: positionsUUID}
+	go m.runFollow(ctx, log, adapter, uuids, sub)
+	sub, err = m.events.subscribe(targetChanged)
+	if err != nil {
+		return err
+	}
+	go m.runSync(ctx, log, adapter, uuids, sub)
+	return nil
+}
+
+// bleCommand passes c to the device and returns without waiting for it to
+// run, since the ATT server handles no other writes, including a stop of
+// the move, until the write handler returns. The result of the command is
+// logged.
+func bleCommand(ctx context.Context, log *slog.Logger, commands chan<- command, c command) error {
+	done, err := post(ctx, commands, c)
+	if err != nil {
+		return err
+	}
+	go func() {
+		var r commandResult
+		select {
+		case r = <-done:
+		case <-ctx.Done():
+			return
+		}
+		if refused(r.err) {
+			log.LogAttrs(ctx, slog.LevelWarn, "move refused", slog.Any("err", r.err))
+			return
+		}
+		if r.err != nil {
+			log.LogAttrs(ctx, slog.LevelError, "bluetooth command", slog.Any("err", r.err))
+		}
+	}()
+	return nil
+}
+
+// presetRequest drives the desk to the memory preset written to the
+// move_to characteristic as value.
+func (m *mitm) presetRequest(ctx context.Context, log *slog.Logger, commands chan<- command, value []byte) error {
+	if len(value) != 1 {
+		return fmt.Errorf("invalid preset value: %v", value)
+	}
+	h := int(value[0])
+	_, err := presetAction(h)
+	if err != nil {
+		return fmt.Errorf("invalid height value: %d", h)
+	}
+	log.LogAttrs(ctx, slog.LevelInfo, "request move to stored height", slog.Int("h", h))
+	if !m.allowed(sourceBLE, permMove) {
+		return errPermission
+	}
+	return bleCommand(ctx, log, commands, command{holder: sourceBLE, src: sourceBLE, log: log, op: opPreset, preset: h})
+}
+
+// namedPositionCommand executes a command written to the named positions
+// characteristic. The commands are "set <name> [<height>]", which stores
+// the position at the height, or the current height if none is given,
+// "del <name>", which deletes the position, "go <name>", which drives the
+// desk to the position, "to <height> [<leader> <seq>]", which drives the
+// desk to the height, and "stop [<leader> <seq>]", which stops the desk.
+// Commands carrying a sync leader's ID and sequence number are dropped if
+// they are not newer than the last accepted from the leader. Moves and
+// stops are passed to the device without waiting for them to run.
+func (m *mitm) namedPositionCommand(ctx context.Context, log *slog.Logger, commands chan<- command, leader *syncSequence, cmd string) error {
+	args := strings.Fields(cmd)
+	if len(args) == 0 {
+		return fmt.Errorf("invalid command: %q", cmd)
+	}
+	switch {
+	case args[0] == "set" && 2 <= len(args) && len(args) <= 3:
+		if !m.allowed(sourceBLE, permConfig) {
+			return errPermission
+		}
+		h := math.NaN()
+		if len(args) == 3 {
+			var err error
+			h, err = strconv.ParseFloat(args[2], 64)
+			if err != nil {
+				return fmt.Errorf("invalid height: %q", args[2])
+			}
+		}
+		p, err := m.setNamedPosition(args[1], h)
+		if err != nil {
+			return err
+		}
+		log.LogAttrs(ctx, slog.LevelInfo, "set named position", slog.String("name", args[1]), slog.Any("position", p))
+		return nil
+	case args[0] == "del" && len(args) == 2:
+		if !m.allowed(sourceBLE, permConfig) {
+			return errPermission
+		}
+		log.LogAttrs(ctx, slog.LevelInfo, "delete named position", slog.String("name", args[1]))
+		return m.deleteNamedPosition(args[1])
+	case args[0] == "go" && len(args) == 2:
+		if !m.allowed(sourceBLE, permMove) {
+			return errPermission
+		}
+		return bleCommand(ctx, log, commands, command{holder: sourceBLE, src: sourceBLE, log: log, op: opNamed, name: args[1]})
+	case args[0] == "to" && (len(args) == 2 || len(args) == 4):
+		if !m.allowed(sourceBLE, permMove) {
+			return errPermission
+		}
+		h, err := strconv.ParseFloat(args[1], 64)
+		if err != nil {
+			return fmt.Errorf("invalid height: %q", args[1])
+		}
+		if len(args) == 4 {
+			ok, err := leader.accept(ctx, log, args[2], args[3])
+			if !ok {
+				return err
+			}
+		}
+		return bleCommand(ctx, log, commands, command{holder: sourceBLE, src: sourceBLE, log: log, op: opHeight, value: h})
+	case args[0] == "stop" && (len(args) == 1 || len(args) == 3):
+		if !m.allowed(sourceBLE, permMove) {
+			return errPermission
+		}
+		if len(args) == 3 {
+			ok, err := leader.accept(ctx, log, args[1], args[2])
+			if !ok {
+				return err
+			}
+		}
+		return bleCommand(ctx, log, commands, command{holder: sourceBLE, src: sourceBLE, log: log, op: opStop})
+	default:
+		return fmt.Errorf("invalid command: %q", cmd)
+	}
+}
+
+// addProvisioning adds the WiFi provisioning service to adapter. The
+// service has ssid, passphrase and hostname characteristics that stage
+// values, and an apply characteristic that stores the staged values when
+// 1 is written to it and reads as the state of the network. The
+// characteristic UUIDs follow the service UUID.
+func (m *mitm) addProvisioning(ctx context.Context, log *slog.Logger, adapter *bluetooth.Adapter) error {
+	serviceUUID, err := bluetooth.ParseUUID(strings.TrimSpace(provisioning))
+	if err != nil {
+		return err
+	}
+	var (
+		staged struct {
+			ssid, pass, hostname string
+		}
+		ssidData     [maxSSID]byte
+		hostnameData [maxHostname]byte
+		applyData    [16]byte
+	)
+	staged.ssid, _ = m.wifiCredentials()
+	staged.hostname = m.store.get().Hostname
+	// stage returns whether a value may be
+	// staged from a write at offset.
+	stage := func(offset int) bool {
+		if m.bluetoothBlocked.Load() {
+			log.LogAttrs(ctx, slog.LevelError, "bluetooth control disabled")
+			return false
+		}
+		if offset != 0 || !m.allowed(sourceBLE, permConfig) {
+			return false
+		}
+		err := m.provisionable()
+		if err != nil {
+			log.LogAttrs(ctx, slog.LevelWarn, "provisioning refused", slog.Any("err", err))
+			return false
+		}
+		return true
+	}
+	return adapter.AddService(&bluetooth.Service{
+		UUID: serviceUUID,
+		Characteristics: []bluetooth.CharacteristicConfig{
+			{
+				UUID:  nextUUID(serviceUUID, 1),
+				Value: ssidData[:],
+				Flags: bluetooth.CharacteristicReadPermission | bluetooth.CharacteristicWritePermission,
+				WriteEvent: func(client bluetooth.Connection, offset int, value []byte) {
+					if stage(offset) {
+						staged.ssid = string(value)
+					}
+				},
+				ReadEvent: func(client bluetooth.Connection, offset int, value []byte) {
+					if offset != 0 || !m.allowed(sourceBLE, permRead) {
+						return
+					}
+					clear(value)
+					copy(value, staged.ssid)
+				},
+			},
+			{
+				// The passphrase cannot be read back.
+				UUID:  nextUUID(serviceUUID, 2),
+				Flags: bluetooth.CharacteristicWritePermission,
+				WriteEvent: func(client bluetooth.Connection, offset int, value []byte) {
+					if stage(offset) {
+						staged.pass = string(value)
+					}
+				},
+			},
+			{
+				UUID:  nextUUID(serviceUUID, 3),
+				Value: hostnameData[:],
+				Flags: bluetooth.CharacteristicReadPermission | bluetooth.CharacteristicWritePermission,
+				WriteEvent: func(client bluetooth.Connection, offset int, value []byte) {
+					if stage(offset) {
+						staged.hostname = string(value)
+					}
+				},
+				ReadEvent: func(client bluetooth.Connection, offset int, value []byte) {
+					if offset != 0 || !m.allowed(sourceBLE, permRead) {
+						return
+					}
+					clear(value)
+					copy(value, staged.hostname)
+				},
+			},
+			{
+				UUID:  nextUUID(serviceUUID, 4),
+				Value: applyData[:],
+				Flags: bluetooth.CharacteristicReadPermission | bluetooth.CharacteristicWritePermission,
+				WriteEvent: func(client bluetooth.Connection, offset int, value []byte) {
+					if !stage(offset) || len(value) != 1 || value[0] != 1 {
+						return
+					}
+					err := m.provision(staged.ssid, staged.pass, staged.hostname)
+					staged.pass = ""
+					if err != nil {
+						log.LogAttrs(ctx, slog.LevelError, "provision wifi", slog.Any("err", err))
+						return
+					}
+					log.LogAttrs(ctx, slog.LevelInfo, "provision wifi", slog.String("ssid", staged.ssid), slog.String("hostname", staged.hostname))
+				},
+				ReadEvent: func(client bluetooth.Connection, offset int, value []byte) {
+					if offset != 0 || !m.allowed(sourceBLE, permRead) {
+						return
+					}
+					clear(value)
+					copy(value, m.networkStatus())
+				},
+			},
+		},
+	})
+}
+
+// nextUUID returns the UUID n after u.
+func nextUUID(u bluetooth.UUID, n uint32) bluetooth.UUID {
+	u[0] += n
+	return u
+}
+
+// manufacturer is the manufacturer name reported by the Bluetooth device
+// information service.
+const manufacturer = "kortschak/desk"
+
+// addDeviceInformation adds the standard Bluetooth device information
+// service to adapter so that generic clients can identify the device. The
+// model number is the configured controller model.
+func (m *mitm) addDeviceInformation(adapter *bluetooth.Adapter) error {
+	return adapter.AddService(&bluetooth.Service{
+		UUID: bluetooth.ServiceUUIDDeviceInformation,
+		Characteristics: []bluetooth.CharacteristicConfig{
+			{
+				UUID:  bluetooth.CharacteristicUUIDManufacturerNameString,
+				Value: []byte(manufacturer),
+				Flags: bluetooth.CharacteristicReadPermission,
+			},
+			{
+				UUID:  bluetooth.CharacteristicUUIDModelNumberString,
+				Value: []byte(m.config().Model),
+				Flags: bluetooth.CharacteristicReadPermission,
+			},
+			{
+				UUID:  bluetooth.CharacteristicUUIDFirmwareRevisionString,
+				Value: []byte(firmwareVersion()),
+				Flags: bluetooth.CharacteristicReadPermission,
+			},
+		},
+	})
+}
+
+// notifyHeight notifies subscribers to the height characteristic c of each
+// new height reported by the controller, at most once per the configured
+// throttle interval, until ctx is cancelled. The value has the same form
+// as a read of the characteristic.
+func (m *mitm) notifyHeight(ctx context.Context, log *slog.Logger, c *bluetooth.Characteristic, sub *subscription) {
+	defer m.events.unsubscribe(sub)
+	var v [4]byte
+	for {
+		// Apply the current interval, since the
+		// subscription lasts as long as the server.
+		sub.throttle(time.Duration(m.cfg.Load().Throttle.BLE))
+		e, _, err := sub.next(ctx)
+		if err != nil {
+			return
+		}
+		if m.bluetoothBlocked.Load() || !m.allowed(sourceBLE, permRead) {
+			continue
+		}
+		clear(v[:])
+		copy(v[:], e.pos.String())
+		_, err = c.Write(v[:])
+		if err != nil {
+			log.LogAttrs(ctx, slog.LevelDebug, "notify height", slog.Any("err", err))
+		}
+	}
 }
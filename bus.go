@@ -0,0 +1,304 @@
+// Copyright ©2025 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// eventKind is the type of an event carried by the event bus.
+type eventKind uint8
+
+const (
+	heightChanged eventKind = 1 << iota // The reported height has changed.
+	keyPressed                          // A handset key press has started.
+	fault                               // The controller has reported an error.
+	networkUp                           // The network stack has been set up.
+	powerOn                             // The controller has reset after losing power.
+	moveCommanded                       // The desk has been sent to a preset or named position.
+	targetChanged                       // A move target has been set or discarded.
+)
+
+// event is an event carried by the event bus. Only the fields for the
+// event's kind are valid.
+type event struct {
+	kind eventKind
+	time time.Time // Local time of the event.
+
+	pos, prev position   // heightChanged
+	keys      string     // keyPressed
+	code      contErr    // fault
+	addr      netip.Addr // networkUp
+
+	// moveCommanded: the source of the command
+	// and either the preset or the name of the
+	// position the desk was sent to.
+	src    string
+	preset int
+	name   string
+
+	// targetChanged: the height of the target in
+	// display units, NaN if it was discarded.
+	height float64
+}
+
+const (
+	// maxSubscribers is the largest number of
+	// concurrent event bus subscriptions.
+	maxSubscribers = 12
+
+	// subscriptionLen is the number of events
+	// buffered for each subscription. When the
+	// buffer is full the oldest event is dropped.
+	subscriptionLen = 16
+)
+
+var errBusFull = errors.New("too many event subscribers")
+
+// maxThrottle is the longest configurable time between height changes
+// sent to a sink.
+const maxThrottle = 10 * time.Second
+
+// throttleConfig is the minimum time between height changes sent to each
+// sink that streams the height. A zero interval sends every change.
+type throttleConfig struct {
+	BLE    duration `json:"ble"`    // Bluetooth height notifications.
+	Events duration `json:"events"` // Server-sent event streams.
+	WS     duration `json:"ws"`     // WebSocket height streams.
+}
+
+// validate returns an error if an interval is out of range.
+func (c throttleConfig) validate() error {
+	for _, d := range []duration{c.BLE, c.Events, c.WS} {
+		if d < 0 || d > duration(maxThrottle) {
+			return errors.New("throttle interval out of range")
+		}
+	}
+	return nil
+}
+
+// bus is a bounded publish/subscribe event bus. Publishing does not block
+// or allocate; events are copied into a fixed-size buffer for each
+// subscriber, and slow subscribers lose their oldest events. Each
+// subscription may throttle the height changes it delivers so that a
+// desk in motion does not flood slow sinks.
+//
+// The bus carries changes to the consumers that act on them. The current
+// height, the time of the last handset key press and the controller state
+// are still held by mitm for reads that need the state at that moment,
+// such as a move checking for a handset key press at each frame or a
+// status response.
+type bus struct {
+	mu   sync.Mutex
+	subs [maxSubscribers]*subscription
+}
+
+// subscription is a subscriber's view of the event bus.
+type subscription struct {
+	kinds eventKind
+	ready chan struct{} // Signalled when events are buffered.
+
+	mu      sync.Mutex
+	buf     [subscriptionLen]event
+	head, n int
+	dropped int // Events dropped since the last call to next.
+
+	// interval is the minimum time between height
+	// changes delivered to the subscriber. Height
+	// changes arriving sooner are coalesced into
+	// held, which is delivered once the interval
+	// has elapsed since lastHeight.
+	interval   time.Duration
+	lastHeight time.Time
+	held       event
+	holding    bool
+}
+
+// throttle sets the minimum time between height changes delivered by s
+// to d. Height changes published within d of the last are coalesced so
+// that only the most recent is delivered. A zero d delivers every change.
+func (s *subscription) throttle(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.interval = d
+}
+
+// subscribe returns a new subscription to events of the given kinds. The
+// subscription must be released with unsubscribe.
+func (b *bus) subscribe(kinds eventKind) (*subscription, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i, s := range b.subs {
+		if s == nil {
+			s = &subscription{kinds: kinds, ready: make(chan struct{}, 1)}
+			b.subs[i] = s
+			return s, nil
+		}
+	}
+	return nil, errBusFull
+}
+
+// unsubscribe releases s.
+func (b *bus) unsubscribe(s *subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i, sub := range b.subs {
+		if sub == s {
+			b.subs[i] = nil
+		}
+	}
+}
+
+// publish delivers e to all subscribers to its kind.
+func (b *bus) publish(e event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, s := range b.subs {
+		if s == nil || s.kinds&e.kind == 0 {
+			continue
+		}
+		s.mu.Lock()
+		if e.kind == heightChanged && (s.holding || e.time.Sub(s.lastHeight) < s.interval) {
+			s.held = e
+			s.holding = true
+			s.mu.Unlock()
+			// Wake the subscriber so that it waits
+			// for the held change to be due.
+			select {
+			case s.ready <- struct{}{}:
+			default:
+			}
+			continue
+		}
+		if e.kind == heightChanged {
+			s.lastHeight = e.time
+		}
+		if s.n == len(s.buf) {
+			s.head = (s.head + 1) % len(s.buf)
+			s.n--
+			s.dropped++
+		}
+		s.buf[(s.head+s.n)%len(s.buf)] = e
+		s.n++
+		s.mu.Unlock()
+		select {
+		case s.ready <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// next returns the next event for the subscription, waiting until one is
+// available or ctx is cancelled, and the number of events dropped before
+// it because the subscriber was too slow. Height changes coalesced by the
+// subscription's throttle are not counted as dropped.
+func (s *subscription) next(ctx context.Context) (e event, dropped int, err error) {
+	for {
+		e, dropped, ok, due := s.poll()
+		if ok {
+			return e, dropped, nil
+		}
+		select {
+		case <-ctx.Done():
+			return event{}, 0, ctx.Err()
+		case <-s.ready:
+		case <-due:
+		}
+	}
+}
+
+// poll returns the next event for the subscription without waiting, the
+// number of events dropped before it and whether there was one. Callers
+// that wait for events alongside other work may call poll after receiving
+// from s.ready. If there was no event, due is not nil if a coalesced
+// height change will be available when it receives.
+func (s *subscription) poll() (e event, dropped int, ok bool, due <-chan time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.n != 0 {
+		e = s.buf[s.head]
+		s.head = (s.head + 1) % len(s.buf)
+		s.n--
+		dropped, s.dropped = s.dropped, 0
+		return e, dropped, true, nil
+	}
+	if s.holding {
+		wait := s.interval - time.Since(s.lastHeight)
+		if wait <= 0 {
+			e = s.held
+			s.holding = false
+			s.lastHeight = time.Now()
+			return e, 0, true, nil
+		}
+		due = time.After(wait)
+	}
+	return event{}, 0, false, due
+}
+
+// drain discards the events buffered for s and returns whether there were
+// any.
+func (s *subscription) drain() bool {
+	var found bool
+	for {
+		_, _, ok, _ := s.poll()
+		if !ok {
+			return found
+		}
+		found = true
+	}
+}
+
+// settled waits for an event on sub, or returns without waiting if
+// pending is true, then waits for the height of the desk to be known and
+// the desk to be idle, and returns the height. Consumers of settled
+// heights subscribe to heightChanged and powerOn events, since the height
+// may change while it is unknown after a loss of power.
+func (m *mitm) settled(ctx context.Context, sub *subscription, pending bool) (position, error) {
+	for {
+		pending = sub.drain() || pending
+		var due <-chan time.Time
+		if pending {
+			if m.heightKnown.Load() && !m.moving() {
+				return m.position.Load().(position), nil
+			}
+			due = time.After(motionPoll)
+		}
+		select {
+		case <-ctx.Done():
+			return position{}, ctx.Err()
+		case <-sub.ready:
+		case <-due:
+		}
+	}
+}
+
+// runEvents applies events from sub to the desk state, the handset key
+// actions, the controller fault rules and the recovery from a loss of
+// controller power until ctx is cancelled.
+func (m *mitm) runEvents(ctx context.Context, sub *subscription) {
+	defer m.events.unsubscribe(sub)
+	for {
+		e, _, err := sub.next(ctx)
+		if err != nil {
+			return
+		}
+		switch e.kind {
+		case heightChanged:
+			m.desk.observe(e.prev, e.pos, e.time)
+		case keyPressed:
+			m.desk.keyPressed(e.keys, m.clock.at(e.time))
+			m.handsetKey(ctx, e.keys)
+		case fault:
+			m.desk.controllerError(e.code, m.clock.at(e.time))
+			m.controllerError(ctx, e.code)
+		case powerOn:
+			go m.powerRestored(ctx)
+		}
+	}
+}
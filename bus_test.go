@@ -0,0 +1,52 @@
+// Copyright ©2025 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// TestSettled checks that the consumers of settled heights are woken by
+// height changes on the event bus and wait for the desk to be idle.
+func TestSettled(t *testing.T) {
+	m := &mitm{}
+	cfg := defaultConfig.clone()
+	m.cfg.Store(&cfg)
+	sub, err := m.events.subscribe(heightChanged | powerOn)
+	if err != nil {
+		t.Fatalf("unexpected error subscribing: %v", err)
+	}
+	defer m.events.unsubscribe(sub)
+
+	m.setPosition(position{mantissa: 720, exponent: -1})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	_, err = m.settled(ctx, sub, false)
+	cancel()
+	if err != context.DeadlineExceeded {
+		t.Errorf("unexpected error without a height change: got:%v want:%v", err, context.DeadlineExceeded)
+	}
+
+	want := position{mantissa: 725, exponent: -1}
+	m.setPosition(want)
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	_, err = m.settled(ctx, sub, false)
+	cancel()
+	if err != context.DeadlineExceeded {
+		t.Errorf("unexpected error while moving: got:%v want:%v", err, context.DeadlineExceeded)
+	}
+
+	// The change was consumed by the last call,
+	// so the waiter must be told it is pending.
+	m.idleFrame(newFrame(controllerStart, 0, 0, 0))
+	got, err := m.settled(context.Background(), sub, true)
+	if err != nil {
+		t.Fatalf("unexpected error after idle frame: %v", err)
+	}
+	if got != want {
+		t.Errorf("unexpected settled height: got:%v want:%v", got, want)
+	}
+}
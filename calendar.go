@@ -0,0 +1,56 @@
+// Copyright ©2025 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+const (
+	// defaultMeeting is the time a meeting is assumed
+	// to last if no duration is given when it starts.
+	defaultMeeting = time.Hour
+
+	// maxMeeting is the longest meeting duration that
+	// may be given. Meetings are ended at their expected
+	// end so a missed end event cannot suppress the
+	// sit/stand cycle indefinitely.
+	maxMeeting = 8 * time.Hour
+)
+
+// startMeeting records that a meeting has started and is expected to last
+// for d. Sit/stand reminders and moves are suppressed during a meeting.
+func (m *mitm) startMeeting(ctx context.Context, d time.Duration) error {
+	if d <= 0 || d > maxMeeting {
+		return fmt.Errorf("meeting duration out of range: %s", d)
+	}
+	m.log.LogAttrs(ctx, slog.LevelInfo, "meeting started", slog.Duration("for", d))
+	m.meetingUntil.Store(time.Now().Add(d).UnixNano())
+	return nil
+}
+
+// endMeeting records that the current meeting has ended.
+func (m *mitm) endMeeting(ctx context.Context) {
+	if m.meetingUntil.Swap(0) != 0 {
+		m.log.LogAttrs(ctx, slog.LevelInfo, "meeting ended")
+	}
+}
+
+// inMeeting returns whether a meeting is in progress.
+func (m *mitm) inMeeting() bool {
+	until := m.meetingUntil.Load()
+	return until != 0 && time.Now().Before(time.Unix(0, until))
+}
+
+// meetingStatus returns a description of the meeting state.
+func (m *mitm) meetingStatus() string {
+	if !m.inMeeting() {
+		return "meeting=none"
+	}
+	return fmt.Sprintf("meeting=active remaining=%s", time.Until(time.Unix(0, m.meetingUntil.Load())).Round(time.Second))
+}
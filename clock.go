@@ -0,0 +1,97 @@
+// Copyright ©2025 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// minDriftInterval is the shortest time between
+	// time server syncs that is used to measure the
+	// drift of the local clock.
+	minDriftInterval = 10 * time.Minute
+
+	// maxDrift is the largest plausible drift of
+	// the local clock. Measurements beyond this are
+	// assumed to be due to a bad sync and are
+	// discarded.
+	maxDrift = 1000e-6
+)
+
+// clock is the device's wall clock. It is set from a time server and
+// corrects the local clock for its measured drift between syncs so that
+// it remains accurate while the time server is unreachable.
+type clock struct {
+	mu     sync.Mutex
+	wall   time.Time // Time server time at the last sync.
+	local  time.Time // Local time at the last sync.
+	drift  float64   // Fractional rate error of the local clock.
+	synced bool
+}
+
+// now returns the current time corrected for drift. If the clock has never
+// been synced, the uncorrected local time is returned.
+func (c *clock) now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.synced {
+		return time.Now()
+	}
+	elapsed := time.Since(c.local)
+	return c.wall.Add(elapsed - time.Duration(float64(elapsed)*c.drift))
+}
+
+// sync sets the clock to wall, the time server time at the local time
+// local, and updates the drift estimate if the previous sync was long
+// enough ago to give a useful measurement. It returns the correction
+// applied to the clock.
+func (c *clock) sync(wall, local time.Time) (step time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.synced {
+		c.wall, c.local, c.synced = wall, local, true
+		return 0
+	}
+	elapsed := local.Sub(c.local)
+	step = wall.Sub(c.wall.Add(elapsed - time.Duration(float64(elapsed)*c.drift)))
+	if elapsed >= minDriftInterval {
+		drift := float64(elapsed-wall.Sub(c.wall)) / float64(elapsed)
+		if -maxDrift <= drift && drift <= maxDrift {
+			// Smooth the estimate to limit the effect
+			// of network delay jitter on individual
+			// syncs.
+			c.drift += (drift - c.drift) / 4
+		}
+	}
+	c.wall, c.local = wall, local
+	return step
+}
+
+// at returns the corrected time of the local time t.
+func (c *clock) at(t time.Time) time.Time {
+	return c.now().Add(-time.Since(t))
+}
+
+// isSynced returns whether the clock has been synced with a time server.
+func (c *clock) isSynced() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.synced
+}
+
+// status returns a description of the clock state.
+func (c *clock) status() string {
+	c.mu.Lock()
+	synced, last, drift := c.synced, c.local, c.drift
+	c.mu.Unlock()
+	if !synced {
+		return fmt.Sprintf("time=%s synced=false", c.now().Format(time.RFC3339))
+	}
+	return fmt.Sprintf("time=%s synced=true since_sync=%s drift_ppm=%.1f",
+		c.now().Format(time.RFC3339), time.Since(last).Round(time.Second), drift*1e6)
+}
@@ -0,0 +1,77 @@
+// Copyright ©2025 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestClockSync(t *testing.T) {
+	t0 := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	type sync struct {
+		local, wall time.Duration // Since t0.
+		wantStep    time.Duration
+		wantDrift   float64
+	}
+	for _, test := range []struct {
+		name  string
+		syncs []sync
+	}{
+		{
+			name: "first",
+			syncs: []sync{
+				{local: 0, wall: time.Hour, wantStep: 0, wantDrift: 0},
+			},
+		},
+		{
+			name: "fast clock",
+			syncs: []sync{
+				{local: 0, wall: 0},
+				// 100ppm fast over an hour.
+				{local: time.Hour, wall: time.Hour - 360*time.Millisecond, wantStep: -360 * time.Millisecond, wantDrift: 100e-6 / 4},
+				// The correction removes a quarter
+				// of the error of the next hour.
+				{local: 2 * time.Hour, wall: 2*time.Hour - 720*time.Millisecond, wantStep: -270 * time.Millisecond, wantDrift: 100e-6/4 + (100e-6-100e-6/4)/4},
+			},
+		},
+		{
+			name: "slow clock",
+			syncs: []sync{
+				{local: 0, wall: 0},
+				{local: time.Hour, wall: time.Hour + 360*time.Millisecond, wantStep: 360 * time.Millisecond, wantDrift: -100e-6 / 4},
+			},
+		},
+		{
+			name: "short interval",
+			syncs: []sync{
+				{local: 0, wall: 0},
+				{local: minDriftInterval - time.Second, wall: minDriftInterval - 2*time.Second, wantStep: -time.Second, wantDrift: 0},
+			},
+		},
+		{
+			name: "implausible drift",
+			syncs: []sync{
+				{local: 0, wall: 0},
+				{local: time.Hour, wall: time.Hour + 10*time.Second, wantStep: 10 * time.Second, wantDrift: 0},
+			},
+		},
+	} {
+		var c clock
+		for i, s := range test.syncs {
+			step := c.sync(t0.Add(s.wall), t0.Add(s.local))
+			if step != s.wantStep {
+				t.Errorf("unexpected step for %s sync %d: got:%v want:%v", test.name, i, step, s.wantStep)
+			}
+			if math.Abs(c.drift-s.wantDrift) > 1e-12 {
+				t.Errorf("unexpected drift for %s sync %d: got:%g want:%g", test.name, i, c.drift, s.wantDrift)
+			}
+		}
+		if !c.isSynced() {
+			t.Errorf("clock not synced for %s", test.name)
+		}
+	}
+}
@@ -0,0 +1,521 @@
+// Copyright ©2025 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+// config is the run-time configuration of the device.
+type config struct {
+	// Model is the name of the controller model,
+	// which determines the command sequences sent
+	// to the controller.
+	Model string `json:"model"`
+
+	// Language is the language of user-facing
+	// text, one of "en", "de" or "fr".
+	Language string `json:"language"`
+
+	// Unit is the unit of the height shown on
+	// the controller display, "cm" or "in". It
+	// is used only to label reported heights.
+	Unit string `json:"unit"`
+
+	// Debounce is the time the button line must be stable
+	// before a further change is passed through to the
+	// controller.
+	Debounce duration `json:"debounce"`
+
+	// ControllerSilence is the time without frames
+	// from the controller after which an alert is
+	// raised. Zero disables the check.
+	ControllerSilence duration `json:"controller_silence"`
+
+	// HandsetAbsence is the time without frames
+	// from the handset after which virtual handset
+	// mode is entered. Zero disables the check.
+	HandsetAbsence duration `json:"handset_absence"`
+
+	// Rest is the time after the desk last moved
+	// before a remote move may start. Moves are
+	// held until it has elapsed. Zero disables
+	// the rest period.
+	Rest duration `json:"rest"`
+
+	// Webhook is the http URL that alerts are
+	// posted to. No alerts are posted if empty.
+	Webhook string `json:"webhook,omitempty"`
+	// WebhookSecret is the shared secret used to
+	// sign webhook bodies. Bodies are not signed
+	// if empty.
+	WebhookSecret string `json:"webhook_secret,omitempty"`
+
+	// MQTT is the MQTT broker configuration.
+	MQTT mqttConfig `json:"mqtt"`
+
+	// Telemetry is the UDP telemetry
+	// configuration.
+	Telemetry telemetryConfig `json:"telemetry"`
+
+	// NTP is the time server configuration.
+	NTP ntpConfig `json:"ntp"`
+
+	// Group is the name of the group of desks
+	// that the device belongs to, for example
+	// a room name. It is at most maxGroup
+	// bytes long.
+	Group string `json:"group,omitempty"`
+
+	// Relay is the controller power relay
+	// configuration.
+	Relay relayConfig `json:"relay"`
+
+	// Cycle is the sit/stand cycle
+	// configuration.
+	Cycle cycleConfig `json:"cycle"`
+
+	// Quiet is the quiet hours schedule.
+	Quiet quietConfig `json:"quiet"`
+
+	// Notify is the notification sinks for
+	// each event.
+	Notify notifyConfig `json:"notify"`
+
+	// BuzzerPin is the GPIO number driving the
+	// notification buzzer. Zero indicates that
+	// no buzzer is fitted.
+	BuzzerPin int `json:"buzzer_pin,omitempty"`
+
+	// Raw is the raw frame injection
+	// configuration.
+	Raw rawConfig `json:"raw"`
+
+	// Watchdog is the hardware watchdog
+	// configuration.
+	Watchdog watchdogConfig `json:"watchdog"`
+
+	// Permissions is the set of permissions
+	// granted to each remote command source.
+	Permissions permissions `json:"permissions"`
+
+	// Allow is the list of CIDR prefixes of
+	// the HTTP clients that may connect. All
+	// clients may connect if empty.
+	Allow []string `json:"allow,omitempty"`
+
+	// RateLimit is the HTTP rate limiting
+	// configuration.
+	RateLimit rateLimitConfig `json:"rate_limit"`
+
+	// UsagePing is the anonymous usage ping
+	// configuration.
+	UsagePing usagePingConfig `json:"usage_ping"`
+
+	// DDNS is the dynamic DNS update
+	// configuration.
+	DDNS ddnsConfig `json:"ddns"`
+
+	// Follow is the configuration for
+	// forwarding moves to a second desk.
+	Follow followConfig `json:"follow"`
+
+	// Sync is the configuration for keeping
+	// other desks at the height of this one.
+	Sync syncConfig `json:"sync"`
+
+	// Throttle is the minimum time between
+	// height changes sent to each streaming
+	// sink while the desk is moving.
+	Throttle throttleConfig `json:"throttle"`
+}
+
+// usagePingConfig is the configuration for the anonymous usage ping.
+type usagePingConfig struct {
+	// URL is the http URL that usage pings
+	// are posted to. No pings are sent if
+	// empty.
+	URL string `json:"url,omitempty"`
+}
+
+// ddnsConfig is the configuration for dynamic DNS updates.
+type ddnsConfig struct {
+	// URL is the http URL that is requested
+	// to update the DNS record. No updates are
+	// made if empty.
+	URL string `json:"url,omitempty"`
+
+	// Interval is the time between updates
+	// when the address has not changed.
+	Interval duration `json:"interval"`
+}
+
+// followConfig is the configuration for forwarding moves to a second desk
+// unit over Bluetooth.
+type followConfig struct {
+	// Name is the Bluetooth local name of the
+	// unit sent the moves to presets and named
+	// positions made by this unit. No moves are
+	// forwarded if empty.
+	Name string `json:"name,omitempty"`
+}
+
+// maxGroup is the longest group name.
+const maxGroup = 32
+
+const (
+	// maxFollowers is the largest number of units
+	// that may track the height of a unit.
+	maxFollowers = 3
+
+	// maxSyncLead is the longest time a move
+	// may be held back for sync followers.
+	maxSyncLead = time.Second
+)
+
+// syncConfig is the configuration for height synchronisation with other
+// desk units over Bluetooth.
+type syncConfig struct {
+	// Followers is the list of the Bluetooth
+	// local names of the units that track the
+	// height of this unit. The unit does not
+	// lead if empty.
+	Followers []string `json:"followers,omitempty"`
+
+	// Lead is the time added to half the
+	// measured round trip time of the links to
+	// the followers to give the time the start
+	// of a move is held back while followers are
+	// connected, so that the followers start
+	// their moves with the desk.
+	Lead duration `json:"lead"`
+}
+
+// mqttConfig is the configuration for the connection to an MQTT broker.
+type mqttConfig struct {
+	// Broker is the host:port address of the
+	// broker. No connection is made if empty.
+	Broker string `json:"broker,omitempty"`
+	// Topic is the prefix for topics published
+	// by the device.
+	Topic    string `json:"topic"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	// API is whether the HTTP API is served
+	// to requests relayed by the broker.
+	API bool `json:"api,omitempty"`
+}
+
+// telemetryConfig is the configuration for UDP telemetry.
+type telemetryConfig struct {
+	// Collector is the IPv4 address and port
+	// of the telemetry collector. No telemetry
+	// is sent if empty.
+	Collector string `json:"collector,omitempty"`
+	// Interval is the time between telemetry
+	// datagrams.
+	Interval duration `json:"interval"`
+}
+
+// ntpConfig is the configuration for syncing the device clock.
+type ntpConfig struct {
+	// Server is the host name or IPv4 address
+	// of the SNTP time server. The clock is not
+	// synced if empty.
+	Server string `json:"server,omitempty"`
+	// Interval is the time between syncs.
+	Interval duration `json:"interval"`
+}
+
+// defaultConfig is the configuration used when no other configuration
+// has been provided.
+var defaultConfig = config{
+	Model:             "aoke-wp-cb01-901",
+	Language:          "en",
+	Unit:              "cm",
+	Debounce:          duration(5 * time.Millisecond),
+	ControllerSilence: duration(30 * time.Second),
+	HandsetAbsence:    duration(time.Minute),
+	Rest:              duration(2 * time.Second),
+	MQTT: mqttConfig{
+		Topic: "desk",
+	},
+	Telemetry: telemetryConfig{
+		Interval: duration(time.Minute),
+	},
+	NTP: ntpConfig{
+		Server:   "pool.ntp.org",
+		Interval: duration(time.Hour),
+	},
+	Relay: relayConfig{
+		Off: duration(5 * time.Second),
+	},
+	Cycle: cycleConfig{
+		Sit:      1,
+		Stand:    2,
+		SitFor:   duration(45 * time.Minute),
+		StandFor: duration(15 * time.Minute),
+		Warn:     duration(time.Minute),
+	},
+	Notify: notifyConfig{
+		Cycle:      []string{sinkLED, sinkWebhook},
+		Controller: []string{sinkLog, sinkWebhook},
+		Power:      []string{sinkLog, sinkWebhook},
+	},
+	Raw: rawConfig{
+		Starts: []int{handsetStart},
+	},
+	Watchdog: watchdogConfig{
+		Timeout: duration(10 * time.Second),
+		Tasks:   []string{taskHeartbeat},
+	},
+	Permissions: permissions{
+		HTTP: []string{permRead, permMove, permConfig},
+		BLE:  []string{permRead, permMove, permConfig},
+		MQTT: []string{permRead, permMove, permConfig},
+		// The MQTT API is reachable from wherever
+		// the broker is, so may not change the
+		// configuration unless granted.
+		MQTTAPI: []string{permRead, permMove},
+	},
+	RateLimit: rateLimitConfig{
+		Rate:    2,
+		Burst:   10,
+		Strikes: 20,
+		Ban:     duration(5 * time.Minute),
+	},
+	DDNS: ddnsConfig{
+		Interval: duration(time.Hour),
+	},
+	Sync: syncConfig{
+		Lead: duration(50 * time.Millisecond),
+	},
+	Throttle: throttleConfig{
+		BLE:    duration(250 * time.Millisecond),
+		Events: duration(100 * time.Millisecond),
+		WS:     duration(100 * time.Millisecond),
+	},
+}
+
+// validate returns an error if the configuration is not valid.
+func (c config) validate() error {
+	if models[c.Model] == nil {
+		return fmt.Errorf("unknown controller model: %q", c.Model)
+	}
+	if catalog[c.Language] == nil {
+		return fmt.Errorf("unsupported language: %q", c.Language)
+	}
+	if c.Unit != "cm" && c.Unit != "in" {
+		return fmt.Errorf("unsupported unit: %q", c.Unit)
+	}
+	if c.Debounce < 0 || c.Debounce > duration(time.Second) {
+		return errors.New("debounce out of range")
+	}
+	if c.ControllerSilence < 0 {
+		return errors.New("negative controller silence")
+	}
+	if c.HandsetAbsence < 0 {
+		return errors.New("negative handset absence")
+	}
+	if c.Rest < 0 || c.Rest > duration(30*time.Second) {
+		return errors.New("rest period out of range")
+	}
+	if c.MQTT.Topic == "" {
+		return errors.New("missing mqtt topic")
+	}
+	if c.Telemetry.Interval < duration(time.Second) {
+		return errors.New("telemetry interval too short")
+	}
+	if c.Telemetry.Collector != "" {
+		addr, err := netip.ParseAddrPort(c.Telemetry.Collector)
+		if err != nil || !addr.Addr().Is4() {
+			return fmt.Errorf("invalid telemetry collector: %q", c.Telemetry.Collector)
+		}
+	}
+	if c.NTP.Interval < duration(time.Minute) {
+		return errors.New("ntp interval too short")
+	}
+	// The group is carried in an MQTT topic level
+	// and in a DNS-SD TXT string.
+	if len(c.Group) > maxGroup || strings.ContainsAny(c.Group, "/+#") {
+		return fmt.Errorf("invalid group name: %q", c.Group)
+	}
+	err := c.Relay.validate()
+	if err != nil {
+		return err
+	}
+	err = c.Cycle.validate()
+	if err != nil {
+		return err
+	}
+	err = c.Quiet.validate()
+	if err != nil {
+		return err
+	}
+	err = validBuzzerPin(c.BuzzerPin)
+	if err != nil {
+		return err
+	}
+	if c.BuzzerPin != 0 && c.BuzzerPin == c.Relay.Pin {
+		return fmt.Errorf("buzzer pin used by relay: %d", c.BuzzerPin)
+	}
+	err = c.Notify.validate(c.BuzzerPin)
+	if err != nil {
+		return err
+	}
+	err = c.Watchdog.validate()
+	if err != nil {
+		return err
+	}
+	err = c.Raw.validate()
+	if err != nil {
+		return err
+	}
+	_, err = parseAllowlist(c.Allow)
+	if err != nil {
+		return err
+	}
+	err = c.RateLimit.validate()
+	if err != nil {
+		return err
+	}
+	err = c.Throttle.validate()
+	if err != nil {
+		return err
+	}
+	if c.UsagePing.URL != "" {
+		u, err := url.Parse(c.UsagePing.URL)
+		if err != nil || u.Scheme != "http" || u.Host == "" {
+			return fmt.Errorf("invalid usage ping url: %q", c.UsagePing.URL)
+		}
+	}
+	if c.DDNS.URL != "" {
+		u, err := url.Parse(c.DDNS.URL)
+		if err != nil || u.Scheme != "http" || u.Host == "" {
+			return fmt.Errorf("invalid ddns url: %q", c.DDNS.URL)
+		}
+	}
+	if c.DDNS.Interval < duration(time.Minute) {
+		return errors.New("ddns interval too short")
+	}
+	if len(c.Follow.Name) > maxLocalName {
+		return fmt.Errorf("follow name too long: %q", c.Follow.Name)
+	}
+	if len(c.Sync.Followers) > maxFollowers {
+		return fmt.Errorf("too many sync followers: %d", len(c.Sync.Followers))
+	}
+	for _, name := range c.Sync.Followers {
+		if name == "" || len(name) > maxLocalName {
+			return fmt.Errorf("invalid sync follower name: %q", name)
+		}
+	}
+	if c.Sync.Lead < 0 || c.Sync.Lead > duration(maxSyncLead) {
+		return errors.New("sync lead out of range")
+	}
+	return c.Permissions.validate()
+}
+
+// config returns a copy of the current configuration.
+func (m *mitm) config() config {
+	return m.cfg.Load().clone()
+}
+
+// clone returns a copy of c that shares no slices with it.
+func (c config) clone() config {
+	c.Relay.Errors = slices.Clone(c.Relay.Errors)
+	c.Allow = slices.Clone(c.Allow)
+	c.Sync.Followers = slices.Clone(c.Sync.Followers)
+	c.Raw.Starts = slices.Clone(c.Raw.Starts)
+	c.Watchdog.Tasks = slices.Clone(c.Watchdog.Tasks)
+	c.Notify = c.Notify.clone()
+	c.Permissions = c.Permissions.clone()
+	return c
+}
+
+var errStaleConfig = errors.New("configuration has been changed")
+
+// setConfig validates and applies cfg.
+func (m *mitm) setConfig(cfg config) error {
+	m.cfgMu.Lock()
+	defer m.cfgMu.Unlock()
+	return m.setConfigLocked(cfg)
+}
+
+// updateConfig applies the changes made by fn to the current configuration
+// if the configuration revision is rev. If the configuration has been
+// changed since revision rev, errStaleConfig is returned.
+func (m *mitm) updateConfig(rev uint64, fn func(*config) error) error {
+	m.cfgMu.Lock()
+	defer m.cfgMu.Unlock()
+	if rev != m.cfgRev {
+		return errStaleConfig
+	}
+	cfg := m.config()
+	err := fn(&cfg)
+	if err != nil {
+		return err
+	}
+	return m.setConfigLocked(cfg)
+}
+
+// configRevision returns a copy of the current configuration and its
+// revision.
+func (m *mitm) configRevision() (config, uint64) {
+	m.cfgMu.Lock()
+	defer m.cfgMu.Unlock()
+	return m.config(), m.cfgRev
+}
+
+// setConfigLocked implements setConfig, incrementing the configuration
+// revision. The caller must hold m.cfgMu.
+func (m *mitm) setConfigLocked(cfg config) error {
+	err := m.checkConfig(cfg)
+	if err != nil {
+		return err
+	}
+	allow, _ := parseAllowlist(cfg.Allow) // Checked by checkConfig.
+	m.cfg.Store(&cfg)
+	m.allow.Store(&allow)
+	m.cfgRev++
+	m.debounce.interval.Store(int64(cfg.Debounce))
+	m.relay.setPin(cfg.Relay.Pin)
+	return nil
+}
+
+// checkConfig returns an error if cfg is not valid or cannot be applied
+// to the running device.
+func (m *mitm) checkConfig(cfg config) error {
+	err := cfg.validate()
+	if err != nil {
+		return err
+	}
+	if models[cfg.Model].line != m.line {
+		// The UARTs are only configured at start-up.
+		return errors.New("controller model line configuration does not match running configuration")
+	}
+	return nil
+}
+
+// duration is a time.Duration that is represented as a string in JSON.
+type duration time.Duration
+
+func (d duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+func (d *duration) UnmarshalText(b []byte) error {
+	v, err := time.ParseDuration(string(b))
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
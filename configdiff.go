@@ -0,0 +1,100 @@
+// Copyright ©2025 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"slices"
+	"strings"
+)
+
+// restartFields are the configuration fields whose changes only take full
+// effect after a restart. The controller model determines the UART line
+// configuration, which is only set at startup, and the model number
+// reported over Bluetooth.
+var restartFields = []string{"model"}
+
+// configChange is a difference between two configurations.
+type configChange struct {
+	// Path is the dotted path of the field.
+	Path string `json:"path"`
+	// From and To are the values of the field in
+	// each configuration, absent if the field is
+	// not present.
+	From json.RawMessage `json:"from,omitempty"`
+	To   json.RawMessage `json:"to,omitempty"`
+	// Restart is whether the change only takes
+	// full effect after a restart.
+	Restart bool `json:"restart"`
+}
+
+// diffConfig returns the fields that differ between from and to, ordered
+// by path. Objects are compared field by field; all other values,
+// including lists, are compared whole.
+func diffConfig(from, to config) ([]configChange, error) {
+	a, err := flatConfig(from)
+	if err != nil {
+		return nil, err
+	}
+	b, err := flatConfig(to)
+	if err != nil {
+		return nil, err
+	}
+	changes := []configChange{}
+	for path, v := range a {
+		if w, ok := b[path]; !ok || !bytes.Equal(v, w) {
+			changes = append(changes, configChange{Path: path, From: v, To: w})
+		}
+	}
+	for path, w := range b {
+		if _, ok := a[path]; !ok {
+			changes = append(changes, configChange{Path: path, To: w})
+		}
+	}
+	for i, c := range changes {
+		top, _, _ := strings.Cut(c.Path, ".")
+		changes[i].Restart = slices.Contains(restartFields, top)
+	}
+	slices.SortFunc(changes, func(a, b configChange) int {
+		return strings.Compare(a.Path, b.Path)
+	})
+	return changes, nil
+}
+
+// flatConfig returns the JSON values of the fields of cfg keyed by their
+// dotted paths.
+func flatConfig(cfg config) (map[string]json.RawMessage, error) {
+	b, err := json.Marshal(cfg)
+	if err != nil {
+		return nil, err
+	}
+	dst := make(map[string]json.RawMessage)
+	return dst, flattenJSON(dst, "", b)
+}
+
+// flattenJSON adds the non-object values within the JSON value v to dst
+// keyed by their dotted paths below prefix.
+func flattenJSON(dst map[string]json.RawMessage, prefix string, v json.RawMessage) error {
+	if !isObject(v) {
+		dst[prefix] = v
+		return nil
+	}
+	var fields map[string]json.RawMessage
+	err := json.Unmarshal(v, &fields)
+	if err != nil {
+		return err
+	}
+	for k, f := range fields {
+		if prefix != "" {
+			k = prefix + "." + k
+		}
+		err = flattenJSON(dst, k, f)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
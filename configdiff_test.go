@@ -0,0 +1,100 @@
+// Copyright ©2025 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+var diffConfigTests = []struct {
+	name   string
+	change func(*config)
+	want   []configChange
+}{
+	{
+		name:   "none",
+		change: func(*config) {},
+		want:   []configChange{},
+	},
+	{
+		name:   "value",
+		change: func(c *config) { c.Unit = "in" },
+		want: []configChange{
+			{Path: "unit", From: json.RawMessage(`"cm"`), To: json.RawMessage(`"in"`)},
+		},
+	},
+	{
+		name:   "nested value",
+		change: func(c *config) { c.MQTT.Topic = "office" },
+		want: []configChange{
+			{Path: "mqtt.topic", From: json.RawMessage(`"desk"`), To: json.RawMessage(`"office"`)},
+		},
+	},
+	{
+		name:   "added field",
+		change: func(c *config) { c.MQTT.API = true },
+		want: []configChange{
+			{Path: "mqtt.api", To: json.RawMessage(`true`)},
+		},
+	},
+	{
+		name:   "list",
+		change: func(c *config) { c.Watchdog.Tasks = []string{taskHeartbeat, taskHandset} },
+		want: []configChange{
+			{Path: "watchdog.tasks", From: json.RawMessage(`["heartbeat"]`), To: json.RawMessage(`["heartbeat","handset"]`)},
+		},
+	},
+	{
+		name: "restart and ordering",
+		change: func(c *config) {
+			c.Unit = "in"
+			c.Model = "other"
+			c.Language = "de"
+		},
+		want: []configChange{
+			{Path: "language", From: json.RawMessage(`"en"`), To: json.RawMessage(`"de"`)},
+			{Path: "model", From: json.RawMessage(`"aoke-wp-cb01-901"`), To: json.RawMessage(`"other"`), Restart: true},
+			{Path: "unit", From: json.RawMessage(`"cm"`), To: json.RawMessage(`"in"`)},
+		},
+	},
+}
+
+func TestDiffConfig(t *testing.T) {
+	for _, test := range diffConfigTests {
+		to := defaultConfig
+		test.change(&to)
+		got, err := diffConfig(defaultConfig, to)
+		if err != nil {
+			t.Errorf("unexpected error for %s: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("unexpected changes for %s:\ngot: %s\nwant:%s", test.name, mustJSON(got), mustJSON(test.want))
+		}
+
+		// The reverse diff swaps the values.
+		rev, err := diffConfig(to, defaultConfig)
+		if err != nil {
+			t.Errorf("unexpected error for reverse %s: %v", test.name, err)
+			continue
+		}
+		for i := range rev {
+			rev[i].From, rev[i].To = rev[i].To, rev[i].From
+		}
+		if !reflect.DeepEqual(rev, test.want) {
+			t.Errorf("unexpected reverse changes for %s:\ngot: %s\nwant:%s", test.name, mustJSON(rev), mustJSON(test.want))
+		}
+	}
+}
+
+func mustJSON(v any) []byte {
+	b, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
@@ -0,0 +1,236 @@
+// Copyright ©2025 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"time"
+)
+
+// Open TCP and BLE connections are tracked so that they can be listed
+// and a wedged connection, such as a stalled log stream, can be closed
+// without restarting the device.
+
+const (
+	// maxConns is the number of open connections
+	// tracked. This exceeds the number of TCP and
+	// BLE connections the device can hold.
+	maxConns = 8
+
+	// recentBLEConns is the number of closed BLE
+	// connections remembered.
+	recentBLEConns = 4
+)
+
+const (
+	connTCP = "tcp"
+	connBLE = "ble"
+)
+
+var (
+	errNoConn  = errors.New("no such connection")
+	errOwnConn = errors.New("cannot close the requesting connection")
+)
+
+// connTable is the set of open connections and recently closed BLE
+// connections.
+type connTable struct {
+	mu     sync.Mutex
+	lastID uint32
+	open   [maxConns]trackedConn
+	recent [recentBLEConns]trackedConn
+	next   int // Index of the next recent entry.
+}
+
+// trackedConn is the state of a tracked connection. An entry with a zero
+// id is unused.
+type trackedConn struct {
+	id       uint32
+	proto    string
+	peer     string
+	endpoint string
+	opened   time.Time
+	closed   time.Time
+	closer   func() error
+}
+
+// add records a connection from peer using proto opened at now and
+// returns its ID. The connection is closed by closer when it is forced
+// closed. If the table is full, the connection is not tracked and the
+// returned ID is zero.
+func (t *connTable) add(proto, peer string, now time.Time, closer func() error) uint32 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i := range t.open {
+		c := &t.open[i]
+		if c.id != 0 {
+			continue
+		}
+		t.lastID++
+		if t.lastID == 0 {
+			t.lastID++
+		}
+		*c = trackedConn{id: t.lastID, proto: proto, peer: peer, opened: now, closer: closer}
+		return c.id
+	}
+	return 0
+}
+
+// serving records that the connection id is serving endpoint.
+func (t *connTable) serving(id uint32, endpoint string) {
+	if id == 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if c := t.find(id); c != nil {
+		c.endpoint = endpoint
+	}
+}
+
+// remove forgets the connection id closed at now. Closed BLE connections
+// are remembered in the recent connections.
+func (t *connTable) remove(id uint32, now time.Time) {
+	if id == 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	c := t.find(id)
+	if c == nil {
+		return
+	}
+	if c.proto == connBLE {
+		c.closed = now
+		c.closer = nil
+		t.recent[t.next] = *c
+		t.next = (t.next + 1) % len(t.recent)
+	}
+	*c = trackedConn{}
+}
+
+// lookup returns the ID of the open connection from peer using proto,
+// or zero if there is none.
+func (t *connTable) lookup(proto, peer string) uint32 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, c := range t.open {
+		if c.id != 0 && c.proto == proto && c.peer == peer {
+			return c.id
+		}
+	}
+	return 0
+}
+
+// find returns the open connection id. The caller must hold t.mu.
+func (t *connTable) find(id uint32) *trackedConn {
+	for i := range t.open {
+		if t.open[i].id == id {
+			return &t.open[i]
+		}
+	}
+	return nil
+}
+
+// closeConn closes the open connection id. The connection is forgotten
+// when its owner removes it.
+func (t *connTable) closeConn(id uint32) error {
+	t.mu.Lock()
+	c := t.find(id)
+	if c == nil || id == 0 {
+		t.mu.Unlock()
+		return errNoConn
+	}
+	closer := c.closer
+	t.mu.Unlock()
+	if closer == nil {
+		return errNoConn
+	}
+	return closer()
+}
+
+// active returns whether there is an open connection using proto other
+// than except.
+func (t *connTable) active(proto string, except uint32) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, c := range t.open {
+		if c.id != 0 && c.id != except && c.proto == proto {
+			return true
+		}
+	}
+	return false
+}
+
+// closeAll closes the open connections using proto other than except and
+// returns the number closed.
+func (t *connTable) closeAll(proto string, except uint32) int {
+	t.mu.Lock()
+	var closers []func() error
+	for _, c := range t.open {
+		if c.id != 0 && c.id != except && c.proto == proto && c.closer != nil {
+			closers = append(closers, c.closer)
+		}
+	}
+	t.mu.Unlock()
+	for _, fn := range closers {
+		fn()
+	}
+	return len(closers)
+}
+
+// connInfo is the reported state of a connection.
+type connInfo struct {
+	ID       uint32  `json:"id"`
+	Proto    string  `json:"proto"`
+	Peer     string  `json:"peer"`
+	Endpoint string  `json:"endpoint,omitempty"`
+	Age      float64 `json:"age_seconds"`
+
+	// Closed is the time since the connection
+	// was closed. It is only set for recently
+	// closed BLE connections, whose Age is the
+	// duration they were open.
+	Closed *float64 `json:"closed_seconds_ago,omitempty"`
+}
+
+// list returns the open connections and the recently closed BLE
+// connections at now.
+func (t *connTable) list(now time.Time) (open, recent []connInfo) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	open = []connInfo{}
+	for _, c := range t.open {
+		if c.id == 0 {
+			continue
+		}
+		open = append(open, connInfo{
+			ID:       c.id,
+			Proto:    c.proto,
+			Peer:     c.peer,
+			Endpoint: c.endpoint,
+			Age:      math.Round(now.Sub(c.opened).Seconds()),
+		})
+	}
+	recent = []connInfo{}
+	for i := range t.recent {
+		// Report the most recently closed first.
+		c := t.recent[(t.next-1-i+2*len(t.recent))%len(t.recent)]
+		if c.id == 0 {
+			continue
+		}
+		closed := math.Round(now.Sub(c.closed).Seconds())
+		recent = append(recent, connInfo{
+			ID:     c.id,
+			Proto:  c.proto,
+			Peer:   c.peer,
+			Age:    math.Round(c.closed.Sub(c.opened).Seconds()),
+			Closed: &closed,
+		})
+	}
+	return open, recent
+}
@@ -0,0 +1,120 @@
+// Copyright ©2025 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestConnTable(t *testing.T) {
+	t0 := time.Unix(1735689600, 0)
+	var tab connTable
+	closed := make(map[uint32]bool)
+	closer := func(id *uint32) func() error {
+		return func() error {
+			closed[*id] = true
+			return nil
+		}
+	}
+
+	var ids [maxConns]uint32
+	for i := range ids {
+		proto := connTCP
+		if i%2 == 1 {
+			proto = connBLE
+		}
+		ids[i] = tab.add(proto, fmt.Sprint("peer-", i), t0.Add(time.Duration(i)*time.Second), closer(&ids[i]))
+		if ids[i] == 0 {
+			t.Fatalf("connection %d not tracked", i)
+		}
+	}
+	if id := tab.add(connTCP, "overflow", t0, nil); id != 0 {
+		t.Errorf("unexpected tracking of connection beyond table size: got id %d", id)
+	}
+
+	tab.serving(ids[0], "/api/v1/logs")
+	if got := tab.lookup(connBLE, "peer-1"); got != ids[1] {
+		t.Errorf("unexpected lookup result: got:%d want:%d", got, ids[1])
+	}
+	if got := tab.lookup(connTCP, "peer-1"); got != 0 {
+		t.Errorf("unexpected lookup result for wrong protocol: got:%d want:0", got)
+	}
+
+	open, recent := tab.list(t0.Add(10 * time.Second))
+	if len(open) != maxConns || len(recent) != 0 {
+		t.Fatalf("unexpected connection counts: got:%d open %d recent want:%d open 0 recent", len(open), len(recent), maxConns)
+	}
+	if open[0].ID != ids[0] || open[0].Endpoint != "/api/v1/logs" || open[0].Age != 10 {
+		t.Errorf("unexpected first connection: %+v", open[0])
+	}
+
+	// Closing calls the closer, but the entry
+	// is only forgotten when its owner removes it.
+	err := tab.closeConn(ids[2])
+	if err != nil || !closed[ids[2]] {
+		t.Errorf("unexpected result closing connection: err=%v closed=%t", err, closed[ids[2]])
+	}
+	if err := tab.closeConn(1 << 30); err != errNoConn {
+		t.Errorf("unexpected error closing unknown connection: got:%v want:%v", err, errNoConn)
+	}
+	if err := tab.closeConn(0); err != errNoConn {
+		t.Errorf("unexpected error closing zero connection: got:%v want:%v", err, errNoConn)
+	}
+	tab.remove(ids[2], t0.Add(11*time.Second))
+	tab.remove(ids[1], t0.Add(12*time.Second))
+	tab.remove(ids[3], t0.Add(13*time.Second))
+	open, recent = tab.list(t0.Add(20 * time.Second))
+	if len(open) != maxConns-3 {
+		t.Errorf("unexpected open connection count after remove: got:%d want:%d", len(open), maxConns-3)
+	}
+	// Only BLE connections are remembered, most
+	// recently closed first.
+	if len(recent) != 2 || recent[0].ID != ids[3] || recent[1].ID != ids[1] {
+		t.Fatalf("unexpected recent connections: %+v", recent)
+	}
+	if recent[1].Age != 11 || *recent[1].Closed != 8 {
+		t.Errorf("unexpected recent connection times: age=%v closed=%v want age=11 closed=8", recent[1].Age, *recent[1].Closed)
+	}
+
+	// A freed slot is reused with a new ID.
+	id := tab.add(connTCP, "new", t0, nil)
+	if id == 0 || id == ids[1] || id == ids[2] || id == ids[3] {
+		t.Errorf("unexpected ID of new connection: %d", id)
+	}
+
+	if !tab.active(connBLE, 0) {
+		t.Error("expected active BLE connections")
+	}
+	if !tab.active(connBLE, ids[5]) {
+		t.Error("expected active BLE connections other than one")
+	}
+	n := tab.closeAll(connTCP, ids[0])
+	// TCP connections 4 and 6 have closers, and the
+	// new connection does not.
+	if n != 2 || !closed[ids[4]] || !closed[ids[6]] || closed[ids[0]] {
+		t.Errorf("unexpected close all result: got:%d closed=%v", n, closed)
+	}
+
+	// The recent list holds only the last
+	// recentBLEConns closed BLE connections.
+	for _, i := range []int{5, 7} {
+		tab.remove(ids[i], t0.Add(30*time.Second))
+	}
+	for i := range 3 {
+		id := tab.add(connBLE, "short", t0, nil)
+		tab.remove(id, t0.Add(time.Duration(40+i)*time.Second))
+	}
+	_, recent = tab.list(t0.Add(time.Minute))
+	if len(recent) != recentBLEConns {
+		t.Errorf("unexpected recent connection count: got:%d want:%d", len(recent), recentBLEConns)
+	}
+	for i, c := range recent[:3] {
+		if c.Peer != "short" || *c.Closed != float64(60-42+i) {
+			t.Errorf("unexpected recent connection %d: %+v closed %v", i, c, *c.Closed)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+// Copyright ©2025 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"machine"
+)
+
+// credential is a stored user name and salted password hash.
+type credential struct {
+	User string `json:"user"`
+	Salt []byte `json:"salt"`
+	Hash []byte `json:"hash"`
+}
+
+// newCredential returns a credential for the user and password.
+func newCredential(user, password string) credential {
+	salt := make([]byte, 16)
+	for i := 0; i < len(salt); i += 4 {
+		r, _ := machine.GetRNG()
+		binary.LittleEndian.PutUint32(salt[i:], r)
+	}
+	return credential{User: user, Salt: salt, Hash: passwordHash(salt, password)}
+}
+
+// match returns whether user and password match the credential.
+func (c *credential) match(user, password string) bool {
+	userOK := subtle.ConstantTimeCompare([]byte(user), []byte(c.User))
+	passOK := subtle.ConstantTimeCompare(passwordHash(c.Salt, password), c.Hash)
+	return userOK&passOK == 1
+}
+
+func passwordHash(salt []byte, password string) []byte {
+	h := sha256.New()
+	h.Write(salt)
+	h.Write([]byte(password))
+	return h.Sum(nil)
+}
@@ -0,0 +1,299 @@
+// Copyright ©2025 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// maxSnooze is the longest time a reminder may be snoozed.
+const maxSnooze = time.Hour
+
+var errNoReminder = errors.New("no reminder pending")
+
+// handsetSnooze is the time a reminder is snoozed by pressing the
+// handset memory key while it is pending.
+const handsetSnooze = 10 * time.Minute
+
+// cycleGestureHold is the time the handset up and down buttons must be
+// held together to start or stop the sit/stand cycle.
+const cycleGestureHold = 3 * time.Second
+
+// cycleConfig is the configuration of the sit/stand cycle.
+type cycleConfig struct {
+	// Sit and Stand are the memory presets
+	// for the sitting and standing positions.
+	Sit   int `json:"sit"`
+	Stand int `json:"stand"`
+
+	// SitFor and StandFor are the durations
+	// of the sitting and standing phases.
+	SitFor   duration `json:"sit_for"`
+	StandFor duration `json:"stand_for"`
+
+	// Warn is the time before a move that a
+	// warning is given. Zero disables warnings.
+	Warn duration `json:"warn"`
+}
+
+// validate returns an error if the cycle configuration is not valid.
+func (c cycleConfig) validate() error {
+	if c.Sit < 1 || 4 < c.Sit || c.Stand < 1 || 4 < c.Stand {
+		return errors.New("cycle preset out of range")
+	}
+	if c.Sit == c.Stand {
+		return errors.New("cycle sit and stand presets are the same")
+	}
+	if c.SitFor < duration(time.Minute) || c.StandFor < duration(time.Minute) {
+		return errors.New("cycle phase too short")
+	}
+	if c.Warn < 0 || c.Warn >= min(c.SitFor, c.StandFor) {
+		return errors.New("cycle warning out of range")
+	}
+	return nil
+}
+
+// cycleState is the persisted state of the sit/stand cycle.
+type cycleState struct {
+	Running bool   `json:"running"`
+	Phase   string `json:"phase,omitempty"` // "sit" or "stand".
+}
+
+// cycle is the run-time state of the sit/stand cycle.
+type cycle struct {
+	mu     sync.Mutex
+	state  cycleState
+	until  time.Time // End of the current phase.
+	warned bool      // The warning for the current phase has been given.
+}
+
+// setCycle starts or stops the sit/stand cycle. A started cycle begins
+// with a sitting phase without moving the desk.
+func (m *mitm) setCycle(ctx context.Context, run bool) error {
+	m.cycle.mu.Lock()
+	defer m.cycle.mu.Unlock()
+	return m.setCycleLocked(ctx, run)
+}
+
+// toggleCycle starts the sit/stand cycle if it is stopped and stops it
+// if it is running.
+func (m *mitm) toggleCycle(ctx context.Context) error {
+	m.cycle.mu.Lock()
+	defer m.cycle.mu.Unlock()
+	return m.setCycleLocked(ctx, !m.cycle.state.Running)
+}
+
+// setCycleLocked implements setCycle. The caller must hold m.cycle.mu.
+func (m *mitm) setCycleLocked(ctx context.Context, run bool) error {
+	if run == m.cycle.state.Running {
+		return nil
+	}
+	m.log.LogAttrs(ctx, slog.LevelInfo, "set cycle", slog.Bool("run", run))
+	state := cycleState{Running: run}
+	if run {
+		state.Phase = "sit"
+		m.startPhase(state.Phase)
+	}
+	m.cycle.state = state
+	return m.store.update(func(p *persistent) { p.Cycle = state })
+}
+
+// cycleRunning returns whether the sit/stand cycle is running.
+func (m *mitm) cycleRunning() bool {
+	m.cycle.mu.Lock()
+	defer m.cycle.mu.Unlock()
+	return m.cycle.state.Running
+}
+
+// cycleStatus returns a description of the sit/stand cycle state.
+func (m *mitm) cycleStatus() string {
+	m.cycle.mu.Lock()
+	defer m.cycle.mu.Unlock()
+	if !m.cycle.state.Running {
+		return "cycle=stopped"
+	}
+	return fmt.Sprintf("cycle=%s remaining=%s", m.cycle.state.Phase, time.Until(m.cycle.until).Round(time.Second))
+}
+
+// reminderPending returns whether a reminder has been given for the
+// current phase and the desk has not yet moved. The caller must hold
+// m.cycle.mu.
+func (m *mitm) reminderPending() bool {
+	return m.cycle.state.Running && m.cycle.warned && time.Now().Before(m.cycle.until)
+}
+
+// snoozeReminder defers the pending reminder by d, postponing the move
+// until the reminder warning time after the deferred reminder.
+func (m *mitm) snoozeReminder(ctx context.Context, d time.Duration) error {
+	if d <= 0 || d > maxSnooze {
+		return fmt.Errorf("snooze out of range: %s", d)
+	}
+	m.cycle.mu.Lock()
+	defer m.cycle.mu.Unlock()
+	if !m.reminderPending() {
+		return errNoReminder
+	}
+	m.log.LogAttrs(ctx, slog.LevelInfo, "snooze reminder", slog.Duration("for", d))
+	m.cycle.until = time.Now().Add(d + time.Duration(m.config().Cycle.Warn))
+	m.cycle.warned = false
+	return nil
+}
+
+// ackReminder dismisses the pending reminder. The cycle moves on to the
+// next phase without moving the desk, on the basis that the user has
+// acted on the reminder.
+func (m *mitm) ackReminder(ctx context.Context) error {
+	m.cycle.mu.Lock()
+	defer m.cycle.mu.Unlock()
+	if !m.reminderPending() {
+		return errNoReminder
+	}
+	next := nextPhase(m.cycle.state.Phase)
+	m.log.LogAttrs(ctx, slog.LevelInfo, "acknowledge reminder", slog.String("phase", next))
+	m.cycle.state.Phase = next
+	m.startPhase(next)
+	return m.store.update(func(p *persistent) { p.Cycle = m.cycle.state })
+}
+
+// nextPhase returns the sit/stand cycle phase that follows phase.
+func nextPhase(phase string) string {
+	if phase == "stand" {
+		return "sit"
+	}
+	return "stand"
+}
+
+// startPhase sets the end time of phase. The caller must hold m.cycle.mu.
+func (m *mitm) startPhase(phase string) {
+	cfg := m.config().Cycle
+	d := cfg.SitFor
+	if phase == "stand" {
+		d = cfg.StandFor
+	}
+	m.cycle.until = time.Now().Add(time.Duration(d))
+	m.cycle.warned = false
+}
+
+// runCycle runs the sit/stand cycle until ctx is cancelled, resuming the
+// persisted cycle state. A resumed phase restarts from its beginning.
+func (m *mitm) runCycle(ctx context.Context) {
+	m.cycle.mu.Lock()
+	m.cycle.state = m.store.get().Cycle
+	if m.cycle.state.Running {
+		m.log.LogAttrs(ctx, slog.LevelInfo, "resume cycle", slog.String("phase", m.cycle.state.Phase))
+		m.startPhase(m.cycle.state.Phase)
+	}
+	m.cycle.mu.Unlock()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		m.cycleStep(ctx)
+	}
+}
+
+// cycleStep gives the pre-move reminder and moves the desk when the
+// current phase of the sit/stand cycle is due to end.
+func (m *mitm) cycleStep(ctx context.Context) {
+	warning, ok := m.cycleAdvance(ctx)
+	if ok {
+		m.raise(ctx, warning)
+	}
+}
+
+// cycleAdvance moves the desk and starts the next phase of the sit/stand
+// cycle if the current phase has ended. It returns a warning alert and
+// true if the pre-move warning is due. The next phase is started before
+// the desk is moved so that m.cycle.mu is not held during the move.
+func (m *mitm) cycleAdvance(ctx context.Context) (warning alert, ok bool) {
+	m.cycle.mu.Lock()
+	if !m.cycle.state.Running {
+		m.cycle.mu.Unlock()
+		return alert{}, false
+	}
+	cfg := m.config().Cycle
+	next, preset, msg := "stand", cfg.Stand, msgCycleStand
+	if m.cycle.state.Phase == "stand" {
+		next, preset, msg = "sit", cfg.Sit, msgCycleSit
+	}
+	left := time.Until(m.cycle.until)
+	if m.inMeeting() {
+		// Hold the phase so that a reminder
+		// is given before the desk moves once
+		// the meeting has ended.
+		if warn := time.Duration(cfg.Warn); left < warn {
+			m.cycle.until = time.Now().Add(warn)
+			m.cycle.warned = false
+		}
+		m.cycle.mu.Unlock()
+		return alert{}, false
+	}
+	if !m.cycle.warned && cfg.Warn > 0 && left <= time.Duration(cfg.Warn) {
+		m.cycle.warned = true
+		warning = alert{Name: eventCycle, State: "warning", Detail: next, Message: m.text(msg, left.Round(time.Second))}
+		ok = true
+	}
+	if left > 0 {
+		m.cycle.mu.Unlock()
+		return warning, ok
+	}
+	m.cycle.state.Phase = next
+	m.startPhase(next)
+	err := m.store.update(func(p *persistent) { p.Cycle = m.cycle.state })
+	m.cycle.mu.Unlock()
+	if err != nil {
+		m.log.LogAttrs(ctx, slog.LevelError, "persist cycle", slog.Any("err", err))
+	}
+
+	log := m.logFor("uart")
+	log.LogAttrs(ctx, slog.LevelInfo, "cycle move", slog.String("phase", next), slog.Int("preset", preset))
+	m.mu.Lock()
+	err = errors.New("handset in use")
+	if !m.handsetBusy() {
+		err = m.claimMotion("cycle")
+		if err == nil {
+			err = m.moveToPreset(ctx, log, sourceDevice, preset, "")
+		}
+	}
+	m.mu.Unlock()
+	if err != nil {
+		log.LogAttrs(ctx, slog.LevelError, "cycle move", slog.Any("err", err))
+	}
+	return warning, ok
+}
+
+// gesture detects the handset button gesture that starts and stops the
+// sit/stand cycle. It must only be used from a single goroutine.
+type gesture struct {
+	since time.Time // Start of the current gesture, zero if none.
+	fired bool      // The current gesture has been acted on.
+}
+
+// key reports whether the handset keys in press complete the gesture.
+func (g *gesture) key(press string, now time.Time) bool {
+	if press != "ud" {
+		g.since = time.Time{}
+		g.fired = false
+		return false
+	}
+	if g.since.IsZero() {
+		g.since = now
+	}
+	if g.fired || now.Sub(g.since) < cycleGestureHold {
+		return false
+	}
+	g.fired = true
+	return true
+}
@@ -0,0 +1,101 @@
+// Copyright ©2025 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build http || !bluetooth
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+// Dynamic DNS updates are made by requesting the configured update URL,
+// which carries the domain and token in its query, as supported by
+// DuckDNS and dyndns2-style services. The service takes the address to
+// publish from the source of the request. The device cannot see its
+// public address, so an update is made when the network comes up, when
+// the address of the device changes, when the URL is changed and at the
+// configured interval.
+
+const (
+	// ddnsPoll is the time between checks for
+	// whether an update is due.
+	ddnsPoll = time.Minute
+
+	// ddnsRetry is the time to wait after a
+	// failed update before trying again.
+	ddnsRetry = 5 * time.Minute
+)
+
+var errDDNS = errors.New("ddns update refused")
+
+// runDDNS keeps the configured dynamic DNS record up to date until ctx is
+// cancelled.
+func (m *mitm) runDDNS(ctx context.Context, n *netStack) {
+	log := m.logFor("wifi")
+	var (
+		lastURL    string
+		lastAddr   netip.Addr
+		lastPublic netip.Addr
+		next       time.Time
+	)
+	for {
+		cfg := m.cfg.Load().DDNS
+		addr := n.stack.Addr()
+		now := time.Now()
+		if cfg.URL != "" && (cfg.URL != lastURL || addr != lastAddr || !now.Before(next)) {
+			public, err := n.updateDDNS(ctx, cfg.URL)
+			if err != nil {
+				log.LogAttrs(ctx, slog.LevelWarn, "ddns update", slog.Any("err", err))
+				next = now.Add(ddnsRetry)
+			} else {
+				level := slog.LevelDebug
+				if public.IsValid() && public != lastPublic {
+					level = slog.LevelInfo
+					lastPublic = public
+				}
+				log.LogAttrs(ctx, level, "ddns updated", slog.Any("public", public))
+				next = now.Add(time.Duration(cfg.Interval))
+			}
+			// Don't retry a failed update until
+			// the retry time, even if it was
+			// the URL or address that changed.
+			lastURL = cfg.URL
+			lastAddr = addr
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(ddnsPoll):
+		}
+	}
+}
+
+// updateDDNS requests the dynamic DNS update URL u and returns the public
+// address reported in the response, if any. The response body is checked
+// for the refusals of DuckDNS and dyndns2-style services.
+func (n *netStack) updateDDNS(ctx context.Context, u string) (netip.Addr, error) {
+	var buf [128]byte
+	k, err := n.hook.get(ctx, n, u, buf[:])
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	var public netip.Addr
+	for _, f := range strings.Fields(string(buf[:k])) {
+		switch f {
+		case "KO", "badauth", "nohost", "notfqdn", "abuse", "badagent", "911", "dnserr":
+			return netip.Addr{}, fmt.Errorf("%w: %s", errDDNS, f)
+		}
+		if a, err := netip.ParseAddr(f); err == nil {
+			public = a
+		}
+	}
+	return public, nil
+}
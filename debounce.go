@@ -0,0 +1,61 @@
+// Copyright ©2025 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// debouncer filters contact bounce from a switch input. The first edge
+// after a stable period is accepted immediately so that pass-through
+// latency is not increased, and subsequent edges within the debounce
+// interval are rejected. A rejected edge that leaves the switch in a
+// different state is picked up by settle once the interval has elapsed.
+type debouncer struct {
+	interval atomic.Int64 // Debounce interval in nanoseconds.
+	last     atomic.Int64 // Time of the last accepted edge in Unix nanoseconds.
+	state    atomic.Bool  // Last accepted state.
+
+	bounces *atomic.Uint64 // Count of rejected edges.
+}
+
+// edge reports whether a change of the switch to high at now should be
+// accepted. It is safe to call from an interrupt handler.
+func (d *debouncer) edge(high bool, now time.Time) bool {
+	if high == d.state.Load() {
+		return false
+	}
+	t := now.UnixNano()
+	if t-d.last.Load() < d.interval.Load() {
+		d.bounces.Add(1)
+		return false
+	}
+	d.last.Store(t)
+	d.state.Store(high)
+	return true
+}
+
+// settle polls get at the debounce interval and calls do when the switch
+// state differs from the last accepted state after bounces were rejected.
+// It returns when ctx is cancelled.
+func (d *debouncer) settle(ctx context.Context, get func() bool, do func(high bool)) {
+	for {
+		wait := time.Duration(d.interval.Load())
+		if wait < time.Millisecond {
+			wait = 10 * time.Millisecond
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+		high := get()
+		if high != d.state.Load() {
+			do(high)
+		}
+	}
+}
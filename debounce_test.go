@@ -0,0 +1,107 @@
+// Copyright ©2025 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDebouncerEdge(t *testing.T) {
+	t0 := time.Unix(1735689600, 0)
+	type edge struct {
+		high bool
+		at   time.Duration // Since t0.
+		want bool
+	}
+	for _, test := range []struct {
+		name        string
+		interval    time.Duration
+		edges       []edge
+		wantBounces uint64
+	}{
+		{
+			name:     "clean",
+			interval: 20 * time.Millisecond,
+			edges: []edge{
+				{high: true, at: 0, want: true},
+				{high: false, at: 100 * time.Millisecond, want: true},
+				{high: true, at: 200 * time.Millisecond, want: true},
+			},
+		},
+		{
+			name:     "bounce",
+			interval: 20 * time.Millisecond,
+			edges: []edge{
+				{high: true, at: 0, want: true},
+				{high: false, at: time.Millisecond, want: false},
+				{high: true, at: 2 * time.Millisecond, want: false},
+				{high: false, at: 3 * time.Millisecond, want: false},
+				{high: false, at: 20 * time.Millisecond, want: true},
+			},
+			wantBounces: 2,
+		},
+		{
+			name:     "repeated state",
+			interval: 20 * time.Millisecond,
+			edges: []edge{
+				{high: false, at: 0, want: false},
+				{high: true, at: 0, want: true},
+				{high: true, at: 100 * time.Millisecond, want: false},
+			},
+		},
+		{
+			name:     "disabled",
+			interval: 0,
+			edges: []edge{
+				{high: true, at: 0, want: true},
+				{high: false, at: 0, want: true},
+				{high: true, at: 0, want: true},
+			},
+		},
+	} {
+		var bounces atomic.Uint64
+		d := debouncer{bounces: &bounces}
+		d.interval.Store(int64(test.interval))
+		d.last.Store(t0.Add(-time.Hour).UnixNano())
+		for i, e := range test.edges {
+			got := d.edge(e.high, t0.Add(e.at))
+			if got != e.want {
+				t.Errorf("unexpected result for %s edge %d to %t at %v: got:%t want:%t", test.name, i, e.high, e.at, got, e.want)
+			}
+		}
+		if got := bounces.Load(); got != test.wantBounces {
+			t.Errorf("unexpected bounce count for %s: got:%d want:%d", test.name, got, test.wantBounces)
+		}
+	}
+}
+
+func TestDebouncerSettle(t *testing.T) {
+	var bounces atomic.Uint64
+	d := debouncer{bounces: &bounces}
+	d.interval.Store(int64(time.Millisecond))
+	d.edge(true, time.Now())
+	// The switch settled low after a rejected edge.
+	var switchHigh atomic.Bool
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	got := make(chan bool, 1)
+	go d.settle(ctx, switchHigh.Load, func(high bool) {
+		select {
+		case got <- high:
+		default:
+		}
+	})
+	select {
+	case high := <-got:
+		if high {
+			t.Error("unexpected settled state: got:true want:false")
+		}
+	case <-time.After(time.Second):
+		t.Error("settled state not picked up")
+	}
+}
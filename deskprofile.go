@@ -0,0 +1,138 @@
+// Copyright ©2025 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// A desk profile bundles what is known about a desk and its controller,
+// apart from the device, network and site configuration, so that it can
+// be shared between users with the same desk. It holds the controller
+// model and its timing quirks, the learned range and preset heights, and
+// the named positions.
+
+// deskProfileVersion is the version of the desk profile format.
+const deskProfileVersion = 1
+
+var errProfileVersion = errors.New("unsupported desk profile version")
+
+// deskProfile is an exported desk profile.
+type deskProfile struct {
+	Version int        `json:"version"`
+	Quirks  deskQuirks `json:"quirks"`
+
+	// Range is the learned range of the desk,
+	// nil if not known. It is exported for
+	// reference and is not imported.
+	Range *heightRange `json:"range,omitempty"`
+
+	// Presets is the learned height of each
+	// controller memory preset. A zero mantissa
+	// indicates the height is not known.
+	Presets [4]savedPosition `json:"presets"`
+
+	Positions []namedPosition `json:"positions,omitempty"`
+}
+
+// deskQuirks is the configuration describing the controller and the
+// desk. Each field has the name of the configuration field it holds, and
+// is nil if the profile does not set it.
+type deskQuirks struct {
+	Model             *string   `json:"model,omitempty"`
+	Unit              *string   `json:"unit,omitempty"`
+	Debounce          *duration `json:"debounce,omitempty"`
+	ControllerSilence *duration `json:"controller_silence,omitempty"`
+	Rest              *duration `json:"rest,omitempty"`
+}
+
+// exportProfile returns the desk profile of the device.
+func (m *mitm) exportProfile() deskProfile {
+	cfg := m.config()
+	s := m.store.get()
+	return deskProfile{
+		Version: deskProfileVersion,
+		Quirks: deskQuirks{
+			Model:             &cfg.Model,
+			Unit:              &cfg.Unit,
+			Debounce:          &cfg.Debounce,
+			ControllerSilence: &cfg.ControllerSilence,
+			Rest:              &cfg.Rest,
+		},
+		Range:     s.Range,
+		Presets:   s.Presets,
+		Positions: s.Positions,
+	}
+}
+
+// validate returns an error if the profile cannot be imported.
+func (p deskProfile) validate() error {
+	if p.Version != deskProfileVersion {
+		return fmt.Errorf("%w: %d", errProfileVersion, p.Version)
+	}
+	if len(p.Positions) > maxPositions {
+		return errTooManyPositions
+	}
+	for i, n := range p.Positions {
+		err := validPositionName(n.Name)
+		if err != nil {
+			return err
+		}
+		if slices.ContainsFunc(p.Positions[:i], func(o namedPosition) bool { return o.Name == n.Name }) {
+			return fmt.Errorf("%w: duplicate %q", errPositionName, n.Name)
+		}
+	}
+	return nil
+}
+
+// importProfile applies and persists the desk profile p, replacing the
+// preset heights and named positions. The quirks set by p are applied over
+// the running configuration, and those it does not set are left as they
+// are. The learned range is kept, since it must match the heights this
+// desk reports. The configuration, presets and positions are persisted in
+// a single update, and the configuration is only applied once they have
+// been persisted.
+func (m *mitm) importProfile(p deskProfile) error {
+	err := p.validate()
+	if err != nil {
+		return err
+	}
+	quirks, err := json.Marshal(p.Quirks)
+	if err != nil {
+		return err
+	}
+	_, rev := m.configRevision()
+	return m.updateConfig(rev, func(cfg *config) error {
+		err := json.Unmarshal(quirks, cfg)
+		if err != nil {
+			return err
+		}
+		err = m.checkConfig(*cfg)
+		if err != nil {
+			return err
+		}
+		var mergeErr error
+		err = m.store.update(func(s *persistent) {
+			changes, err := mergeJSON(s.Config, quirks)
+			if err != nil {
+				mergeErr = err
+				return
+			}
+			s.Config = changes
+			s.Presets = p.Presets
+			s.Positions = slices.Clone(p.Positions)
+		})
+		if err == nil {
+			err = mergeErr
+		}
+		if err != nil {
+			return persistError{err}
+		}
+		return nil
+	})
+}
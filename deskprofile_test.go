@@ -0,0 +1,76 @@
+// Copyright ©2025 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// TestImportProfile checks that an imported profile keeps the quirks it
+// does not set and the learned range, and is applied in a single update.
+func TestImportProfile(t *testing.T) {
+	flash := newFakeFlash(storeBlocks, 1024, 256)
+	m := &mitm{line: models[defaultConfig.Model].line}
+	m.store.flash = flash
+	cfg := defaultConfig.clone()
+	cfg.Rest = duration(3 * time.Second)
+	m.cfg.Store(&cfg)
+	local := &heightRange{Min: savedPosition{Mantissa: 650, Exponent: -1}, Max: savedPosition{Mantissa: 1200, Exponent: -1}}
+	err := m.store.update(func(s *persistent) { s.Range = local })
+	if err != nil {
+		t.Fatalf("unexpected error setting range: %v", err)
+	}
+
+	var p deskProfile
+	err = json.Unmarshal([]byte(`{
+	"version": 1,
+	"quirks": {"unit": "in"},
+	"range": {"min": {"mantissa": 1, "exponent": 0}, "max": {"mantissa": 999, "exponent": 0}},
+	"presets": [{"mantissa": 720, "exponent": -1}, {}, {}, {}],
+	"positions": [{"name": "standing", "position": {"mantissa": 1100, "exponent": -1}}]
+}`), &p)
+	if err != nil {
+		t.Fatalf("unexpected error decoding profile: %v", err)
+	}
+	err = m.importProfile(p)
+	if err != nil {
+		t.Fatalf("unexpected error importing profile: %v", err)
+	}
+	got := m.config()
+	if got.Unit != "in" || got.Rest != cfg.Rest || got.Model != cfg.Model || got.Debounce != cfg.Debounce {
+		t.Errorf("unexpected quirks after import: got unit:%q rest:%v model:%q debounce:%v want unit:%q rest:%v model:%q debounce:%v",
+			got.Unit, got.Rest, got.Model, got.Debounce, "in", cfg.Rest, cfg.Model, cfg.Debounce)
+	}
+	s := reload(t, flash).get()
+	if got, want := string(s.Config), `{"unit":"in"}`; got != want {
+		t.Errorf("unexpected persisted changes: got:%s want:%s", got, want)
+	}
+	if !reflect.DeepEqual(s.Range, local) {
+		t.Errorf("unexpected range after import: got:%+v want:%+v", s.Range, local)
+	}
+	if s.Presets != p.Presets {
+		t.Errorf("unexpected presets after import: got:%+v want:%+v", s.Presets, p.Presets)
+	}
+	if !reflect.DeepEqual(s.Positions, p.Positions) {
+		t.Errorf("unexpected positions after import: got:%+v want:%+v", s.Positions, p.Positions)
+	}
+
+	flash.tear = 1
+	p.Quirks.Unit = nil
+	p.Positions = nil
+	err = m.importProfile(p)
+	var persistErr persistError
+	if !errors.As(err, &persistErr) {
+		t.Errorf("unexpected error for failed persist: got:%v want:%v", err, persistError{errTorn})
+	}
+	s = reload(t, flash).get()
+	if len(s.Positions) != 1 {
+		t.Errorf("unexpected positions after failed persist: got:%+v want one position", s.Positions)
+	}
+}
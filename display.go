@@ -0,0 +1,52 @@
+// Copyright ©2025 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+)
+
+// The handset display is driven by the controller's frames, which reach
+// the handset directly rather than through the device. When the display
+// times out, the controller sends frames with empty content, so whether
+// the display is lit is tracked from the frames the device reads. The
+// display can be woken with a keep-alive key action, which does not move
+// the desk, but it cannot be blanked or dimmed since the device cannot
+// suppress or replace the controller's frames.
+
+var errDisplayOff = errors.New("display is driven by the controller and cannot be turned off")
+
+// displayFrame records whether the last controller frame lit the handset
+// display.
+func (m *mitm) displayFrame(ctx context.Context, lit bool) {
+	if m.displayLit.Swap(lit) != lit {
+		m.logFor("uart").LogAttrs(ctx, slog.LevelDebug, "display", slog.Bool("on", lit))
+	}
+}
+
+// displayStatus returns "on" if the handset display is lit and "off"
+// otherwise.
+func (m *mitm) displayStatus() string {
+	if m.displayLit.Load() {
+		return "on"
+	}
+	return "off"
+}
+
+// wakeDisplay lights the handset display by sending a keep-alive key
+// action for src once the desk is idle.
+func (m *mitm) wakeDisplay(ctx context.Context, log *slog.Logger, src string) error {
+	if !m.idleLock(ctx) {
+		return ctx.Err()
+	}
+	defer m.mu.Unlock()
+	if m.handsetBusy() {
+		return errors.New("handset in use")
+	}
+	m.alive()
+	return m.command(ctx, log, src, actionKeepAlive)
+}
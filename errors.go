@@ -35,6 +35,26 @@ var (
 		{on: true, duration: 10 * time.Millisecond},
 		{on: false, duration: 990 * time.Millisecond},
 	}
+	// controllerLost is the heartbeat when the controller
+	// has stopped sending frames.
+	controllerLost = ledSequence{
+		{on: true, duration: 10 * time.Millisecond},
+		{on: false, duration: 190 * time.Millisecond},
+		{on: true, duration: 10 * time.Millisecond},
+		{on: false, duration: 790 * time.Millisecond},
+	}
+	// notifyFlash is flashed by the LED
+	// notification sink.
+	notifyFlash = ledSequence{
+		{on: true, duration: 100 * time.Millisecond},
+		{on: false, duration: 100 * time.Millisecond},
+		{on: true, duration: 100 * time.Millisecond},
+		{on: false, duration: 100 * time.Millisecond},
+		{on: true, duration: 100 * time.Millisecond},
+		{on: false, duration: 100 * time.Millisecond},
+		{on: true, duration: 100 * time.Millisecond},
+		{on: false, duration: 300 * time.Millisecond},
+	}
 	// uncaughtPanic is the panic termination heartbeat.
 	uncaughtPanic = ledSequence{
 		{on: true, duration: 990 * time.Millisecond},
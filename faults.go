@@ -0,0 +1,164 @@
+// Copyright ©2025 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build faults
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Fault injection is built in with the faults build tag so that the
+// supervisor, UART resynchronisation and recovery paths can be exercised.
+// Faults are configured on the serial console with the faults command,
+// which holds for the life of the process. Random choices are made with
+// a seeded generator so that runs are reproducible.
+
+// faultsBuilt is whether fault injection is built in.
+const faultsBuilt = true
+
+var errInjected = errors.New("injected fault")
+
+// faults is the fault injection state.
+var faults faultInjector
+
+// faultInjector holds the fault injection configuration and the state of
+// its random number generator.
+type faultInjector struct {
+	mu       sync.Mutex
+	cfg      faultConfig
+	rngState uint64
+}
+
+// faultConfig is the set of faults to inject.
+type faultConfig struct {
+	drop    uint64 // Percentage of UART bytes dropped.
+	corrupt uint64 // Percentage of UART frames with a corrupted checksum.
+	stall   bool   // The radio packet loop is stalled.
+	flash   bool   // Flash writes fail.
+}
+
+// set configures fault injection from space-separated key=value pairs in
+// spec. The keys are uart_drop and checksum, percentages, radio_stall and
+// flash_fail, booleans, and seed, the seed of the random number generator.
+// A spec of "off" clears all faults, leaving the generator state.
+func (f *faultInjector) set(spec string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if strings.TrimSpace(spec) == "off" {
+		f.cfg = faultConfig{}
+		return nil
+	}
+	next := f.cfg
+	seed := f.rngState
+	for _, field := range strings.Fields(spec) {
+		key, val, ok := strings.Cut(field, "=")
+		if !ok {
+			return fmt.Errorf("invalid fault: %q", field)
+		}
+		var err error
+		switch key {
+		case "uart_drop":
+			next.drop, err = parsePercent(val)
+		case "checksum":
+			next.corrupt, err = parsePercent(val)
+		case "radio_stall":
+			next.stall, err = strconv.ParseBool(val)
+		case "flash_fail":
+			next.flash, err = strconv.ParseBool(val)
+		case "seed":
+			seed, err = strconv.ParseUint(val, 10, 64)
+		default:
+			return fmt.Errorf("unknown fault: %q", key)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid fault value: %q", field)
+		}
+	}
+	f.cfg = next
+	f.rngState = seed
+	return nil
+}
+
+// parsePercent parses a whole number percentage.
+func parsePercent(s string) (uint64, error) {
+	v, err := strconv.ParseUint(s, 10, 64)
+	if err != nil || v > 100 {
+		return 0, fmt.Errorf("invalid percentage: %q", s)
+	}
+	return v, nil
+}
+
+// String returns the fault configuration in the form accepted by set.
+func (f *faultInjector) String() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return fmt.Sprintf("uart_drop=%d checksum=%d radio_stall=%t flash_fail=%t", f.cfg.drop, f.cfg.corrupt, f.cfg.stall, f.cfg.flash)
+}
+
+// chance returns true with probability pct percent. The caller must hold
+// f.mu.
+func (f *faultInjector) chance(pct uint64) bool {
+	if pct == 0 {
+		return false
+	}
+	// SplitMix64.
+	f.rngState += 0x9e3779b97f4a7c15
+	z := f.rngState
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	z ^= z >> 31
+	return z%100 < pct
+}
+
+// dropBytes returns b with bytes removed at the configured drop rate.
+func (f *faultInjector) dropBytes(b []byte) []byte {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.cfg.drop == 0 {
+		return b
+	}
+	kept := b[:0]
+	for _, c := range b {
+		if !f.chance(f.cfg.drop) {
+			kept = append(kept, c)
+		}
+	}
+	return kept
+}
+
+// corruptFrame inverts the checksum byte of the frame at the configured
+// corruption rate.
+func (f *faultInjector) corruptFrame(frame []byte) {
+	if len(frame) == 0 {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.chance(f.cfg.corrupt) {
+		frame[len(frame)-1] ^= 0xff
+	}
+}
+
+// radioStalled returns whether the radio packet loop is stalled.
+func (f *faultInjector) radioStalled() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.cfg.stall
+}
+
+// flashWrite returns errInjected if flash writes are failing.
+func (f *faultInjector) flashWrite() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.cfg.flash {
+		return errInjected
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+// Copyright ©2025 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build faults
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"slices"
+	"testing"
+)
+
+// setFaults configures fault injection with spec for the duration of the
+// test.
+func setFaults(t *testing.T, spec string) {
+	t.Helper()
+	err := faults.set(spec)
+	if err != nil {
+		t.Fatalf("unexpected error setting faults %q: %v", spec, err)
+	}
+	t.Cleanup(func() { faults.set("off") })
+}
+
+// frameStream returns n handset frames, each in its own chunk.
+func frameStream(n int) [][]byte {
+	chunks := make([][]byte, n)
+	for i := range chunks {
+		chunks[i] = keyFrame(byte(i) & (keyUp | keyDown))
+	}
+	return chunks
+}
+
+// readAll returns the results of reading packets from r until the end of
+// its data.
+func readAll(r *uartReader) []packetResult {
+	var got []packetResult
+	for {
+		res := readPackets(r, 1)[0]
+		if res.err == io.EOF {
+			return got
+		}
+		got = append(got, res)
+	}
+}
+
+func TestFaultsUARTDrop(t *testing.T) {
+	const frames = 200
+	var runs [2][]packetResult
+	for i := range runs {
+		setFaults(t, "seed=1 uart_drop=5")
+		var (
+			stats uartStats
+			beats int
+		)
+		r := newTestReader(&fakeUART{chunks: frameStream(frames)}, &stats, &beats)
+		runs[i] = readAll(r)
+		faults.set("off")
+
+		snap := stats.snapshot()
+		if snap.BytesRead >= frames*frameLen {
+			t.Errorf("expected dropped bytes: read %d of %d", snap.BytesRead, frames*frameLen)
+		}
+		if snap.Resyncs == 0 {
+			t.Error("expected resynchronisation after dropped bytes")
+		}
+		if snap.Frames == 0 {
+			t.Error("expected frames to be read with dropped bytes")
+		}
+
+		// The reader must recover its framing
+		// once bytes are no longer dropped.
+		r.src = &fakeUART{chunks: frameStream(4)}
+		got := readAll(r)
+		if len(got) == 0 {
+			t.Fatal("no frames read after dropping stopped")
+		}
+		last := got[len(got)-1]
+		if want := keyFrame(3 & (keyUp | keyDown)); !bytes.Equal(last.pkt, want) || last.err != nil {
+			t.Errorf("unexpected last frame after dropping stopped: got:%x %v want:%x <nil>", last.pkt, last.err, want)
+		}
+	}
+	if !slices.EqualFunc(runs[0], runs[1], func(a, b packetResult) bool {
+		return bytes.Equal(a.pkt, b.pkt) && a.err == b.err
+	}) {
+		t.Error("seeded fault injection not reproducible")
+	}
+}
+
+func TestFaultsChecksum(t *testing.T) {
+	setFaults(t, "seed=1 checksum=100")
+	var beats int
+	chunks := frameStream(8)
+	want := make([][]byte, len(chunks))
+	for i, c := range chunks {
+		want[i] = slices.Clone(c)
+		want[i][frameLen-1] ^= 0xff
+	}
+	r := newTestReader(&fakeUART{chunks: chunks}, nil, &beats)
+	got := readAll(r)
+	if len(got) != len(want) {
+		t.Fatalf("unexpected number of frames: got:%d want:%d", len(got), len(want))
+	}
+	for i, g := range got {
+		if !bytes.Equal(g.pkt, want[i]) || g.err != nil {
+			t.Errorf("unexpected frame %d: got:%x %v want:%x <nil>", i, g.pkt, g.err, want[i])
+		}
+		if _, err := aokeKeys(g.pkt); err != errChecksumMismatch {
+			t.Errorf("unexpected error decoding corrupted frame %d: got:%v want:%v", i, err, errChecksumMismatch)
+		}
+	}
+}
+
+func TestFaultsFlashFail(t *testing.T) {
+	flash := newFakeFlash(storeBlocks, 1024, 256)
+	s := &store{flash: flash}
+	for i := range 2 {
+		err := s.update(setHostname(fmt.Sprint("desk-", i)))
+		if err != nil {
+			t.Fatalf("unexpected error on update %d: %v", i, err)
+		}
+	}
+	mem := slices.Clone(flash.mem)
+
+	setFaults(t, "flash_fail=true")
+	err := s.update(setHostname("failed"))
+	if err != errInjected {
+		t.Errorf("unexpected error for failed flash write: got:%v want:%v", err, errInjected)
+	}
+	if !bytes.Equal(flash.mem, mem) {
+		t.Error("flash modified by failed write")
+	}
+	got := reload(t, flash)
+	if got.state.Hostname != "desk-1" {
+		t.Errorf("unexpected host name after failed write: got:%q want:%q", got.state.Hostname, "desk-1")
+	}
+
+	faults.set("off")
+	err = s.update(setHostname("recovered"))
+	if err != nil {
+		t.Fatalf("unexpected error on update after flash recovered: %v", err)
+	}
+	got = reload(t, flash)
+	if got.state.Hostname != "recovered" {
+		t.Errorf("unexpected host name after flash recovered: got:%q want:%q", got.state.Hostname, "recovered")
+	}
+}
@@ -0,0 +1,191 @@
+// Copyright ©2025 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build bluetooth
+
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"tinygo.org/x/bluetooth"
+)
+
+// A unit can be paired with a second desk in the same room so that the
+// second desk follows it. The unit acts as a Bluetooth central, connecting
+// to the follower's desk service, and forwards each move to a preset or a
+// named position by writing to the follower's move_to and named position
+// characteristics. The follower runs the moves as it would any other
+// Bluetooth command, so the presets and position names of the two desks
+// should correspond. Moves commanded over Bluetooth are not forwarded so
+// that two units following each other do not echo moves back and forth.
+//
+// Moves are written with write requests, which the follower acknowledges
+// once it has handled the write, so that a failure is reported. Write
+// commands cannot be used since the HCI ATT server drops them without
+// calling the characteristic's write handler.
+
+// followScan is the longest time spent scanning for the follower.
+const followScan = 10 * time.Second
+
+var (
+	errNoFollower     = errors.New("follower not found")
+	errNoWriteRequest = errors.New("bluetooth stack cannot send write requests")
+)
+
+// followUUIDs holds the UUIDs of the follower's desk service and the
+// characteristics that moves are written to.
+type followUUIDs struct {
+	service, moveTo, positions bluetooth.UUID
+}
+
+// requestWriter is a characteristic that is written with a write request.
+type requestWriter interface {
+	Write(p []byte) (int, error)
+}
+
+// follower is a connection to the unit that follows this one.
+type follower struct {
+	name      string
+	dev       bluetooth.Device
+	moveTo    requestWriter
+	positions requestWriter
+}
+
+// runFollow forwards the moves received on sub to the configured follower
+// until ctx is cancelled. The follower is connected to when the first
+// move is forwarded and is reconnected if a write fails.
+func (m *mitm) runFollow(ctx context.Context, log *slog.Logger, adapter *bluetooth.Adapter, uuids followUUIDs, sub *subscription) {
+	defer m.events.unsubscribe(sub)
+	var f *follower
+	defer func() {
+		if f != nil {
+			f.dev.Disconnect()
+		}
+	}()
+	for {
+		e, _, err := sub.next(ctx)
+		if err != nil {
+			return
+		}
+		name := m.cfg.Load().Follow.Name
+		if f != nil && f.name != name {
+			f.dev.Disconnect()
+			f = nil
+		}
+		if name == "" || e.src == sourceBLE || m.bluetoothBlocked.Load() {
+			continue
+		}
+		// Retry once on a new connection if the
+		// write fails on an existing one.
+		for range 2 {
+			if f == nil {
+				f, err = connectFollower(adapter, name, uuids)
+				if err != nil {
+					break
+				}
+				log.LogAttrs(ctx, slog.LevelInfo, "follower connected", slog.String("name", name), slog.String("peer", f.dev.Address.String()))
+			}
+			err = f.forward(e)
+			if err == nil {
+				break
+			}
+			f.dev.Disconnect()
+			f = nil
+		}
+		if err != nil {
+			log.LogAttrs(ctx, slog.LevelWarn, "forward move", slog.String("name", name), slog.Any("err", err))
+			continue
+		}
+		log.LogAttrs(ctx, slog.LevelInfo, "forward move", slog.String("name", name), slog.String("src", e.src), slog.Int("preset", e.preset), slog.String("position", e.name))
+	}
+}
+
+// connectFollower scans for the unit advertising the local name and
+// connects to its desk service.
+func connectFollower(adapter *bluetooth.Adapter, name string, uuids followUUIDs) (*follower, error) {
+	var (
+		addr  bluetooth.Address
+		found bool
+	)
+	stop := time.AfterFunc(followScan, func() { adapter.StopScan() })
+	err := adapter.Scan(func(a *bluetooth.Adapter, r bluetooth.ScanResult) {
+		if r.LocalName() == name {
+			addr = r.Address
+			found = true
+			a.StopScan()
+		}
+	})
+	stop.Stop()
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, errNoFollower
+	}
+	dev, err := adapter.Connect(addr, bluetooth.ConnectionParams{})
+	if err != nil {
+		return nil, err
+	}
+	f, err := discoverFollower(dev, uuids)
+	if err != nil {
+		dev.Disconnect()
+		return nil, err
+	}
+	f.name = name
+	return f, nil
+}
+
+// discoverFollower returns the follower connected as dev with its desk
+// service characteristics.
+func discoverFollower(dev bluetooth.Device, uuids followUUIDs) (*follower, error) {
+	services, err := dev.DiscoverServices([]bluetooth.UUID{uuids.service})
+	if err != nil {
+		return nil, err
+	}
+	if len(services) == 0 {
+		return nil, errNoFollower
+	}
+	chars, err := services[0].DiscoverCharacteristics([]bluetooth.UUID{uuids.moveTo, uuids.positions})
+	if err != nil {
+		return nil, err
+	}
+	f := &follower{dev: dev}
+	var n int
+	for _, c := range chars {
+		// Not all platforms' Bluetooth stacks can
+		// send write requests.
+		w, ok := any(c).(requestWriter)
+		if !ok {
+			return nil, errNoWriteRequest
+		}
+		switch c.UUID() {
+		case uuids.moveTo:
+			f.moveTo = w
+			n++
+		case uuids.positions:
+			f.positions = w
+			n++
+		}
+	}
+	if n != 2 {
+		return nil, errNoFollower
+	}
+	return f, nil
+}
+
+// forward writes the move in e to the follower, returning once the
+// follower has acknowledged the write.
+func (f *follower) forward(e event) error {
+	var err error
+	if e.name != "" {
+		_, err = f.positions.Write([]byte("go " + e.name))
+	} else {
+		_, err = f.moveTo.Write([]byte{byte(e.preset)})
+	}
+	return err
+}
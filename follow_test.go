@@ -0,0 +1,101 @@
+// Copyright ©2025 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build bluetooth
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"testing"
+)
+
+// fakeCharacteristic is a follower characteristic that records the
+// values written to it.
+type fakeCharacteristic struct {
+	writes [][]byte
+	err    error
+}
+
+func (c *fakeCharacteristic) Write(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	c.writes = append(c.writes, append([]byte(nil), p...))
+	return len(p), nil
+}
+
+var forwardTests = []struct {
+	name  string
+	event event
+	want  command
+}{
+	{
+		name:  "preset",
+		event: event{preset: 2},
+		want:  command{op: opPreset, preset: 2},
+	},
+	{
+		name:  "named",
+		event: event{name: "standing"},
+		want:  command{op: opNamed, name: "standing"},
+	},
+}
+
+// TestForward checks that a move forwarded by the leader is run by a
+// follower receiving the written value.
+func TestForward(t *testing.T) {
+	ctx := context.Background()
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	for _, test := range forwardTests {
+		t.Run(test.name, func(t *testing.T) {
+			var moveTo, positions fakeCharacteristic
+			f := &follower{moveTo: &moveTo, positions: &positions}
+			err := f.forward(test.event)
+			if err != nil {
+				t.Fatalf("unexpected error forwarding %s: %v", test.name, err)
+			}
+			if len(moveTo.writes)+len(positions.writes) != 1 {
+				t.Fatalf("unexpected number of writes for %s: got:%d want:1", test.name, len(moveTo.writes)+len(positions.writes))
+			}
+
+			m := &mitm{}
+			cfg := defaultConfig
+			m.cfg.Store(&cfg)
+			commands := make(chan command)
+			got := make(chan command, 1)
+			go func() {
+				c := <-commands
+				got <- c
+				c.done <- commandResult{}
+			}()
+			if len(moveTo.writes) != 0 {
+				err = m.presetRequest(ctx, log, commands, moveTo.writes[0])
+			} else {
+				err = m.namedPositionCommand(ctx, log, commands, &syncSequence{}, string(positions.writes[0]))
+			}
+			if err != nil {
+				t.Fatalf("unexpected error running %s: %v", test.name, err)
+			}
+			c := <-got
+			if c.op != test.want.op || c.preset != test.want.preset || c.name != test.want.name || c.src != sourceBLE {
+				t.Errorf("unexpected command for %s: got:%+v want:%+v", test.name, c, test.want)
+			}
+		})
+	}
+}
+
+func TestForwardError(t *testing.T) {
+	errLost := errors.New("lost")
+	f := &follower{moveTo: &fakeCharacteristic{err: errLost}, positions: &fakeCharacteristic{err: errLost}}
+	for _, e := range []event{{preset: 1}, {name: "sitting"}} {
+		err := f.forward(e)
+		if err != errLost {
+			t.Errorf("unexpected error for %+v: got:%v want:%v", e, err, errLost)
+		}
+	}
+}
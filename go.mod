@@ -4,6 +4,7 @@ go 1.22
 
 require (
 	github.com/soypat/cyw43439 v0.0.0-20250106095300-90bf0c1db251
+	github.com/soypat/natiu-mqtt v0.5.1
 	github.com/soypat/seqs v0.0.0-20240527012110-1201bab640ef
 	tinygo.org/x/bluetooth v0.0.0-00010101000000-000000000000
 )
@@ -0,0 +1,130 @@
+// Copyright ©2025 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// handsetFrame records the arrival of a frame from the handset, leaving
+// virtual handset mode if it is active.
+func (m *mitm) handsetFrame(ctx context.Context) {
+	m.lastHandset.Store(time.Now().UnixNano())
+	if m.handsetAbsent.CompareAndSwap(true, false) {
+		m.logFor("uart").LogAttrs(ctx, slog.LevelInfo, "handset present")
+	}
+}
+
+// memoryWindow is the time after the memory key is pressed during which
+// a preset key programs the preset rather than moving to it.
+const memoryWindow = 5 * time.Second
+
+// handsetKey acts on a change in the handset keys held to keys: a preset
+// key makes its preset the target of the desk and, unless it programs the
+// preset, is published as a move with its target, and the memory key
+// starts the window in which a preset key programs the preset. A memory
+// key press that snoozes a reminder is consumed by snoozeKey and does not
+// reach here.
+func (m *mitm) handsetKey(ctx context.Context, keys string) {
+	switch {
+	case len(keys) == 1 && '1' <= keys[0] && keys[0] <= '4':
+		n := int(keys[0] - '0')
+		m.presetPressed(n)
+		if time.Since(time.Unix(0, m.lastMemory.Load())) > memoryWindow {
+			m.events.publish(event{kind: moveCommanded, time: time.Now(), src: sourceHandset, preset: n})
+			m.publishTarget(m.presetTarget(n))
+		}
+	case keys == "m":
+		m.lastMemory.Store(time.Now().UnixNano())
+	}
+}
+
+// snoozeKey consumes a press of the handset memory key that snoozes a
+// pending reminder, so that the press is not passed to the controller,
+// where it would start programming a preset. It must only be used from a
+// single goroutine.
+type snoozeKey struct {
+	down     bool // The memory key is held.
+	consumed bool // The current press snoozed a reminder.
+}
+
+// key reports whether the handset keys in press are consumed. When the
+// memory key is pressed alone, snooze is called to snooze any pending
+// reminder, and the press is consumed until the memory key is released
+// if it returns true.
+func (s *snoozeKey) key(press string, snooze func() bool) bool {
+	if !strings.Contains(press, "m") {
+		*s = snoozeKey{}
+		return false
+	}
+	if !s.down {
+		s.down = true
+		s.consumed = press == "m" && snooze()
+	}
+	return s.consumed
+}
+
+// snoozeHandset snoozes a pending reminder for a press of the handset
+// memory key, returning whether a reminder was snoozed.
+func (m *mitm) snoozeHandset(ctx context.Context) bool {
+	err := m.snoozeReminder(ctx, handsetSnooze)
+	if err != nil {
+		if err != errNoReminder {
+			m.logFor("uart").LogAttrs(ctx, slog.LevelError, "snooze reminder", slog.Any("err", err))
+		}
+		return false
+	}
+	return true
+}
+
+// watchHandset switches to virtual handset mode when no frames have been
+// received from the handset for longer than the configured window while
+// the controller is awake and talking. The
+// handset does not send frames while the controller is asleep or silent,
+// so those times are not counted. In virtual handset mode the handset
+// button line is not treated as holding the desk so that remote commands
+// are not blocked by a floating line.
+func (m *mitm) watchHandset(ctx context.Context) {
+	m.lastHandset.Store(time.Now().UnixNano())
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	var idle time.Time // Time the controller was last seen asleep or silent.
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if m.controllerAsleep.Load() || m.controllerLost.Load() {
+			idle = time.Now()
+		}
+		last := time.Unix(0, m.lastHandset.Load())
+		if idle.After(last) {
+			last = idle
+		}
+		window := time.Duration(m.cfg.Load().HandsetAbsence)
+		quiet := time.Since(last)
+		if window > 0 && quiet > window && m.handsetAbsent.CompareAndSwap(false, true) {
+			m.logFor("uart").LogAttrs(ctx, slog.LevelWarn, "handset absent", slog.Duration("quiet", quiet.Round(time.Second)))
+		}
+	}
+}
+
+// handsetBusy returns whether the handset button is held. It is always
+// false in virtual handset mode.
+func (m *mitm) handsetBusy() bool {
+	return !m.handsetAbsent.Load() && m.button.Get()
+}
+
+// handsetStatus returns a description of the handset state.
+func (m *mitm) handsetStatus() string {
+	if m.handsetAbsent.Load() {
+		return "handset: absent"
+	}
+	return "handset: present"
+}
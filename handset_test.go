@@ -0,0 +1,72 @@
+// Copyright ©2025 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import "testing"
+
+var snoozeKeyTests = []struct {
+	name    string
+	presses []string
+	pending bool
+	want    []bool
+	snoozes int
+}{
+	{
+		name:    "no reminder",
+		presses: []string{"_", "m", "m", "_", "1"},
+		want:    []bool{false, false, false, false, false},
+		snoozes: 1,
+	},
+	{
+		name:    "reminder",
+		presses: []string{"_", "m", "m", "_", "1"},
+		pending: true,
+		want:    []bool{false, true, true, false, false},
+		snoozes: 1,
+	},
+	{
+		name:    "memory key with another key",
+		presses: []string{"m", "m1", "m", "_"},
+		pending: true,
+		want:    []bool{true, true, true, false},
+		snoozes: 1,
+	},
+	{
+		name:    "another key first",
+		presses: []string{"1", "m1", "m", "_"},
+		pending: true,
+		want:    []bool{false, false, false, false},
+		snoozes: 0,
+	},
+	{
+		name:    "second press",
+		presses: []string{"m", "_", "m", "_"},
+		pending: true,
+		want:    []bool{true, false, true, false},
+		snoozes: 2,
+	},
+}
+
+func TestSnoozeKey(t *testing.T) {
+	for _, test := range snoozeKeyTests {
+		var (
+			s       snoozeKey
+			snoozes int
+		)
+		snooze := func() bool {
+			snoozes++
+			return test.pending
+		}
+		for i, p := range test.presses {
+			got := s.key(p, snooze)
+			if got != test.want[i] {
+				t.Errorf("unexpected consumption for %s press %d %q: got:%t want:%t", test.name, i, p, got, test.want[i])
+			}
+		}
+		if snoozes != test.snoozes {
+			t.Errorf("unexpected number of snoozes for %s: got:%d want:%d", test.name, snoozes, test.snoozes)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright ©2025 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// hoursPerWeek is the number of hour-of-week bins in a heatmap.
+const hoursPerWeek = 7 * 24
+
+// heatmapSample is the interval at which the standing state is
+// sampled into the heatmap.
+const heatmapSample = time.Minute
+
+// heatmap is an hour-of-week histogram of desk use. Bins are indexed
+// by UTC hour of the week starting from midnight on Sunday. Only times
+// after the clock has been synced are recorded.
+type heatmap struct {
+	mu     sync.Mutex
+	moves  [hoursPerWeek]uint32 // Number of movements started.
+	stand  [hoursPerWeek]uint32 // Seconds spent standing.
+	intend [hoursPerWeek]uint32 // Seconds in the standing phase of the sit/stand cycle.
+}
+
+// heatmapSnapshot is the JSON form of a heatmap.
+type heatmapSnapshot struct {
+	Moves  []uint32 `json:"moves"`
+	Stand  []uint32 `json:"stand_seconds"`
+	Intend []uint32 `json:"intend_seconds"`
+	Synced bool     `json:"synced"`
+}
+
+// hourOfWeek returns the heatmap bin for t.
+func hourOfWeek(t time.Time) int {
+	t = t.UTC()
+	return int(t.Weekday())*24 + t.Hour()
+}
+
+// move records the start of a movement at t.
+func (h *heatmap) move(t time.Time) {
+	h.mu.Lock()
+	h.moves[hourOfWeek(t)]++
+	h.mu.Unlock()
+}
+
+// sample adds d to the standing and intended standing time at t.
+func (h *heatmap) sample(t time.Time, d time.Duration, standing, intended bool) {
+	i := hourOfWeek(t)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if standing {
+		h.stand[i] += uint32(d / time.Second)
+	}
+	if intended {
+		h.intend[i] += uint32(d / time.Second)
+	}
+}
+
+// snapshot returns a copy of the heatmap.
+func (h *heatmap) snapshot() heatmapSnapshot {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return heatmapSnapshot{
+		Moves:  append([]uint32(nil), h.moves[:]...),
+		Stand:  append([]uint32(nil), h.stand[:]...),
+		Intend: append([]uint32(nil), h.intend[:]...),
+	}
+}
+
+// moveStarted records a movement in the heatmap if the clock is synced.
+func (m *mitm) moveStarted() {
+	if m.clock.isSynced() {
+		m.metrics.heatmap.move(m.clock.now())
+	}
+}
+
+// runHeatmap samples the standing state of the desk into the heatmap
+// until ctx is cancelled.
+func (m *mitm) runHeatmap(ctx context.Context) {
+	ticker := time.NewTicker(heatmapSample)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if !m.clock.isSynced() {
+			continue
+		}
+		m.cycle.mu.Lock()
+		intended := m.cycle.state.Running && m.cycle.state.Phase == "stand"
+		m.cycle.mu.Unlock()
+		m.metrics.heatmap.sample(m.clock.now(), heatmapSample, m.standing(), intended)
+	}
+}
+
+// standing returns whether the desk is at a standing height; closer to
+// the learned height of the sit/stand cycle's standing preset than to
+// its sitting preset. It returns false if either height is not known.
+func (m *mitm) standing() bool {
+	if !m.heightKnown.Load() {
+		return false
+	}
+	cfg := m.config().Cycle
+	presets := m.store.get().Presets
+	sit, stand := presets[cfg.Sit-1], presets[cfg.Stand-1]
+	if sit.Mantissa == 0 || stand.Mantissa == 0 {
+		return false
+	}
+	lo := position{mantissa: sit.Mantissa, exponent: sit.Exponent}.units()
+	hi := position{mantissa: stand.Mantissa, exponent: stand.Exponent}.units()
+	h := m.position.Load().(position).units()
+	if hi > lo {
+		return h > (lo+hi)/2
+	}
+	return h < (lo+hi)/2
+}
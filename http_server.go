@@ -7,12 +7,21 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/hmac"
+	_ "embed"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
+	"math"
 	"net/http"
 	"net/netip"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/soypat/seqs/stacks"
@@ -22,126 +31,632 @@ import (
 
 var useHTTP = true
 
-func (m *mitm) httpServer(ctx context.Context) error {
-	_, stack, err := wifi.SetupWithDHCP(m.dev, wifi.SetupConfig{
-		Hostname: "desk",
-		TCPPorts: 1,
-	}, m.log)
-	if err != nil {
-		return fmt.Errorf("failed to set up dhcp: %w", err)
-	}
+// uiPage is the web dashboard served at the root. The {{lang}} and
+// {{text}} placeholders are replaced by dashboard before it is served.
+//
+//go:embed ui.html
+var uiPage []byte
 
-	const tcpBufLen = 2048 // Half a page each direction.
-	ln, err := stacks.NewTCPListener(stack, stacks.TCPListenerConfig{
-		MaxConnections: 3,
-		ConnTxBufSize:  tcpBufLen,
-		ConnRxBufSize:  tcpBufLen,
-	})
-	if err != nil {
-		return fmt.Errorf("failed to create listener: %w", err)
-	}
-	const port = 80
-	err = ln.StartListening(port)
-	if err != nil {
-		return fmt.Errorf("failed to start listener: %w", err)
+// dashboard returns the web dashboard in the configured language.
+func (m *mitm) dashboard() []byte {
+	lang := m.config().Language
+	if catalog[lang] == nil {
+		lang = "en"
 	}
+	// The marshaled text is safe to include in the page's
+	// script since json escapes '<', '>' and '&'.
+	text, _ := json.Marshal(map[string]string{
+		"stop":     m.text(msgUIStop),
+		"level":    m.text(msgUILogLevel),
+		"bt":       m.text(msgUIBluetooth),
+		"password": m.text(msgUIPassword),
+		"token":    m.text(msgUIToken),
+		"code":     m.text(msgUIOneTimeCode),
+		"ok":       m.text(msgUIOK),
+	})
+	page := bytes.Replace(uiPage, []byte("{{lang}}"), []byte(lang), 1)
+	return bytes.Replace(page, []byte("{{text}}"), text, 1)
+}
 
-	addr := netip.AddrPortFrom(stack.Addr(), port)
-	m.log.LogAttrs(ctx, slog.LevelInfo, "listening", slog.String("addr", "http://"+addr.String()))
+// httpTransport is the HTTP server transport.
+type httpTransport struct{ m *mitm }
+
+func (httpTransport) name() string { return "http" }
+
+func (t httpTransport) start(ctx context.Context, commands chan<- command) error {
+	return t.m.httpServer(ctx, commands)
+}
+
+func (m *mitm) httpServer(ctx context.Context, commands chan<- command) error {
+	log := m.logFor("http")
+	// Endpoints other than the dashboard are versioned under /api/v1
+	// so that incompatible changes can be made under a new prefix.
+	// Requests with a method that is not registered for a path are
+	// refused with a 405 status by the mux.
 	mux := http.NewServeMux()
-	mux.Handle("/height/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodGet {
-			w.WriteHeader(http.StatusMethodNotAllowed)
+	routes := &apiRoutes{mux: mux}
+	routes.handleFunc(apiEndpoint{Path: "/", Methods: []string{http.MethodGet}, Summary: "Web dashboard"}, func(w http.ResponseWriter, r *http.Request) {
+		log.LogAttrs(ctx, slog.LevelInfo, "dashboard request")
+		if !m.permit(w, r, permRead) {
+			return
+		}
+		w.Header().Set("Connection", "close")
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(m.dashboard())
+	})
+	routes.handleFunc(apiEndpoint{Path: "/api/v1/", Methods: []string{http.MethodGet}, Summary: "Endpoint and feature index"}, func(w http.ResponseWriter, r *http.Request) {
+		log.LogAttrs(ctx, slog.LevelInfo, "api index request")
+		w.Header().Set("Connection", "close")
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(apiIndex{Endpoints: routes.endpoints, Features: m.features()})
+	})
+	routes.handleFunc(apiEndpoint{Path: "/api/v1/openapi.json", Methods: []string{http.MethodGet}, Summary: "OpenAPI description of the HTTP API"}, func(w http.ResponseWriter, r *http.Request) {
+		log.LogAttrs(ctx, slog.LevelInfo, "openapi request")
+		w.Header().Set("Connection", "close")
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(openAPI(routes.endpoints))
+	})
+	routes.handleFunc(apiEndpoint{Path: "/api/v1/height", Methods: []string{http.MethodGet}, Summary: "Desk height", Params: []apiParam{formatParam}}, func(w http.ResponseWriter, r *http.Request) {
+		log.LogAttrs(ctx, slog.LevelInfo, "height report request")
+		if !m.permit(w, r, permRead) {
 			return
 		}
-		m.log.LogAttrs(ctx, slog.LevelInfo, "height report request")
 		w.Header().Set("Connection", "close")
+		type height struct {
+			Height *float64 `json:"height"`
+			Stale  bool     `json:"stale,omitempty"`
+			Age    *float64 `json:"age_seconds,omitempty"`
+		}
+		if !m.heightKnown.Load() {
+			// Report the height recorded before the
+			// restart until the controller sends one.
+			if p, age, ok := m.staleHeight(); ok {
+				h := p.units()
+				text := "h=" + p.String() + " stale"
+				resp := height{Height: &h, Stale: true}
+				if age >= 0 {
+					text += " age=" + age.Round(time.Second).String()
+					secs := age.Round(time.Second).Seconds()
+					resp.Age = &secs
+				}
+				reply(w, r, http.StatusOK, text, resp)
+				return
+			}
+		}
+		if status := m.degraded(); status != "" {
+			replyError(w, r, http.StatusServiceUnavailable, status)
+			return
+		}
 		p := m.position.Load().(position)
 		if p.mantissa == 0 {
-			w.Write([]byte("none"))
+			reply(w, r, http.StatusOK, "none", height{})
 			return
 		}
-		fmt.Fprintf(w, "h=%s", p)
-	}))
-	mux.Handle("/move_to/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPut {
-			w.WriteHeader(http.StatusMethodNotAllowed)
+		h := p.units()
+		reply(w, r, http.StatusOK, "h="+p.String(), height{Height: &h})
+	})
+	routes.handleFunc(apiEndpoint{Path: "/api/v1/state", Methods: []string{http.MethodGet}, Summary: "Device state"}, func(w http.ResponseWriter, r *http.Request) {
+		log.LogAttrs(ctx, slog.LevelInfo, "state request")
+		if !m.permit(w, r, permRead) {
 			return
 		}
-		m.mu.Lock()
-		defer m.mu.Unlock()
-		if m.button.Get() {
+		w.Header().Set("Connection", "close")
+		w.Header().Set("Content-Type", "application/json")
+		state := m.state()
+		state.Features = m.features()
+		json.NewEncoder(w).Encode(state)
+	})
+	routes.handleFunc(apiEndpoint{Path: "/api/v1/health", Methods: []string{http.MethodGet}, Summary: "Device health", Params: []apiParam{formatParam}}, func(w http.ResponseWriter, r *http.Request) {
+		log.LogAttrs(ctx, slog.LevelDebug, "health request")
+		if !m.permit(w, r, permRead) {
 			return
 		}
-		m.log.LogAttrs(ctx, slog.LevelInfo, "set height request")
 		w.Header().Set("Connection", "close")
-		h, err := strconv.Atoi(r.URL.Query().Get("position"))
+		h := m.health()
+		code := http.StatusOK
+		if h.Status == healthDegraded {
+			code = http.StatusServiceUnavailable
+		}
+		text := "status=" + h.Status
+		if !h.Store.ok() {
+			text += fmt.Sprintf(" store: corrupt=%d fallback=%t reset=%t", h.Store.Corrupt, h.Store.Fallback, h.Store.Reset)
+		}
+		reply(w, r, code, text, h)
+	})
+	probe := func(name string, report func() probeReport) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			log.LogAttrs(ctx, slog.LevelDebug, name+" request")
+			if !m.permit(w, r, permRead) {
+				return
+			}
+			w.Header().Set("Connection", "close")
+			p := report()
+			code := http.StatusOK
+			if !p.OK {
+				code = http.StatusServiceUnavailable
+			}
+			reply(w, r, code, p.String(), p)
+		}
+	}
+	routes.handleFunc(apiEndpoint{Path: "/api/v1/livez", Methods: []string{http.MethodGet}, Summary: "Firmware liveness", Params: []apiParam{formatParam}}, probe("liveness", m.liveness))
+	routes.handleFunc(apiEndpoint{Path: "/api/v1/readyz", Methods: []string{http.MethodGet}, Summary: "Device readiness", Params: []apiParam{formatParam}}, probe("readiness", m.readiness))
+	routes.handleFunc(apiEndpoint{Path: "/api/v1/ws/height", Methods: []string{http.MethodGet}, Summary: "WebSocket stream of desk height"}, func(w http.ResponseWriter, r *http.Request) {
+		log.LogAttrs(ctx, slog.LevelInfo, "height stream request")
+		if !m.permit(w, r, permRead) {
+			return
+		}
+		sub, err := m.events.subscribe(heightChanged)
 		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
+			w.Header().Set("Connection", "close")
+			w.WriteHeader(http.StatusServiceUnavailable)
 			fmt.Fprint(w, err)
 			return
 		}
-
-		m.log.LogAttrs(ctx, slog.LevelInfo, "request move to stored height", slog.Int("h", h))
-		if h < 1 || 4 < h {
+		defer m.events.unsubscribe(sub)
+		sub.throttle(time.Duration(m.cfg.Load().Throttle.WS))
+		ws, err := upgradeWS(w, r)
+		if err != nil {
+			w.Header().Set("Connection", "close")
 			w.WriteHeader(http.StatusBadRequest)
-			fmt.Fprintf(w, "invalid height: %d", h)
+			fmt.Fprint(w, err)
 			return
 		}
-
-		b := byte(1 << h)
-		pkt := []byte{0xa5, 0x00, b, 0xff - b, 0xff}
-		m.log.LogAttrs(ctx, slog.LevelInfo, "write pkt to controller", slog.Any("pkt", bytesAttr(pkt)))
-		m.act.High()
-		time.Sleep(time.Millisecond)
-		for range 5 {
-			_, err = m.controller.Write(pkt)
-			time.Sleep(10 * time.Millisecond)
+		defer ws.Close()
+		err = m.streamHeight(ctx, ws, sub)
+		if err != nil {
+			log.LogAttrs(ctx, slog.LevelDebug, "height stream", slog.Any("err", err))
+		}
+	})
+	routes.handleFunc(apiEndpoint{Path: "/api/v1/events", Methods: []string{http.MethodGet}, Summary: "Server-sent event stream of desk events"}, func(w http.ResponseWriter, r *http.Request) {
+		log.LogAttrs(ctx, slog.LevelInfo, "event stream request")
+		if !m.permit(w, r, permRead) {
+			return
+		}
+		sub, err := m.events.subscribe(heightChanged | keyPressed | fault)
+		if err != nil {
+			w.Header().Set("Connection", "close")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprint(w, err)
+			return
+		}
+		defer m.events.unsubscribe(sub)
+		sub.throttle(time.Duration(m.cfg.Load().Throttle.Events))
+		w.Header().Set("Connection", "Keep-Alive")
+		w.Header().Set("Transfer-Encoding", "chunked")
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		err = m.streamEvents(ctx, w, r, sub)
+		if err != nil {
+			log.LogAttrs(ctx, slog.LevelDebug, "event stream", slog.Any("err", err))
+		}
+	})
+	routes.handleFunc(apiEndpoint{Path: "/api/v1/move_to", Methods: []string{http.MethodPut}, Summary: "Move to a memory preset or a percentage of the desk's range", Params: []apiParam{
+		{Name: "position", Type: "integer", Enum: presetEnum},
+		{Name: "pct", Type: "number"},
+		{Name: "profile", Type: "string", Enum: []string{profileNormal, profileQuiet}},
+		formatParam,
+	}}, func(w http.ResponseWriter, r *http.Request) {
+		log.LogAttrs(ctx, slog.LevelInfo, "set height request")
+		w.Header().Set("Connection", "close")
+		q := r.URL.Query()
+		var (
+			h   int
+			pct float64
+			err error
+		)
+		switch {
+		case q.Has("position") && q.Has("pct"):
+			replyError(w, r, http.StatusBadRequest, "position and pct are mutually exclusive")
+			return
+		case q.Has("pct"):
+			pct, err = strconv.ParseFloat(q.Get("pct"), 64)
 			if err != nil {
-				m.log.Error("write to controller", slog.Any("err", err))
-				w.WriteHeader(http.StatusInternalServerError)
-				fmt.Fprintf(w, "internal error: %v", err)
+				replyError(w, r, http.StatusBadRequest, err)
 				return
 			}
+			log.LogAttrs(ctx, slog.LevelInfo, "request move to percentage", slog.Float64("pct", pct))
+		default:
+			h, err = strconv.Atoi(q.Get("position"))
+			if err != nil {
+				replyError(w, r, http.StatusBadRequest, err)
+				return
+			}
+			log.LogAttrs(ctx, slog.LevelInfo, "request move to stored height", slog.Int("h", h))
+			_, err = presetAction(h)
+			if err != nil {
+				replyError(w, r, http.StatusBadRequest, err)
+				return
+			}
+		}
+		profile := q.Get("profile")
+		switch profile {
+		case "", profileNormal, profileQuiet:
+		default:
+			replyError(w, r, http.StatusBadRequest, fmt.Sprintf("invalid motion profile: %q", profile))
+			return
+		}
+		src := requestSource(r)
+		if !m.allowed(src, permMove) {
+			replyError(w, r, http.StatusForbidden, m.refusal(permMove))
+			return
+		}
+		c := command{holder: src + " " + remoteHost(r), src: src, log: log, op: opPreset, preset: h, profile: profile}
+		if q.Has("pct") {
+			c.op, c.value = opPercent, pct
+		}
+		_, err = submit(r.Context(), commands, c)
+		switch {
+		case refused(err):
+			replyError(w, r, http.StatusConflict, err)
+			return
+		case errors.Is(err, errPercent), errors.Is(err, errOutOfRange):
+			replyError(w, r, http.StatusBadRequest, err)
+			return
+		case err == errNoRange:
+			replyError(w, r, http.StatusConflict, err)
+			return
+		case err != nil:
+			log.Error("write to controller", slog.Any("err", err))
+			replyError(w, r, http.StatusInternalServerError, fmt.Sprintf("internal error: %v", err))
+			return
+		}
+		reply(w, r, http.StatusOK, "ok", result{OK: true})
+	})
+	routes.handleFunc(apiEndpoint{Path: "/api/v1/move_by", Methods: []string{http.MethodPut}, Summary: "Move by a relative offset", Params: []apiParam{
+		{Name: "delta", Type: "number", Required: true},
+		formatParam,
+	}}, func(w http.ResponseWriter, r *http.Request) {
+		log.LogAttrs(ctx, slog.LevelInfo, "move by request")
+		if !m.permit(w, r, permMove) {
+			return
+		}
+		w.Header().Set("Connection", "close")
+		delta, err := strconv.ParseFloat(r.URL.Query().Get("delta"), 64)
+		if err != nil {
+			replyError(w, r, http.StatusBadRequest, err)
+			return
+		}
+		if status := m.degraded(); status != "" {
+			replyError(w, r, http.StatusServiceUnavailable, status)
+			return
+		}
+		src := requestSource(r)
+		p, err := submit(r.Context(), commands, command{holder: src + " " + remoteHost(r), src: src, log: log, op: opBy, value: delta})
+		if refused(err) {
+			replyError(w, r, http.StatusConflict, err)
+			return
+		}
+		if errors.Is(err, errOffset) || errors.Is(err, errOutOfRange) {
+			replyError(w, r, http.StatusBadRequest, err)
+			return
+		}
+		if err != nil {
+			log.LogAttrs(ctx, slog.LevelError, "move by", slog.Any("err", err))
+			replyError(w, r, http.StatusInternalServerError, fmt.Sprintf("internal error: %v", err))
+			return
+		}
+		h := p.units()
+		reply(w, r, http.StatusOK, p.String(), struct {
+			Height *float64 `json:"height"`
+		}{&h})
+	})
+	routes.handleFunc(apiEndpoint{Path: "/api/v1/stop", Methods: []string{http.MethodPut}, Summary: "Stop the desk", Params: []apiParam{formatParam}}, func(w http.ResponseWriter, r *http.Request) {
+		log.LogAttrs(ctx, slog.LevelInfo, "stop request")
+		if !m.permit(w, r, permMove) {
+			return
+		}
+		w.Header().Set("Connection", "close")
+		src := requestSource(r)
+		_, err := submit(r.Context(), commands, command{holder: src + " " + remoteHost(r), src: src, log: log, op: opStop})
+		if err != nil {
+			log.LogAttrs(ctx, slog.LevelError, "stop", slog.Any("err", err))
+			replyError(w, r, http.StatusInternalServerError, fmt.Sprintf("internal error: %v", err))
+			return
+		}
+		reply(w, r, http.StatusOK, "ok", result{OK: true})
+	})
+	routes.handleFunc(apiEndpoint{Path: "/api/v1/presets", Methods: []string{http.MethodGet}, Summary: "Learned preset heights"}, func(w http.ResponseWriter, r *http.Request) {
+		log.LogAttrs(ctx, slog.LevelInfo, "presets request")
+		if !m.permit(w, r, permRead) {
+			return
+		}
+		w.Header().Set("Connection", "close")
+		w.Write([]byte(m.presetStatus()))
+	})
+	routes.handleFunc(apiEndpoint{Path: "/api/v1/presets/restore", Methods: []string{http.MethodPut}, Summary: "Restore a preset height", Params: []apiParam{
+		{Name: "preset", Type: "integer", Required: true, Enum: presetEnum},
+	}}, func(w http.ResponseWriter, r *http.Request) {
+		log.LogAttrs(ctx, slog.LevelInfo, "restore preset request")
+		if !m.permit(w, r, permConfig) || !m.permit(w, r, permMove) {
+			return
+		}
+		w.Header().Set("Connection", "close")
+		n, err := strconv.Atoi(r.URL.Query().Get("preset"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, err)
+			return
+		}
+		src := requestSource(r)
+		p, err := submit(r.Context(), commands, command{holder: src + " " + remoteHost(r), src: src, log: log, op: opRestore, preset: n})
+		switch {
+		case refused(err):
+			w.WriteHeader(http.StatusConflict)
+			fmt.Fprint(w, err)
+			return
+		case err == errNoPreset:
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, err)
+			return
+		case err != nil:
+			log.LogAttrs(ctx, slog.LevelError, "restore preset", slog.Any("err", err))
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "internal error: %v", err)
+			return
+		}
+		fmt.Fprintf(w, "%d=%s", n, p)
+	})
+	routes.handleFunc(apiEndpoint{Path: "/api/v1/raw", Methods: []string{http.MethodPut}, Summary: "Send a raw frame to the controller", Params: []apiParam{
+		{Name: "frame", Type: "string", Required: true},
+		{Name: "confirm", Type: "string"},
+	}}, func(w http.ResponseWriter, r *http.Request) {
+		log.LogAttrs(ctx, slog.LevelInfo, "raw frame request")
+		if !m.permit(w, r, permConfig) || !m.confirm(w, r) {
+			return
+		}
+		w.Header().Set("Connection", "close")
+		q := r.URL.Query()
+		frame, err := hex.DecodeString(q.Get("frame"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, err)
+			return
+		}
+		err = m.checkRaw(frame)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, err)
+			return
+		}
+		token := q.Get("confirm")
+		if token == "" {
+			w.WriteHeader(http.StatusAccepted)
+			fmt.Fprintf(w, "confirm=%s", m.raw.issue(frame))
+			return
+		}
+		if !m.raw.redeem(token, frame) {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, errRawToken)
+			return
+		}
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if m.handsetBusy() {
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte("handset in use"))
+			return
+		}
+		log.LogAttrs(ctx, slog.LevelWarn, "write raw frame to controller", slog.Any("pkt", bytesAttr(frame)))
+		err = m.writeController(r.Context(), priorityCommand, []step{{frame: frame, repeat: 1}}, nil)
+		if err != nil {
+			log.Error("write to controller", slog.Any("err", err))
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "internal error: %v", err)
+			return
 		}
-		m.alive()
-		m.act.Low()
 		w.Write([]byte("ok"))
-	}))
-	mux.Handle("/log_at/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPut {
-			w.WriteHeader(http.StatusMethodNotAllowed)
+	})
+	routes.handleFunc(apiEndpoint{Path: "/api/v1/log_at", Methods: []string{http.MethodPut}, Summary: "Set log level", Params: []apiParam{
+		{Name: "level", Type: "string", Required: true},
+		{Name: "component", Type: "string", Enum: logComponents[:]},
+		formatParam,
+	}}, func(w http.ResponseWriter, r *http.Request) {
+		log.LogAttrs(ctx, slog.LevelInfo, "set log level request")
+		if !m.permit(w, r, permConfig) || !m.confirm(w, r) {
+			return
+		}
+		w.Header().Set("Connection", "close")
+		q := r.URL.Query()
+		component := q.Get("component")
+		err := m.setLogLevel(component, q.Get("level"))
+		if err != nil {
+			replyError(w, r, http.StatusBadRequest, err)
+			return
+		}
+		if component == "" {
+			log.LogAttrs(ctx, slog.LevelInfo, "request level", slog.Any("level", m.level.Level()))
+		} else {
+			log.LogAttrs(ctx, slog.LevelInfo, "request level", slog.String("component", component), slog.Any("level", m.componentLevel(component).Level()))
+		}
+		reply(w, r, http.StatusOK, "ok", result{OK: true})
+	})
+	routes.handleFunc(apiEndpoint{Path: "/api/v1/trace", Methods: []string{http.MethodPut}, Summary: "Set UART frame tracing", Params: []apiParam{
+		{Name: "on", Type: "boolean", Required: true},
+		{Name: "rate", Type: "integer"},
+	}}, func(w http.ResponseWriter, r *http.Request) {
+		log.LogAttrs(ctx, slog.LevelInfo, "set trace request")
+		if !m.permit(w, r, permConfig) || !m.confirm(w, r) {
 			return
 		}
-		m.log.LogAttrs(ctx, slog.LevelInfo, "set log level request")
 		w.Header().Set("Connection", "close")
-		err := m.level.UnmarshalText([]byte(r.URL.Query().Get("level")))
+		q := r.URL.Query()
+		on, err := strconv.ParseBool(q.Get("on"))
 		if err != nil {
 			w.WriteHeader(http.StatusBadRequest)
 			fmt.Fprint(w, err)
 			return
 		}
-		m.log.LogAttrs(ctx, slog.LevelInfo, "request level", slog.Any("level", m.level.Level()))
+		rate := m.trace.rate.Load()
+		if s := q.Get("rate"); s != "" {
+			rate, err = strconv.ParseInt(s, 10, 64)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprint(w, err)
+				return
+			}
+			if rate < 1 || 1000 < rate {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintf(w, "invalid trace rate: %d", rate)
+				return
+			}
+		}
+		m.setTrace(on, rate)
 		w.Write([]byte("ok"))
-	}))
-	mux.Handle("/log/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodGet {
-			w.WriteHeader(http.StatusMethodNotAllowed)
+	})
+	routes.handleFunc(apiEndpoint{Path: "/api/v1/log", Methods: []string{http.MethodGet}, Summary: "Stream log records", Params: []apiParam{
+		{Name: "session", Type: "string"},
+		{Name: "resume", Type: "integer"},
+	}}, func(w http.ResponseWriter, r *http.Request) {
+		log.LogAttrs(ctx, slog.LevelInfo, "get log")
+		if !m.permit(w, r, permRead) {
 			return
 		}
-		m.log.LogAttrs(ctx, slog.LevelInfo, "get log")
+		q := r.URL.Query()
+		seq := m.logs.last()
+		if resume := q.Get("resume"); resume != "" {
+			var err error
+			seq, err = strconv.ParseUint(resume, 10, 64)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprint(w, err)
+				return
+			}
+			if q.Get("session") != m.logs.session {
+				// The device has restarted since the
+				// client last saw the log, so send all
+				// that we have.
+				seq = 0
+			}
+		}
 		w.Header().Set("Connection", "Keep-Alive")
 		w.Header().Set("Transfer-Encoding", "chunked")
-		m.sw.use(w)
-		defer m.sw.close()
-		time.Sleep(10 * time.Minute)
-	}))
-	mux.Handle("/bt/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPut {
-			w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Header().Set("X-Log-Session", m.logs.session)
+		flusher, _ := w.(http.Flusher)
+		deadline := time.Now().Add(10 * time.Minute)
+		var buf []byte
+		for time.Now().Before(deadline) {
+			var (
+				got uint64
+				ok  bool
+			)
+			buf, got, ok = m.logs.next(buf[:0], seq)
+			if !ok {
+				select {
+				case <-ctx.Done():
+					return
+				case <-r.Context().Done():
+					return
+				case <-time.After(100 * time.Millisecond):
+				}
+				continue
+			}
+			if got != seq {
+				_, err := fmt.Fprintf(w, "# lost %d records\n", got-seq)
+				if err != nil {
+					return
+				}
+			}
+			_, err := fmt.Fprintf(w, "%d %s", got, buf)
+			if err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+			seq = got + 1
+		}
+	})
+	routes.handleFunc(apiEndpoint{Path: "/api/v1/log/page", Methods: []string{http.MethodGet}, Summary: "Page through retained log records", Params: []apiParam{
+		{Name: "from", Type: "integer"},
+		{Name: "to", Type: "integer"},
+		{Name: "limit", Type: "integer"},
+		{Name: "cursor", Type: "string"},
+	}}, func(w http.ResponseWriter, r *http.Request) {
+		log.LogAttrs(ctx, slog.LevelInfo, "get log page")
+		if !m.permit(w, r, permRead) {
+			return
+		}
+		w.Header().Set("Connection", "close")
+		q := r.URL.Query()
+		limit := logPageLen
+		if s := q.Get("limit"); s != "" {
+			var err error
+			limit, err = strconv.Atoi(s)
+			if err != nil || limit < 1 || maxLogPageLen < limit {
+				replyError(w, r, http.StatusBadRequest, fmt.Sprintf("invalid limit: %q", s))
+				return
+			}
+		}
+		// The end of the range is fixed when the first
+		// page is requested and carried in the cursor so
+		// that records written while the client pages
+		// through the log do not move the end.
+		c := logCursor{session: m.logs.session, to: m.logs.last()}
+		if s := q.Get("cursor"); s != "" {
+			var err error
+			c, err = parseLogCursor(s)
+			if err != nil {
+				replyError(w, r, http.StatusBadRequest, err)
+				return
+			}
+			if c.session != m.logs.session {
+				replyError(w, r, http.StatusGone, "log session has changed")
+				return
+			}
+		} else {
+			for _, p := range []struct {
+				name string
+				dst  *uint64
+			}{
+				{name: "from", dst: &c.seq},
+				{name: "to", dst: &c.to},
+			} {
+				s := q.Get(p.name)
+				if s == "" {
+					continue
+				}
+				v, err := strconv.ParseUint(s, 10, 64)
+				if err != nil {
+					replyError(w, r, http.StatusBadRequest, fmt.Sprintf("invalid %s: %q", p.name, s))
+					return
+				}
+				*p.dst = v
+			}
+			c.to = min(c.to, m.logs.last())
+			if c.to < c.seq {
+				replyError(w, r, http.StatusBadRequest, "invalid range")
+				return
+			}
+		}
+		recs, next, lost := m.logs.page(c.seq, c.to, limit, logPageBytes)
+		page := struct {
+			Session string      `json:"session"`
+			Records []logRecord `json:"records"`
+			Lost    uint64      `json:"lost,omitempty"`
+			Next    string      `json:"next,omitempty"`
+		}{
+			Session: m.logs.session,
+			Records: recs,
+			Lost:    lost,
+		}
+		if page.Records == nil {
+			page.Records = []logRecord{}
+		}
+		if next < c.to {
+			c.seq = next
+			page.Next = c.String()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(page)
+	})
+	routes.handleFunc(apiEndpoint{Path: "/api/v1/bt", Methods: []string{http.MethodPut}, Summary: "Allow Bluetooth control", Feature: "bluetooth", Params: []apiParam{
+		{Name: "allow", Type: "boolean", Required: true},
+		formatParam,
+	}}, func(w http.ResponseWriter, r *http.Request) {
+		log.LogAttrs(ctx, slog.LevelInfo, "set bluetooth state")
+		if !m.permit(w, r, permConfig) || !m.confirm(w, r) {
 			return
 		}
-		m.log.LogAttrs(ctx, slog.LevelInfo, "set bluetooth state")
 		w.Header().Set("Connection", "close")
 		switch allow := r.URL.Query().Get("allow"); allow {
 		case "true":
@@ -149,12 +664,1290 @@ func (m *mitm) httpServer(ctx context.Context) error {
 		case "false":
 			m.bluetoothBlocked.Store(true)
 		default:
-			w.WriteHeader(http.StatusBadRequest)
-			fmt.Fprintf(w, "unknown state: %q", allow)
+			replyError(w, r, http.StatusBadRequest, fmt.Sprintf("unknown state: %q", allow))
+			return
+		}
+		log.LogAttrs(ctx, slog.LevelInfo, "set bluetooth state", slog.Bool("allow", m.bluetoothBlocked.Load()))
+		reply(w, r, http.StatusOK, "ok", struct {
+			result
+			Allow bool `json:"allow"`
+		}{result: result{OK: true}, Allow: !m.bluetoothBlocked.Load()})
+	})
+	routeHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Connection", "close")
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+			log.LogAttrs(ctx, slog.LevelInfo, "get route request")
+			if !m.permit(w, r, permRead) {
+				return
+			}
+			fmt.Fprintf(w, "route=%s", route(m.route.Load()))
+		case http.MethodPut:
+			log.LogAttrs(ctx, slog.LevelInfo, "set route request")
+			if !m.permit(w, r, permMove) {
+				return
+			}
+			q := r.URL.Query()
+			rt, err := parseRoute(q.Get("mode"))
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprint(w, err)
+				return
+			}
+			hold := defaultRouteHold
+			if d := q.Get("for"); d != "" {
+				hold, err = time.ParseDuration(d)
+				if err != nil {
+					w.WriteHeader(http.StatusBadRequest)
+					fmt.Fprint(w, err)
+					return
+				}
+				if hold <= 0 || maxRouteHold < hold {
+					w.WriteHeader(http.StatusBadRequest)
+					fmt.Fprintf(w, "invalid hold duration: %v", hold)
+					return
+				}
+			}
+			m.setRoute(ctx, rt, hold)
+			w.Write([]byte("ok"))
+		}
+	})
+	routes.handle(apiEndpoint{Path: "/api/v1/route", Methods: []string{http.MethodGet, http.MethodPut}, Summary: "Pass-through route", Params: []apiParam{
+		{Name: "mode", Type: "string", Method: http.MethodPut, Required: true, Enum: []string{"pass", "on", "off"}},
+		{Name: "for", Type: "string", Method: http.MethodPut},
+	}}, routeHandler)
+	routes.handleFunc(apiEndpoint{Path: "/api/v1/led/say", Methods: []string{http.MethodPut}, Summary: "Flash text on the LED", Params: []apiParam{
+		{Name: "text", Type: "string", Required: true},
+		{Name: "mode", Type: "string", Enum: []string{"morse", "count"}},
+		formatParam,
+	}}, func(w http.ResponseWriter, r *http.Request) {
+		log.LogAttrs(ctx, slog.LevelInfo, "led say request")
+		if !m.permit(w, r, permConfig) {
+			return
+		}
+		w.Header().Set("Connection", "close")
+		q := r.URL.Query()
+		var (
+			seq ledSequence
+			err error
+		)
+		switch mode := q.Get("mode"); mode {
+		case "", "morse":
+			seq, err = morseSequence(q.Get("text"))
+		case "count":
+			seq, err = countSequence(q.Get("text"))
+		default:
+			err = fmt.Errorf("unknown mode: %q", mode)
+		}
+		if err != nil {
+			replyError(w, r, http.StatusBadRequest, err)
+			return
+		}
+		if !m.flashOnce(seq) {
+			replyError(w, r, http.StatusConflict, "LED busy")
+			return
+		}
+		reply(w, r, http.StatusOK, "ok", result{OK: true})
+	})
+	routes.handleFunc(apiEndpoint{Path: "/api/v1/selftest", Methods: []string{http.MethodPut}, Summary: "Wiring self-test", Params: []apiParam{
+		{Name: "fixture", Type: "string", Required: true, Enum: fixtures},
+	}}, func(w http.ResponseWriter, r *http.Request) {
+		log.LogAttrs(ctx, slog.LevelInfo, "self-test request")
+		if !m.permit(w, r, permConfig) {
+			return
+		}
+		res, err := m.selftest(ctx, r.URL.Query().Get("fixture"))
+		if err != nil {
+			replyError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+		w.Header().Set("Connection", "close")
+		res.WriteTo(w)
+	})
+	routes.handleFunc(apiEndpoint{Path: "/api/v1/power_cycle", Methods: []string{http.MethodPut}, Summary: "Power cycle the controller", Feature: "relay"}, func(w http.ResponseWriter, r *http.Request) {
+		log.LogAttrs(ctx, slog.LevelInfo, "power cycle request")
+		if !m.permit(w, r, permMove) || !m.confirm(w, r) {
+			return
+		}
+		w.Header().Set("Connection", "close")
+		err := m.powerCycle(ctx, "requested", false)
+		if err != nil {
+			w.WriteHeader(http.StatusConflict)
+			fmt.Fprint(w, err)
 			return
 		}
-		m.log.LogAttrs(ctx, slog.LevelInfo, "set bluetooth state", slog.Bool("allow", m.bluetoothBlocked.Load()))
 		w.Write([]byte("ok"))
-	}))
-	return http.Serve(ln, mux)
+	})
+	kioskHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Connection", "close")
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+			log.LogAttrs(ctx, slog.LevelInfo, "get kiosk request")
+			if !m.permit(w, r, permRead) {
+				return
+			}
+		case http.MethodPut:
+			log.LogAttrs(ctx, slog.LevelInfo, "set kiosk request")
+			if !m.permit(w, r, permConfig) || !m.confirm(w, r) {
+				return
+			}
+			on, err := strconv.ParseBool(r.URL.Query().Get("on"))
+			if err != nil {
+				replyError(w, r, http.StatusBadRequest, err)
+				return
+			}
+			err = m.setKiosk(on)
+			if err != nil {
+				log.LogAttrs(ctx, slog.LevelError, "persist kiosk mode", slog.Any("err", err))
+				replyError(w, r, http.StatusInternalServerError, err)
+				return
+			}
+			log.LogAttrs(ctx, slog.LevelWarn, "kiosk mode", slog.Bool("on", on))
+		}
+		on := m.kiosk.Load()
+		reply(w, r, http.StatusOK, "kiosk="+strconv.FormatBool(on), struct {
+			Kiosk bool `json:"kiosk"`
+		}{on})
+	})
+	routes.handle(apiEndpoint{Path: "/api/v1/kiosk", Methods: []string{http.MethodGet, http.MethodPut}, Summary: "Read-only kiosk mode", Params: []apiParam{
+		{Name: "on", Type: "boolean", Method: http.MethodPut, Required: true},
+		formatParam,
+	}}, kioskHandler)
+	cycleHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Connection", "close")
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+			log.LogAttrs(ctx, slog.LevelInfo, "get cycle request")
+			if !m.permit(w, r, permRead) {
+				return
+			}
+		case http.MethodPut:
+			log.LogAttrs(ctx, slog.LevelInfo, "set cycle request")
+			if !m.permit(w, r, permMove) {
+				return
+			}
+			run, err := strconv.ParseBool(r.URL.Query().Get("run"))
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprint(w, err)
+				return
+			}
+			err = m.setCycle(ctx, run)
+			if err != nil {
+				log.LogAttrs(ctx, slog.LevelError, "set cycle", slog.Any("err", err))
+			}
+		}
+		w.Write([]byte(m.cycleStatus()))
+	})
+	routes.handle(apiEndpoint{Path: "/api/v1/cycle", Methods: []string{http.MethodGet, http.MethodPut}, Summary: "Sit/stand cycle", Params: []apiParam{
+		{Name: "run", Type: "boolean", Method: http.MethodPut, Required: true},
+	}}, cycleHandler)
+	routes.handleFunc(apiEndpoint{Path: "/api/v1/reminder/snooze", Methods: []string{http.MethodPut}, Summary: "Snooze the pending reminder", Params: []apiParam{
+		{Name: "min", Type: "integer"},
+	}}, func(w http.ResponseWriter, r *http.Request) {
+		log.LogAttrs(ctx, slog.LevelInfo, "snooze reminder request")
+		if !m.permit(w, r, permMove) {
+			return
+		}
+		w.Header().Set("Connection", "close")
+		mins := 10
+		if s := r.URL.Query().Get("min"); s != "" {
+			var err error
+			mins, err = strconv.Atoi(s)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprint(w, err)
+				return
+			}
+		}
+		err := m.snoozeReminder(ctx, time.Duration(mins)*time.Minute)
+		if err != nil {
+			if err == errNoReminder {
+				w.WriteHeader(http.StatusConflict)
+			} else {
+				w.WriteHeader(http.StatusBadRequest)
+			}
+			fmt.Fprint(w, err)
+			return
+		}
+		w.Write([]byte(m.cycleStatus()))
+	})
+	routes.handleFunc(apiEndpoint{Path: "/api/v1/reminder/ack", Methods: []string{http.MethodPut}, Summary: "Dismiss the pending reminder"}, func(w http.ResponseWriter, r *http.Request) {
+		log.LogAttrs(ctx, slog.LevelInfo, "acknowledge reminder request")
+		if !m.permit(w, r, permMove) {
+			return
+		}
+		w.Header().Set("Connection", "close")
+		err := m.ackReminder(ctx)
+		if err == errNoReminder {
+			w.WriteHeader(http.StatusConflict)
+			fmt.Fprint(w, err)
+			return
+		}
+		if err != nil {
+			log.LogAttrs(ctx, slog.LevelError, "persist cycle", slog.Any("err", err))
+		}
+		w.Write([]byte(m.cycleStatus()))
+	})
+	calendarHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Connection", "close")
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+			log.LogAttrs(ctx, slog.LevelInfo, "get calendar request")
+			if !m.permit(w, r, permRead) {
+				return
+			}
+		case http.MethodPut:
+			log.LogAttrs(ctx, slog.LevelInfo, "calendar event request")
+			if !m.permit(w, r, permMove) {
+				return
+			}
+			q := r.URL.Query()
+			switch event := q.Get("event"); event {
+			case "start":
+				d := defaultMeeting
+				if s := q.Get("for"); s != "" {
+					var err error
+					d, err = time.ParseDuration(s)
+					if err != nil {
+						w.WriteHeader(http.StatusBadRequest)
+						fmt.Fprint(w, err)
+						return
+					}
+				}
+				err := m.startMeeting(ctx, d)
+				if err != nil {
+					w.WriteHeader(http.StatusBadRequest)
+					fmt.Fprint(w, err)
+					return
+				}
+			case "end":
+				m.endMeeting(ctx)
+			default:
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintf(w, "invalid calendar event: %q", event)
+				return
+			}
+		}
+		w.Write([]byte(m.meetingStatus()))
+	})
+	routes.handle(apiEndpoint{Path: "/api/v1/calendar", Methods: []string{http.MethodGet, http.MethodPut}, Summary: "Meeting state", Params: []apiParam{
+		{Name: "event", Type: "string", Method: http.MethodPut, Required: true, Enum: []string{"start", "end"}},
+		{Name: "for", Type: "string", Method: http.MethodPut},
+	}}, calendarHandler)
+	configHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Connection", "close")
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+			log.LogAttrs(ctx, slog.LevelInfo, "get config request")
+			if !m.permit(w, r, permConfig) {
+				return
+			}
+		case http.MethodPut:
+			log.LogAttrs(ctx, slog.LevelInfo, "set config request")
+			if !m.permit(w, r, permConfig) || !m.confirm(w, r) {
+				return
+			}
+			match := r.Header.Get("If-Match")
+			if match == "" {
+				w.WriteHeader(http.StatusPreconditionRequired)
+				fmt.Fprint(w, "missing If-Match header")
+				return
+			}
+			rev, err := m.parseETag(match)
+			if err != nil {
+				if err == errStaleConfig {
+					_, rev := m.configRevision()
+					w.Header().Set("ETag", m.etag(rev))
+					w.WriteHeader(http.StatusPreconditionFailed)
+				} else {
+					w.WriteHeader(http.StatusBadRequest)
+				}
+				fmt.Fprint(w, err)
+				return
+			}
+			body, err := io.ReadAll(io.LimitReader(r.Body, maxConfigBody+1))
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprint(w, err)
+				return
+			}
+			if len(body) > maxConfigBody {
+				w.WriteHeader(http.StatusRequestEntityTooLarge)
+				fmt.Fprint(w, "config too long")
+				return
+			}
+			err = m.changeConfig(rev, body, r.RemoteAddr)
+			var persistErr persistError
+			switch {
+			case err == errStaleConfig:
+				_, rev := m.configRevision()
+				w.Header().Set("ETag", m.etag(rev))
+				w.WriteHeader(http.StatusPreconditionFailed)
+				fmt.Fprint(w, err)
+				return
+			case errors.As(err, &persistErr):
+				log.LogAttrs(ctx, slog.LevelError, "persist config", slog.Any("err", err))
+				w.WriteHeader(http.StatusInternalServerError)
+				fmt.Fprintf(w, "internal error: %v", err)
+				return
+			case err != nil:
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprint(w, err)
+				return
+			}
+		case http.MethodDelete:
+			log.LogAttrs(ctx, slog.LevelInfo, "reset config request")
+			if !m.permit(w, r, permConfig) || !m.confirm(w, r) {
+				return
+			}
+			err := m.resetConfig()
+			if err != nil {
+				log.LogAttrs(ctx, slog.LevelError, "reset config", slog.Any("err", err))
+				w.WriteHeader(http.StatusInternalServerError)
+				fmt.Fprintf(w, "internal error: %v", err)
+				return
+			}
+		}
+		cfg, rev := m.configRevision()
+		w.Header().Set("ETag", m.etag(rev))
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(cfg)
+	})
+	routes.handle(apiEndpoint{Path: "/api/v1/config", Methods: []string{http.MethodGet, http.MethodPut, http.MethodDelete}, Summary: "Device configuration"}, configHandler)
+	routes.handleFunc(apiEndpoint{Path: "/api/v1/config/diff", Methods: []string{http.MethodPut}, Summary: "Compare a candidate configuration with the running configuration"}, func(w http.ResponseWriter, r *http.Request) {
+		log.LogAttrs(ctx, slog.LevelInfo, "config diff request")
+		if !m.permit(w, r, permConfig) {
+			return
+		}
+		w.Header().Set("Connection", "close")
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxConfigBody+1))
+		if err != nil {
+			replyError(w, r, http.StatusBadRequest, err)
+			return
+		}
+		if len(body) > maxConfigBody {
+			replyError(w, r, http.StatusRequestEntityTooLarge, "config too long")
+			return
+		}
+		running, rev := m.configRevision()
+		candidate := running.clone()
+		err = json.Unmarshal(body, &candidate)
+		if err != nil {
+			replyError(w, r, http.StatusBadRequest, err)
+			return
+		}
+		changes, err := diffConfig(running, candidate)
+		if err != nil {
+			replyError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		diff := struct {
+			Changes []configChange `json:"changes"`
+			Restart bool           `json:"restart"`
+			Error   string         `json:"error,omitempty"`
+		}{Changes: changes}
+		for _, c := range changes {
+			diff.Restart = diff.Restart || c.Restart
+		}
+		if err := m.checkConfig(candidate); err != nil {
+			diff.Error = err.Error()
+		} else if err := checkAllowClient(candidate.Allow, r.RemoteAddr); err != nil {
+			diff.Error = err.Error()
+		}
+		// The ETag is that of the running configuration
+		// so that the reviewed changes can be applied
+		// with If-Match only if it is unchanged.
+		w.Header().Set("ETag", m.etag(rev))
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(diff)
+	})
+	routes.handleFunc(apiEndpoint{Path: "/api/v1/profile/export", Methods: []string{http.MethodGet}, Summary: "Export the desk profile"}, func(w http.ResponseWriter, r *http.Request) {
+		log.LogAttrs(ctx, slog.LevelInfo, "export desk profile request")
+		if !m.permit(w, r, permRead) {
+			return
+		}
+		w.Header().Set("Connection", "close")
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(m.exportProfile())
+	})
+	routes.handleFunc(apiEndpoint{Path: "/api/v1/profile/import", Methods: []string{http.MethodPut}, Summary: "Import a desk profile"}, func(w http.ResponseWriter, r *http.Request) {
+		log.LogAttrs(ctx, slog.LevelInfo, "import desk profile request")
+		if !m.permit(w, r, permConfig) {
+			return
+		}
+		w.Header().Set("Connection", "close")
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxConfigBody+1))
+		if err != nil {
+			replyError(w, r, http.StatusBadRequest, err)
+			return
+		}
+		if len(body) > maxConfigBody {
+			replyError(w, r, http.StatusRequestEntityTooLarge, "profile too long")
+			return
+		}
+		var p deskProfile
+		err = json.Unmarshal(body, &p)
+		if err != nil {
+			replyError(w, r, http.StatusBadRequest, err)
+			return
+		}
+		err = m.importProfile(p)
+		if err != nil {
+			log.LogAttrs(ctx, slog.LevelError, "import desk profile", slog.Any("err", err))
+			status := http.StatusBadRequest
+			var persistErr persistError
+			if errors.As(err, &persistErr) {
+				status = http.StatusInternalServerError
+			}
+			replyError(w, r, status, err)
+			return
+		}
+		log.LogAttrs(ctx, slog.LevelWarn, "imported desk profile", slog.String("model", m.config().Model))
+		reply(w, r, http.StatusOK, "ok", result{OK: true})
+	})
+	routes.handleFunc(apiEndpoint{Path: "/api/v1/metrics", Methods: []string{http.MethodGet}, Summary: "Prometheus metrics"}, func(w http.ResponseWriter, r *http.Request) {
+		log.LogAttrs(ctx, slog.LevelDebug, "metrics request")
+		if !m.permit(w, r, permRead) {
+			return
+		}
+		w.Header().Set("Connection", "close")
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		m.metrics.WriteTo(w)
+	})
+	routes.handleFunc(apiEndpoint{Path: "/api/v1/stats/heatmap", Methods: []string{http.MethodGet}, Summary: "Hour-of-week desk use"}, func(w http.ResponseWriter, r *http.Request) {
+		log.LogAttrs(ctx, slog.LevelDebug, "heatmap request")
+		if !m.permit(w, r, permRead) {
+			return
+		}
+		w.Header().Set("Connection", "close")
+		w.Header().Set("Content-Type", "application/json")
+		heat := m.metrics.heatmap.snapshot()
+		heat.Synced = m.clock.isSynced()
+		json.NewEncoder(w).Encode(heat)
+	})
+	routes.handleFunc(apiEndpoint{Path: "/api/v1/handset", Methods: []string{http.MethodGet}, Summary: "Handset presence"}, func(w http.ResponseWriter, r *http.Request) {
+		log.LogAttrs(ctx, slog.LevelDebug, "handset request")
+		if !m.permit(w, r, permRead) {
+			return
+		}
+		w.Header().Set("Connection", "close")
+		w.Write([]byte(m.handsetStatus()))
+	})
+	displayHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Connection", "close")
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+			log.LogAttrs(ctx, slog.LevelDebug, "get display request")
+			if !m.permit(w, r, permRead) {
+				return
+			}
+		case http.MethodPut:
+			log.LogAttrs(ctx, slog.LevelInfo, "set display request")
+			if !m.permit(w, r, permMove) {
+				return
+			}
+			on, err := strconv.ParseBool(r.URL.Query().Get("on"))
+			if err != nil {
+				replyError(w, r, http.StatusBadRequest, err)
+				return
+			}
+			if !on {
+				replyError(w, r, http.StatusNotImplemented, errDisplayOff)
+				return
+			}
+			err = m.wakeDisplay(r.Context(), log, requestSource(r))
+			if err != nil {
+				log.LogAttrs(ctx, slog.LevelError, "wake display", slog.Any("err", err))
+				replyError(w, r, http.StatusConflict, err)
+				return
+			}
+		}
+		status := m.displayStatus()
+		reply(w, r, http.StatusOK, "display: "+status, struct {
+			Display string `json:"display"`
+		}{status})
+	})
+	routes.handle(apiEndpoint{Path: "/api/v1/display", Methods: []string{http.MethodGet, http.MethodPut}, Summary: "Handset display", Params: []apiParam{
+		{Name: "on", Type: "boolean", Method: http.MethodPut, Required: true},
+		formatParam,
+	}}, displayHandler)
+	routes.handleFunc(apiEndpoint{Path: "/api/v1/clock", Methods: []string{http.MethodGet}, Summary: "Device clock"}, func(w http.ResponseWriter, r *http.Request) {
+		log.LogAttrs(ctx, slog.LevelDebug, "clock request")
+		if !m.permit(w, r, permRead) {
+			return
+		}
+		w.Header().Set("Connection", "close")
+		w.Write([]byte(m.clock.status()))
+	})
+	routes.handleFunc(apiEndpoint{Path: "/api/v1/uart", Methods: []string{http.MethodGet}, Summary: "UART statistics"}, func(w http.ResponseWriter, r *http.Request) {
+		log.LogAttrs(ctx, slog.LevelDebug, "uart stats request")
+		if !m.permit(w, r, permRead) {
+			return
+		}
+		w.Header().Set("Connection", "close")
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]uartSnapshot{
+			"handset":    m.metrics.handset.snapshot(),
+			"controller": m.metrics.controller.snapshot(),
+		})
+	})
+	routes.handleFunc(apiEndpoint{Path: "/api/v1/group/announce", Methods: []string{http.MethodPut}, Summary: "Announce the desk to its group", Feature: "mqtt"}, func(w http.ResponseWriter, r *http.Request) {
+		log.LogAttrs(ctx, slog.LevelInfo, "group announce request")
+		if !m.permit(w, r, permRead) {
+			return
+		}
+		w.Header().Set("Connection", "close")
+		if m.config().Group == "" {
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte("no group configured"))
+			return
+		}
+		n := m.net.Load()
+		if n == nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("network not ready"))
+			return
+		}
+		err := m.announce(n)
+		if err != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprint(w, err)
+			return
+		}
+		w.Write([]byte("ok"))
+	})
+	authHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Connection", "close")
+		var cred *credential
+		switch r.Method {
+		case http.MethodPut:
+			log.LogAttrs(ctx, slog.LevelInfo, "set credential request")
+			if !m.permit(w, r, permConfig) || !m.confirm(w, r) {
+				return
+			}
+			user, password := r.FormValue("user"), r.FormValue("password")
+			if user == "" || password == "" {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte("missing user or password"))
+				return
+			}
+			c := newCredential(user, password)
+			cred = &c
+		case http.MethodDelete:
+			log.LogAttrs(ctx, slog.LevelInfo, "clear credential request")
+			if !m.permit(w, r, permConfig) || !m.confirm(w, r) {
+				return
+			}
+		}
+		err := m.store.update(func(p *persistent) { p.Auth = cred })
+		if err != nil {
+			log.LogAttrs(ctx, slog.LevelError, "persist credential", slog.Any("err", err))
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "internal error: %v", err)
+			return
+		}
+		w.Write([]byte("ok"))
+	})
+	routes.handle(apiEndpoint{Path: "/api/v1/auth", Methods: []string{http.MethodPut, http.MethodDelete}, Summary: "HTTP credential", Params: []apiParam{
+		{Name: "user", Type: "string", Method: http.MethodPut, Required: true},
+		{Name: "password", Type: "string", Method: http.MethodPut, Required: true},
+	}}, authHandler)
+	tokenHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Connection", "close")
+		var err error
+		switch r.Method {
+		case http.MethodPut:
+			log.LogAttrs(ctx, slog.LevelInfo, "set token request")
+			if !m.permit(w, r, permConfig) || !m.confirm(w, r) {
+				return
+			}
+			err = m.setToken(r.FormValue("token"), true)
+			if err == errShortToken {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprint(w, err)
+				return
+			}
+		case http.MethodDelete:
+			log.LogAttrs(ctx, slog.LevelInfo, "clear token request")
+			if !m.permit(w, r, permConfig) || !m.confirm(w, r) {
+				return
+			}
+			err = m.store.update(func(p *persistent) { p.Token = nil })
+		}
+		if err != nil {
+			log.LogAttrs(ctx, slog.LevelError, "persist token", slog.Any("err", err))
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "internal error: %v", err)
+			return
+		}
+		w.Write([]byte("ok"))
+	})
+	routes.handle(apiEndpoint{Path: "/api/v1/token", Methods: []string{http.MethodPut, http.MethodDelete}, Summary: "Bearer token for requests that change state", Params: []apiParam{
+		{Name: "token", Type: "string", Method: http.MethodPut, Required: true},
+	}}, tokenHandler)
+	signingKeyHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Connection", "close")
+		var key []byte
+		switch r.Method {
+		case http.MethodPut:
+			log.LogAttrs(ctx, slog.LevelInfo, "set signing key request")
+			if !m.permit(w, r, permConfig) || !m.confirm(w, r) {
+				return
+			}
+			var err error
+			key, err = hex.DecodeString(r.FormValue("key"))
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprint(w, err)
+				return
+			}
+			if len(key) < minSigningKey {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprint(w, errShortKey)
+				return
+			}
+		case http.MethodDelete:
+			log.LogAttrs(ctx, slog.LevelInfo, "clear signing key request")
+			if !m.permit(w, r, permConfig) || !m.confirm(w, r) {
+				return
+			}
+		}
+		err := m.store.update(func(p *persistent) { p.SigningKey = key })
+		if err != nil {
+			log.LogAttrs(ctx, slog.LevelError, "persist signing key", slog.Any("err", err))
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "internal error: %v", err)
+			return
+		}
+		w.Write([]byte("ok"))
+	})
+	routes.handle(apiEndpoint{Path: "/api/v1/signing_key", Methods: []string{http.MethodPut, http.MethodDelete}, Summary: "Key for HMAC-SHA256 signed requests", Params: []apiParam{
+		{Name: "key", Type: "string", Method: http.MethodPut, Required: true},
+	}}, signingKeyHandler)
+	totpHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Connection", "close")
+		var secret []byte
+		switch r.Method {
+		case http.MethodPut:
+			log.LogAttrs(ctx, slog.LevelInfo, "set totp secret request")
+			secret = newTOTPSecret()
+		case http.MethodDelete:
+			log.LogAttrs(ctx, slog.LevelInfo, "clear totp secret request")
+		}
+		// Replacing or removing a secret requires
+		// a code from the current secret.
+		if !m.permit(w, r, permConfig) || !m.confirm(w, r) {
+			return
+		}
+		err := m.store.update(func(p *persistent) { p.TOTPSecret = secret })
+		if err != nil {
+			log.LogAttrs(ctx, slog.LevelError, "persist totp secret", slog.Any("err", err))
+			replyError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		if secret == nil {
+			reply(w, r, http.StatusOK, "ok", result{OK: true})
+			return
+		}
+		// Codes from the old secret must not
+		// prevent the use of the new one.
+		m.totpUsed.Store(0)
+		uri := totpURI(m.hostname(), secret)
+		reply(w, r, http.StatusOK, uri, struct {
+			URI string `json:"uri"`
+		}{uri})
+	})
+	routes.handle(apiEndpoint{Path: "/api/v1/totp", Methods: []string{http.MethodPut, http.MethodDelete}, Summary: "Secret for one-time codes protecting disruptive endpoints", Params: []apiParam{
+		{Name: "totp", Type: "string"},
+		formatParam,
+	}}, totpHandler)
+	uiPasswordHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Connection", "close")
+		var password string
+		switch r.Method {
+		case http.MethodPut:
+			log.LogAttrs(ctx, slog.LevelInfo, "set dashboard password request")
+			password = r.FormValue("password")
+			if password == "" {
+				replyError(w, r, http.StatusBadRequest, errShortPassword)
+				return
+			}
+		case http.MethodDelete:
+			log.LogAttrs(ctx, slog.LevelInfo, "clear dashboard password request")
+		}
+		if !m.permit(w, r, permConfig) {
+			return
+		}
+		err := m.setUIPassword(password)
+		switch {
+		case err == errShortPassword:
+			replyError(w, r, http.StatusBadRequest, err)
+			return
+		case err != nil:
+			log.LogAttrs(ctx, slog.LevelError, "persist dashboard password", slog.Any("err", err))
+			replyError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		reply(w, r, http.StatusOK, "ok", result{OK: true})
+	})
+	routes.handle(apiEndpoint{Path: "/api/v1/ui_password", Methods: []string{http.MethodPut, http.MethodDelete}, Summary: "Dashboard password", Params: []apiParam{
+		{Name: "password", Type: "string", Method: http.MethodPut, Required: true},
+		formatParam,
+	}}, uiPasswordHandler)
+	sessionHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Connection", "close")
+		switch r.Method {
+		case http.MethodPut:
+			log.LogAttrs(ctx, slog.LevelInfo, "login request")
+			cred := m.store.get().UIPassword
+			if cred == nil {
+				replyError(w, r, http.StatusConflict, errNoUIPassword)
+				return
+			}
+			if !cred.match("", r.FormValue("password")) {
+				log.LogAttrs(ctx, slog.LevelWarn, "login refused", slog.String("remote", remoteHost(r)))
+				replyError(w, r, http.StatusForbidden, "incorrect password")
+				return
+			}
+			http.SetCookie(w, &http.Cookie{
+				Name:     sessionCookie,
+				Value:    m.sessions.open(time.Now(), sessionLifetime),
+				Path:     "/",
+				MaxAge:   int(sessionLifetime / time.Second),
+				HttpOnly: true,
+				SameSite: http.SameSiteStrictMode,
+			})
+		case http.MethodDelete:
+			log.LogAttrs(ctx, slog.LevelInfo, "logout request")
+			if c, err := r.Cookie(sessionCookie); err == nil {
+				m.sessions.close(c.Value)
+			}
+			http.SetCookie(w, &http.Cookie{Name: sessionCookie, Path: "/", MaxAge: -1})
+		}
+		reply(w, r, http.StatusOK, "ok", result{OK: true})
+	})
+	routes.handle(apiEndpoint{Path: "/api/v1/session", Methods: []string{http.MethodPut, http.MethodDelete}, Summary: "Dashboard login session", Params: []apiParam{
+		{Name: "password", Type: "string", Method: http.MethodPut, Required: true},
+		formatParam,
+	}}, sessionHandler)
+	shareHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Connection", "close")
+		switch r.Method {
+		case http.MethodPut:
+			log.LogAttrs(ctx, slog.LevelInfo, "share request")
+			if !m.permit(w, r, permConfig) {
+				return
+			}
+			lifetime := defaultShareLifetime
+			if d := r.URL.Query().Get("for"); d != "" {
+				var err error
+				lifetime, err = time.ParseDuration(d)
+				if err != nil {
+					replyError(w, r, http.StatusBadRequest, err)
+					return
+				}
+				if lifetime <= 0 || maxShareLifetime < lifetime {
+					replyError(w, r, http.StatusBadRequest, fmt.Sprintf("invalid share duration: %v", lifetime))
+					return
+				}
+			}
+			token := m.shares.open(time.Now(), lifetime)
+			log.LogAttrs(ctx, slog.LevelWarn, "share token issued", slog.String("remote", remoteHost(r)), slog.Duration("for", lifetime))
+			reply(w, r, http.StatusOK, shareParam+"="+token, struct {
+				Token   string   `json:"token"`
+				Expires float64  `json:"expires_in_seconds"`
+				Paths   []string `json:"paths"`
+			}{token, lifetime.Seconds(), sharePaths})
+		case http.MethodDelete:
+			log.LogAttrs(ctx, slog.LevelInfo, "revoke shares request")
+			if !m.permit(w, r, permConfig) {
+				return
+			}
+			m.shares.clear()
+			reply(w, r, http.StatusOK, "ok", result{OK: true})
+		}
+	})
+	routes.handle(apiEndpoint{Path: "/api/v1/share", Methods: []string{http.MethodPut, http.MethodDelete}, Summary: "Temporary read-only access to diagnostics", Params: []apiParam{
+		{Name: "for", Type: "string", Method: http.MethodPut},
+		formatParam,
+	}}, shareHandler)
+	bansHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Connection", "close")
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+			log.LogAttrs(ctx, slog.LevelDebug, "bans request")
+			if !m.permit(w, r, permRead) {
+				return
+			}
+			bans := m.limit.bans(time.Now())
+			var buf strings.Builder
+			for _, b := range bans {
+				fmt.Fprintf(&buf, "%s %gs\n", b.Addr, b.Remaining)
+			}
+			if bans == nil {
+				bans = []ban{}
+			}
+			reply(w, r, http.StatusOK, buf.String(), bans)
+		case http.MethodDelete:
+			log.LogAttrs(ctx, slog.LevelInfo, "clear bans request")
+			if !m.permit(w, r, permConfig) {
+				return
+			}
+			m.limit.unban()
+			reply(w, r, http.StatusOK, "ok", result{OK: true})
+		}
+	})
+	routes.handle(apiEndpoint{Path: "/api/v1/bans", Methods: []string{http.MethodGet, http.MethodDelete}, Summary: "Clients banned by the rate limiter", Params: []apiParam{formatParam}}, bansHandler)
+	routes.handleFunc(apiEndpoint{Path: "/api/v1/reboot", Methods: []string{http.MethodPut}, Summary: "Restart the device", Params: []apiParam{
+		{Name: "totp", Type: "string"},
+		formatParam,
+	}}, func(w http.ResponseWriter, r *http.Request) {
+		log.LogAttrs(ctx, slog.LevelInfo, "reboot request")
+		if !m.permit(w, r, permConfig) || !m.confirm(w, r) {
+			return
+		}
+		w.Header().Set("Connection", "close")
+		err := m.drain()
+		if err != nil {
+			replyError(w, r, http.StatusServiceUnavailable, err)
+			return
+		}
+		reply(w, r, http.StatusAccepted, "restarting", result{OK: true})
+		go m.reboot(ctx, log, "http", connID(r))
+	})
+	connsHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+			log.LogAttrs(ctx, slog.LevelDebug, "connections request")
+			if !m.permit(w, r, permRead) {
+				return
+			}
+			w.Header().Set("Connection", "close")
+			open, recent := m.conns.list(time.Now())
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]any{
+				"open":   open,
+				"recent": recent,
+			})
+		case http.MethodDelete:
+			log.LogAttrs(ctx, slog.LevelInfo, "close connection request")
+			if !m.permit(w, r, permConfig) {
+				return
+			}
+			w.Header().Set("Connection", "close")
+			id, err := strconv.ParseUint(r.FormValue("id"), 10, 32)
+			if err != nil || id == 0 {
+				replyError(w, r, http.StatusBadRequest, fmt.Sprintf("invalid connection id: %q", r.FormValue("id")))
+				return
+			}
+			if uint32(id) == connID(r) {
+				replyError(w, r, http.StatusConflict, errOwnConn)
+				return
+			}
+			err = m.conns.closeConn(uint32(id))
+			if errors.Is(err, errNoConn) {
+				replyError(w, r, http.StatusNotFound, err)
+				return
+			}
+			m.metrics.forcedCloses.Add(1)
+			log.LogAttrs(ctx, slog.LevelWarn, "connection closed", slog.Uint64("id", id), slog.Any("err", err))
+			reply(w, r, http.StatusOK, "ok", result{OK: true})
+		}
+	})
+	routes.handle(apiEndpoint{Path: "/api/v1/connections", Methods: []string{http.MethodGet, http.MethodDelete}, Summary: "Open client connections", Params: []apiParam{
+		{Name: "id", Type: "integer", Method: http.MethodDelete, Required: true},
+		formatParam,
+	}}, connsHandler)
+	// The original endpoints were served without a version prefix.
+	routes.alias("/move_to/", "/api/v1/move_to")
+	routes.alias("/height/", "/api/v1/height")
+	// Requests relayed from the MQTT broker are authenticated
+	// and rate limited in the same way as HTTP requests.
+	api := m.rateLimit(m.authenticate(mux))
+	return m.serveHTTP(ctx, log, m.trackConns(api), api, commands)
+}
+
+// serveHTTP sets up the network stack and serves h on it until ctx is
+// cancelled. API requests received over MQTT are served by api. If the
+// network watchdog finds the stack wedged, the stack and listener are torn
+// down and set up again without rejoining the network. If the network
+// cannot be joined within networkStartTimeout, or the stack cannot be set
+// up, the device is marked offline and setup is retried until it succeeds.
+func (m *mitm) serveHTTP(ctx context.Context, log *slog.Logger, h, api http.Handler, commands chan<- command) error {
+	associated := false
+	// offline marks the device offline after the failed setup
+	// attempt with the nicLoop stop channel, and returns whether
+	// to retry. Failures other than a join timeout are retried
+	// after networkRetry, rejoining the network in case they were
+	// caused by losing it.
+	offline := func(stop chan struct{}, err error) bool {
+		close(stop)
+		if !m.offline.Swap(true) {
+			log.LogAttrs(ctx, slog.LevelWarn, "network: offline", slog.Any("err", err))
+		}
+		if !errors.Is(err, wifi.ErrJoinTimeout) {
+			log.LogAttrs(ctx, slog.LevelError, "network setup", slog.Any("err", err))
+			associated = false
+			select {
+			case <-ctx.Done():
+			case <-time.After(networkRetry):
+			}
+		}
+		return ctx.Err() == nil
+	}
+	for {
+		stop := make(chan struct{})
+		dhcp, stack, err := wifi.SetupWithDHCP(m.dev, wifi.SetupConfig{
+			Hostname:    m.hostname(),
+			TCPPorts:    1 + outboundConns,
+			UDPPorts:    2, // For DNS and SNTP.
+			Associated:  associated,
+			Stop:        stop,
+			Stall:       faults.radioStalled,
+			JoinTimeout: networkStartTimeout,
+			Credentials: m.wifiCredentials,
+		}, m.logFor("wifi"))
+		if err != nil {
+			if !offline(stop, fmt.Errorf("failed to set up dhcp: %w", err)) {
+				return nil
+			}
+			continue
+		}
+		associated = true
+		if m.offline.Swap(false) {
+			log.LogAttrs(ctx, slog.LevelInfo, "network: online")
+		}
+		n := newNetStack(m.dev, stack, dhcp, m.logFor("wifi"))
+		m.net.Store(n)
+		m.checkHostname(ctx, n)
+
+		netCtx, cancel := context.WithCancel(ctx)
+		go m.runMQTT(netCtx, n, api, commands)
+		go m.runTelemetry(netCtx, n)
+		go m.runSNTP(netCtx, n)
+		go m.runUsagePing(netCtx, n)
+		go m.runDDNS(netCtx, n)
+		go m.runMDNS(netCtx, n)
+
+		const tcpBufLen = 2048 // Half a page each direction.
+		ln, err := stacks.NewTCPListener(stack, stacks.TCPListenerConfig{
+			MaxConnections: 3,
+			ConnTxBufSize:  tcpBufLen,
+			ConnRxBufSize:  tcpBufLen,
+		})
+		if err != nil {
+			cancel()
+			m.net.Store(nil)
+			if !offline(stop, fmt.Errorf("failed to create listener: %w", err)) {
+				return nil
+			}
+			continue
+		}
+		const port = 80
+		err = ln.StartListening(port)
+		if err != nil {
+			cancel()
+			m.net.Store(nil)
+			if !offline(stop, fmt.Errorf("failed to start listener: %w", err)) {
+				return nil
+			}
+			continue
+		}
+
+		addr := netip.AddrPortFrom(stack.Addr(), port)
+		log.LogAttrs(ctx, slog.LevelInfo, "listening", slog.String("addr", "http://"+addr.String()))
+		m.events.publish(event{kind: networkUp, time: time.Now(), addr: stack.Addr()})
+
+		wedged := make(chan struct{})
+		go func() {
+			if m.watchNet(netCtx, n) {
+				close(wedged)
+				ln.Close()
+			}
+		}()
+		srv := &http.Server{Handler: h, ConnContext: connContext}
+		err = srv.Serve(allowListener{Listener: ln, ctx: ctx, m: m})
+		cancel()
+		select {
+		case <-wedged:
+		default:
+			close(stop)
+			return err
+		}
+		m.metrics.netRestarts.Add(1)
+		log.LogAttrs(ctx, slog.LevelWarn, "restart network stack", slog.Any("err", err))
+		m.net.Store(nil)
+		close(stop)
+	}
+}
+
+// permit returns whether the source of r has been granted perm, responding
+// with a forbidden status if it has not.
+func (m *mitm) permit(w http.ResponseWriter, r *http.Request, perm string) bool {
+	if m.allowed(requestSource(r), perm) {
+		return true
+	}
+	w.Header().Set("Connection", "close")
+	replyError(w, r, http.StatusForbidden, m.refusal(perm))
+	return false
+}
+
+// sourceKey is the context key for the command source of a request.
+type sourceKey struct{}
+
+// requestSource returns the command source of r: sourceMQTTAPI for
+// requests relayed from the MQTT broker and sourceHTTP otherwise.
+func requestSource(r *http.Request) string {
+	if src, ok := r.Context().Value(sourceKey{}).(string); ok {
+		return src
+	}
+	return sourceHTTP
+}
+
+// rateLimit wraps h to refuse requests from clients that exceed the
+// configured rate limit with a too many requests status. Requests are
+// limited before authentication so that unauthenticated clients are
+// also limited.
+func (m *mitm) rateLimit(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		addr, err := netip.ParseAddrPort(r.RemoteAddr)
+		if err != nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+		ok, retry, ban := m.limit.allow(addr.Addr(), m.cfg.Load().RateLimit, time.Now())
+		if ok {
+			h.ServeHTTP(w, r)
+			return
+		}
+		m.metrics.rateLimited.Add(1)
+		if ban {
+			m.logFor("http").LogAttrs(r.Context(), slog.LevelWarn, "client banned", slog.String("remote", addr.Addr().String()), slog.Duration("for", retry))
+		}
+		w.Header().Set("Connection", "close")
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retry.Seconds()))))
+		replyError(w, r, http.StatusTooManyRequests, errRateLimited)
+	})
+}
+
+// confirm returns whether r carries a valid one-time code in its
+// X-Desk-TOTP header or totp form value when one-time codes are required,
+// responding with a forbidden status if it does not.
+func (m *mitm) confirm(w http.ResponseWriter, r *http.Request) bool {
+	code := r.Header.Get("X-Desk-TOTP")
+	if code == "" {
+		code = r.FormValue("totp")
+	}
+	err := m.checkCode(code)
+	if err == nil {
+		return true
+	}
+	m.logFor("http").LogAttrs(r.Context(), slog.LevelWarn, "one-time code refused", slog.String("remote", remoteHost(r)), slog.String("path", r.URL.Path), slog.Any("err", err))
+	w.Header().Set("Connection", "close")
+	replyError(w, r, http.StatusForbidden, err)
+	return false
+}
+
+// authenticate wraps h to require authentication. A request signed with
+// the stored signing key is accepted. Otherwise, when a bearer token,
+// signing key or dashboard password has been stored, requests that may
+// change state must carry the token or a dashboard session cookie, and
+// when an HTTP Basic credential has been stored, all requests must carry
+// it unless they carry a valid bearer token or session cookie. Login
+// requests need only the HTTP Basic credential.
+func (m *mitm) authenticate(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if shared, ok := m.shared(r); shared {
+			if !ok {
+				m.logFor("http").LogAttrs(r.Context(), slog.LevelWarn, "share token refused", slog.String("remote", remoteHost(r)), slog.String("path", r.URL.Path))
+				replyError(w, r, http.StatusForbidden, "invalid or expired share token")
+				return
+			}
+			m.logFor("http").LogAttrs(r.Context(), slog.LevelInfo, "shared request", slog.String("remote", remoteHost(r)), slog.String("path", r.URL.Path))
+			h.ServeHTTP(w, r)
+			return
+		}
+		state := m.store.get()
+		if r.Header.Get("X-Desk-Signature") != "" {
+			err := m.verifySignature(r, state.SigningKey)
+			if err != nil {
+				m.logFor("http").LogAttrs(r.Context(), slog.LevelWarn, "signed request refused", slog.String("remote", remoteHost(r)), slog.Any("err", err))
+				unauthorized(w, `HMAC-SHA256 realm="desk"`)
+				return
+			}
+			h.ServeHTTP(w, r)
+			return
+		}
+		if c, err := r.Cookie(sessionCookie); err == nil && m.sessions.valid(c.Value, time.Now()) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if state.Token != nil || state.SigningKey != nil || state.UIPassword != nil {
+			var challenge string
+			switch {
+			case state.UIPassword != nil:
+				challenge = `Session realm="desk"`
+			case state.Token != nil:
+				challenge = `Bearer realm="desk"`
+			default:
+				challenge = `HMAC-SHA256 realm="desk"`
+			}
+			token, ok := bearerToken(r)
+			switch {
+			case ok && state.Token != nil && state.Token.match("", token):
+				h.ServeHTTP(w, r)
+				return
+			case ok || (protected(r) && r.URL.Path != "/api/v1/session"):
+				unauthorized(w, challenge)
+				return
+			}
+		}
+		if cred := state.Auth; cred != nil {
+			user, password, ok := r.BasicAuth()
+			if !ok || !cred.match(user, password) {
+				unauthorized(w, `Basic realm="desk", charset="UTF-8"`)
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// verifySignature checks the HMAC-SHA256 signature of r made with key,
+// its timestamp and that it has not been replayed. The body of r is
+// replaced with a copy of the body that was read.
+func (m *mitm) verifySignature(r *http.Request, key []byte) error {
+	if key == nil {
+		return errors.New("no signing key")
+	}
+	if !m.clock.isSynced() {
+		return errors.New("clock not synced")
+	}
+	ts := r.Header.Get("X-Desk-Timestamp")
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid timestamp: %w", err)
+	}
+	now := m.clock.now()
+	if skew := now.Sub(time.Unix(sec, 0)); skew < -signatureSkew || signatureSkew < skew {
+		return fmt.Errorf("timestamp skew: %v", skew)
+	}
+	sig, err := hex.DecodeString(r.Header.Get("X-Desk-Signature"))
+	if err != nil {
+		return fmt.Errorf("invalid signature: %w", err)
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxSignedBody+1))
+	if err != nil {
+		return err
+	}
+	if len(body) > maxSignedBody {
+		return errors.New("body too long")
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	if !hmac.Equal(sig, requestMAC(key, ts, r.Method, r.URL.RequestURI(), body)) {
+		return errors.New("signature mismatch")
+	}
+	return m.replay.add(sig, now)
+}
+
+// bearerToken returns the bearer token in the Authorization header of r.
+func bearerToken(r *http.Request) (token string, ok bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	return token, true
+}
+
+// safeMethod returns whether requests with method do not change state.
+func safeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead
+}
+
+// protected returns whether r requires credentials once any are stored.
+// Requests that change state are protected, as are reads of the device
+// configuration since it holds secrets such as the MQTT password.
+func protected(r *http.Request) bool {
+	return !safeMethod(r.Method) || r.URL.Path == "/api/v1/config"
+}
+
+// unauthorized responds with an unauthorized status and a challenge.
+func unauthorized(w http.ResponseWriter, challenge string) {
+	w.Header().Set("Connection", "close")
+	w.Header().Set("WWW-Authenticate", challenge)
+	w.WriteHeader(http.StatusUnauthorized)
+}
+
+// remoteHost returns the host part of the remote address of r.
+func remoteHost(r *http.Request) string {
+	addr, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return addr.Addr().String()
+}
+
+// wantJSON returns whether the client has requested a JSON response,
+// either with a format=json query parameter or in its Accept header.
+func wantJSON(r *http.Request) bool {
+	if r.URL.Query().Get("format") == "json" {
+		return true
+	}
+	for _, t := range strings.Split(r.Header.Get("Accept"), ",") {
+		typ, _, _ := strings.Cut(t, ";")
+		if strings.TrimSpace(typ) == "application/json" {
+			return true
+		}
+	}
+	return false
+}
+
+// reply writes a response with the status code. If the client requested
+// JSON the response is the JSON encoding of v, otherwise it is text.
+func reply(w http.ResponseWriter, r *http.Request, code int, text string, v any) {
+	if !wantJSON(r) {
+		w.WriteHeader(code)
+		w.Write([]byte(text))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// replyError writes an error response with the status code. If the client
+// requested JSON the response is an object with the error in its error
+// field.
+func replyError(w http.ResponseWriter, r *http.Request, code int, err any) {
+	msg := fmt.Sprint(err)
+	reply(w, r, code, msg, result{Error: msg})
+}
+
+// result is the JSON response of endpoints that perform an action.
+type result struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// etag returns the entity tag for the configuration revision rev. Since
+// revisions restart at boot, the tag includes the boot ID so that tags
+// issued before a restart do not match a revision after it.
+func (m *mitm) etag(rev uint64) string {
+	return `"` + m.boot + "-" + strconv.FormatUint(rev, 10) + `"`
+}
+
+// parseETag returns the configuration revision in the entity tag s. If s
+// was issued before the last restart, errStaleConfig is returned.
+func (m *mitm) parseETag(s string) (uint64, error) {
+	s = strings.TrimPrefix(strings.TrimSpace(s), "W/")
+	boot, r, ok := strings.Cut(strings.Trim(s, `"`), "-")
+	rev, err := strconv.ParseUint(r, 10, 64)
+	if !ok || err != nil {
+		return 0, fmt.Errorf("invalid entity tag: %s", s)
+	}
+	if boot != m.boot {
+		return 0, errStaleConfig
+	}
+	return rev, nil
 }
@@ -0,0 +1,35 @@
+// Copyright ©2025 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import "errors"
+
+// In kiosk mode the device reports the desk's state but refuses to move
+// it on behalf of any remote command source. The handset is passed
+// through to the controller as usual.
+
+var errKiosk = errors.New("read-only kiosk mode")
+
+// setKiosk turns kiosk mode on or off, persisting the setting.
+func (m *mitm) setKiosk(on bool) error {
+	if m.store.get().Kiosk == on {
+		m.kiosk.Store(on)
+		return nil
+	}
+	err := m.store.update(func(p *persistent) { p.Kiosk = on })
+	if err != nil {
+		return err
+	}
+	m.kiosk.Store(on)
+	return nil
+}
+
+// refusal returns the reason for refusing a remote request for perm.
+func (m *mitm) refusal(perm string) error {
+	if perm == permMove && m.kiosk.Load() {
+		return errKiosk
+	}
+	return errPermission
+}
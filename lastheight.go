@@ -0,0 +1,74 @@
+// Copyright ©2025 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// lastHeight is the persisted height of the desk when it last settled,
+// so that a height can be reported after a restart before the controller
+// has sent one.
+type lastHeight struct {
+	Position savedPosition `json:"position"`
+
+	// Time is the wall clock time the height
+	// was recorded, or zero if the clock had
+	// not been synced.
+	Time time.Time `json:"time,omitempty"`
+}
+
+// runLastHeight persists the height of the desk once it has settled after
+// a change received on sub until ctx is cancelled, extending the learned
+// range of the desk to include it. Heights are only written when the desk
+// is idle to limit flash wear.
+func (m *mitm) runLastHeight(ctx context.Context, sub *subscription) {
+	defer m.events.unsubscribe(sub)
+	// Check the height on start since the desk
+	// may have been moved while the device was
+	// off.
+	pending := true
+	for {
+		p, err := m.settled(ctx, sub, pending)
+		if err != nil {
+			return
+		}
+		pending = false
+		saved := savedPosition{Mantissa: p.mantissa, Exponent: p.exponent}
+		if last := m.store.get().LastHeight; last != nil && last.Position == saved {
+			continue
+		}
+		rec := lastHeight{Position: saved}
+		if m.clock.isSynced() {
+			rec.Time = m.clock.now()
+		}
+		m.log.LogAttrs(ctx, slog.LevelDebug, "record last height", slog.Any("position", p))
+		err = m.store.update(func(s *persistent) {
+			s.LastHeight = &rec
+			s.Range = extendRange(s.Range, saved)
+		})
+		if err != nil {
+			m.log.LogAttrs(ctx, slog.LevelError, "persist last height", slog.Any("err", err))
+		}
+	}
+}
+
+// staleHeight returns the height recorded before the last restart and its
+// age. The age is negative if it is not known. It returns false if no
+// height was recorded.
+func (m *mitm) staleHeight() (p position, age time.Duration, ok bool) {
+	last := m.store.get().LastHeight
+	if last == nil || last.Position.Mantissa == 0 {
+		return position{}, 0, false
+	}
+	p = position{mantissa: last.Position.Mantissa, exponent: last.Position.Exponent}
+	age = -1
+	if !last.Time.IsZero() && m.clock.isSynced() {
+		age = m.clock.now().Sub(last.Time)
+	}
+	return p, age, true
+}
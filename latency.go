@@ -0,0 +1,73 @@
+// Copyright ©2025 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+// latencyTimeout is the time after a key frame is injected beyond which
+// a height change is not attributed to the injected frame.
+const latencyTimeout = 5 * time.Second
+
+// latency measures the time between a key frame being injected to the
+// controller and the first subsequent change in the height reported by
+// the controller.
+type latency struct {
+	mu      sync.Mutex
+	start   time.Time // Zero if no measurement is pending.
+	from    position
+	samples [32]time.Duration
+	n       uint64 // Total number of samples.
+}
+
+// inject starts a measurement from the height p.
+func (l *latency) inject(p position, now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.start = now
+	l.from = p
+}
+
+// frame completes a pending measurement if p differs from the height
+// when the measurement started.
+func (l *latency) frame(p position, now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.start.IsZero() {
+		return
+	}
+	d := now.Sub(l.start)
+	if d > latencyTimeout {
+		l.start = time.Time{}
+		return
+	}
+	if p == l.from {
+		return
+	}
+	l.samples[l.n%uint64(len(l.samples))] = d
+	l.n++
+	l.start = time.Time{}
+}
+
+// quantiles returns the latency quantiles qs over the most recent samples
+// and the total number of samples.
+func (l *latency) quantiles(qs ...float64) ([]time.Duration, uint64) {
+	l.mu.Lock()
+	s := slices.Clone(l.samples[:min(l.n, uint64(len(l.samples)))])
+	n := l.n
+	l.mu.Unlock()
+	if len(s) == 0 {
+		return nil, n
+	}
+	slices.Sort(s)
+	v := make([]time.Duration, len(qs))
+	for i, q := range qs {
+		v[i] = s[int(q*float64(len(s)-1)+0.5)]
+	}
+	return v, n
+}
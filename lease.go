@@ -0,0 +1,83 @@
+// Copyright ©2025 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// leaseTimeout is the longest time a motion
+	// lease is held.
+	leaseTimeout = 30 * time.Second
+
+	// leaseGrace is the time a motion lease is
+	// held after it is granted while waiting for
+	// the desk to start moving.
+	leaseGrace = 2 * time.Second
+)
+
+// lease is the motion lease. The initiator of a move owns the lease until
+// the desk stops moving or the lease times out, and moves from other
+// initiators are refused while it is held.
+type lease struct {
+	mu      sync.Mutex
+	owner   string
+	granted time.Time
+}
+
+// leaseError is returned when a move is refused because another initiator
+// holds the motion lease.
+type leaseError struct {
+	owner string
+}
+
+func (e leaseError) Error() string {
+	return "motion locked by " + e.owner
+}
+
+// claimMotion takes the motion lease for owner. If the lease is held by
+// another owner, a leaseError is returned. An owner may renew its own
+// lease.
+func (m *mitm) claimMotion(owner string) error {
+	m.lease.mu.Lock()
+	defer m.lease.mu.Unlock()
+	now := time.Now()
+	if m.lease.owner != "" && m.lease.owner != owner && m.leaseHeld(now) {
+		return leaseError{owner: m.lease.owner}
+	}
+	m.lease.owner = owner
+	m.lease.granted = now
+	return nil
+}
+
+// leaseHeld returns whether the current lease is still in force at now.
+// The caller must hold m.lease.mu.
+func (m *mitm) leaseHeld(now time.Time) bool {
+	age := now.Sub(m.lease.granted)
+	if age >= leaseTimeout {
+		return false
+	}
+	return age < leaseGrace || m.moving()
+}
+
+// releaseMotion releases the motion lease regardless of its owner.
+func (m *mitm) releaseMotion() {
+	m.lease.mu.Lock()
+	defer m.lease.mu.Unlock()
+	m.lease.owner = ""
+}
+
+// motionOwner returns the current holder of the motion lease, or the empty
+// string if it is not held.
+func (m *mitm) motionOwner() string {
+	m.lease.mu.Lock()
+	defer m.lease.mu.Unlock()
+	if m.lease.owner == "" || !m.leaseHeld(time.Now()) {
+		return ""
+	}
+	return m.lease.owner
+}
@@ -0,0 +1,130 @@
+// Copyright ©2025 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+)
+
+// The controller does not report the physical limits of the desk, so they
+// are learned from the range of heights the desk has settled at. The range
+// only grows, and is used once it spans at least minRangeSpan.
+
+// minRangeSpan is the smallest span of the learned range in display units
+// for it to be used to validate and normalise heights.
+const minRangeSpan = 10.0
+
+var (
+	errOutOfRange = errors.New("height outside the range of the desk")
+	errNoRange    = errors.New("desk range not known")
+	errPercent    = errors.New("invalid percentage")
+)
+
+// heightRange is the range of heights the desk has settled at.
+type heightRange struct {
+	Min savedPosition `json:"min"`
+	Max savedPosition `json:"max"`
+}
+
+// extendRange returns the range r extended to include p. If r is nil, the
+// range holds only p.
+func extendRange(r *heightRange, p savedPosition) *heightRange {
+	if r == nil {
+		return &heightRange{Min: p, Max: p}
+	}
+	next := *r
+	h := position{mantissa: p.Mantissa, exponent: p.Exponent}.units()
+	if h < (position{mantissa: next.Min.Mantissa, exponent: next.Min.Exponent}).units() {
+		next.Min = p
+	}
+	if h > (position{mantissa: next.Max.Mantissa, exponent: next.Max.Exponent}).units() {
+		next.Max = p
+	}
+	return &next
+}
+
+// deskRange returns the learned range of the desk and whether it is wide
+// enough to be used.
+func (m *mitm) deskRange() (min, max position, ok bool) {
+	r := m.store.get().Range
+	if r == nil {
+		return position{}, position{}, false
+	}
+	min = position{mantissa: r.Min.Mantissa, exponent: r.Min.Exponent}
+	max = position{mantissa: r.Max.Mantissa, exponent: r.Max.Exponent}
+	return min, max, max.units()-min.units() >= minRangeSpan
+}
+
+// checkRange returns an error wrapping errOutOfRange if p is outside the
+// learned range of the desk. Any height is accepted until the range is
+// known.
+func (m *mitm) checkRange(p position) error {
+	min, max, ok := m.deskRange()
+	if !ok {
+		return nil
+	}
+	if h := p.units(); h < min.units() || max.units() < h {
+		return fmt.Errorf("%w: %s not in %s-%s", errOutOfRange, p, min, max)
+	}
+	return nil
+}
+
+// percent returns the height p as a percentage of the learned range of
+// the desk, and whether the range is known.
+func (m *mitm) percent(p position) (float64, bool) {
+	min, max, ok := m.deskRange()
+	if !ok {
+		return 0, false
+	}
+	pct := 100 * (p.units() - min.units()) / (max.units() - min.units())
+	return math.Round(math.Max(0, math.Min(100, pct))), true
+}
+
+// atPercent returns the position at pct percent of the learned range of
+// the desk.
+func (m *mitm) atPercent(pct float64) (position, error) {
+	if math.IsNaN(pct) || pct < 0 || 100 < pct {
+		return position{}, fmt.Errorf("%w: %v", errPercent, pct)
+	}
+	min, max, ok := m.deskRange()
+	if !ok {
+		return position{}, errNoRange
+	}
+	return min.offset(pct / 100 * (max.units() - min.units())), nil
+}
+
+// moveToPercent moves the desk to pct percent of its learned range using
+// the motion profile. If profile is empty, the scheduled profile is used.
+// The caller must hold m.mu.
+func (m *mitm) moveToPercent(ctx context.Context, log *slog.Logger, src string, pct float64, profile string) error {
+	p, err := m.atPercent(pct)
+	if err != nil {
+		return err
+	}
+	if profile == "" {
+		profile = m.profile()
+	}
+	log.LogAttrs(ctx, slog.LevelInfo, "move to percentage", slog.Float64("pct", pct), slog.Any("target", p), slog.String("profile", profile))
+	return m.driveTo(ctx, log, src, savedPosition{Mantissa: p.mantissa, Exponent: p.exponent}, profile == profileQuiet)
+}
+
+// moveToHeight moves the desk to the height h in display units. The
+// caller must hold m.mu.
+func (m *mitm) moveToHeight(ctx context.Context, log *slog.Logger, src string, h float64) error {
+	if math.IsNaN(h) || math.IsInf(h, 0) || h <= 0 {
+		return fmt.Errorf("invalid height: %v", h)
+	}
+	if !m.heightKnown.Load() {
+		return errors.New("height not known")
+	}
+	p := m.position.Load().(position)
+	p = p.offset(h - p.units())
+	log.LogAttrs(ctx, slog.LevelInfo, "move to height", slog.Float64("height", h), slog.Any("target", p))
+	return m.driveTo(ctx, log, src, savedPosition{Mantissa: p.mantissa, Exponent: p.exponent}, false)
+}
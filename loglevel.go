@@ -0,0 +1,124 @@
+// Copyright ©2025 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"sync/atomic"
+)
+
+// logComponents is the set of subsystems that may have their log level
+// set independently of the global log level.
+var logComponents = [...]string{"wifi", "uart", "http", "ble", "mqtt"}
+
+// initLog sets up the device logger and the component loggers, writing
+// all log output to w.
+func (m *mitm) initLog(w io.Writer) {
+	m.handler = slog.NewTextHandler(w, &slog.HandlerOptions{
+		// Filtering is done by levelHandler.
+		Level: slog.Level(math.MinInt),
+	})
+	m.log = slog.New(&levelHandler{level: &m.level, h: m.handler})
+	for i := range m.levels {
+		m.levels[i].global = &m.level
+	}
+}
+
+// logFor returns a logger for the named component.
+func (m *mitm) logFor(component string) *slog.Logger {
+	l := m.componentLevel(component)
+	if l == nil {
+		panic(fmt.Sprintf("unknown log component: %s", component))
+	}
+	return slog.New(&levelHandler{
+		level: l,
+		h:     m.handler.WithAttrs([]slog.Attr{slog.String("component", component)}),
+	})
+}
+
+// setLogLevel sets the log level of the named component, or the global
+// level if component is empty. A level of "inherit" returns the component
+// to the global level.
+func (m *mitm) setLogLevel(component, level string) error {
+	if component == "" {
+		return m.level.UnmarshalText([]byte(level))
+	}
+	l := m.componentLevel(component)
+	if l == nil {
+		return fmt.Errorf("unknown component: %q", component)
+	}
+	if level == "inherit" {
+		l.setLevel(0, true)
+		return nil
+	}
+	var lvl slog.Level
+	err := lvl.UnmarshalText([]byte(level))
+	if err != nil {
+		return err
+	}
+	l.setLevel(lvl, false)
+	return nil
+}
+
+// componentLevel returns the level for the named component, or nil if the
+// component is not known.
+func (m *mitm) componentLevel(component string) *componentLevel {
+	for i, c := range logComponents {
+		if c == component {
+			return &m.levels[i]
+		}
+	}
+	return nil
+}
+
+// componentLevel is the log level of a component. It follows the global
+// level unless it has been set.
+type componentLevel struct {
+	global *slog.LevelVar
+	set    atomic.Bool
+	level  slog.LevelVar
+}
+
+// Level returns the component's log level.
+func (l *componentLevel) Level() slog.Level {
+	if l.set.Load() {
+		return l.level.Level()
+	}
+	return l.global.Level()
+}
+
+// setLevel sets the component's log level. If inherit is true, the level
+// follows the global level.
+func (l *componentLevel) setLevel(level slog.Level, inherit bool) {
+	l.level.Set(level)
+	l.set.Store(!inherit)
+}
+
+// levelHandler is a slog.Handler that filters records by level before
+// passing them to the wrapped handler.
+type levelHandler struct {
+	level slog.Leveler
+	h     slog.Handler
+}
+
+func (h *levelHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *levelHandler) Handle(ctx context.Context, r slog.Record) error {
+	return h.h.Handle(ctx, r)
+}
+
+func (h *levelHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &levelHandler{level: h.level, h: h.h.WithAttrs(attrs)}
+}
+
+func (h *levelHandler) WithGroup(name string) slog.Handler {
+	return &levelHandler{level: h.level, h: h.h.WithGroup(name)}
+}
@@ -0,0 +1,169 @@
+// Copyright ©2025 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// logRingLen is the number of log records retained for resumption of
+// log streams.
+const logRingLen = 64
+
+// logRing is a ring buffer of log records. Each call to Write is held as
+// a single record and is assigned a sequence number that is unique within
+// the session.
+type logRing struct {
+	// session identifies the sequence
+	// numbering of the ring. It is unique
+	// to each boot of the device.
+	session string
+
+	mu   sync.Mutex
+	seq  uint64 // Sequence number of the next record.
+	recs [logRingLen][]byte
+}
+
+// Write adds p to the ring as a single record, evicting the oldest record
+// if the ring is full.
+func (r *logRing) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	i := r.seq % logRingLen
+	r.recs[i] = append(r.recs[i][:0], p...)
+	r.seq++
+	return len(p), nil
+}
+
+// last returns the sequence number of the next record to be written.
+func (r *logRing) last() uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.seq
+}
+
+// snapshot appends the most recent retained records to dst, each prefixed
+// with its sequence number, oldest first, adding no more than limit bytes.
+func (r *logRing) snapshot(dst []byte, limit int) []byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	oldest := r.seq - min(r.seq, logRingLen)
+	seq := r.seq
+	n := 0
+	for seq > oldest {
+		k := len(strconv.FormatUint(seq-1, 10)) + 1 + len(r.recs[(seq-1)%logRingLen])
+		if n+k > limit {
+			break
+		}
+		n += k
+		seq--
+	}
+	for ; seq < r.seq; seq++ {
+		dst = strconv.AppendUint(dst, seq, 10)
+		dst = append(dst, ' ')
+		dst = append(dst, r.recs[seq%logRingLen]...)
+	}
+	return dst
+}
+
+// next appends the oldest retained record with a sequence number at least
+// seq to dst and returns it with its sequence number. If no such record
+// exists, next returns ok=false.
+func (r *logRing) next(dst []byte, seq uint64) (rec []byte, got uint64, ok bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if seq >= r.seq {
+		return dst, seq, false
+	}
+	oldest := r.seq - min(r.seq, logRingLen)
+	seq = max(seq, oldest)
+	return append(dst, r.recs[seq%logRingLen]...), seq, true
+}
+
+const (
+	// logPageLen and maxLogPageLen are the default
+	// and largest number of records in a page of
+	// the log.
+	logPageLen    = 16
+	maxLogPageLen = 64
+
+	// logPageBytes is the largest total length of
+	// the records in a page of the log, so that a
+	// page fits the TCP buffers of the device.
+	logPageBytes = 1536
+)
+
+var errCursor = errors.New("invalid cursor")
+
+// logRecord is a log record with its sequence number.
+type logRecord struct {
+	Seq  uint64 `json:"seq"`
+	Text string `json:"text"`
+}
+
+// page returns the retained records with sequence numbers from seq up to,
+// but not including, to, oldest first. No more than limit records are
+// returned, and records are only added while their text totals no more
+// than maxBytes, although at least one record is returned if any is in
+// range. It also returns the sequence number following the last record
+// returned and the number of records in the range that have been evicted.
+func (r *logRing) page(seq, to uint64, limit, maxBytes int) (recs []logRecord, next, lost uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	to = min(to, r.seq)
+	oldest := r.seq - min(r.seq, logRingLen)
+	if seq < oldest {
+		lost = min(oldest, to) - seq
+		seq = oldest
+	}
+	n := 0
+	for ; seq < to && len(recs) < limit; seq++ {
+		rec := r.recs[seq%logRingLen]
+		if len(recs) != 0 && n+len(rec) > maxBytes {
+			break
+		}
+		n += len(rec)
+		recs = append(recs, logRecord{Seq: seq, Text: string(rec)})
+	}
+	return recs, seq, lost
+}
+
+// logCursor is the position of a client paging through the log. It is
+// only valid within the log session it was issued in.
+type logCursor struct {
+	session string
+	seq, to uint64
+}
+
+// String returns the opaque text form of the cursor.
+func (c logCursor) String() string {
+	return c.session + "." + strconv.FormatUint(c.seq, 10) + "." + strconv.FormatUint(c.to, 10)
+}
+
+// parseLogCursor returns the cursor represented by s.
+func parseLogCursor(s string) (logCursor, error) {
+	session, rest, ok := strings.Cut(s, ".")
+	if !ok {
+		return logCursor{}, errCursor
+	}
+	seq, to, ok := strings.Cut(rest, ".")
+	if !ok {
+		return logCursor{}, errCursor
+	}
+	c := logCursor{session: session}
+	var err error
+	c.seq, err = strconv.ParseUint(seq, 10, 64)
+	if err != nil {
+		return logCursor{}, errCursor
+	}
+	c.to, err = strconv.ParseUint(to, 10, 64)
+	if err != nil || c.to < c.seq {
+		return logCursor{}, errCursor
+	}
+	return c, nil
+}
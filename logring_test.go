@@ -0,0 +1,132 @@
+// Copyright ©2025 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// records returns the log records with sequence numbers in [from, to)
+// as written by newTestRing.
+func records(from, to uint64) []logRecord {
+	var recs []logRecord
+	for seq := from; seq < to; seq++ {
+		recs = append(recs, logRecord{Seq: seq, Text: fmt.Sprintf("record %03d\n", seq)})
+	}
+	return recs
+}
+
+// newTestRing returns a log ring holding n records.
+func newTestRing(n int) *logRing {
+	var r logRing
+	for i := range n {
+		fmt.Fprintf(&r, "record %03d\n", i)
+	}
+	return &r
+}
+
+var logPageTests = []struct {
+	name     string
+	written  int
+	seq, to  uint64
+	limit    int
+	maxBytes int
+
+	want     []logRecord
+	wantNext uint64
+	wantLost uint64
+}{
+	{
+		name: "empty", written: 0,
+		seq: 0, to: 10, limit: 16, maxBytes: logPageBytes,
+		want: nil, wantNext: 0,
+	},
+	{
+		name: "all", written: 10,
+		seq: 0, to: 10, limit: 16, maxBytes: logPageBytes,
+		want: records(0, 10), wantNext: 10,
+	},
+	{
+		name: "range", written: 10,
+		seq: 3, to: 6, limit: 16, maxBytes: logPageBytes,
+		want: records(3, 6), wantNext: 6,
+	},
+	{
+		name: "to beyond end", written: 10,
+		seq: 8, to: 100, limit: 16, maxBytes: logPageBytes,
+		want: records(8, 10), wantNext: 10,
+	},
+	{
+		name: "limit", written: 10,
+		seq: 0, to: 10, limit: 4, maxBytes: logPageBytes,
+		want: records(0, 4), wantNext: 4,
+	},
+	{
+		name: "bytes", written: 10,
+		seq: 0, to: 10, limit: 16, maxBytes: 3 * len("record 000\n"),
+		want: records(0, 3), wantNext: 3,
+	},
+	{
+		name: "oversized record", written: 10,
+		seq: 2, to: 10, limit: 16, maxBytes: 1,
+		want: records(2, 3), wantNext: 3,
+	},
+	{
+		name: "evicted", written: logRingLen + 10,
+		seq: 0, to: logRingLen + 10, limit: 4, maxBytes: logPageBytes,
+		want: records(10, 14), wantNext: 14, wantLost: 10,
+	},
+	{
+		name: "all evicted", written: logRingLen + 10,
+		seq: 0, to: 5, limit: 4, maxBytes: logPageBytes,
+		want: nil, wantNext: 10, wantLost: 5,
+	},
+}
+
+func TestLogRingPage(t *testing.T) {
+	for _, test := range logPageTests {
+		r := newTestRing(test.written)
+		got, next, lost := r.page(test.seq, test.to, test.limit, test.maxBytes)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("unexpected records for %s:\ngot: %v\nwant:%v", test.name, got, test.want)
+		}
+		if next != test.wantNext {
+			t.Errorf("unexpected next for %s: got:%d want:%d", test.name, next, test.wantNext)
+		}
+		if lost != test.wantLost {
+			t.Errorf("unexpected lost for %s: got:%d want:%d", test.name, lost, test.wantLost)
+		}
+	}
+}
+
+func TestLogCursor(t *testing.T) {
+	for _, test := range []struct {
+		text    string
+		want    logCursor
+		wantErr error
+	}{
+		{text: "abc.1.5", want: logCursor{session: "abc", seq: 1, to: 5}},
+		{text: "abc.5.5", want: logCursor{session: "abc", seq: 5, to: 5}},
+		{text: "abc.6.5", wantErr: errCursor},
+		{text: "abc.1", wantErr: errCursor},
+		{text: "abc", wantErr: errCursor},
+		{text: "abc.x.5", wantErr: errCursor},
+		{text: "abc.1.-5", wantErr: errCursor},
+	} {
+		got, err := parseLogCursor(test.text)
+		if err != test.wantErr {
+			t.Errorf("unexpected error for %q: got:%v want:%v", test.text, err, test.wantErr)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("unexpected cursor for %q: got:%+v want:%+v", test.text, got, test.want)
+		}
+		if err == nil && got.String() != test.text {
+			t.Errorf("unexpected round trip of %q: got:%q", test.text, got)
+		}
+	}
+}
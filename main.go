@@ -6,12 +6,12 @@ package main
 
 import (
 	"context"
+	"encoding/binary"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"log/slog"
 	"machine"
-	"net/http"
-	"sync/atomic"
 	"time"
 
 	"github.com/soypat/cyw43439"
@@ -24,6 +24,7 @@ func main() {
 	// Let serial port stabilise.
 	time.Sleep(time.Second)
 
+	base, siteErr := siteDefaults()
 	m := mitm{
 		dev: cyw43439.NewPicoWDevice(),
 
@@ -32,17 +33,23 @@ func main() {
 
 		controller: machine.UART1,
 		act:        machine.GPIO16, // P21
+		line:       models[base.Model].line,
+		baseCfg:    base,
 
-		last: make(chan time.Time),
+		leds:   make(chan ledSequence, 1),
+		writer: newControllerWriter(),
+
+		relay: relay{pin: machine.NoPin},
+		store: store{flash: machine.Flash},
 	}
+	m.sinks = m.notifiers()
 	m.position.Store(position{})
+	m.debounce.bounces = &m.metrics.bounces
+	m.boot = bootID()
+	m.logs.session = m.boot
 	m.level.Set(slog.LevelInfo)
-	m.log = slog.New(slog.NewTextHandler(
-		io.MultiWriter(machine.Serial, &m.sw),
-		&slog.HandlerOptions{
-			Level: &m.level,
-		},
-	))
+	m.trace.rate.Store(defaultTraceRate)
+	m.initLog(io.MultiWriter(machine.Serial, &m.logs))
 	m.log.LogAttrs(ctx, slog.LevelInfo, "initialise pico W device")
 
 	defer func() {
@@ -71,37 +78,90 @@ func main() {
 		}
 	}()
 
-	err := m.init(ctx)
+	if faultsBuilt {
+		m.log.LogAttrs(ctx, slog.LevelWarn, "fault injection built in")
+	}
+	if siteErr != nil {
+		m.log.LogAttrs(ctx, slog.LevelError, "site config", slog.Any("err", siteErr))
+	}
+	err := m.setConfig(base.clone())
+	if err != nil {
+		panic(err)
+	}
+	// Subscribe before the UARTs are read so that
+	// no controller faults are missed.
+	m.log.LogAttrs(ctx, slog.LevelInfo, "start event consumer")
+	events, err := m.events.subscribe(heightChanged | keyPressed | fault | powerOn)
+	if err != nil {
+		panic(err)
+	}
+	go m.runEvents(ctx, events)
+	heights, err := m.events.subscribe(heightChanged | powerOn)
+	if err != nil {
+		panic(err)
+	}
+
+	err = m.init(ctx)
 	if err != nil {
 		panic(err)
 	}
+	err = m.store.load()
+	if err != nil {
+		m.log.LogAttrs(ctx, slog.LevelWarn, "load persistent state", slog.Any("err", err))
+	}
+	if h := m.store.status(); !h.ok() {
+		m.log.LogAttrs(ctx, slog.LevelError, "persistent state corrupted", slog.Int("corrupt", h.Corrupt), slog.Bool("fallback", h.Fallback), slog.Bool("reset", h.Reset))
+	}
+	m.restoreConfig(ctx)
+	m.kiosk.Store(m.store.get().Kiosk)
 
 	m.log.LogAttrs(ctx, slog.LevelInfo, "pass through pin")
 	m.button.SetInterrupt(machine.PinToggle, func(pin machine.Pin) {
-		high := pin.Get()
-		if high {
-			m.alive()
-		}
-		m.act.Set(high)
+		m.passButton(pin.Get())
 	})
+	go m.debounce.settle(ctx, m.button.Get, m.passButton)
+
+	m.log.LogAttrs(ctx, slog.LevelInfo, "start controller watch")
+	go m.watchController(ctx)
+
+	m.log.LogAttrs(ctx, slog.LevelInfo, "start handset watch")
+	go m.watchHandset(ctx)
+
+	m.log.LogAttrs(ctx, slog.LevelInfo, "start preset learner")
+	go m.runPresets(ctx)
+
+	m.log.LogAttrs(ctx, slog.LevelInfo, "start height recorder")
+	go m.runLastHeight(ctx, heights)
+
+	m.log.LogAttrs(ctx, slog.LevelInfo, "start heatmap")
+	go m.runHeatmap(ctx)
+
+	m.log.LogAttrs(ctx, slog.LevelInfo, "start sit/stand cycle")
+	go m.runCycle(ctx)
 
 	m.log.LogAttrs(ctx, slog.LevelInfo, "start keep-alive")
 	go m.keepAlive(ctx)
 
+	m.log.LogAttrs(ctx, slog.LevelInfo, "wait for controller")
+	if !m.awaitController(ctx, serverStartTimeout) {
+		m.log.LogAttrs(ctx, slog.LevelWarn, "no height from controller", slog.Duration("timeout", serverStartTimeout))
+	}
+
 	if useHTTP {
-		m.log.LogAttrs(ctx, slog.LevelInfo, "start http server")
-		go func() {
-			err := m.httpServer(ctx)
-			if err != nil {
-				panic(err)
-			}
-		}()
+		if m.store.get().Token == nil {
+			m.log.LogAttrs(ctx, slog.LevelWarn, "no control token set: send \"token <token>\" on the serial console to require one")
+		}
+		m.log.LogAttrs(ctx, slog.LevelInfo, "start serial console")
+		go m.serialConsole(ctx)
 	}
 
-	if useBluetooth {
-		m.log.LogAttrs(ctx, slog.LevelInfo, "start bluetooth server")
+	m.log.LogAttrs(ctx, slog.LevelInfo, "start command runner")
+	commands := make(chan command, commandQueueLen)
+	go m.runCommands(ctx, commands)
+	for _, t := range m.transports() {
+		m.log.LogAttrs(ctx, slog.LevelInfo, "start transport", slog.String("transport", t.name()))
 		go func() {
-			err := m.bluetoothServer(ctx)
+			err := t.start(ctx, commands)
 			if err != nil {
 				panic(err)
 			}
@@ -109,42 +169,22 @@ func main() {
 	}
 
 	m.log.LogAttrs(ctx, slog.LevelInfo, "start heartbeat")
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		default:
-		}
-		machine.Watchdog.Update()
-		err := flash(m.dev, normalOperation)
-		if err != nil {
-			m.log.LogAttrs(ctx, slog.LevelError, "heartbeat", slog.Any("err", err))
-		}
-	}
+	m.heartbeat(ctx)
 }
 
-type switchedWriter struct {
-	cw atomic.Pointer[io.Writer]
-}
-
-func (w *switchedWriter) Write(p []byte) (int, error) {
-	cw := w.cw.Load()
-	if cw == nil {
-		return len(p), nil
-	}
-	n, err := (*cw).Write(p)
-	if w, ok := (*cw).(http.Flusher); ok {
-		w.Flush()
+// bootID returns a random identifier for the current boot.
+func bootID() string {
+	var id [8]byte
+	for i := 0; i < len(id); i += 4 {
+		r, _ := machine.GetRNG()
+		binary.LittleEndian.PutUint32(id[i:], r)
 	}
-	return n, err
-}
-
-func (w *switchedWriter) use(val io.Writer) {
-	w.cw.Store(&val)
+	return hex.EncodeToString(id[:])
 }
 
-func (w *switchedWriter) close() {
-	w.cw.Store(nil)
+// deviceID returns the unique identifier of the device.
+func deviceID() string {
+	return hex.EncodeToString(machine.DeviceID())
 }
 
 type bytesAttr []byte
@@ -0,0 +1,199 @@
+// Copyright ©2025 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build http || !bluetooth
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"log/slog"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The device announces its HTTP service with unsolicited multicast DNS
+// responses (RFC 6762 section 8.3) so that DNS-SD browsers can find it
+// and read its capabilities from the TXT record. UDP datagrams cannot be
+// received, so queries are not answered; instead the records are
+// announced again well within their TTL and whenever the TXT record
+// changes.
+
+const (
+	// mdnsPort is the multicast DNS port.
+	mdnsPort = 5353
+
+	// mdnsTTL is the TTL of the announced
+	// records in seconds.
+	mdnsTTL = 120
+
+	// mdnsInterval is the time between
+	// announcements of unchanged records.
+	mdnsInterval = mdnsTTL / 2 * time.Second
+
+	// mdnsService is the DNS-SD service type
+	// announced.
+	mdnsService = "_http._tcp.local"
+)
+
+// mdnsGroup is the multicast DNS group address.
+var mdnsGroup = netip.AddrPortFrom(netip.AddrFrom4([4]byte{224, 0, 0, 251}), mdnsPort)
+
+// mdnsFeatures is the order of the feature flags in the features bitfield
+// of the TXT record; the first feature is the least significant bit. New
+// features must only be appended.
+var mdnsFeatures = []string{"bluetooth", "relay", "mqtt", "webhook", "telemetry", "usage_ping", "ddns"}
+
+// DNS record types and classes.
+const (
+	dnsTypeA      = 1
+	dnsTypePTR    = 12
+	dnsTypeTXT    = 16
+	dnsTypeSRV    = 33
+	dnsClassIN    = 1
+	dnsCacheFlush = 0x8000 // The record is unique to the device.
+)
+
+// runMDNS announces the HTTP service until ctx is cancelled. The records
+// are announced twice a second apart when the network comes up, as
+// required by RFC 6762, then every mdnsInterval and when the desk settles
+// at a new height.
+func (m *mitm) runMDNS(ctx context.Context, n *netStack) {
+	log := m.logFor("wifi")
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	var (
+		last    string
+		sent    time.Time
+		startup = 2
+		buf     []byte
+	)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if m.moving() {
+			continue
+		}
+		txt := m.mdnsTXT()
+		key := strings.Join(txt, "\x00")
+		if startup == 0 && key == last && time.Since(sent) < mdnsInterval {
+			continue
+		}
+		if startup > 0 {
+			startup--
+		}
+		buf = appendMDNSAnnouncement(buf[:0], m.hostname(), n.stack.Addr(), txt)
+		err := n.sendUDP(mdnsGroup, mdnsPort, buf)
+		if err != nil {
+			log.LogAttrs(ctx, slog.LevelWarn, "mdns announce", slog.Any("err", err))
+			continue
+		}
+		last = key
+		sent = time.Now()
+	}
+}
+
+// mdnsTXT returns the strings of the TXT record describing the device.
+func (m *mitm) mdnsTXT() []string {
+	features := m.features()
+	var bits uint64
+	for i, f := range mdnsFeatures {
+		if features[f] {
+			bits |= 1 << i
+		}
+	}
+	txt := []string{
+		"path=/",
+		"api=v1",
+		"version=" + firmwareVersion(),
+		"features=" + strconv.FormatUint(bits, 16),
+		"unit=" + m.config().Unit,
+	}
+	if group := m.cfg.Load().Group; group != "" {
+		txt = append(txt, "group="+group)
+	}
+	if m.heightKnown.Load() {
+		txt = append(txt, "h="+m.position.Load().(position).String())
+	}
+	return txt
+}
+
+// appendMDNSAnnouncement appends an unsolicited multicast DNS response
+// announcing the HTTP service of the device named host at addr with the
+// TXT record strings txt.
+func appendMDNSAnnouncement(dst []byte, host string, addr netip.Addr, txt []string) []byte {
+	instance := host + "." + mdnsService
+	target := host + ".local"
+
+	// Header: ID 0, authoritative response, four answers.
+	dst = binary.BigEndian.AppendUint16(dst, 0)
+	dst = binary.BigEndian.AppendUint16(dst, 0x8400)
+	dst = binary.BigEndian.AppendUint16(dst, 0)
+	dst = binary.BigEndian.AppendUint16(dst, 4)
+	dst = binary.BigEndian.AppendUint16(dst, 0)
+	dst = binary.BigEndian.AppendUint16(dst, 0)
+
+	dst = appendDNSRecordHead(dst, mdnsService, dnsTypePTR, dnsClassIN)
+	dst = appendDNSRData(dst, func(b []byte) []byte {
+		return appendDNSName(b, instance)
+	})
+
+	dst = appendDNSRecordHead(dst, instance, dnsTypeSRV, dnsClassIN|dnsCacheFlush)
+	dst = appendDNSRData(dst, func(b []byte) []byte {
+		b = binary.BigEndian.AppendUint16(b, 0)  // Priority.
+		b = binary.BigEndian.AppendUint16(b, 0)  // Weight.
+		b = binary.BigEndian.AppendUint16(b, 80) // Port.
+		return appendDNSName(b, target)
+	})
+
+	dst = appendDNSRecordHead(dst, instance, dnsTypeTXT, dnsClassIN|dnsCacheFlush)
+	dst = appendDNSRData(dst, func(b []byte) []byte {
+		for _, s := range txt {
+			b = append(b, byte(len(s)))
+			b = append(b, s...)
+		}
+		return b
+	})
+
+	dst = appendDNSRecordHead(dst, target, dnsTypeA, dnsClassIN|dnsCacheFlush)
+	return appendDNSRData(dst, func(b []byte) []byte {
+		a := addr.As4()
+		return append(b, a[:]...)
+	})
+}
+
+// appendDNSRecordHead appends the name, type, class and TTL of a resource
+// record to dst.
+func appendDNSRecordHead(dst []byte, name string, typ, class uint16) []byte {
+	dst = appendDNSName(dst, name)
+	dst = binary.BigEndian.AppendUint16(dst, typ)
+	dst = binary.BigEndian.AppendUint16(dst, class)
+	return binary.BigEndian.AppendUint32(dst, mdnsTTL)
+}
+
+// appendDNSRData appends the record data written by fn to dst, preceded
+// by its length.
+func appendDNSRData(dst []byte, fn func([]byte) []byte) []byte {
+	at := len(dst)
+	dst = append(dst, 0, 0)
+	dst = fn(dst)
+	binary.BigEndian.PutUint16(dst[at:], uint16(len(dst)-at-2))
+	return dst
+}
+
+// appendDNSName appends the uncompressed wire encoding of the dotted name
+// to dst.
+func appendDNSName(dst []byte, name string) []byte {
+	for _, label := range strings.Split(name, ".") {
+		dst = append(dst, byte(len(label)))
+		dst = append(dst, label...)
+	}
+	return append(dst, 0)
+}
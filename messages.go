@@ -0,0 +1,92 @@
+// Copyright ©2025 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import "fmt"
+
+// message identifies a user-facing string.
+type message int
+
+const (
+	msgControllerOffline message = iota
+	msgControllerOnline
+	msgPowerCycled
+	msgPowerRestored
+	msgCycleStand
+	msgCycleSit
+
+	// Web dashboard strings.
+	msgUIStop
+	msgUILogLevel
+	msgUIBluetooth
+	msgUIPassword
+	msgUIToken
+	msgUIOneTimeCode
+	msgUIOK
+)
+
+// catalog holds the translations of user-facing strings keyed by
+// language. Strings may contain fmt verbs. Every language must
+// have an entry for every message.
+var catalog = map[string][]string{
+	"en": {
+		msgControllerOffline: "The desk controller has stopped responding.",
+		msgControllerOnline:  "The desk controller is responding again.",
+		msgPowerCycled:       "The desk controller was restarted (%s).",
+		msgPowerRestored:     "Power to the desk controller was restored.",
+		msgCycleStand:        "Time to stand up. The desk will rise in %s.",
+		msgCycleSit:          "Time to sit down. The desk will lower in %s.",
+		msgUIStop:            "Stop",
+		msgUILogLevel:        "Log level",
+		msgUIBluetooth:       "Bluetooth control",
+		msgUIPassword:        "Password",
+		msgUIToken:           "Control token",
+		msgUIOneTimeCode:     "One-time code",
+		msgUIOK:              "ok",
+	},
+	"de": {
+		msgControllerOffline: "Die Tischsteuerung reagiert nicht mehr.",
+		msgControllerOnline:  "Die Tischsteuerung reagiert wieder.",
+		msgPowerCycled:       "Die Tischsteuerung wurde neu gestartet (%s).",
+		msgPowerRestored:     "Die Stromversorgung der Tischsteuerung ist wiederhergestellt.",
+		msgCycleStand:        "Zeit aufzustehen. Der Tisch fährt in %s hoch.",
+		msgCycleSit:          "Zeit, sich zu setzen. Der Tisch fährt in %s herunter.",
+		msgUIStop:            "Stopp",
+		msgUILogLevel:        "Protokollstufe",
+		msgUIBluetooth:       "Bluetooth-Steuerung",
+		msgUIPassword:        "Passwort",
+		msgUIToken:           "Steuerungstoken",
+		msgUIOneTimeCode:     "Einmalcode",
+		msgUIOK:              "ok",
+	},
+	"fr": {
+		msgControllerOffline: "Le contrôleur du bureau ne répond plus.",
+		msgControllerOnline:  "Le contrôleur du bureau répond de nouveau.",
+		msgPowerCycled:       "Le contrôleur du bureau a été redémarré (%s).",
+		msgPowerRestored:     "L'alimentation du contrôleur du bureau a été rétablie.",
+		msgCycleStand:        "Il est temps de se lever. Le bureau montera dans %s.",
+		msgCycleSit:          "Il est temps de s'asseoir. Le bureau descendra dans %s.",
+		msgUIStop:            "Arrêt",
+		msgUILogLevel:        "Niveau de journalisation",
+		msgUIBluetooth:       "Commande Bluetooth",
+		msgUIPassword:        "Mot de passe",
+		msgUIToken:           "Jeton de commande",
+		msgUIOneTimeCode:     "Code à usage unique",
+		msgUIOK:              "ok",
+	},
+}
+
+// text returns the text of msg in the configured language, formatted with
+// args.
+func (m *mitm) text(msg message, args ...any) string {
+	texts, ok := catalog[m.config().Language]
+	if !ok {
+		texts = catalog["en"]
+	}
+	if len(args) == 0 {
+		return texts[msg]
+	}
+	return fmt.Sprintf(texts[msg], args...)
+}
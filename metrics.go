@@ -0,0 +1,122 @@
+// Copyright ©2025 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync/atomic"
+)
+
+// metrics holds the device's operational counters.
+type metrics struct {
+	// bounces is the number of button edges
+	// rejected as contact bounce.
+	bounces atomic.Uint64
+
+	// powerCycles is the number of times the
+	// controller has been power cycled.
+	powerCycles atomic.Uint64
+
+	// netRestarts is the number of times the
+	// network stack has been restarted by the
+	// network watchdog.
+	netRestarts atomic.Uint64
+
+	// rejected is the number of HTTP
+	// connections rejected by the allowlist.
+	rejected atomic.Uint64
+
+	// rateLimited is the number of HTTP
+	// requests refused by the rate limiter.
+	rateLimited atomic.Uint64
+
+	// tcpConns and bleConns are the number of
+	// TCP and BLE connections accepted.
+	tcpConns atomic.Uint64
+	bleConns atomic.Uint64
+
+	// forcedCloses is the number of connections
+	// closed by request.
+	forcedCloses atomic.Uint64
+
+	// handset and controller are the UART
+	// statistics for each port.
+	handset    uartStats
+	controller uartStats
+
+	// latency is the latency between injected
+	// key frames and height changes.
+	latency latency
+
+	// heatmap is the hour-of-week histogram
+	// of desk use.
+	heatmap heatmap
+}
+
+// labelled is a counter value with its Prometheus label set.
+type labelled struct {
+	labels string
+	val    uint64
+}
+
+// WriteTo writes the metrics to dst in the Prometheus text exposition format.
+func (s *metrics) WriteTo(dst io.Writer) (int64, error) {
+	var n int64
+	for _, c := range []struct {
+		name, help string
+		vals       []labelled
+	}{
+		{name: "desk_button_bounces_total", help: "Button edges rejected as contact bounce.", vals: []labelled{{val: s.bounces.Load()}}},
+		{name: "desk_power_cycles_total", help: "Controller power cycles.", vals: []labelled{{val: s.powerCycles.Load()}}},
+		{name: "desk_network_restarts_total", help: "Network stack restarts by the network watchdog.", vals: []labelled{{val: s.netRestarts.Load()}}},
+		{name: "desk_http_rejected_total", help: "HTTP connections rejected by the allowlist.", vals: []labelled{{val: s.rejected.Load()}}},
+		{name: "desk_http_rate_limited_total", help: "HTTP requests refused by the rate limiter.", vals: []labelled{{val: s.rateLimited.Load()}}},
+		{name: "desk_connections_total", help: "Client connections accepted.", vals: []labelled{
+			{labels: `{proto="tcp"}`, val: s.tcpConns.Load()},
+			{labels: `{proto="ble"}`, val: s.bleConns.Load()},
+		}},
+		{name: "desk_connections_closed_total", help: "Client connections closed by request.", vals: []labelled{{val: s.forcedCloses.Load()}}},
+		{name: "desk_uart_polls_total", help: "UART polls for data.", vals: []labelled{
+			{labels: `{port="handset"}`, val: s.handset.polls.Load()},
+			{labels: `{port="controller"}`, val: s.controller.polls.Load()},
+		}},
+		{name: "desk_uart_idle_polls_total", help: "UART polls that found no data.", vals: []labelled{
+			{labels: `{port="handset"}`, val: s.handset.idlePolls.Load()},
+			{labels: `{port="controller"}`, val: s.controller.idlePolls.Load()},
+		}},
+	} {
+		k, err := fmt.Fprintf(dst, "# HELP %[1]s %[2]s\n# TYPE %[1]s counter\n", c.name, c.help)
+		n += int64(k)
+		if err != nil {
+			return n, err
+		}
+		for _, v := range c.vals {
+			k, err := fmt.Fprintf(dst, "%s%s %d\n", c.name, v.labels, v.val)
+			n += int64(k)
+			if err != nil {
+				return n, err
+			}
+		}
+	}
+
+	qs := []float64{0.5, 0.95}
+	lat, count := s.latency.quantiles(qs...)
+	k, err := fmt.Fprint(dst, "# HELP desk_controller_latency_seconds Time from an injected key frame to the first height change.\n# TYPE desk_controller_latency_seconds summary\n")
+	n += int64(k)
+	if err != nil {
+		return n, err
+	}
+	for i, d := range lat {
+		k, err = fmt.Fprintf(dst, "desk_controller_latency_seconds{quantile=\"%g\"} %g\n", qs[i], d.Seconds())
+		n += int64(k)
+		if err != nil {
+			return n, err
+		}
+	}
+	k, err = fmt.Fprintf(dst, "desk_controller_latency_seconds_count %d\n", count)
+	n += int64(k)
+	return n, err
+}
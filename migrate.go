@@ -0,0 +1,78 @@
+// Copyright ©2025 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// The persistent state is stored as JSON carrying the version of its
+// layout. Fields may be added without changing the version, since older
+// records decode into the new layout. When a field is renamed, removed or
+// changes type, storeVersion must be incremented and a migration added to
+// storeMigrations that rewrites records of the previous version, so that
+// upgrading the firmware does not discard the stored state.
+
+// storeVersion is the version of the layout of persistent.
+const storeVersion = 1
+
+// storeMigrations holds the migrations between layout versions;
+// storeMigrations[v] rewrites the fields of a version v record into
+// version v+1.
+var storeMigrations = [storeVersion]func(fields map[string]json.RawMessage) error{
+	// Version 0 records were written before the
+	// layout was versioned and differ from version
+	// 1 only in lacking the version field.
+	0: func(map[string]json.RawMessage) error { return nil },
+}
+
+var errNewerStore = errors.New("stored state written by newer firmware")
+
+// decodeStore decodes a stored record, migrating it to the current layout.
+// Fields are decoded individually so that a field that cannot be decoded
+// is dropped without losing the others; the returned state is valid even
+// when an error is returned, unless the record is not a JSON object.
+func decodeStore(body []byte) (persistent, error) {
+	var fields map[string]json.RawMessage
+	err := json.Unmarshal(body, &fields)
+	if err != nil {
+		return persistent{}, err
+	}
+	var version int
+	if v, ok := fields["version"]; ok {
+		err = json.Unmarshal(v, &version)
+		if err != nil || version < 0 {
+			return persistent{}, fmt.Errorf("invalid store version: %s", v)
+		}
+	}
+	for ; version < storeVersion; version++ {
+		err = storeMigrations[version](fields)
+		if err != nil {
+			return persistent{}, fmt.Errorf("migrate store from version %d: %w", version, err)
+		}
+	}
+	delete(fields, "version")
+
+	var (
+		state persistent
+		errs  []error
+	)
+	if version > storeVersion {
+		errs = append(errs, fmt.Errorf("%w: version %d", errNewerStore, version))
+	}
+	for k, v := range fields {
+		field, err := json.Marshal(map[string]json.RawMessage{k: v})
+		if err == nil {
+			err = json.Unmarshal(field, &state)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("drop stored %s: %w", k, err))
+		}
+	}
+	state.Version = storeVersion
+	return state, errors.Join(errs...)
+}
@@ -0,0 +1,88 @@
+// Copyright ©2025 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+var decodeStoreTests = []struct {
+	name    string
+	body    string
+	want    persistent
+	wantErr string // Substring of the error, empty for no error.
+}{
+	{
+		name: "current",
+		body: `{"version":1,"hostname":"desk-a","kiosk":true}`,
+		want: persistent{Version: storeVersion, Hostname: "desk-a", Kiosk: true},
+	},
+	{
+		name: "unversioned",
+		body: `{"hostname":"desk-a","presets":[{"m":720,"e":-1},{},{},{}]}`,
+		want: persistent{Version: storeVersion, Hostname: "desk-a", Presets: [4]savedPosition{{Mantissa: 720, Exponent: -1}}},
+	},
+	{
+		name: "empty",
+		body: `{}`,
+		want: persistent{Version: storeVersion},
+	},
+	{
+		name:    "bad field",
+		body:    `{"version":1,"hostname":"desk-a","kiosk":"yes"}`,
+		want:    persistent{Version: storeVersion, Hostname: "desk-a"},
+		wantErr: "drop stored kiosk",
+	},
+	{
+		name:    "newer",
+		body:    `{"version":2,"hostname":"desk-a"}`,
+		want:    persistent{Version: storeVersion, Hostname: "desk-a"},
+		wantErr: errNewerStore.Error(),
+	},
+	{
+		name:    "negative version",
+		body:    `{"version":-1,"hostname":"desk-a"}`,
+		want:    persistent{},
+		wantErr: "invalid store version",
+	},
+	{
+		name:    "invalid version",
+		body:    `{"version":"one","hostname":"desk-a"}`,
+		want:    persistent{},
+		wantErr: "invalid store version",
+	},
+	{
+		name:    "not an object",
+		body:    `["desk-a"]`,
+		want:    persistent{},
+		wantErr: "cannot unmarshal",
+	},
+	{
+		name:    "truncated",
+		body:    `{"version":1,"hostname":"de`,
+		want:    persistent{},
+		wantErr: "unexpected end",
+	},
+}
+
+func TestDecodeStore(t *testing.T) {
+	for _, test := range decodeStoreTests {
+		got, err := decodeStore([]byte(test.body))
+		switch {
+		case test.wantErr == "" && err != nil:
+			t.Errorf("unexpected error for %s: %v", test.name, err)
+		case test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)):
+			t.Errorf("unexpected error for %s: got:%v want:%q", test.name, err, test.wantErr)
+		}
+		if test.name == "newer" && !errors.Is(err, errNewerStore) {
+			t.Errorf("expected errNewerStore for %s: got:%v", test.name, err)
+		}
+		if got.Version != test.want.Version || got.Hostname != test.want.Hostname || got.Kiosk != test.want.Kiosk || got.Presets != test.want.Presets {
+			t.Errorf("unexpected state for %s:\ngot: %+v\nwant:%+v", test.name, got, test.want)
+		}
+	}
+}
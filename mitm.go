@@ -8,6 +8,7 @@ import (
 	"context"
 	"log/slog"
 	"machine"
+	"net/netip"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -18,20 +19,93 @@ import (
 type mitm struct {
 	dev *cyw43439.Device
 
-	handset *machine.UART
-	button  machine.Pin
+	handset  *machine.UART
+	button   machine.Pin
+	debounce debouncer
 
 	mu         sync.Mutex
 	controller *machine.UART
+	writer     controllerWriter // Queues of frames for the controller, written only by runWriter.
 	act        machine.Pin
-	last       chan time.Time
+	line       lineConfig
+	lastAction atomic.Int64  // Time of the last button action sent to the controller in Unix nanoseconds.
+	stopping   atomic.Bool   // A stop is waiting for m.mu.
+	stops      atomic.Uint64 // Number of stops, so moves that release m.mu can detect one.
+
+	route      atomic.Int32 // route
+	routeMu    sync.Mutex
+	routeTimer *time.Timer
 
 	position         atomic.Value // position
+	heightKnown      atomic.Bool  // A height has been decoded from a controller frame.
+	lastMove         atomic.Int64 // Time of the last change in position in Unix nanoseconds.
+	lastIdle         atomic.Int64 // Time the controller last marked the end of a move in Unix nanoseconds.
+	lastKey          atomic.Int64 // Time of the last handset key press in Unix nanoseconds.
+	lastMemory       atomic.Int64 // Time of the last handset memory key press in Unix nanoseconds.
+	syncLead         atomic.Int64 // Time moves are held back for sync followers in nanoseconds, zero if none is connected.
 	bluetoothBlocked atomic.Bool
+	kiosk            atomic.Bool // Remote moves are refused; mirrors the persisted setting.
+
+	lastFrame        atomic.Int64 // Time of the last controller frame in Unix nanoseconds.
+	controllerAsleep atomic.Bool  // The controller has sent its sleep frame.
+	controllerLost   atomic.Bool  // The controller has been silent for too long.
+	powerLost        atomic.Bool  // The controller may have lost power; cleared by a height frame.
+	displayLit       atomic.Bool  // The last controller frame lit the handset display.
+
+	lastHandset   atomic.Int64 // Time of the last handset frame in Unix nanoseconds.
+	handsetAbsent atomic.Bool  // Virtual handset mode is active.
+
+	net     atomic.Pointer[netStack] // nil until the network is up.
+	offline atomic.Bool              // The network could not be joined within networkStartTimeout.
+
+	clock clock
+	relay relay
+	cycle cycle
+
+	meetingUntil atomic.Int64 // Expected end of the current meeting in Unix nanoseconds, zero if none.
+
+	lease  lease
+	raw    rawGuard
+	replay replayCache
+	limit  rateLimiter
+	conns  connTable
+
+	draining atomic.Bool // The device is draining before a restart.
+
+	sessions sessionTable
+	shares   sessionTable  // Read-only share tokens.
+	totpUsed atomic.Uint64 // Time step of the last accepted one-time code.
+
+	events  bus
+	desk    deskState
+	presets presetLearner
+	store   store
+	tasks   supervisor
 
-	log   *slog.Logger
-	sw    switchedWriter
-	level slog.LevelVar
+	diag atomic.Bool      // UARTs are in use by the self-test.
+	leds chan ledSequence // LED sequences to flash in place of the heartbeat.
+
+	bleRemind atomic.Pointer[func(alert)] // Bluetooth reminder notifier, nil until the server is up.
+	sinks     map[string]notifier         // Notification sinks by name.
+
+	cfg     atomic.Pointer[config]
+	baseCfg config     // Default configuration with the site overlay applied.
+	cfgMu   sync.Mutex // Serialises configuration changes.
+	cfgRev  uint64     // Configuration revision, guarded by cfgMu.
+	boot    string     // Random identifier of the current boot.
+	metrics metrics
+
+	// allow holds the parsed prefixes of the
+	// configured allowlist. It is nil until the
+	// configuration is set.
+	allow atomic.Pointer[[]netip.Prefix]
+
+	log     *slog.Logger
+	handler slog.Handler
+	logs    logRing
+	trace   tracer
+	level   slog.LevelVar
+	levels  [len(logComponents)]componentLevel
 }
 
 func (m *mitm) init(ctx context.Context) error {
@@ -44,11 +118,18 @@ func (m *mitm) init(ctx context.Context) error {
 	} else {
 		cfg = cyw43439.DefaultWifiConfig()
 	}
-	err := m.dev.Init(cfg)
-	if err != nil {
-		return newLedError(1, err)
-	}
-	m.log.LogAttrs(ctx, slog.LevelInfo, "cyw43439 initialised", slog.Duration("duration", time.Since(start)))
+	// The cyw43439 takes 1-2s to initialise, so bring it up while
+	// the UARTs are configured and start forwarding frames, to
+	// shorten the time after power-up during which handset key
+	// presses are not passed to the controller.
+	radio := make(chan error, 1)
+	go func() {
+		err := m.dev.Init(cfg)
+		if err == nil {
+			m.log.LogAttrs(ctx, slog.LevelInfo, "cyw43439 initialised", slog.Duration("duration", time.Since(start)))
+		}
+		radio <- err
+	}()
 
 	m.log.LogAttrs(ctx, slog.LevelInfo, "configure pins")
 	m.button.Configure(machine.PinConfig{
@@ -60,112 +141,168 @@ func (m *mitm) init(ctx context.Context) error {
 
 	m.log.LogAttrs(ctx, slog.LevelInfo, "configure uarts")
 	m.log.LogAttrs(ctx, slog.LevelInfo, "configure controller uart")
-	err = m.controller.Configure(machine.UARTConfig{
-		BaudRate: 9600,
+	err := m.controller.Configure(machine.UARTConfig{
+		BaudRate: m.line.baud,
 		TX:       machine.UART1_TX_PIN, // P11
 		RX:       machine.UART1_RX_PIN, // P12
 	})
 	if err != nil {
+		// Wait for the radio, which drives
+		// the LED the error is flashed on.
+		<-radio
 		return newLedError(2, err)
 	}
 	m.log.LogAttrs(ctx, slog.LevelInfo, "configure handset uart")
 	err = m.handset.Configure(machine.UARTConfig{
-		BaudRate: 9600,
+		BaudRate: m.line.baud,
 		TX:       machine.UART0_TX_PIN, // P1
 		RX:       machine.UART0_RX_PIN, // P2
 	})
 	if err != nil {
+		<-radio
 		return newLedError(3, err)
 	}
 
-	m.log.LogAttrs(ctx, slog.LevelInfo, "set up watchdog")
-	machine.Watchdog.Configure(machine.WatchdogConfig{
-		TimeoutMillis: 10000,
-	})
-	err = machine.Watchdog.Start()
-	if err != nil {
-		return newLedError(4, err)
-	}
+	m.log.LogAttrs(ctx, slog.LevelInfo, "start controller writer")
+	go m.runWriter(ctx)
 
 	m.log.LogAttrs(ctx, slog.LevelInfo, "read uart")
-	const poll = 10 * time.Millisecond
-	var lastP string // Read and write only in the following goroutine.
-	go m.readUART(ctx, "handset", 0xa5, 5, m.handset, poll, func(pkt []byte) {
-		machine.Watchdog.Update()
-		p, err := key(pkt[1:])
+	log := m.logFor("uart")
+	var (
+		// Read and write only in the following goroutine.
+		lastP        string
+		cycleGesture gesture
+		snooze       snoozeKey
+	)
+	go m.readUART(ctx, "handset", m.line.handset, m.handset, &m.metrics.handset, func(pkt []byte) {
+		m.handsetFrame(ctx)
+		p, err := models[m.cfg.Load().Model].keys(pkt)
 		if err != nil {
 			if err != errReset {
-				m.log.LogAttrs(ctx, slog.LevelError, "key", slog.Any("err", err), slog.Any("pkt", bytesAttr(pkt)))
+				log.LogAttrs(ctx, slog.LevelError, "key", slog.Any("err", err), slog.Any("pkt", bytesAttr(pkt)))
 				return
 			}
-			m.log.LogAttrs(ctx, slog.LevelInfo-1, "key", slog.Any("err", err), slog.Any("pkt", bytesAttr(pkt)))
+			log.LogAttrs(ctx, slog.LevelInfo-1, "key", slog.Any("err", err), slog.Any("pkt", bytesAttr(pkt)))
+		}
+		if snooze.key(p, func() bool { return m.snoozeHandset(ctx) }) {
+			log.LogAttrs(ctx, slog.LevelDebug, "drop snoozing handset frame", slog.Any("pkt", bytesAttr(pkt)))
+			return
+		}
+		if p != "_" {
+			m.lastKey.Store(time.Now().UnixNano())
 		}
 		if p != lastP {
-			m.log.LogAttrs(ctx, slog.LevelInfo-1, "key", slog.String("press", p))
+			log.LogAttrs(ctx, slog.LevelInfo-1, "key", slog.String("press", p))
+			if p != "_" {
+				m.events.publish(event{kind: keyPressed, time: time.Now(), keys: p})
+			}
 			lastP = p
 		}
-		if !m.mu.TryLock() {
+		if cycleGesture.key(p, time.Now()) {
+			go func() {
+				err := m.toggleCycle(ctx)
+				if err != nil {
+					log.LogAttrs(ctx, slog.LevelError, "toggle cycle", slog.Any("err", err))
+				}
+			}()
+		}
+		if !m.passFrame(pkt) {
+			log.LogAttrs(ctx, slog.LevelDebug, "drop handset frame", slog.Any("pkt", bytesAttr(pkt)))
 			return
 		}
-		defer m.mu.Unlock()
-		_, err = m.controller.Write(pkt)
-		time.Sleep(poll)
-		if err != nil {
-			m.log.LogAttrs(ctx, slog.LevelError, "write handset uart", slog.Any("err", err))
+		if p != "_" {
+			m.alive()
 		}
 	})
-	go m.readUART(ctx, "controller", 0x5a, 5, m.controller, poll, func(pkt []byte) {
-		machine.Watchdog.Update()
-		p, err := height(pkt[1:])
+	go m.readUART(ctx, "controller", m.line.controller, m.controller, &m.metrics.controller, func(pkt []byte) {
+		m.controllerFrame(pkt)
+		// Record the end of a move after any
+		// change in height carried by the frame.
+		defer m.idleFrame(pkt)
+		if m.controllerAsleep.Load() {
+			log.LogAttrs(ctx, slog.LevelInfo, "controller sleeping", slog.Any("pkt", bytesAttr(pkt)))
+			m.displayFrame(ctx, false)
+			return
+		}
+		p, err := models[m.cfg.Load().Model].height(pkt)
+		if err == nil || err == errNoHeight {
+			m.displayFrame(ctx, err == nil)
+			m.controllerRecovered()
+		}
+		if err == errReset {
+			log.LogAttrs(ctx, slog.LevelInfo-1, "height", slog.Any("err", err), slog.Any("pkt", bytesAttr(pkt)))
+			if m.powerLost.Swap(false) {
+				m.events.publish(event{kind: powerOn, time: time.Now()})
+			}
+			return
+		}
 		if err != nil && err != errNoHeight {
-			m.log.LogAttrs(ctx, slog.LevelError, "height", slog.Any("err", err), slog.Any("pkt", bytesAttr(pkt)))
+			log.LogAttrs(ctx, slog.LevelError, "height", slog.Any("err", err), slog.Any("pkt", bytesAttr(pkt)))
+			if code, ok := err.(contErr); ok {
+				m.events.publish(event{kind: fault, time: time.Now(), code: code})
+			}
 			return
 		}
 		if err != errNoHeight {
-			m.log.LogAttrs(ctx, slog.LevelInfo-1, "height", slog.Any("position", p), slog.Any("pkt", bytesAttr(pkt)))
-			m.position.Store(p)
+			log.LogAttrs(ctx, slog.LevelInfo-1, "height", slog.Any("position", p), slog.Any("pkt", bytesAttr(pkt)))
+			m.metrics.latency.frame(p, time.Now())
+			m.setPosition(p)
+			m.powerLost.Store(false)
 		}
 	})
 
+	m.log.LogAttrs(ctx, slog.LevelInfo, "wait for cyw43439")
+	err = <-radio
+	if err != nil {
+		return newLedError(1, err)
+	}
+
+	m.log.LogAttrs(ctx, slog.LevelInfo, "set up watchdog")
+	timeout := m.config().Watchdog.Timeout
+	machine.Watchdog.Configure(machine.WatchdogConfig{
+		TimeoutMillis: uint32(time.Duration(timeout) / time.Millisecond),
+	})
+	err = machine.Watchdog.Start()
+	if err != nil {
+		return newLedError(4, err)
+	}
+	go m.superviseWatchdog(ctx, timeout)
+
 	return nil
 }
 
 const keepAliveInterval = 15 * time.Minute
 
+// keepAlive sends a keep-alive button action to the controller whenever
+// keepAliveInterval has elapsed since the last button action from any
+// source.
 func (m *mitm) keepAlive(ctx context.Context) {
-	pkt := []byte{0xa5, 0x00, 0x60, 0x9f, 0xff} // Packet is an Up+Down button press.
-	last := time.Now()
+	log := m.logFor("uart")
+	m.alive()
 	for {
-		// TODO: Replace this with the commented case below and remove
-		// the timer when tinygo supports go1.23 time.Timer behaviour.
-		timer := time.NewTimer(last.Add(keepAliveInterval).Sub(time.Now()))
+		// TODO: Replace this with time.After when tinygo
+		// supports go1.23 time.Timer behaviour.
+		due := time.Unix(0, m.lastAction.Load()).Add(keepAliveInterval)
+		timer := time.NewTimer(time.Until(due))
 
 		select {
-		// case last = <-time.After(last.Add(keepAliveInterval).Sub(time.Now())):
-		case last = <-timer.C:
-			m.log.LogAttrs(ctx, slog.LevelInfo, "send keep-alive")
-			func() {
-				m.mu.Lock()
-				defer m.mu.Unlock()
-
-				m.log.LogAttrs(ctx, slog.LevelDebug, "write keep-alive pkt to controller", slog.Any("pkt", bytesAttr(pkt)))
-				m.act.High()
-				time.Sleep(time.Millisecond)
-				for range 5 {
-					_, err := m.controller.Write(pkt)
-					time.Sleep(10 * time.Millisecond)
-					if err != nil {
-						m.log.Error("write to controller", slog.Any("err", err))
-						return
-					}
-				}
-				m.act.Low()
-			}()
-		case last = <-m.last:
-			if !timer.Stop() {
-				<-timer.C
+		case <-timer.C:
+			if next := time.Unix(0, m.lastAction.Load()).Add(keepAliveInterval); next.After(due) {
+				log.LogAttrs(ctx, slog.LevelDebug, "delay keep-alive", slog.Any("until", next))
+				continue
+			}
+			if !m.idleLock(ctx) {
+				return
+			}
+			log.LogAttrs(ctx, slog.LevelInfo, "send keep-alive")
+			// Count the attempt as an action so that a failed
+			// write is retried after a full interval.
+			m.alive()
+			err := m.command(ctx, log, sourceDevice, actionKeepAlive)
+			m.mu.Unlock()
+			if err != nil {
+				log.Error("write to controller", slog.Any("err", err))
 			}
-			m.log.LogAttrs(ctx, slog.LevelDebug, "delay keep-alive", slog.Any("until", last.Add(keepAliveInterval)))
 		case <-ctx.Done():
 			if !timer.Stop() {
 				<-timer.C
@@ -175,21 +312,86 @@ func (m *mitm) keepAlive(ctx context.Context) {
 	}
 }
 
+// idleLock waits until the desk is not moving and acquires m.mu. The
+// keep-alive key frames stop the desk if sent during a move, so they must
+// only be sent while it is idle. It returns false without holding m.mu if
+// ctx is cancelled while waiting.
+func (m *mitm) idleLock(ctx context.Context) bool {
+	queued := false
+	for {
+		if !m.moving() {
+			m.mu.Lock()
+			if !m.moving() {
+				return true
+			}
+			m.mu.Unlock()
+		}
+		if !queued {
+			m.logFor("uart").LogAttrs(ctx, slog.LevelInfo, "queue keep-alive until idle")
+			queued = true
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(motionPoll):
+		}
+	}
+}
+
+// passButton passes a debounced change of the button state through to
+// the controller's act line. Changes are passed through in virtual
+// handset mode, since the handset wakes the controller with the button
+// line before it sends any frames.
+func (m *mitm) passButton(high bool) {
+	if !m.debounce.edge(high, time.Now()) {
+		return
+	}
+	if route(m.route.Load()) != routePass {
+		return
+	}
+	if high {
+		m.alive()
+	}
+	m.act.Set(high)
+}
+
+// alive records that a button action has been sent to the controller,
+// deferring the next keep-alive. It must be called by every path that
+// sends a button action.
 func (m *mitm) alive() {
+	m.lastAction.Store(time.Now().UnixNano())
+}
+
+// flashOnce queues seq to be flashed once in place of the next heartbeat.
+// If a sequence is already queued, seq is dropped. It returns whether seq
+// was queued.
+func (m *mitm) flashOnce(seq ledSequence) bool {
 	select {
-	case m.last <- time.Now():
+	case m.leds <- seq:
+		return true
 	default:
+		return false
 	}
 }
 
-func (m *mitm) readUART(ctx context.Context, name string, start byte, len int, uart *machine.UART, wait time.Duration, do func([]byte)) {
+func (m *mitm) readUART(ctx context.Context, name string, f framing, uart *machine.UART, stats *uartStats, do func([]byte)) {
+	log := m.logFor("uart")
+	const (
+		minPoll = time.Millisecond
+		maxPoll = 50 * time.Millisecond
+	)
 	r := uartReader{
-		src:   uart,
-		wait:  wait,
-		start: start,
-		len:   len,
+		src:     uart,
+		wait:    minPoll,
+		minWait: minPoll,
+		maxWait: maxPoll,
+		stats:   stats,
+		beat:    m.tasks.register(name, taskStall).beat,
+		pause:   &m.diag,
+		start:   f.start,
+		len:     f.len,
 	}
-	defer m.log.LogAttrs(ctx, slog.LevelInfo, "exit read uart")
+	defer log.LogAttrs(ctx, slog.LevelInfo, "exit read uart")
 	for {
 		select {
 		case <-ctx.Done():
@@ -201,10 +403,10 @@ func (m *mitm) readUART(ctx context.Context, name string, start byte, len int, u
 			return
 		}
 		if err != nil {
-			m.log.LogAttrs(ctx, slog.LevelError, "read", slog.String("name", name), slog.Any("pkt", bytesAttr(pkt)), slog.Any("err", err))
+			log.LogAttrs(ctx, slog.LevelError, "read", slog.String("name", name), slog.Any("pkt", bytesAttr(pkt)), slog.Any("err", err))
 			continue
 		}
-		m.log.LogAttrs(ctx, slog.LevelDebug, "read", slog.String("name", name), slog.Any("pkt", bytesAttr(pkt)))
+		m.traceFrame(ctx, name, pkt)
 
 		do(pkt)
 	}
@@ -0,0 +1,144 @@
+// Copyright ©2025 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// action is a command that may be sent to the controller.
+type action int
+
+const (
+	actionPreset1 action = iota + 1
+	actionPreset2
+	actionPreset3
+	actionPreset4
+	actionKeepAlive
+	actionUp     // Move up for the duration of the command.
+	actionDown   // Move down for the duration of the command.
+	actionMemory // Press the memory key to program a preset.
+	actionStop   // Interrupt a move without starting another.
+
+	// actionHandshake is the handset start-up chirp.
+	// The act line must be held high for handshakeLead
+	// before it is sent.
+	actionHandshake
+)
+
+// presetAction returns the action that moves the desk to the memory
+// preset n.
+func presetAction(n int) (action, error) {
+	if n < 1 || 4 < n {
+		return 0, fmt.Errorf("invalid height: %d", n)
+	}
+	return actionPreset1 + action(n-1), nil
+}
+
+var errNoCommand = errors.New("command not supported by controller model")
+
+// step is a frame sent to the controller as part of a command sequence.
+type step struct {
+	frame  []byte
+	repeat int           // Number of times the frame is sent.
+	delay  time.Duration // Time to wait after the last repeat.
+}
+
+// model describes the quirks of a controller model.
+type model struct {
+	line     lineConfig
+	commands map[action][]step
+
+	// keys returns the set of keys marked as
+	// pressed in the handset frame pkt, which
+	// is delimited by line.handset. A frame
+	// with no keys pressed is reported as "_".
+	keys func(pkt []byte) (string, error)
+
+	// height returns the position reported in
+	// the controller frame pkt, which is
+	// delimited by line.controller.
+	height func(pkt []byte) (position, error)
+
+	// idle reports whether the controller frame
+	// pkt marks the end of a move. If nil, the
+	// end of a move is detected by the reported
+	// height not changing for motionSettle.
+	idle func(pkt []byte) bool
+}
+
+// models is the table of supported controller models.
+var models = map[string]*model{
+	"aoke-wp-cb01-901": {
+		line:   aokeLine,
+		keys:   aokeKeys,
+		height: aokeHeight,
+		commands: map[action][]step{
+			actionPreset1:   {{frame: keyFrame(key1), repeat: 5}},
+			actionPreset2:   {{frame: keyFrame(key2), repeat: 5}},
+			actionPreset3:   {{frame: keyFrame(key3), repeat: 5}},
+			actionPreset4:   {{frame: keyFrame(key4), repeat: 5}},
+			actionKeepAlive: {{frame: keyFrame(keyUp | keyDown), repeat: 5}},
+			actionUp:        {{frame: keyFrame(keyUp), repeat: 5}},
+			actionDown:      {{frame: keyFrame(keyDown), repeat: 5}},
+			actionMemory:    {{frame: keyFrame(keyM), repeat: 5, delay: 500 * time.Millisecond}},
+			// The controller abandons a preset move on any
+			// key press, and does not move when the up and
+			// down keys are pressed together.
+			actionStop: {{frame: keyFrame(keyUp | keyDown), repeat: 5}},
+			// The handset chirps empty key frames
+			// after power-up until the controller
+			// responds.
+			actionHandshake: {{frame: keyFrame(0), repeat: 10}},
+		},
+		// The controller keeps sending the height
+		// after a move until the display times out.
+		idle: aokeIdle,
+	},
+}
+
+// command sends the command sequence for a in the configured controller
+// model to the controller on behalf of src. The sequence is abandoned with
+// errStopped if a stop is requested, or with errHandsetKey if a handset key
+// is pressed. The caller must hold m.mu.
+func (m *mitm) command(ctx context.Context, log *slog.Logger, src string, a action) error {
+	if !m.allowed(src, permMove) {
+		return errPermission
+	}
+	seq := models[m.config().Model].commands[a]
+	if seq == nil {
+		return errNoCommand
+	}
+	m.act.High()
+	defer m.actIdle()
+	time.Sleep(time.Millisecond)
+	if actionPreset1 <= a && a <= actionPreset4 {
+		m.metrics.latency.inject(m.position.Load().(position), time.Now())
+		m.presetPressed(int(a-actionPreset1) + 1)
+	}
+	for _, s := range seq {
+		log.LogAttrs(ctx, slog.LevelDebug, "write pkt to controller", slog.Any("pkt", bytesAttr(s.frame)), slog.Int("repeat", s.repeat))
+	}
+	keyed := m.lastKey.Load()
+	prio, abort := priorityCommand, func() bool {
+		return m.stopping.Load() || m.lastKey.Load() != keyed
+	}
+	if a == actionStop {
+		prio, abort = priorityStop, nil
+	}
+	err := m.writeController(ctx, prio, seq, abort)
+	if err == errStopped && m.lastKey.Load() != keyed {
+		err = errHandsetKey
+	}
+	if err != nil {
+		return err
+	}
+	m.alive()
+	return nil
+}
@@ -0,0 +1,95 @@
+// Copyright ©2025 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	// morseUnit is the duration of a Morse code dot.
+	morseUnit = 150 * time.Millisecond
+
+	// maxSay is the longest text that may be
+	// flashed on the LED.
+	maxSay = 32
+)
+
+// morse is the Morse code for each supported character.
+var morse = map[rune]string{
+	'a': ".-", 'b': "-...", 'c': "-.-.", 'd': "-..", 'e': ".", 'f': "..-.",
+	'g': "--.", 'h': "....", 'i': "..", 'j': ".---", 'k': "-.-", 'l': ".-..",
+	'm': "--", 'n': "-.", 'o': "---", 'p': ".--.", 'q': "--.-", 'r': ".-.",
+	's': "...", 't': "-", 'u': "..-", 'v': "...-", 'w': ".--", 'x': "-..-",
+	'y': "-.--", 'z': "--..",
+	'0': "-----", '1': ".----", '2': "..---", '3': "...--", '4': "....-",
+	'5': ".....", '6': "-....", '7': "--...", '8': "---..", '9': "----.",
+	'.': ".-.-.-", '-': "-....-", '/': "-..-.",
+}
+
+// morseSequence returns an ledSequence that flashes text in Morse code
+// followed by a long pause. Letters are case-insensitive.
+func morseSequence(text string) (ledSequence, error) {
+	text = strings.ToLower(strings.TrimSpace(text))
+	if text == "" || len(text) > maxSay {
+		return nil, fmt.Errorf("text must be 1 to %d characters", maxSay)
+	}
+	var seq ledSequence
+	for _, c := range text {
+		if c == ' ' {
+			// Extend the letter gap to a word gap.
+			if len(seq) != 0 {
+				seq[len(seq)-1].duration = 7 * morseUnit
+			}
+			continue
+		}
+		code, ok := morse[c]
+		if !ok {
+			return nil, fmt.Errorf("no morse code for %q", c)
+		}
+		for _, s := range code {
+			on := morseUnit
+			if s == '-' {
+				on = 3 * morseUnit
+			}
+			seq = append(seq,
+				ledState{on: true, duration: on},
+				ledState{on: false, duration: morseUnit},
+			)
+		}
+		seq[len(seq)-1].duration = 3 * morseUnit
+	}
+	seq[len(seq)-1].duration = 2 * time.Second
+	return seq, nil
+}
+
+// countSequence returns an ledSequence that flashes each digit in text as
+// a count of short flashes, with zero shown as a single long flash,
+// followed by a long pause.
+func countSequence(text string) (ledSequence, error) {
+	if text == "" || len(text) > maxSay {
+		return nil, fmt.Errorf("text must be 1 to %d digits", maxSay)
+	}
+	var seq ledSequence
+	for _, c := range text {
+		if c < '0' || '9' < c {
+			return nil, fmt.Errorf("not a digit: %q", c)
+		}
+		if c == '0' {
+			seq = append(seq, ledState{on: true, duration: 900 * time.Millisecond}, ledState{})
+		}
+		for range c - '0' {
+			seq = append(seq,
+				ledState{on: true, duration: 300 * time.Millisecond},
+				ledState{on: false, duration: 250 * time.Millisecond},
+			)
+		}
+		seq[len(seq)-1].duration = time.Second
+	}
+	seq[len(seq)-1].duration = 2 * time.Second
+	return seq, nil
+}
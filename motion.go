@@ -0,0 +1,92 @@
+// Copyright ©2025 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+const (
+	// motionSettle is the time without a change in
+	// reported height or a handset key press after
+	// which the desk is considered to be idle.
+	motionSettle = time.Second
+
+	// motionPoll is the interval at which actions
+	// waiting for the desk to become idle recheck
+	// the motion state.
+	motionPoll = 250 * time.Millisecond
+)
+
+// setPosition stores the position reported by the controller, recording
+// the time and direction if it has changed and the start of a movement if
+// the desk was idle.
+func (m *mitm) setPosition(p position) {
+	known := m.heightKnown.Swap(true)
+	if old, _ := m.position.Swap(p).(position); old != p {
+		now := time.Now()
+		if known {
+			m.events.publish(event{kind: heightChanged, time: now, pos: p, prev: old})
+		}
+		last := m.lastMove.Swap(now.UnixNano())
+		if (now.Sub(time.Unix(0, last)) >= motionSettle || m.lastIdle.Load() >= last) && known {
+			m.moveStarted()
+		}
+	}
+}
+
+// idleFrame records the end of a move if the configured controller model
+// marks it with the frame pkt.
+func (m *mitm) idleFrame(pkt []byte) {
+	idle := models[m.cfg.Load().Model].idle
+	if idle != nil && idle(pkt) {
+		m.lastIdle.Store(time.Now().UnixNano())
+	}
+}
+
+// moving returns whether the desk is moving or is about to move; the
+// reported height has changed recently without the controller having
+// marked the end of the move, a handset key has been pressed recently or
+// the handset button is held.
+func (m *mitm) moving() bool {
+	now := time.Now()
+	last := m.lastMove.Load()
+	if now.Sub(time.Unix(0, last)) < motionSettle && m.lastIdle.Load() < last {
+		return true
+	}
+	if now.Sub(time.Unix(0, m.lastKey.Load())) < motionSettle {
+		return true
+	}
+	return m.handsetBusy()
+}
+
+// rest waits until the configured rest period has elapsed since the
+// reported height last changed, so that moves are not started while the
+// control box is still switching after the last one. It returns errStopped
+// if a stop is requested while waiting. The caller must hold m.mu, so
+// further moves are queued behind it.
+func (m *mitm) rest(ctx context.Context, log *slog.Logger) error {
+	logged := false
+	for {
+		wait := time.Duration(m.cfg.Load().Rest) - time.Since(time.Unix(0, m.lastMove.Load()))
+		if wait <= 0 {
+			return nil
+		}
+		if !logged {
+			log.LogAttrs(ctx, slog.LevelInfo, "wait for rest period", slog.Duration("wait", wait))
+			logged = true
+		}
+		if m.stopping.Load() {
+			return errStopped
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(min(wait, motionPoll)):
+		}
+	}
+}
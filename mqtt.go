@@ -0,0 +1,372 @@
+// Copyright ©2025 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build http || !bluetooth
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/soypat/natiu-mqtt"
+	"github.com/soypat/seqs/stacks"
+)
+
+const (
+	mqttKeepAlive = 60 * time.Second
+	mqttRetry     = 10 * time.Second
+
+	// mqttMaxCommand is the maximum length
+	// of a command or API request payload.
+	mqttMaxCommand = 512
+
+	// mqttMaxSnapshot is the maximum length
+	// of a published log snapshot.
+	mqttMaxSnapshot = 768
+)
+
+// mqttClient is the device's connection to an MQTT broker.
+type mqttClient struct {
+	client atomic.Pointer[mqtt.Client] // nil when not connected.
+	topic  atomic.Pointer[string]      // Device topic prefix of the current connection.
+	group  atomic.Pointer[string]      // Group topic prefix of the current connection, empty if none.
+	busy   atomic.Bool                 // An API request is being served.
+}
+
+// mqttPrefix returns the device and group topic prefixes for the device.
+// If the device is in a group, the group prefix is the group name appended
+// to the configured topic, and the device prefix is the device identifier
+// appended to the group prefix, so that the state of each device in the
+// group is published separately. Otherwise the device prefix is the
+// configured topic and the group prefix is empty.
+func mqttPrefix(cfg config) (device, group string) {
+	if cfg.Group == "" {
+		return cfg.MQTT.Topic, ""
+	}
+	group = cfg.MQTT.Topic + "/" + cfg.Group
+	return group + "/" + deviceID(), group
+}
+
+var errMQTTOffline = errors.New("mqtt not connected")
+
+// publish publishes payload to the topic under the device topic prefix.
+func (c *mqttClient) publish(topic string, payload []byte, retain bool) error {
+	return c.publishTo(c.topic.Load(), topic, payload, retain)
+}
+
+// publishGroup publishes payload to the topic under the group topic
+// prefix.
+func (c *mqttClient) publishGroup(topic string, payload []byte, retain bool) error {
+	return c.publishTo(c.group.Load(), topic, payload, retain)
+}
+
+func (c *mqttClient) publishTo(prefix *string, topic string, payload []byte, retain bool) error {
+	client := c.client.Load()
+	if client == nil {
+		return errMQTTOffline
+	}
+	if *prefix == "" {
+		return errors.New("not in a group")
+	}
+	flags, err := mqtt.NewPublishFlags(mqtt.QoS0, false, retain)
+	if err != nil {
+		return err
+	}
+	return client.PublishPayload(flags, mqtt.VariablesPublish{
+		TopicName: []byte(*prefix + "/" + topic),
+	}, payload)
+}
+
+// runMQTT maintains a connection to the configured MQTT broker until ctx
+// is cancelled. The broker is given a retained will that marks the device
+// as offline on the availability topic. If the API is enabled, requests
+// received on the request topic are served with api.
+func (m *mitm) runMQTT(ctx context.Context, n *netStack, api http.Handler, commands chan<- command) {
+	log := m.logFor("mqtt")
+	const bufLen = 1024
+	conn, err := stacks.NewTCPConn(n.stack, stacks.TCPConnConfig{
+		TxBufSize: bufLen,
+		RxBufSize: bufLen,
+	})
+	if err != nil {
+		log.LogAttrs(ctx, slog.LevelError, "mqtt conn", slog.Any("err", err))
+		return
+	}
+	var payload [mqttMaxCommand]byte
+	client := mqtt.NewClient(mqtt.ClientConfig{
+		Decoder: mqtt.DecoderNoAlloc{UserBuffer: make([]byte, bufLen)},
+		OnPub: func(_ mqtt.Header, vp mqtt.VariablesPublish, r io.Reader) error {
+			k, err := io.ReadFull(r, payload[:])
+			switch err {
+			case nil:
+				_, err = io.Copy(io.Discard, r)
+				if err != nil {
+					return err
+				}
+				log.LogAttrs(ctx, slog.LevelWarn, "mqtt command too long", slog.String("topic", string(vp.TopicName)))
+				return nil
+			case io.EOF, io.ErrUnexpectedEOF:
+			default:
+				return err
+			}
+			if string(vp.TopicName) == *n.mqtt.topic.Load()+"/request" {
+				m.mqttRequest(ctx, n, api, conn.RemoteAddr().String(), payload[:k])
+				return nil
+			}
+			m.mqttCommand(ctx, n, commands, string(vp.TopicName), payload[:k])
+			return nil
+		},
+	})
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+		cfg := m.config()
+		if cfg.MQTT.Broker == "" {
+			time.Sleep(mqttRetry)
+			continue
+		}
+		err := m.mqttSession(ctx, n, conn, client, cfg)
+		n.mqtt.client.Store(nil)
+		hangUp(conn)
+		log.LogAttrs(ctx, slog.LevelWarn, "mqtt disconnected", slog.String("broker", cfg.MQTT.Broker), slog.Any("err", err))
+		time.Sleep(mqttRetry)
+	}
+}
+
+// mqttSession connects client to the broker in cfg over conn and handles
+// traffic until the connection fails or the broker or group configuration
+// changes.
+func (m *mitm) mqttSession(ctx context.Context, n *netStack, conn *stacks.TCPConn, client *mqtt.Client, cfg config) error {
+	log := m.logFor("mqtt")
+	heights, err := m.events.subscribe(heightChanged | powerOn)
+	if err != nil {
+		return err
+	}
+	defer m.events.unsubscribe(heights)
+	err = n.dial(ctx, conn, cfg.MQTT.Broker)
+	if err != nil {
+		return err
+	}
+	topic, group := mqttPrefix(cfg)
+	availability := topic + "/availability"
+	vc := mqtt.VariablesConnect{
+		ClientID:     []byte("desk-" + m.logs.session[:8]),
+		Protocol:     []byte("MQTT"),
+		KeepAlive:    uint16(mqttKeepAlive / time.Second),
+		CleanSession: true,
+		WillTopic:    []byte(availability),
+		WillMessage:  []byte("offline"),
+		WillRetain:   true,
+	}
+	if cfg.MQTT.Username != "" {
+		vc.Username = []byte(cfg.MQTT.Username)
+		vc.Password = []byte(cfg.MQTT.Password)
+	}
+	conn.SetDeadline(time.Now().Add(dialTimeout))
+	connCtx, cancel := context.WithTimeout(ctx, dialTimeout)
+	err = client.Connect(connCtx, conn, &vc)
+	cancel()
+	if err != nil {
+		return err
+	}
+	defer client.Disconnect(errors.New("session ended"))
+	n.mqtt.topic.Store(&topic)
+	n.mqtt.group.Store(&group)
+	n.mqtt.client.Store(client)
+	log.LogAttrs(ctx, slog.LevelInfo, "mqtt connected", slog.String("broker", cfg.MQTT.Broker))
+
+	err = n.mqtt.publish("availability", []byte(m.availability()), true)
+	if err != nil {
+		return err
+	}
+	if cfg.Group != "" {
+		err = m.announce(n)
+		if err != nil {
+			return err
+		}
+	}
+	conn.SetDeadline(time.Now().Add(dialTimeout))
+	subCtx, cancel := context.WithTimeout(ctx, dialTimeout)
+	filters := []mqtt.SubscribeRequest{
+		{TopicFilter: []byte(topic + "/cmd/+"), QoS: mqtt.QoS0},
+	}
+	if cfg.MQTT.API {
+		filters = append(filters, mqtt.SubscribeRequest{TopicFilter: []byte(topic + "/request"), QoS: mqtt.QoS0})
+	}
+	if group != "" {
+		filters = append(filters, mqtt.SubscribeRequest{TopicFilter: []byte(group + "/cmd/+"), QoS: mqtt.QoS0})
+	}
+	err = client.Subscribe(subCtx, mqtt.VariablesSubscribe{
+		PacketIdentifier: 1,
+		TopicFilters:     filters,
+	})
+	cancel()
+	if err != nil {
+		return err
+	}
+	pending := true // The settled height has not been published.
+	for client.IsConnected() {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		pending = heights.drain() || pending
+		if pending && m.heightKnown.Load() && !m.moving() {
+			err = m.publishHeight(n, m.position.Load().(position))
+			if err != nil {
+				return err
+			}
+			pending = false
+		}
+		if now := m.config(); now.MQTT != cfg.MQTT || now.Group != cfg.Group {
+			return errors.New("configuration changed")
+		}
+		if time.Since(client.LastTx()) > mqttKeepAlive/2 {
+			err = client.StartPing()
+			if err != nil {
+				return err
+			}
+		}
+		conn.SetDeadline(time.Now().Add(time.Second))
+		err = client.HandleNext()
+		if err != nil && !client.IsConnected() {
+			return err
+		}
+	}
+	return client.Err()
+}
+
+// publishHeight publishes the settled height p to the retained height
+// topic, and to the retained position topic as a percentage of the learned
+// range of the desk if it is known.
+func (m *mitm) publishHeight(n *netStack, p position) error {
+	err := n.mqtt.publish("height", []byte(p.String()), true)
+	if err != nil {
+		return err
+	}
+	pct, ok := m.percent(p)
+	if !ok {
+		return nil
+	}
+	return n.mqtt.publish("position", strconv.AppendFloat(nil, pct, 'f', -1, 64), true)
+}
+
+// mqttCommand handles a message received on a device or group MQTT
+// command topic. The log_at command takes a payload in the form of the /api/v1/log_at HTTP
+// query, the log_snapshot command publishes the most recent log records
+// to the log topic, and the set_position command moves the desk to the
+// percentage of its learned range in the payload.
+func (m *mitm) mqttCommand(ctx context.Context, n *netStack, commands chan<- command, topic string, payload []byte) {
+	log := m.logFor("mqtt")
+	cmd, ok := strings.CutPrefix(topic, *n.mqtt.topic.Load()+"/cmd/")
+	if !ok {
+		group := *n.mqtt.group.Load()
+		if group == "" {
+			return
+		}
+		cmd, ok = strings.CutPrefix(topic, group+"/cmd/")
+		if !ok {
+			return
+		}
+	}
+	log.LogAttrs(ctx, slog.LevelInfo, "mqtt command", slog.String("cmd", cmd))
+	var err error
+	switch cmd {
+	case "log_at":
+		if !m.allowed(sourceMQTT, permConfig) {
+			err = errPermission
+			break
+		}
+		var q url.Values
+		q, err = url.ParseQuery(string(payload))
+		if err != nil {
+			break
+		}
+		err = m.setLogLevel(q.Get("component"), q.Get("level"))
+	case "log_snapshot":
+		if !m.allowed(sourceMQTT, permRead) {
+			err = errPermission
+			break
+		}
+		err = n.mqtt.publish("log", m.logs.snapshot(nil, mqttMaxSnapshot), false)
+	case "set_position":
+		if !m.allowed(sourceMQTT, permMove) {
+			err = errPermission
+			break
+		}
+		var pct float64
+		pct, err = strconv.ParseFloat(strings.TrimSpace(string(payload)), 64)
+		if err != nil {
+			break
+		}
+		_, err = m.atPercent(pct)
+		if err != nil {
+			break
+		}
+		// Moves take seconds, so must not hold
+		// up the handling of MQTT messages.
+		go m.mqttMove(ctx, log, commands, pct)
+	default:
+		err = fmt.Errorf("unknown command: %q", cmd)
+	}
+	if err != nil {
+		log.LogAttrs(ctx, slog.LevelError, "mqtt command", slog.String("cmd", cmd), slog.Any("err", err))
+	}
+}
+
+// mqttMove moves the desk to pct percent of its learned range on behalf
+// of an MQTT client.
+func (m *mitm) mqttMove(ctx context.Context, log *slog.Logger, commands chan<- command, pct float64) {
+	_, err := submit(ctx, commands, command{holder: sourceMQTT, src: sourceMQTT, log: log, op: opPercent, value: pct})
+	if refused(err) {
+		log.LogAttrs(ctx, slog.LevelWarn, "mqtt move", slog.Any("err", err))
+		return
+	}
+	if err != nil {
+		log.LogAttrs(ctx, slog.LevelError, "mqtt move", slog.Any("err", err))
+	}
+}
+
+// announcement is the message published by a device to announce its
+// membership of a group.
+type announcement struct {
+	ID    string `json:"id"`
+	Group string `json:"group"`
+	Addr  string `json:"addr"`
+}
+
+// announce publishes the device's group membership to the group's shared
+// announce topic.
+func (m *mitm) announce(n *netStack) error {
+	msg, err := json.Marshal(announcement{
+		ID:    deviceID(),
+		Group: m.config().Group,
+		Addr:  n.stack.Addr().String(),
+	})
+	if err != nil {
+		return err
+	}
+	return n.mqtt.publishGroup("announce", msg, false)
+}
+
+// availability returns the MQTT availability state of the device.
+func (m *mitm) availability() string {
+	if m.controllerLost.Load() {
+		return "offline"
+	}
+	return "online"
+}
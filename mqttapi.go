@@ -0,0 +1,218 @@
+// Copyright ©2025 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build http || !bluetooth
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+// The HTTP API may also be served over the MQTT connection so that clients
+// can control the device through the broker from outside its network,
+// without a port being forwarded to the device. A request is published to
+// the request topic as a JSON document holding a correlation ID chosen by
+// the client, and the method and path of the HTTP request with optional
+// headers and body. The request is authenticated and rate limited as an
+// HTTP request from the broker's address would be, and served by the HTTP
+// API handlers with the permissions of the MQTT API source. The response
+// is published to the response topic with the correlation ID of the
+// request.
+
+const (
+	// mqttMaxResponse is the maximum length
+	// of a published API response.
+	mqttMaxResponse = 768
+
+	// mqttRequestTimeout is the longest time
+	// an API request may be served for.
+	mqttRequestTimeout = time.Minute
+)
+
+// mqttStreams are the paths of the streaming endpoints, which cannot be
+// served over MQTT.
+var mqttStreams = []string{"/api/v1/events", "/api/v1/log", "/api/v1/ws/height"}
+
+// mqttHeaders are the response headers included in a published response.
+var mqttHeaders = []string{"ETag", "Retry-After"}
+
+var errResponseTooLong = errors.New("response too long")
+
+// apiRequest is an HTTP API request received over MQTT.
+type apiRequest struct {
+	ID     string            `json:"id"`
+	Method string            `json:"method,omitempty"` // GET if empty.
+	Path   string            `json:"path"`
+	Header map[string]string `json:"header,omitempty"`
+
+	// Body is the request body. A JSON string
+	// is sent as its unquoted text and any
+	// other JSON value is sent as is.
+	Body json.RawMessage `json:"body,omitempty"`
+}
+
+// apiResponse is the response to an apiRequest published over MQTT.
+type apiResponse struct {
+	ID     string            `json:"id"`
+	Status int               `json:"status"`
+	Header map[string]string `json:"header,omitempty"`
+
+	// Body is the response body, held as is
+	// if it is JSON and as a JSON string
+	// otherwise.
+	Body json.RawMessage `json:"body,omitempty"`
+}
+
+// mqttRequest serves the API request in payload relayed by the broker at
+// the address remote with api and publishes the response. Requests are
+// served one at a time; a request received while another is being served
+// is refused with a service unavailable status.
+func (m *mitm) mqttRequest(ctx context.Context, n *netStack, api http.Handler, remote string, payload []byte) {
+	log := m.logFor("mqtt")
+	var req apiRequest
+	err := json.Unmarshal(payload, &req)
+	if err != nil {
+		m.mqttRespond(ctx, n, apiResponse{Status: http.StatusBadRequest, Body: textBody(err.Error())})
+		return
+	}
+	log.LogAttrs(ctx, slog.LevelInfo, "mqtt request", slog.String("id", req.ID), slog.String("method", req.Method), slog.String("path", req.Path))
+	if !n.mqtt.busy.CompareAndSwap(false, true) {
+		m.mqttRespond(ctx, n, apiResponse{ID: req.ID, Status: http.StatusServiceUnavailable, Body: textBody("request in progress")})
+		return
+	}
+	// Requests may move the desk, which takes
+	// seconds, so must not hold up the handling
+	// of MQTT messages.
+	go func() {
+		defer n.mqtt.busy.Store(false)
+		m.mqttRespond(ctx, n, m.serveAPI(ctx, api, remote, req))
+	}()
+}
+
+// serveAPI serves req relayed by the broker at the address remote with api
+// on behalf of an MQTT client. Requests are refused if the broker is not
+// in the allowlist.
+func (m *mitm) serveAPI(ctx context.Context, api http.Handler, remote string, req apiRequest) apiResponse {
+	addr, err := netip.ParseAddrPort(remote)
+	if err != nil || !m.allowedClient(addr.Addr()) {
+		return apiResponse{ID: req.ID, Status: http.StatusForbidden, Body: textBody("broker not allowed: " + remote)}
+	}
+	u, err := url.ParseRequestURI(req.Path)
+	if err != nil || !strings.HasPrefix(u.Path, "/api/v1/") {
+		return apiResponse{ID: req.ID, Status: http.StatusBadRequest, Body: textBody("invalid api path: " + req.Path)}
+	}
+	if slices.Contains(mqttStreams, u.Path) {
+		return apiResponse{ID: req.ID, Status: http.StatusBadRequest, Body: textBody("streaming endpoint not available over mqtt: " + u.Path)}
+	}
+	body := []byte(req.Body)
+	var text string
+	if json.Unmarshal(req.Body, &text) == nil {
+		body = []byte(text)
+	}
+	method := req.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	ctx, cancel := context.WithTimeout(context.WithValue(ctx, sourceKey{}, sourceMQTTAPI), mqttRequestTimeout)
+	defer cancel()
+	r, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return apiResponse{ID: req.ID, Status: http.StatusBadRequest, Body: textBody(err.Error())}
+	}
+	r.RemoteAddr = remote
+	r.Header.Set("Accept", "application/json")
+	for k, v := range req.Header {
+		r.Header.Set(k, v)
+	}
+
+	w := apiRecorder{header: make(http.Header)}
+	api.ServeHTTP(&w, r)
+	if w.overflow {
+		return apiResponse{ID: req.ID, Status: http.StatusInternalServerError, Body: textBody(errResponseTooLong.Error())}
+	}
+	resp := apiResponse{ID: req.ID, Status: w.status}
+	if resp.Status == 0 {
+		resp.Status = http.StatusOK
+	}
+	for _, k := range mqttHeaders {
+		if v := w.header.Get(k); v != "" {
+			if resp.Header == nil {
+				resp.Header = make(map[string]string)
+			}
+			resp.Header[k] = v
+		}
+	}
+	b := bytes.TrimSpace(w.body)
+	switch {
+	case len(b) == 0:
+	case strings.HasPrefix(w.header.Get("Content-Type"), "application/json") && json.Valid(b):
+		resp.Body = b
+	default:
+		resp.Body = textBody(string(b))
+	}
+	return resp
+}
+
+// mqttRespond publishes resp to the response topic.
+func (m *mitm) mqttRespond(ctx context.Context, n *netStack, resp apiResponse) {
+	log := m.logFor("mqtt")
+	msg, err := json.Marshal(resp)
+	if err == nil && len(msg) > mqttMaxResponse {
+		msg, err = json.Marshal(apiResponse{ID: resp.ID, Status: http.StatusInternalServerError, Body: textBody(errResponseTooLong.Error())})
+	}
+	if err != nil {
+		log.LogAttrs(ctx, slog.LevelError, "mqtt response", slog.String("id", resp.ID), slog.Any("err", err))
+		return
+	}
+	err = n.mqtt.publish("response", msg, false)
+	if err != nil {
+		log.LogAttrs(ctx, slog.LevelError, "mqtt response", slog.String("id", resp.ID), slog.Any("err", err))
+		return
+	}
+	log.LogAttrs(ctx, slog.LevelDebug, "mqtt response", slog.String("id", resp.ID), slog.Int("status", resp.Status))
+}
+
+// textBody returns s as a JSON string.
+func textBody(s string) json.RawMessage {
+	b, _ := json.Marshal(s)
+	return b
+}
+
+// apiRecorder is an http.ResponseWriter that holds the response to an API
+// request received over MQTT.
+type apiRecorder struct {
+	header   http.Header
+	status   int
+	body     []byte
+	overflow bool // The body was longer than mqttMaxResponse.
+}
+
+func (w *apiRecorder) Header() http.Header { return w.header }
+
+func (w *apiRecorder) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+}
+
+func (w *apiRecorder) Write(p []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	if len(w.body)+len(p) > mqttMaxResponse {
+		w.overflow = true
+		return 0, errResponseTooLong
+	}
+	w.body = append(w.body, p...)
+	return len(p), nil
+}
@@ -0,0 +1,46 @@
+// Copyright ©2025 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import "strings"
+
+// baseHostname is the network host name of the device
+// when there is no name conflict.
+const baseHostname = "desk"
+
+// maxLocalName is the length in bytes of the longest Bluetooth local
+// name that fits in an advertisement with its flags.
+const maxLocalName = 31 - 3 - 2
+
+// nameSuffix returns the suffix appended to the device's network and
+// Bluetooth names to resolve a name conflict. It is derived from the
+// unique device identifier.
+func nameSuffix() string {
+	id := deviceID()
+	return "-" + id[max(0, len(id)-6):]
+}
+
+// hostname returns the network host name of the device.
+func (m *mitm) hostname() string {
+	s := m.store.get()
+	host := s.Hostname
+	if host == "" {
+		host = baseHostname
+	}
+	if s.UniqueName {
+		return host + nameSuffix()
+	}
+	return host
+}
+
+// localName returns the Bluetooth local name of the device given the
+// configured name.
+func (m *mitm) localName(name string) string {
+	name = strings.TrimSpace(name)
+	if m.store.get().UniqueName {
+		return name + nameSuffix()
+	}
+	return name
+}
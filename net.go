@@ -0,0 +1,239 @@
+// Copyright ©2025 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build http || !bluetooth
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"math/rand"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/soypat/cyw43439"
+	"github.com/soypat/seqs"
+	"github.com/soypat/seqs/stacks"
+
+	"github.com/kortschak/desk/wifi"
+)
+
+const (
+	// outboundConns is the number of outbound TCP
+	// connections that may be open at once.
+	outboundConns = 2
+
+	// dialTimeout is the time allowed for an outbound
+	// TCP connection to be established.
+	dialTimeout = 5 * time.Second
+)
+
+var errDialTimeout = errors.New("dial timed out")
+
+// netStack is the device's network stack.
+type netStack struct {
+	dev   *cyw43439.Device
+	stack *stacks.PortStack
+	dhcp  *stacks.DHCPClient
+
+	// mu serialises address resolution
+	// since the seqs ARP and DNS clients
+	// only handle a single request at a
+	// time.
+	mu       sync.Mutex
+	resolver *wifi.Resolver // nil if no DNS server is available.
+
+	hook webhook
+	mqtt mqttClient
+	udp  udpSender
+
+	log *slog.Logger
+}
+
+func newNetStack(dev *cyw43439.Device, stack *stacks.PortStack, dhcp *stacks.DHCPClient, log *slog.Logger) *netStack {
+	n := &netStack{dev: dev, stack: stack, dhcp: dhcp, log: log}
+	var err error
+	n.resolver, err = wifi.NewResolver(stack, dhcp)
+	if err != nil {
+		log.LogAttrs(context.Background(), slog.LevelWarn, "no dns resolver", slog.Any("err", err))
+		n.resolver = nil
+	}
+	return n
+}
+
+// dial opens conn to the TCP service at host:port, where host may be an IP
+// address or, if a DNS server is available, a host name.
+func (n *netStack) dial(ctx context.Context, conn *stacks.TCPConn, hostport string) error {
+	host, port, err := splitHostPort(hostport)
+	if err != nil {
+		return err
+	}
+	addr, mac, err := n.resolve(host)
+	if err != nil {
+		return err
+	}
+	lport := uint16(49152 + rand.Intn(16384))
+	err = conn.OpenDialTCP(lport, mac, netip.AddrPortFrom(addr, port), seqs.Value(rand.Uint32()))
+	if err != nil {
+		return err
+	}
+	deadline := time.Now().Add(dialTimeout)
+	for conn.State() != seqs.StateEstablished {
+		if ctx.Err() != nil || time.Now().After(deadline) {
+			hangUp(conn)
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return errDialTimeout
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return nil
+}
+
+// resolve returns the IP address for host and the hardware address
+// that packets to it should be sent to.
+func (n *netStack) resolve(host string) (netip.Addr, [6]byte, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		if n.resolver == nil {
+			return netip.Addr{}, [6]byte{}, errors.New("no dns resolver")
+		}
+		addrs, err := n.resolver.LookupNetIP(host)
+		if err != nil {
+			return netip.Addr{}, [6]byte{}, err
+		}
+		addr = addrs[0]
+	}
+	hop := addr
+	local := netip.PrefixFrom(n.stack.Addr(), int(n.dhcp.CIDRBits()))
+	if !local.Contains(addr) {
+		hop = n.dhcp.Router()
+	}
+	mac, err := wifi.ResolveHardwareAddr(n.stack, hop)
+	return addr, mac, err
+}
+
+// hangUp closes conn and waits for a short time for the close to complete.
+func hangUp(conn *stacks.TCPConn) {
+	conn.Close()
+	for range 20 {
+		if conn.State().IsClosed() {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// splitHostPort splits hostport into a host and a port number.
+func splitHostPort(hostport string) (host string, port uint16, err error) {
+	i := len(hostport) - 1
+	for i >= 0 && hostport[i] != ':' {
+		i--
+	}
+	if i < 0 {
+		return "", 0, errors.New("missing port in address")
+	}
+	p, err := strconv.ParseUint(hostport[i+1:], 10, 16)
+	if err != nil {
+		return "", 0, err
+	}
+	return hostport[:i], uint16(p), nil
+}
+
+// publishAvailability publishes the device's availability to the MQTT
+// broker.
+func (m *mitm) publishAvailability(ctx context.Context) {
+	n := m.net.Load()
+	if n == nil {
+		return
+	}
+	err := n.mqtt.publish("availability", []byte(m.availability()), true)
+	if err != nil && err != errMQTTOffline {
+		m.log.LogAttrs(ctx, slog.LevelError, "publish availability", slog.Any("err", err))
+	}
+}
+
+// notifyWebhook posts a to the configured webhook.
+func (m *mitm) notifyWebhook(ctx context.Context, a alert) {
+	n := m.net.Load()
+	if n == nil {
+		return
+	}
+	m.postAlert(ctx, n, a)
+}
+
+// notifyMQTT publishes a as JSON to the alert topic for its event.
+func (m *mitm) notifyMQTT(ctx context.Context, a alert) {
+	n := m.net.Load()
+	if n == nil {
+		return
+	}
+	body, err := json.Marshal(a)
+	if err != nil {
+		m.log.LogAttrs(ctx, slog.LevelError, "marshal alert", slog.Any("err", err))
+		return
+	}
+	err = n.mqtt.publish("alert/"+a.Name, body, false)
+	if err != nil && err != errMQTTOffline {
+		m.log.LogAttrs(ctx, slog.LevelError, "publish alert", slog.Any("err", err))
+	}
+}
+
+// postAlert posts a to the configured webhook, if any.
+func (m *mitm) postAlert(ctx context.Context, n *netStack, a alert) {
+	cfg := m.config()
+	if cfg.Webhook == "" {
+		return
+	}
+	log := m.log
+	body, err := json.Marshal(a)
+	if err != nil {
+		log.LogAttrs(ctx, slog.LevelError, "marshal alert", slog.Any("err", err))
+		return
+	}
+	err = n.hook.post(ctx, n, cfg.Webhook, cfg.WebhookSecret, body)
+	if err != nil {
+		log.LogAttrs(ctx, slog.LevelError, "post alert", slog.Any("err", err))
+	}
+}
+
+// checkHostname looks up the device's host name and, if it resolves to
+// another address, records that a unique name must be used. The unique
+// name is used the next time the network stack is set up.
+func (m *mitm) checkHostname(ctx context.Context, n *netStack) {
+	if n.resolver == nil || m.store.get().UniqueName {
+		return
+	}
+	host := m.hostname()
+	n.mu.Lock()
+	addrs, err := n.resolver.LookupNetIP(host)
+	n.mu.Unlock()
+	if err != nil {
+		// Most likely no other device
+		// has registered the name.
+		n.log.LogAttrs(ctx, slog.LevelDebug, "hostname lookup", slog.String("host", host), slog.Any("err", err))
+		return
+	}
+	self := n.stack.Addr()
+	for _, addr := range addrs {
+		if addr == self {
+			continue
+		}
+		unique := host + nameSuffix()
+		n.log.LogAttrs(ctx, slog.LevelWarn, "hostname conflict", slog.String("host", host), slog.Any("other", addr), slog.String("rename", unique))
+		err = m.store.update(func(p *persistent) { p.UniqueName = true })
+		if err != nil {
+			n.log.LogAttrs(ctx, slog.LevelError, "persist unique name", slog.Any("err", err))
+		}
+		return
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright ©2025 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build http || !bluetooth
+
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/kortschak/desk/wifi"
+)
+
+const (
+	// netProbeInterval is the time between
+	// network stack liveness probes.
+	netProbeInterval = 30 * time.Second
+
+	// netProbeFailures is the number of consecutive
+	// failed probes after which the network stack is
+	// considered to be wedged.
+	netProbeFailures = 3
+)
+
+// watchNet probes the liveness of the network stack until ctx is cancelled,
+// returning true if the stack is found to be wedged while the WiFi link is
+// up. The radio does not loop frames back to the device, so a connection
+// to the device's own listener cannot be made; instead the probe resolves
+// the hardware address of the router, which requires the stack to both
+// send and receive.
+func (m *mitm) watchNet(ctx context.Context, n *netStack) bool {
+	failures := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(netProbeInterval):
+		}
+		if !m.dev.IsLinkUp() {
+			// The stack cannot be blamed
+			// for a lost association.
+			failures = 0
+			continue
+		}
+		router := n.dhcp.Router()
+		if !router.IsValid() {
+			continue
+		}
+		n.mu.Lock()
+		_, err := wifi.ResolveHardwareAddr(n.stack, router)
+		n.mu.Unlock()
+		if err == nil {
+			failures = 0
+			continue
+		}
+		failures++
+		n.log.LogAttrs(ctx, slog.LevelWarn, "network probe failed", slog.Int("failures", failures), slog.Any("err", err))
+		if failures >= netProbeFailures {
+			n.log.LogAttrs(ctx, slog.LevelError, "network stack wedged")
+			return true
+		}
+	}
+}
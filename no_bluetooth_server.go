@@ -10,4 +10,7 @@ import "context"
 
 var useBluetooth = false
 
-func (m *mitm) bluetoothServer(context.Context) error { return nil }
+type bluetoothTransport struct{ m *mitm }
+
+func (bluetoothTransport) name() string                                { return "ble" }
+func (bluetoothTransport) start(context.Context, chan<- command) error { return nil }
@@ -0,0 +1,29 @@
+// Copyright ©2025 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !faults
+
+package main
+
+import "errors"
+
+// faultsBuilt is whether fault injection is built in. It is only built in
+// with the faults build tag.
+const faultsBuilt = false
+
+// faults is the fault injection state. Without the faults build tag, no
+// faults are injected.
+var faults faultInjector
+
+// faultInjector injects no faults.
+type faultInjector struct{}
+
+func (faultInjector) set(string) error {
+	return errors.New("fault injection not built in")
+}
+func (faultInjector) String() string            { return "" }
+func (faultInjector) dropBytes(b []byte) []byte { return b }
+func (faultInjector) corruptFrame([]byte)       {}
+func (faultInjector) radioStalled() bool        { return false }
+func (faultInjector) flashWrite() error         { return nil }
@@ -10,4 +10,15 @@ import "context"
 
 var useHTTP = false
 
-func (m *mitm) httpServer(context.Context) error { return nil }
+type httpTransport struct{ m *mitm }
+
+func (httpTransport) name() string                                { return "http" }
+func (httpTransport) start(context.Context, chan<- command) error { return nil }
+
+type netStack struct{}
+
+func (m *mitm) publishAvailability(context.Context) {}
+
+func (m *mitm) notifyWebhook(context.Context, alert) {}
+
+func (m *mitm) notifyMQTT(context.Context, alert) {}
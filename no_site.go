@@ -0,0 +1,11 @@
+// Copyright ©2025 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !site
+
+package main
+
+// siteConfig is the site configuration overlay. No overlay is built in
+// without the site build tag.
+var siteConfig []byte
@@ -0,0 +1,157 @@
+// Copyright ©2025 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"machine"
+	"slices"
+	"time"
+)
+
+// Notification events, named by the alert that carries them.
+const (
+	eventCycle      = "cycle"      // Sit/stand cycle reminders.
+	eventController = "controller" // Controller offline and online.
+	eventPower      = "power"      // Controller power cycles.
+)
+
+// Notification sinks.
+const (
+	sinkLog     = "log"     // Write the alert to the log.
+	sinkLED     = "led"     // Flash the notification LED pattern.
+	sinkBuzzer  = "buzzer"  // Sound the buzzer.
+	sinkBLE     = "ble"     // Notify on the Bluetooth cycle characteristic.
+	sinkWebhook = "webhook" // Post the alert to the webhook.
+	sinkMQTT    = "mqtt"    // Publish the alert to <prefix>/alert/<event>.
+)
+
+// notifier delivers alerts to a notification channel.
+type notifier interface {
+	notify(ctx context.Context, a alert)
+}
+
+// notifierFunc is a function that delivers alerts.
+type notifierFunc func(ctx context.Context, a alert)
+
+func (f notifierFunc) notify(ctx context.Context, a alert) { f(ctx, a) }
+
+// notifiers returns the notification sinks keyed by name.
+func (m *mitm) notifiers() map[string]notifier {
+	return map[string]notifier{
+		sinkLog:     notifierFunc(m.notifyLog),
+		sinkLED:     notifierFunc(m.notifyLED),
+		sinkBuzzer:  notifierFunc(m.notifyBuzzer),
+		sinkBLE:     notifierFunc(m.notifyBLE),
+		sinkWebhook: notifierFunc(m.notifyWebhook),
+		sinkMQTT:    notifierFunc(m.notifyMQTT),
+	}
+}
+
+// notifyConfig is the set of sinks that each event is delivered to.
+type notifyConfig struct {
+	Cycle      []string `json:"cycle"`
+	Controller []string `json:"controller"`
+	Power      []string `json:"power"`
+}
+
+// validate returns an error if the notification configuration is not
+// valid. buzzer is the GPIO number driving the buzzer.
+func (c notifyConfig) validate(buzzer int) error {
+	for _, sinks := range [][]string{c.Cycle, c.Controller, c.Power} {
+		for _, s := range sinks {
+			switch s {
+			case sinkLog, sinkLED, sinkBLE, sinkWebhook, sinkMQTT:
+			case sinkBuzzer:
+				if buzzer == 0 {
+					return fmt.Errorf("buzzer notifications enabled without a buzzer pin")
+				}
+			default:
+				return fmt.Errorf("unknown notification sink: %q", s)
+			}
+		}
+	}
+	return nil
+}
+
+// clone returns a deep copy of c.
+func (c notifyConfig) clone() notifyConfig {
+	return notifyConfig{
+		Cycle:      slices.Clone(c.Cycle),
+		Controller: slices.Clone(c.Controller),
+		Power:      slices.Clone(c.Power),
+	}
+}
+
+// sinks returns the sinks that event is delivered to.
+func (c notifyConfig) sinks(event string) []string {
+	switch event {
+	case eventCycle:
+		return c.Cycle
+	case eventController:
+		return c.Controller
+	case eventPower:
+		return c.Power
+	default:
+		return nil
+	}
+}
+
+// validBuzzerPin returns an error if n is not a usable buzzer GPIO.
+// Zero indicates that no buzzer is fitted.
+func validBuzzerPin(n int) error {
+	if n != 0 && (n < 0 || int(machine.GPIO22) < n || slices.Contains(reservedPins, n)) {
+		return fmt.Errorf("invalid buzzer pin: %d", n)
+	}
+	return nil
+}
+
+// buzz is the buzzer pattern sounded for a notification as alternating
+// on and off durations.
+var buzz = []time.Duration{
+	100 * time.Millisecond, 100 * time.Millisecond,
+	100 * time.Millisecond, 100 * time.Millisecond,
+	300 * time.Millisecond,
+}
+
+func (m *mitm) notifyLog(ctx context.Context, a alert) {
+	m.log.LogAttrs(ctx, slog.LevelWarn, "alert", slog.String("alert", a.Name), slog.String("state", a.State), slog.String("detail", a.Detail))
+}
+
+func (m *mitm) notifyLED(ctx context.Context, a alert) {
+	m.flashOnce(notifyFlash)
+}
+
+func (m *mitm) notifyBuzzer(ctx context.Context, a alert) {
+	go m.sound(m.config().BuzzerPin)
+}
+
+// notifyBLE notifies sit/stand cycle alerts on the Bluetooth cycle
+// characteristic. Other alerts have no Bluetooth representation and
+// are ignored.
+func (m *mitm) notifyBLE(ctx context.Context, a alert) {
+	if a.Name != eventCycle {
+		return
+	}
+	if notify := m.bleRemind.Load(); notify != nil {
+		(*notify)(a)
+	}
+}
+
+// sound plays the notification buzzer pattern on GPIO n.
+func (m *mitm) sound(n int) {
+	if n == 0 || n == m.config().Relay.Pin {
+		return
+	}
+	pin := machine.Pin(n)
+	pin.Configure(machine.PinConfig{Mode: machine.PinOutput})
+	for i, d := range buzz {
+		pin.Set(i%2 == 0)
+		time.Sleep(d)
+	}
+	pin.Low()
+}
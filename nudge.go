@@ -0,0 +1,50 @@
+// Copyright ©2025 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+)
+
+// maxMoveBy is the largest relative move in display units. Relative moves
+// are for fine adjustments; larger moves should use a preset.
+const maxMoveBy = 20.0
+
+var errOffset = errors.New("invalid offset")
+
+// moveBy moves the desk by delta display units from its current height,
+// driving it with bursts of up or down key frames and checking the
+// reported height after each burst. It returns the height reached. The
+// caller must hold m.mu.
+func (m *mitm) moveBy(ctx context.Context, log *slog.Logger, src string, delta float64) (position, error) {
+	if math.IsNaN(delta) || delta == 0 || math.Abs(delta) > maxMoveBy {
+		return position{}, fmt.Errorf("%w: %v", errOffset, delta)
+	}
+	if !m.heightKnown.Load() {
+		return position{}, errors.New("height not known")
+	}
+	target := m.position.Load().(position).offset(delta)
+	if target.mantissa <= 0 {
+		return position{}, fmt.Errorf("%w: %v", errOffset, delta)
+	}
+	log.LogAttrs(ctx, slog.LevelInfo, "move by", slog.Float64("delta", delta), slog.Any("target", target))
+	err := m.driveTo(ctx, log, src, savedPosition{Mantissa: target.mantissa, Exponent: target.exponent}, false)
+	if err != nil {
+		return position{}, err
+	}
+	return m.position.Load().(position), nil
+}
+
+// offset returns the position delta display units from p, rounded to the
+// resolution of p.
+func (p position) offset(delta float64) position {
+	step := position{mantissa: 1, exponent: p.exponent}.units()
+	p.mantissa += int(math.Round(delta / step))
+	return p
+}
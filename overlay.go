@@ -0,0 +1,156 @@
+// Copyright ©2025 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+)
+
+// The configuration is built up in layers: the built-in defaults, the site
+// overlay baked into the image at build time and the changes made at run
+// time, which are persisted in flash.
+
+// maxConfigBody is the length of the longest configuration change. The
+// accumulated changes must fit in the persistent store with the rest of
+// the persistent state.
+const maxConfigBody = 2048
+
+// siteDefaults returns the built-in default configuration with the site
+// overlay applied. If the overlay is not valid, the built-in defaults are
+// returned with an error.
+func siteDefaults() (config, error) {
+	cfg := defaultConfig.clone()
+	if siteConfig == nil {
+		return cfg, nil
+	}
+	err := json.Unmarshal(siteConfig, &cfg)
+	if err == nil {
+		err = cfg.validate()
+	}
+	if err != nil {
+		return defaultConfig.clone(), fmt.Errorf("invalid site config: %w", err)
+	}
+	return cfg, nil
+}
+
+// restoreConfig applies the configuration changes persisted in flash over
+// the current configuration.
+func (m *mitm) restoreConfig(ctx context.Context) {
+	changes := m.store.get().Config
+	if changes == nil {
+		return
+	}
+	_, rev := m.configRevision()
+	err := m.updateConfig(rev, func(cfg *config) error {
+		return json.Unmarshal(changes, cfg)
+	})
+	if err != nil {
+		m.log.LogAttrs(ctx, slog.LevelError, "restore config", slog.Any("err", err))
+		return
+	}
+	m.log.LogAttrs(ctx, slog.LevelInfo, "restored config", slog.Int("len", len(changes)))
+}
+
+// persistError is the error returned when a configuration change could
+// not be persisted.
+type persistError struct {
+	err error
+}
+
+func (e persistError) Error() string { return "persist config: " + e.err.Error() }
+func (e persistError) Unwrap() error { return e.err }
+
+// changeConfig applies the JSON configuration change in body, made by the
+// client at the address remote, over the configuration at revision rev
+// and adds it to the changes persisted in flash. A change whose allowlist
+// would exclude the client is refused. The change is persisted before it is applied so that the running
+// configuration is not left differing from the configuration that is
+// restored at start-up. It returns a persistError if the change could not
+// be persisted, in which case the running configuration is not changed.
+func (m *mitm) changeConfig(rev uint64, body []byte, remote string) error {
+	return m.updateConfig(rev, func(cfg *config) error {
+		err := json.Unmarshal(body, cfg)
+		if err != nil {
+			return err
+		}
+		err = m.checkConfig(*cfg)
+		if err != nil {
+			return err
+		}
+		err = checkAllowClient(cfg.Allow, remote)
+		if err != nil {
+			return err
+		}
+		var mergeErr error
+		err = m.store.update(func(p *persistent) {
+			changes, err := mergeJSON(p.Config, body)
+			if err != nil {
+				mergeErr = err
+				return
+			}
+			p.Config = changes
+		})
+		if err == nil {
+			err = mergeErr
+		}
+		if err != nil {
+			return persistError{err}
+		}
+		return nil
+	})
+}
+
+// resetConfig discards the configuration changes persisted in flash and
+// returns to the built-in defaults with the site overlay applied.
+func (m *mitm) resetConfig() error {
+	err := m.setConfig(m.baseCfg.clone())
+	if err != nil {
+		return err
+	}
+	return m.store.update(func(p *persistent) { p.Config = nil })
+}
+
+// mergeJSON returns the JSON object src merged into the JSON object dst.
+// Objects are merged field by field, recursively; all other values in src
+// replace those in dst.
+func mergeJSON(dst, src json.RawMessage) (json.RawMessage, error) {
+	if dst == nil {
+		var v map[string]json.RawMessage
+		err := json.Unmarshal(src, &v)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(v)
+	}
+	var d, s map[string]json.RawMessage
+	err := json.Unmarshal(dst, &d)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(src, &s)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range s {
+		if old, ok := d[k]; ok && isObject(old) && isObject(v) {
+			v, err = mergeJSON(old, v)
+			if err != nil {
+				return nil, err
+			}
+		}
+		d[k] = v
+	}
+	return json.Marshal(d)
+}
+
+// isObject returns whether the JSON value v is an object.
+func isObject(v json.RawMessage) bool {
+	v = bytes.TrimSpace(v)
+	return len(v) != 0 && v[0] == '{'
+}
@@ -0,0 +1,165 @@
+// Copyright ©2025 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+var mergeJSONTests = []struct {
+	name    string
+	dst     string // Nil if empty.
+	src     string
+	want    string
+	wantErr bool
+}{
+	{
+		name: "nil dst",
+		src:  `{"unit":"in"}`,
+		want: `{"unit":"in"}`,
+	},
+	{
+		name: "new field",
+		dst:  `{"unit":"in"}`,
+		src:  `{"language":"de"}`,
+		want: `{"unit":"in","language":"de"}`,
+	},
+	{
+		name: "replace value",
+		dst:  `{"unit":"in","language":"de"}`,
+		src:  `{"unit":"cm"}`,
+		want: `{"unit":"cm","language":"de"}`,
+	},
+	{
+		name: "merge object",
+		dst:  `{"mqtt":{"broker":"mqtt:1883","topic":"desk"}}`,
+		src:  `{"mqtt":{"topic":"office"}}`,
+		want: `{"mqtt":{"broker":"mqtt:1883","topic":"office"}}`,
+	},
+	{
+		name: "merge nested object",
+		dst:  `{"a":{"b":{"c":1,"d":2}}}`,
+		src:  `{"a":{"b":{"d":3}}}`,
+		want: `{"a":{"b":{"c":1,"d":3}}}`,
+	},
+	{
+		name: "replace array",
+		dst:  `{"allow":["10.0.0.0/8","192.168.0.0/16"]}`,
+		src:  `{"allow":["172.16.0.0/12"]}`,
+		want: `{"allow":["172.16.0.0/12"]}`,
+	},
+	{
+		name: "object replaces scalar",
+		dst:  `{"a":1}`,
+		src:  `{"a":{"b":2}}`,
+		want: `{"a":{"b":2}}`,
+	},
+	{
+		name: "scalar replaces object",
+		dst:  `{"a":{"b":2}}`,
+		src:  `{"a":null}`,
+		want: `{"a":null}`,
+	},
+	{
+		name: "empty src",
+		dst:  `{"a":1}`,
+		src:  `{}`,
+		want: `{"a":1}`,
+	},
+	{
+		name:    "invalid src",
+		dst:     `{"a":1}`,
+		src:     `{"a":`,
+		wantErr: true,
+	},
+	{
+		name:    "invalid dst",
+		dst:     `[1]`,
+		src:     `{"a":1}`,
+		wantErr: true,
+	},
+	{
+		name:    "src not an object",
+		src:     `"a"`,
+		wantErr: true,
+	},
+}
+
+func TestMergeJSON(t *testing.T) {
+	for _, test := range mergeJSONTests {
+		var dst json.RawMessage
+		if test.dst != "" {
+			dst = json.RawMessage(test.dst)
+		}
+		got, err := mergeJSON(dst, json.RawMessage(test.src))
+		if (err != nil) != test.wantErr {
+			t.Errorf("unexpected error for %s: got:%v want error:%t", test.name, err, test.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		var gotV, wantV any
+		err = json.Unmarshal(got, &gotV)
+		if err != nil {
+			t.Errorf("invalid result for %s: %v", test.name, err)
+			continue
+		}
+		err = json.Unmarshal([]byte(test.want), &wantV)
+		if err != nil {
+			t.Fatalf("invalid want for %s: %v", test.name, err)
+		}
+		if !reflect.DeepEqual(gotV, wantV) {
+			t.Errorf("unexpected result for %s:\ngot: %s\nwant:%s", test.name, got, test.want)
+		}
+	}
+}
+
+// testClient is the address of the client making test configuration
+// changes.
+const testClient = "192.0.2.1:49152"
+
+// TestChangeConfig checks that a configuration change is only applied
+// once it has been persisted.
+func TestChangeConfig(t *testing.T) {
+	flash := newFakeFlash(storeBlocks, 1024, 256)
+	m := &mitm{line: models[defaultConfig.Model].line}
+	m.store.flash = flash
+	cfg := defaultConfig.clone()
+	m.cfg.Store(&cfg)
+
+	err := m.changeConfig(0, []byte(`{"unit":"in"}`), testClient)
+	if err != nil {
+		t.Fatalf("unexpected error changing config: %v", err)
+	}
+	if got := m.config().Unit; got != "in" {
+		t.Errorf("unexpected unit after change: got:%q want:%q", got, "in")
+	}
+	if got, want := string(reload(t, flash).get().Config), `{"unit":"in"}`; got != want {
+		t.Errorf("unexpected persisted changes: got:%s want:%s", got, want)
+	}
+
+	err = m.changeConfig(1, []byte(`{"unit":"furlong"}`), testClient)
+	var persistErr persistError
+	if err == nil || errors.As(err, &persistErr) {
+		t.Errorf("unexpected error for invalid change: got:%v want validation error", err)
+	}
+
+	flash.tear = 1
+	err = m.changeConfig(1, []byte(`{"unit":"cm"}`), testClient)
+	if !errors.As(err, &persistErr) {
+		t.Errorf("unexpected error for failed persist: got:%v want:%v", err, persistError{errTorn})
+	}
+	cfg, rev := m.configRevision()
+	if cfg.Unit != "in" || rev != 1 {
+		t.Errorf("unexpected config after failed persist: got unit:%q rev:%d want unit:%q rev:%d", cfg.Unit, rev, "in", 1)
+	}
+	if got, want := string(reload(t, flash).get().Config), `{"unit":"in"}`; got != want {
+		t.Errorf("unexpected persisted changes after failed persist: got:%s want:%s", got, want)
+	}
+}
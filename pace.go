@@ -0,0 +1,70 @@
+// Copyright ©2025 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import "time"
+
+// lineConfig describes the serial line format used by a protocol and
+// the pacing of frames written to the line.
+type lineConfig struct {
+	baud     uint32 // Line rate in bits per second.
+	dataBits int
+	parity   bool
+	stopBits int
+
+	// handset and controller are the framing of
+	// frames sent by the handset and controller.
+	handset    framing
+	controller framing
+
+	idle int // Number of frame times the line is left idle between frames.
+}
+
+// framing describes how frames are delimited on a serial line.
+type framing struct {
+	start byte // Start byte of each frame.
+	len   int  // Number of bytes in a frame, including the start byte.
+}
+
+// aokeLine is the line configuration of the AOKE WP-CB01-901 controller.
+// The handset chirps packets at 10ms intervals, which corresponds to one
+// five byte frame and one frame time of idle line at 9600 baud.
+var aokeLine = lineConfig{
+	baud:     9600,
+	dataBits: 8,
+	stopBits: 1,
+	handset: framing{
+		start: handsetStart,
+		len:   frameLen,
+	},
+	controller: framing{
+		start: controllerStart,
+		len:   frameLen,
+	},
+	idle: 1,
+}
+
+// charBits returns the number of bits used to send a single byte on the
+// line, including the start bit.
+func (c lineConfig) charBits() int {
+	n := 1 + c.dataBits + c.stopBits
+	if c.parity {
+		n++
+	}
+	return n
+}
+
+// frameTime returns the time taken to send a single handset frame, which
+// is the frame type sent to the controller.
+func (c lineConfig) frameTime() time.Duration {
+	return time.Duration(c.handset.len*c.charBits()) * time.Second / time.Duration(c.baud)
+}
+
+// gap returns the time to wait after queueing a frame for sending before
+// the next frame may be queued. It covers the time to send the frame and
+// the configured idle time.
+func (c lineConfig) gap() time.Duration {
+	return time.Duration(1+c.idle) * c.frameTime()
+}
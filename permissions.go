@@ -0,0 +1,88 @@
+// Copyright ©2025 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// Command sources.
+const (
+	sourceHTTP    = "http"
+	sourceBLE     = "ble"
+	sourceMQTT    = "mqtt"
+	sourceMQTTAPI = "mqtt_api" // HTTP API requests relayed from the MQTT broker.
+	sourceHandset = "handset"
+	sourceDevice  = "device" // Commands originating on the device, such as keep-alives.
+)
+
+// Permissions that may be granted to a command source.
+const (
+	permRead   = "read"   // Read desk state.
+	permMove   = "move"   // Move the desk.
+	permConfig = "config" // Change device configuration.
+)
+
+var errPermission = errors.New("permission denied")
+
+// permissions is the set of permissions granted to each remote command
+// source. The handset and the device itself always have full control.
+type permissions struct {
+	HTTP    []string `json:"http"`
+	BLE     []string `json:"ble"`
+	MQTT    []string `json:"mqtt"`
+	MQTTAPI []string `json:"mqtt_api"`
+}
+
+// validate returns an error if the permissions are not valid.
+func (p permissions) validate() error {
+	for _, perms := range [][]string{p.HTTP, p.BLE, p.MQTT, p.MQTTAPI} {
+		for _, perm := range perms {
+			switch perm {
+			case permRead, permMove, permConfig:
+			default:
+				return fmt.Errorf("unknown permission: %q", perm)
+			}
+		}
+	}
+	return nil
+}
+
+// clone returns a deep copy of p.
+func (p permissions) clone() permissions {
+	return permissions{
+		HTTP:    slices.Clone(p.HTTP),
+		BLE:     slices.Clone(p.BLE),
+		MQTT:    slices.Clone(p.MQTT),
+		MQTTAPI: slices.Clone(p.MQTTAPI),
+	}
+}
+
+// allowed returns whether src has been granted perm. Remote sources may
+// not move the desk in kiosk mode.
+func (m *mitm) allowed(src, perm string) bool {
+	p := m.cfg.Load().Permissions
+	switch src {
+	case sourceHandset, sourceDevice:
+		return true
+	}
+	if perm == permMove && m.kiosk.Load() {
+		return false
+	}
+	switch src {
+	case sourceHTTP:
+		return slices.Contains(p.HTTP, perm)
+	case sourceBLE:
+		return slices.Contains(p.BLE, perm)
+	case sourceMQTT:
+		return slices.Contains(p.MQTT, perm)
+	case sourceMQTTAPI:
+		return slices.Contains(p.MQTTAPI, perm)
+	default:
+		return false
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright ©2025 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"slices"
+	"time"
+)
+
+// Named positions are user-defined heights held by the device in addition
+// to the controller's four memory presets. The desk is driven to them
+// with the up and down keys while the reported height is checked.
+
+const (
+	// maxPositions is the number of named
+	// positions that may be stored.
+	maxPositions = 8
+
+	// maxPositionName is the length in bytes of
+	// the longest position name.
+	maxPositionName = 16
+)
+
+var (
+	errNoPosition       = errors.New("no such position")
+	errPositionName     = errors.New("invalid position name")
+	errTooManyPositions = errors.New("too many positions")
+)
+
+// namedPosition is a persisted user-defined position.
+type namedPosition struct {
+	Name     string        `json:"name"`
+	Position savedPosition `json:"position"`
+}
+
+// validPositionName returns an error if name may not be used as a position
+// name. Names are printable ASCII without spaces.
+func validPositionName(name string) error {
+	if name == "" || len(name) > maxPositionName {
+		return fmt.Errorf("%w: %q", errPositionName, name)
+	}
+	for _, c := range []byte(name) {
+		if c <= ' ' || c > '~' {
+			return fmt.Errorf("%w: %q", errPositionName, name)
+		}
+	}
+	return nil
+}
+
+// positions returns the stored named positions.
+func (m *mitm) positions() []namedPosition {
+	return m.store.get().Positions
+}
+
+// setNamedPosition stores the named position at height h in display units,
+// replacing any position with the same name. If h is NaN, the current
+// height of the desk is used. It returns the stored position.
+func (m *mitm) setNamedPosition(name string, h float64) (position, error) {
+	err := validPositionName(name)
+	if err != nil {
+		return position{}, err
+	}
+	if !m.heightKnown.Load() {
+		return position{}, errors.New("height not known")
+	}
+	p := m.position.Load().(position)
+	if !math.IsNaN(h) {
+		if math.IsInf(h, 0) || h <= 0 {
+			return position{}, fmt.Errorf("invalid height: %v", h)
+		}
+		p = p.offset(h - p.units())
+	}
+	err = m.checkRange(p)
+	if err != nil {
+		return position{}, err
+	}
+	saved := savedPosition{Mantissa: p.mantissa, Exponent: p.exponent}
+	named := func(n namedPosition) bool { return n.Name == name }
+	if positions := m.positions(); !slices.ContainsFunc(positions, named) && len(positions) >= maxPositions {
+		return position{}, errTooManyPositions
+	}
+	err = m.store.update(func(s *persistent) {
+		// Copy the positions since the stored slice
+		// is shared with earlier copies of the state.
+		s.Positions = slices.Clone(s.Positions)
+		i := slices.IndexFunc(s.Positions, named)
+		if i < 0 {
+			s.Positions = append(s.Positions, namedPosition{Name: name, Position: saved})
+			return
+		}
+		s.Positions[i].Position = saved
+	})
+	return p, err
+}
+
+// deleteNamedPosition removes the named position.
+func (m *mitm) deleteNamedPosition(name string) error {
+	if !slices.ContainsFunc(m.positions(), func(n namedPosition) bool { return n.Name == name }) {
+		return fmt.Errorf("%w: %q", errNoPosition, name)
+	}
+	return m.store.update(func(s *persistent) {
+		s.Positions = slices.DeleteFunc(slices.Clone(s.Positions), func(n namedPosition) bool { return n.Name == name })
+	})
+}
+
+// moveToNamed drives the desk to the named position. The caller must hold
+// m.mu.
+func (m *mitm) moveToNamed(ctx context.Context, log *slog.Logger, src, name string) error {
+	positions := m.positions()
+	i := slices.IndexFunc(positions, func(n namedPosition) bool { return n.Name == name })
+	if i < 0 {
+		return fmt.Errorf("%w: %q", errNoPosition, name)
+	}
+	saved := positions[i].Position
+	log.LogAttrs(ctx, slog.LevelInfo, "move to named position", slog.String("name", name), slog.Any("target", position{mantissa: saved.Mantissa, exponent: saved.Exponent}))
+	m.events.publish(event{kind: moveCommanded, time: time.Now(), src: src, name: name})
+	return m.driveTo(ctx, log, src, saved, false)
+}
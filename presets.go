@@ -0,0 +1,256 @@
+// Copyright ©2025 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The controller protocol has no query for the memory preset heights, so
+// they are learned by observing the height at which the desk settles after
+// a preset key is pressed, either to move to the preset or to program it
+// after the memory key.
+
+const (
+	// restoreTimeout is the longest time allowed
+	// to drive the desk to a preset height when
+	// restoring it.
+	restoreTimeout = time.Minute
+
+	// restoreNear is the distance from the target
+	// height in display units at which the desk is
+	// driven in short steps rather than held.
+	restoreNear = 1.0
+)
+
+var errNoPreset = errors.New("preset height not known")
+
+// savedPosition is the persisted form of a position.
+type savedPosition struct {
+	Mantissa int `json:"m"`
+	Exponent int `json:"e"`
+}
+
+// presetLearner tracks the preset key most recently pressed so that the
+// height the desk settles at can be recorded.
+type presetLearner struct {
+	mu      sync.Mutex
+	pending int // Preset awaiting the desk to settle, zero if none.
+	since   time.Time
+}
+
+// presetPressed records that the key for preset n has been pressed,
+// making it the target of the desk.
+func (m *mitm) presetPressed(n int) {
+	m.desk.setTarget(m.presetTarget(n))
+	m.presets.mu.Lock()
+	defer m.presets.mu.Unlock()
+	m.presets.pending = n
+	m.presets.since = time.Now()
+}
+
+// presetTarget returns the target of a move to preset n, with the learned
+// height of the preset if it is known.
+func (m *mitm) presetTarget(n int) target {
+	t := target{Preset: n}
+	if saved := m.store.get().Presets[n-1]; saved.Mantissa != 0 {
+		h := position{mantissa: saved.Mantissa, exponent: saved.Exponent}.units()
+		t.Height = &h
+	}
+	return t
+}
+
+// publishTarget publishes the height of the target t, if it is known, so
+// that sync followers can start to move with the desk. It returns whether
+// the target was published.
+func (m *mitm) publishTarget(t target) bool {
+	if t.Height == nil {
+		return false
+	}
+	m.events.publish(event{kind: targetChanged, time: time.Now(), height: *t.Height})
+	return true
+}
+
+// leadTarget records t as the target of the move that is starting and
+// publishes it. If it was published, the move is held back for the sync
+// lead time so that the target reaches the followers before the desk
+// starts to move.
+func (m *mitm) leadTarget(t target) {
+	m.desk.setTarget(t)
+	if m.publishTarget(t) {
+		time.Sleep(time.Duration(m.syncLead.Load()))
+	}
+}
+
+// presetCancelled discards a pressed preset key so that the height at
+// which the desk stops is not learned.
+func (m *mitm) presetCancelled() {
+	m.presets.mu.Lock()
+	defer m.presets.mu.Unlock()
+	m.presets.pending = 0
+}
+
+// runPresets records the height of the desk for a pressed preset key
+// once the desk has settled, persisting it if it has changed.
+func (m *mitm) runPresets(ctx context.Context) {
+	ticker := time.NewTicker(motionPoll)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		m.presets.mu.Lock()
+		n := m.presets.pending
+		settled := n != 0 && time.Since(m.presets.since) > leaseGrace && !m.moving()
+		if settled {
+			m.presets.pending = 0
+		}
+		m.presets.mu.Unlock()
+		if !settled || !m.heightKnown.Load() {
+			continue
+		}
+		p := m.position.Load().(position)
+		saved := savedPosition{Mantissa: p.mantissa, Exponent: p.exponent}
+		if m.store.get().Presets[n-1] == saved {
+			continue
+		}
+		m.log.LogAttrs(ctx, slog.LevelInfo, "learned preset", slog.Int("preset", n), slog.Any("position", p))
+		err := m.store.update(func(s *persistent) { s.Presets[n-1] = saved })
+		if err != nil {
+			m.log.LogAttrs(ctx, slog.LevelError, "persist presets", slog.Any("err", err))
+		}
+	}
+}
+
+// presetStatus returns a description of the learned preset heights.
+func (m *mitm) presetStatus() string {
+	var buf strings.Builder
+	for i, p := range m.store.get().Presets {
+		if i != 0 {
+			buf.WriteByte(' ')
+		}
+		if p.Mantissa == 0 {
+			fmt.Fprintf(&buf, "%d=none", i+1)
+			continue
+		}
+		fmt.Fprintf(&buf, "%d=%s", i+1, position{mantissa: p.Mantissa, exponent: p.Exponent})
+	}
+	return buf.String()
+}
+
+// restorePreset drives the desk to the learned height of preset n and
+// programs the preset at the height reached. The caller must hold m.mu.
+func (m *mitm) restorePreset(ctx context.Context, log *slog.Logger, src string, n int) (position, error) {
+	if n < 1 || 4 < n {
+		return position{}, fmt.Errorf("invalid preset: %d", n)
+	}
+	saved := m.store.get().Presets[n-1]
+	if saved.Mantissa == 0 {
+		return position{}, errNoPreset
+	}
+	log.LogAttrs(ctx, slog.LevelInfo, "restore preset", slog.Int("preset", n))
+	err := m.driveTo(ctx, log, src, saved, false)
+	if err != nil {
+		return position{}, err
+	}
+	time.Sleep(motionSettle)
+	err = m.command(ctx, log, src, actionMemory)
+	if err != nil {
+		return position{}, err
+	}
+	a, _ := presetAction(n)
+	err = m.command(ctx, log, src, a)
+	if err != nil {
+		return position{}, err
+	}
+	return m.position.Load().(position), nil
+}
+
+// driveTo moves the desk to the height saved using the up and down keys.
+// If quiet is false the keys are held until the desk is near the target,
+// otherwise the desk is nudged towards the target in short movements for
+// the whole distance. Heights outside the learned range of the desk are
+// refused. The move waits for the rest period after the last move. The
+// caller must hold m.mu, which is released during the pauses between the
+// movements of a quiet move so that a quiet move does not hold up other
+// users of the controller for its whole length. A handset key press ends
+// the move with errHandsetKey.
+func (m *mitm) driveTo(ctx context.Context, log *slog.Logger, src string, saved savedPosition, quiet bool) error {
+	p := position{mantissa: saved.Mantissa, exponent: saved.Exponent}
+	err := m.checkRange(p)
+	if err != nil {
+		return err
+	}
+	err = m.rest(ctx, log)
+	if err != nil {
+		return err
+	}
+	target := p.units()
+	m.leadTarget(targetHeight(target))
+	// step is the resolution of the reported height.
+	step := position{mantissa: 1, exponent: saved.Exponent}.units()
+	deadline := time.Now().Add(restoreTimeout)
+	if quiet {
+		deadline = time.Now().Add(quietTimeout)
+	}
+	keyed := m.lastKey.Load()
+	for {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if m.lastKey.Load() != keyed {
+			return errHandsetKey
+		}
+		if time.Now().After(deadline) {
+			return errors.New("move timed out")
+		}
+		diff := target - m.position.Load().(position).units()
+		if -step/2 < diff && diff < step/2 {
+			return nil
+		}
+		a := actionUp
+		if diff < 0 {
+			a = actionDown
+		}
+		err = m.command(ctx, log, src, a)
+		if err != nil {
+			return err
+		}
+		switch {
+		case -restoreNear < diff && diff < restoreNear:
+			// Let the desk settle before checking
+			// the height to avoid overshooting.
+			time.Sleep(motionSettle)
+		case quiet:
+			stops := m.stops.Load()
+			m.mu.Unlock()
+			time.Sleep(quietPause)
+			m.mu.Lock()
+			if m.stops.Load() != stops {
+				return errStopped
+			}
+		}
+	}
+}
+
+// units returns the position in display units.
+func (p position) units() float64 {
+	v := float64(p.mantissa)
+	for range p.exponent {
+		v *= 10
+	}
+	for range -p.exponent {
+		v /= 10
+	}
+	return v
+}
@@ -0,0 +1,128 @@
+// Copyright ©2025 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// Motion profiles.
+const (
+	profileNormal = "normal" // Move at full speed.
+	profileQuiet  = "quiet"  // Nudge the desk in short movements.
+)
+
+const (
+	// quietPause is the pause between the short
+	// movements of a quiet move.
+	quietPause = 400 * time.Millisecond
+
+	// quietTimeout is the longest time allowed
+	// for a quiet move.
+	quietTimeout = 3 * time.Minute
+)
+
+// quietConfig is the quiet hours schedule during which moves use the
+// quiet motion profile unless another profile is requested.
+type quietConfig struct {
+	// From and To are the start and end of quiet
+	// hours as "15:04" times. Quiet hours are not
+	// used if either is empty. Quiet hours may span
+	// midnight.
+	From string `json:"from,omitempty"`
+	To   string `json:"to,omitempty"`
+
+	// Offset is the offset from UTC of the
+	// local time zone.
+	Offset duration `json:"utc_offset"`
+}
+
+// validate returns an error if the quiet hours configuration is not valid.
+func (c quietConfig) validate() error {
+	if c.From == "" && c.To == "" {
+		return nil
+	}
+	for _, t := range []string{c.From, c.To} {
+		_, err := time.Parse("15:04", t)
+		if err != nil {
+			return fmt.Errorf("invalid quiet hours time: %q", t)
+		}
+	}
+	if c.Offset < duration(-14*time.Hour) || duration(14*time.Hour) < c.Offset {
+		return fmt.Errorf("utc offset out of range: %s", time.Duration(c.Offset))
+	}
+	return nil
+}
+
+// contains returns whether t is within quiet hours.
+func (c quietConfig) contains(t time.Time) bool {
+	from, err := time.Parse("15:04", c.From)
+	if err != nil {
+		return false
+	}
+	to, err := time.Parse("15:04", c.To)
+	if err != nil {
+		return false
+	}
+	t = t.UTC().Add(time.Duration(c.Offset))
+	now := t.Hour()*60 + t.Minute()
+	start := from.Hour()*60 + from.Minute()
+	end := to.Hour()*60 + to.Minute()
+	if start <= end {
+		return start <= now && now < end
+	}
+	return now >= start || now < end
+}
+
+// profile returns the scheduled motion profile. Quiet hours are only used
+// once the clock has been synced.
+func (m *mitm) profile() string {
+	if m.clock.isSynced() && m.config().Quiet.contains(m.clock.now()) {
+		return profileQuiet
+	}
+	return profileNormal
+}
+
+// moveToPreset moves the desk to memory preset n using the motion profile.
+// If profile is empty, the scheduled profile is used. Quiet moves drive
+// the desk to the learned height of the preset, falling back to a normal
+// move if the height is not known. The move waits for the rest period
+// after the last move. The caller must hold m.mu.
+func (m *mitm) moveToPreset(ctx context.Context, log *slog.Logger, src string, n int, profile string) error {
+	a, err := presetAction(n)
+	if err != nil {
+		return err
+	}
+	if profile == "" {
+		profile = m.profile()
+	}
+	switch profile {
+	case profileNormal:
+	case profileQuiet:
+		saved := m.store.get().Presets[n-1]
+		if saved.Mantissa == 0 {
+			log.LogAttrs(ctx, slog.LevelWarn, "no learned height for quiet move", slog.Int("preset", n))
+			break
+		}
+		if !m.allowed(src, permMove) {
+			return errPermission
+		}
+		log.LogAttrs(ctx, slog.LevelInfo, "quiet move", slog.Int("preset", n))
+		m.events.publish(event{kind: moveCommanded, time: time.Now(), src: src, preset: n})
+		return m.driveTo(ctx, log, src, saved, true)
+	default:
+		return fmt.Errorf("invalid motion profile: %q", profile)
+	}
+	err = m.rest(ctx, log)
+	if err != nil {
+		return err
+	}
+	m.leadTarget(m.presetTarget(n))
+	m.events.publish(event{kind: moveCommanded, time: time.Now(), src: src, preset: n})
+	return m.command(ctx, log, src, a)
+}
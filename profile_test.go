@@ -0,0 +1,48 @@
+// Copyright ©2025 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+var quietContainsTests = []struct {
+	cfg  quietConfig
+	at   string // UTC "15:04".
+	want bool
+}{
+	{cfg: quietConfig{}, at: "12:00", want: false},
+	{cfg: quietConfig{From: "12:00"}, at: "12:00", want: false},
+	{cfg: quietConfig{From: "12:00", To: "14:00"}, at: "11:59", want: false},
+	{cfg: quietConfig{From: "12:00", To: "14:00"}, at: "12:00", want: true},
+	{cfg: quietConfig{From: "12:00", To: "14:00"}, at: "13:59", want: true},
+	{cfg: quietConfig{From: "12:00", To: "14:00"}, at: "14:00", want: false},
+	{cfg: quietConfig{From: "22:00", To: "07:00"}, at: "21:59", want: false},
+	{cfg: quietConfig{From: "22:00", To: "07:00"}, at: "22:00", want: true},
+	{cfg: quietConfig{From: "22:00", To: "07:00"}, at: "00:00", want: true},
+	{cfg: quietConfig{From: "22:00", To: "07:00"}, at: "06:59", want: true},
+	{cfg: quietConfig{From: "22:00", To: "07:00"}, at: "07:00", want: false},
+	{cfg: quietConfig{From: "12:00", To: "12:00"}, at: "12:00", want: false},
+	{cfg: quietConfig{From: "22:00", To: "07:00", Offset: duration(10 * time.Hour)}, at: "12:00", want: true},
+	{cfg: quietConfig{From: "22:00", To: "07:00", Offset: duration(10 * time.Hour)}, at: "21:00", want: false},
+	{cfg: quietConfig{From: "12:00", To: "14:00", Offset: duration(-90 * time.Minute)}, at: "13:29", want: false},
+	{cfg: quietConfig{From: "12:00", To: "14:00", Offset: duration(-90 * time.Minute)}, at: "13:30", want: true},
+	{cfg: quietConfig{From: "noon", To: "14:00"}, at: "13:00", want: false},
+}
+
+func TestQuietContains(t *testing.T) {
+	for _, test := range quietContainsTests {
+		at, err := time.Parse("15:04", test.at)
+		if err != nil {
+			t.Fatalf("invalid test time: %v", err)
+		}
+		at = time.Date(2025, 1, 1, at.Hour(), at.Minute(), 0, 0, time.UTC)
+		got := test.cfg.contains(at)
+		if got != test.want {
+			t.Errorf("unexpected result for %s in %+v: got:%t want:%t", test.at, test.cfg, got, test.want)
+		}
+	}
+}
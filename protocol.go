@@ -9,18 +9,41 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"machine"
 	"slices"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
-// uartReader is a UART packet reader.
+// uartSource is a buffered source of UART data.
+type uartSource interface {
+	Buffered() int
+	Read(p []byte) (int, error)
+}
+
+// uartReader is a UART packet reader. The reader polls the UART for data
+// at an interval that backs off from minWait to maxWait while the line is
+// idle and drops to minWait while a frame is being received.
 type uartReader struct {
-	src  *machine.UART
+	src  uartSource
 	buf  [16]byte
-	wait time.Duration
+	wait time.Duration // Current poll interval.
+
+	minWait time.Duration
+	maxWait time.Duration
+
+	// stats, if not nil, collects polling
+	// statistics.
+	stats *uartStats
+
+	// beat, if not nil, is called on each
+	// poll to record progress.
+	beat func()
+
+	// pause, if not nil, suspends reading
+	// from src while it holds true.
+	pause *atomic.Bool
 
 	start byte
 	len   int
@@ -39,10 +62,36 @@ func (r *uartReader) packet(ctx context.Context) ([]byte, error) {
 			return nil, ctx.Err()
 		default:
 		}
+		if len(r.read) >= r.len {
+			// A complete frame was read with
+			// the previous packet.
+			return r.next()
+		}
+		if r.beat != nil {
+			r.beat()
+		}
+		if r.pause != nil && r.pause.Load() {
+			time.Sleep(r.maxWait)
+			continue
+		}
+		if r.stats != nil {
+			r.stats.polls.Add(1)
+		}
 		if r.src.Buffered() == 0 {
+			if r.stats != nil {
+				r.stats.idlePolls.Add(1)
+			}
+			if len(r.read) != 0 {
+				// Mid-frame, so the rest of
+				// the frame is imminent.
+				time.Sleep(r.minWait)
+				continue
+			}
 			time.Sleep(r.wait)
+			r.wait = min(2*r.wait, r.maxWait)
 			continue
 		}
+		r.wait = r.minWait
 
 		n, err := r.src.Read(r.buf[:])
 		if err != nil {
@@ -50,20 +99,82 @@ func (r *uartReader) packet(ctx context.Context) ([]byte, error) {
 			r.read = r.read[:0]
 			return b, err
 		}
+		n = len(faults.dropBytes(r.buf[:n]))
 		if n == 0 {
 			continue
 		}
+		if r.stats != nil {
+			r.stats.bytesRead.Add(uint64(n))
+		}
 
 		if (len(r.read) == 0 && r.buf[0] == r.start) || len(r.read) != 0 {
 			r.read = append(r.read, r.buf[:n]...)
+		} else if r.stats != nil {
+			// Out of frame data is discarded.
+			r.stats.resyncs.Add(1)
 		}
 		if len(r.read) < r.len {
 			continue
 		}
-		pkt := r.pkt
-		pkt, r.read, err = nextPacket(r.pkt, r.read, r.start, r.len)
-		return pkt, err
+		return r.next()
+	}
+}
+
+// next returns the packet at the start of the data read.
+func (r *uartReader) next() ([]byte, error) {
+	faults.corruptFrame(r.read[:r.len])
+	pkt, rest, err := nextPacket(r.pkt, r.read, r.start, r.len)
+	r.read = rest
+	if r.stats != nil {
+		switch err {
+		case nil:
+			r.stats.frames.Add(1)
+			r.stats.lastFrame.Store(time.Now().UnixNano())
+		case errShortPacket, errLongPacket:
+			r.stats.resyncs.Add(1)
+		}
+	}
+	return pkt, err
+}
+
+// uartStats holds statistics for a UART.
+type uartStats struct {
+	polls     atomic.Uint64 // Number of polls for data.
+	idlePolls atomic.Uint64 // Number of polls that found no data.
+
+	bytesRead    atomic.Uint64 // Number of bytes read.
+	bytesWritten atomic.Uint64 // Number of bytes written.
+	frames       atomic.Uint64 // Number of complete frames read.
+	resyncs      atomic.Uint64 // Number of framing losses.
+	lastFrame    atomic.Int64  // Unix nanosecond time of the last frame.
+}
+
+// uartSnapshot is a point-in-time copy of a uartStats.
+type uartSnapshot struct {
+	Polls        uint64     `json:"polls"`
+	IdlePolls    uint64     `json:"idle_polls"`
+	BytesRead    uint64     `json:"bytes_read"`
+	BytesWritten uint64     `json:"bytes_written"`
+	Frames       uint64     `json:"frames"`
+	Resyncs      uint64     `json:"resyncs"`
+	LastFrame    *time.Time `json:"last_frame,omitempty"`
+}
+
+// snapshot returns a copy of the statistics in s.
+func (s *uartStats) snapshot() uartSnapshot {
+	snap := uartSnapshot{
+		Polls:        s.polls.Load(),
+		IdlePolls:    s.idlePolls.Load(),
+		BytesRead:    s.bytesRead.Load(),
+		BytesWritten: s.bytesWritten.Load(),
+		Frames:       s.frames.Load(),
+		Resyncs:      s.resyncs.Load(),
+	}
+	if t := s.lastFrame.Load(); t != 0 {
+		last := time.Unix(0, t)
+		snap.LastFrame = &last
 	}
+	return snap
 }
 
 // nextPacket fills dst with an n-packet from src and returns the packet and
@@ -110,6 +221,52 @@ var (
 	errLongPacket  = errors.New("packet too long")
 )
 
+// Frame start bytes.
+const (
+	handsetStart    = 0xa5 // Handset-to-controller frame.
+	controllerStart = 0x5a // Controller-to-handset frame.
+)
+
+// Handset key bits.
+const (
+	keyM    = 1 << iota // Memory.
+	key1                // Preset 1.
+	key2                // Preset 2.
+	key3                // Preset 3.
+	key4                // Preset 4.
+	keyUp               // Up.
+	keyDown             // Down.
+)
+
+// frameLen is the length of an AOKE frame including the
+// start and checksum bytes.
+const frameLen = 5
+
+// checksum returns the checksum of the frame content bytes in p.
+func checksum(p []byte) byte {
+	var sum byte
+	for _, b := range p {
+		sum += b
+	}
+	return sum
+}
+
+// newFrame returns a frame with the given start byte and content bytes
+// followed by the checksum of the content.
+func newFrame(start byte, content ...byte) []byte {
+	f := make([]byte, 0, len(content)+2)
+	f = append(f, start)
+	f = append(f, content...)
+	return append(f, checksum(content))
+}
+
+// keyFrame returns a handset frame marking the buttons in keys as pressed.
+// The third content byte is the complement of keys so that the checksum
+// is always 0xff.
+func keyFrame(keys byte) []byte {
+	return newFrame(handsetStart, 0x00, keys, ^keys)
+}
+
 // contErr is a controller error state.
 type contErr byte
 
@@ -120,7 +277,7 @@ func newContErr(p []byte) error {
 		return nil
 	}
 	var check error
-	if p[0]+p[1]+p[2] != p[3] {
+	if checksum(p[:3]) != p[3] {
 		check = errChecksumMismatch
 	}
 	h, _ := digit(p[1])
@@ -133,17 +290,14 @@ func newContErr(p []byte) error {
 
 func (e contErr) Error() string { return fmt.Sprintf("E%02d", e) }
 
-// key returns the set of buttons that are marked as pressed in the provided
-// packet.
-func key(p []byte) (string, error) {
-	if len(p) != 4 {
+// aokeKeys returns the set of buttons that are marked as pressed in the
+// AOKE handset frame pkt.
+func aokeKeys(pkt []byte) (string, error) {
+	if len(pkt) != aokeLine.handset.len || pkt[0] != aokeLine.handset.start {
 		return "", errInvalidPacketLength
 	}
-	var check byte
-	for _, b := range p[:3] {
-		check += b
-	}
-	if check != p[3] {
+	p := pkt[1:]
+	if checksum(p[:3]) != p[3] {
 		return "", errChecksumMismatch
 	}
 	const press = "m1234ud"
@@ -167,11 +321,13 @@ type position struct {
 	exponent int
 }
 
-// height returns the position for the height encoded in p.
-func height(p []byte) (position, error) {
-	if len(p) != 4 {
+// aokeHeight returns the position for the height encoded in the AOKE
+// controller frame pkt.
+func aokeHeight(pkt []byte) (position, error) {
+	if len(pkt) != aokeLine.controller.len || pkt[0] != aokeLine.controller.start {
 		return position{}, errInvalidPacketLength
 	}
+	p := pkt[1:]
 	if bytes.Equal(p, []byte{0, 0, 0, 0}) {
 		return position{}, errNoHeight
 	}
@@ -183,12 +339,10 @@ func height(p []byte) (position, error) {
 		return position{}, err
 	}
 	var (
-		check byte
-		mant  int
-		dot   = 2
+		mant int
+		dot  = 2
 	)
 	for i, b := range p[:3] {
-		check += b
 		d, ok := digit(b)
 		if ok {
 			if dot != 2 {
@@ -198,12 +352,21 @@ func height(p []byte) (position, error) {
 		}
 		mant = 10*mant + int(d-'0')
 	}
-	if check != p[3] {
+	if checksum(p[:3]) != p[3] {
 		return position{mant, dot - 2}, errChecksumMismatch
 	}
 	return position{mant, dot - 2}, nil
 }
 
+// aokeIdle reports whether pkt is the frame with empty content that the
+// controller sends once the handset display has timed out. The display
+// only times out while the desk is still, so the frame marks that any
+// move has ended.
+func aokeIdle(pkt []byte) bool {
+	_, err := aokeHeight(pkt)
+	return err == errNoHeight
+}
+
 func (p position) String() string {
 	switch {
 	case p.exponent == 0:
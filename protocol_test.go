@@ -0,0 +1,221 @@
+// Copyright ©2025 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"slices"
+	"testing"
+	"time"
+)
+
+// fakeUART is a uartSource that returns its chunks of data one read at a
+// time. A nil chunk is an idle poll. Once all the chunks have been read,
+// reads return io.EOF.
+type fakeUART struct {
+	chunks [][]byte
+}
+
+func (u *fakeUART) Buffered() int {
+	if len(u.chunks) == 0 {
+		return 1
+	}
+	if u.chunks[0] == nil {
+		u.chunks = u.chunks[1:]
+		return 0
+	}
+	return len(u.chunks[0])
+}
+
+func (u *fakeUART) Read(p []byte) (int, error) {
+	if len(u.chunks) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, u.chunks[0])
+	u.chunks[0] = u.chunks[0][n:]
+	if len(u.chunks[0]) == 0 {
+		u.chunks = u.chunks[1:]
+	}
+	return n, nil
+}
+
+// newTestReader returns a uartReader of handset frames reading from src.
+func newTestReader(src uartSource, stats *uartStats, beats *int) *uartReader {
+	return &uartReader{
+		src:     src,
+		wait:    time.Microsecond,
+		minWait: time.Microsecond,
+		maxWait: time.Microsecond,
+		stats:   stats,
+		beat:    func() { *beats++ },
+		start:   handsetStart,
+		len:     frameLen,
+	}
+}
+
+type packetResult struct {
+	pkt []byte
+	err error
+}
+
+// readPackets returns the first n results from r.
+func readPackets(r *uartReader, n int) []packetResult {
+	var got []packetResult
+	for range n {
+		pkt, err := r.packet(context.Background())
+		got = append(got, packetResult{pkt: slices.Clone(pkt), err: err})
+	}
+	return got
+}
+
+var uartReaderTests = []struct {
+	name    string
+	chunks  [][]byte
+	want    []packetResult
+	frames  uint64
+	resyncs uint64
+	idle    uint64
+}{
+	{
+		name:   "frame",
+		chunks: [][]byte{keyFrame(keyUp)},
+		want:   []packetResult{{pkt: keyFrame(keyUp)}},
+		frames: 1,
+	},
+	{
+		name:   "split frame",
+		chunks: [][]byte{keyFrame(keyUp)[:2], nil, keyFrame(keyUp)[2:]},
+		want:   []packetResult{{pkt: keyFrame(keyUp)}},
+		frames: 1,
+		idle:   1,
+	},
+	{
+		name:   "idle line",
+		chunks: [][]byte{nil, nil, nil, keyFrame(keyDown)},
+		want:   []packetResult{{pkt: keyFrame(keyDown)}},
+		frames: 1,
+		idle:   3,
+	},
+	{
+		name:   "two frames",
+		chunks: [][]byte{slices.Concat(keyFrame(keyUp), keyFrame(key1))},
+		want:   []packetResult{{pkt: keyFrame(keyUp)}, {pkt: keyFrame(key1)}},
+		frames: 2,
+	},
+	{
+		name:    "out of frame",
+		chunks:  [][]byte{{0x00, 0xff, 0x12}, keyFrame(keyUp)},
+		want:    []packetResult{{pkt: keyFrame(keyUp)}},
+		frames:  1,
+		resyncs: 1,
+	},
+	{
+		name:    "short frame",
+		chunks:  [][]byte{slices.Concat([]byte{handsetStart, 0x00}, keyFrame(keyUp))},
+		want:    []packetResult{{pkt: []byte{handsetStart, 0x00}, err: errShortPacket}, {pkt: keyFrame(keyUp)}},
+		frames:  1,
+		resyncs: 1,
+	},
+	{
+		name:   "end mid frame",
+		chunks: [][]byte{keyFrame(keyUp), keyFrame(keyDown)[:3]},
+		want:   []packetResult{{pkt: keyFrame(keyUp)}, {pkt: keyFrame(keyDown)[:3], err: io.EOF}},
+		frames: 1,
+	},
+}
+
+func TestUARTReader(t *testing.T) {
+	for _, test := range uartReaderTests {
+		var (
+			stats uartStats
+			beats int
+		)
+		var n uint64
+		for _, c := range test.chunks {
+			n += uint64(len(c))
+		}
+		r := newTestReader(&fakeUART{chunks: slices.Clone(test.chunks)}, &stats, &beats)
+		got := readPackets(r, len(test.want))
+		for i, g := range got {
+			w := test.want[i]
+			if !bytes.Equal(g.pkt, w.pkt) || g.err != w.err {
+				t.Errorf("unexpected packet %d for %s: got:%x %v want:%x %v", i, test.name, g.pkt, g.err, w.pkt, w.err)
+			}
+		}
+		snap := stats.snapshot()
+		if snap.Frames != test.frames {
+			t.Errorf("unexpected frame count for %s: got:%d want:%d", test.name, snap.Frames, test.frames)
+		}
+		if snap.Resyncs != test.resyncs {
+			t.Errorf("unexpected resync count for %s: got:%d want:%d", test.name, snap.Resyncs, test.resyncs)
+		}
+		if snap.IdlePolls != test.idle {
+			t.Errorf("unexpected idle poll count for %s: got:%d want:%d", test.name, snap.IdlePolls, test.idle)
+		}
+		if snap.BytesRead != n {
+			t.Errorf("unexpected bytes read for %s: got:%d want:%d", test.name, snap.BytesRead, n)
+		}
+		if uint64(beats) != snap.Polls {
+			t.Errorf("unexpected beat count for %s: got:%d want:%d", test.name, beats, snap.Polls)
+		}
+	}
+}
+
+func TestUARTReaderCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	var beats int
+	r := newTestReader(&fakeUART{chunks: [][]byte{keyFrame(keyUp)}}, nil, &beats)
+	_, err := r.packet(ctx)
+	if err != context.Canceled {
+		t.Errorf("unexpected error for cancelled read: got:%v want:%v", err, context.Canceled)
+	}
+	if beats != 0 {
+		t.Errorf("unexpected beats for cancelled read: got:%d want:0", beats)
+	}
+}
+
+var aokeIdleTests = []struct {
+	name string
+	pkt  []byte
+	want bool
+}{
+	{name: "height", pkt: newFrame(controllerStart, 0x07, 0xdb, 0x6d), want: false}, // 72.5
+	{name: "display off", pkt: newFrame(controllerStart, 0, 0, 0), want: true},
+	{name: "reset", pkt: []byte{controllerStart, 0x77, 0x6d, 0x78, 0x5c}, want: false},
+	{name: "short", pkt: []byte{controllerStart, 0, 0, 0}, want: false},
+}
+
+func TestAokeIdle(t *testing.T) {
+	for _, test := range aokeIdleTests {
+		got := aokeIdle(test.pkt)
+		if got != test.want {
+			t.Errorf("unexpected idle for %s: got:%t want:%t", test.name, got, test.want)
+		}
+	}
+}
+
+// TestIdleFrameEndsMove checks that a move is ended by an idle frame
+// without waiting for the height to settle.
+func TestIdleFrameEndsMove(t *testing.T) {
+	m := &mitm{}
+	cfg := defaultConfig.clone()
+	m.cfg.Store(&cfg)
+	m.setPosition(position{mantissa: 720, exponent: -1})
+	m.setPosition(position{mantissa: 725, exponent: -1})
+	if !m.moving() {
+		t.Fatal("expected desk to be moving after a change in height")
+	}
+	m.idleFrame(newFrame(controllerStart, 0x07, 0xdb, 0x6d))
+	if !m.moving() {
+		t.Error("unexpected end of move after a height frame")
+	}
+	m.idleFrame(newFrame(controllerStart, 0, 0, 0))
+	if m.moving() {
+		t.Error("expected end of move after an idle frame")
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright ©2025 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// A unit is commissioned by provisioning its WiFi credentials and,
+// optionally, its host name over Bluetooth. The provisioned values are
+// held in flash and take precedence over those built in to the firmware,
+// so a build does not need to carry site credentials. Since Bluetooth
+// clients are not authenticated, provisioning is only accepted while the
+// unit has no provisioned network or cannot join its network; a unit that
+// is online is reconfigured over HTTP.
+
+const (
+	// maxSSID is the length in bytes of the
+	// longest WiFi SSID.
+	maxSSID = 32
+
+	// minPassphrase and maxPassphrase are the
+	// bounds on the length in bytes of a WPA2
+	// passphrase.
+	minPassphrase = 8
+	maxPassphrase = 63
+
+	// maxHostname is the length in bytes of the
+	// longest host name, leaving room for the
+	// unique name suffix.
+	maxHostname = 63 - 7
+)
+
+var (
+	errProvision   = errors.New("invalid provisioning")
+	errProvisioned = errors.New("network is provisioned and online")
+)
+
+// wifiCredentials is the provisioned WiFi network.
+type wifiCredentials struct {
+	SSID string `json:"ssid"`
+
+	// Password is the WPA2 passphrase, empty
+	// for an open network. It is held in the
+	// clear since it is needed to join.
+	Password string `json:"password,omitempty"`
+}
+
+// validCredentials returns an error if the SSID and passphrase cannot be
+// used to join a network.
+func validCredentials(ssid, pass string) error {
+	if ssid == "" || len(ssid) > maxSSID {
+		return fmt.Errorf("%w: ssid length %d", errProvision, len(ssid))
+	}
+	if pass != "" && (len(pass) < minPassphrase || len(pass) > maxPassphrase) {
+		return fmt.Errorf("%w: passphrase length %d", errProvision, len(pass))
+	}
+	return nil
+}
+
+// validHostname returns an error if name is not a valid host name label.
+// An empty name is valid and selects the default host name.
+func validHostname(name string) error {
+	if name == "" {
+		return nil
+	}
+	if len(name) > maxHostname || name[0] == '-' || name[len(name)-1] == '-' {
+		return fmt.Errorf("%w: host name %q", errProvision, name)
+	}
+	for _, c := range []byte(name) {
+		switch {
+		case 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-':
+		default:
+			return fmt.Errorf("%w: host name %q", errProvision, name)
+		}
+	}
+	return nil
+}
+
+// wifiCredentials returns the provisioned WiFi SSID and passphrase. The
+// SSID is empty if the device has not been provisioned.
+func (m *mitm) wifiCredentials() (ssid, pass string) {
+	c := m.store.get().WiFi
+	if c == nil {
+		return "", ""
+	}
+	return c.SSID, c.Password
+}
+
+// provision stores the WiFi credentials and host name. The credentials
+// are used from the next attempt to join the network, and the host name
+// from the next time the network stack is set up. If ssid is empty, the
+// stored credentials are left unchanged.
+func (m *mitm) provision(ssid, pass, hostname string) error {
+	if ssid != "" {
+		err := validCredentials(ssid, pass)
+		if err != nil {
+			return err
+		}
+	}
+	err := validHostname(hostname)
+	if err != nil {
+		return err
+	}
+	return m.store.update(func(s *persistent) {
+		if ssid != "" {
+			s.WiFi = &wifiCredentials{SSID: ssid, Password: pass}
+		}
+		s.Hostname = hostname
+	})
+}
+
+// provisionable returns errProvisioned if the WiFi settings may not be
+// provisioned over Bluetooth because the device has been provisioned and
+// its network is not offline.
+func (m *mitm) provisionable() error {
+	switch m.networkStatus() {
+	case networkOffline:
+		return nil
+	case networkOnline:
+		return errProvisioned
+	}
+	if ssid, _ := m.wifiCredentials(); ssid != "" {
+		return errProvisioned
+	}
+	return nil
+}
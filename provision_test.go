@@ -0,0 +1,45 @@
+// Copyright ©2025 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build http || !bluetooth
+
+package main
+
+import "testing"
+
+var provisionableTests = []struct {
+	name        string
+	provisioned bool
+	online      bool
+	offline     bool
+	want        error
+}{
+	{name: "new starting", want: nil},
+	{name: "new offline", offline: true, want: nil},
+	{name: "new online", online: true, want: errProvisioned},
+	{name: "provisioned starting", provisioned: true, want: errProvisioned},
+	{name: "provisioned offline", provisioned: true, offline: true, want: nil},
+	{name: "provisioned online", provisioned: true, online: true, want: errProvisioned},
+}
+
+func TestProvisionable(t *testing.T) {
+	for _, test := range provisionableTests {
+		m := &mitm{}
+		m.store.flash = newFakeFlash(storeBlocks, 1024, 256)
+		if test.provisioned {
+			err := m.provision("office", "correct horse", "")
+			if err != nil {
+				t.Fatalf("unexpected error provisioning for %s: %v", test.name, err)
+			}
+		}
+		if test.online {
+			m.net.Store(&netStack{})
+		}
+		m.offline.Store(test.offline)
+		got := m.provisionable()
+		if got != test.want {
+			t.Errorf("unexpected result for %s: got:%v want:%v", test.name, got, test.want)
+		}
+	}
+}
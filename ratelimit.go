@@ -0,0 +1,177 @@
+// Copyright ©2025 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"math"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// HTTP clients are rate limited by source address with a token bucket so
+// that a misbehaving client cannot keep the controller UART saturated.
+// Clients that are repeatedly refused are banned for a time.
+
+// rateClients is the number of client addresses tracked by the rate
+// limiter. When the table is full, the least recently seen client that
+// is not banned is forgotten.
+const rateClients = 16
+
+var errRateLimited = errors.New("too many requests")
+
+// rateLimitConfig is the configuration for HTTP rate limiting.
+type rateLimitConfig struct {
+	// Rate is the sustained number of requests
+	// per second allowed from each client. Zero
+	// disables rate limiting.
+	Rate float64 `json:"rate"`
+	// Burst is the number of requests a client
+	// may make in excess of Rate.
+	Burst int `json:"burst"`
+
+	// Strikes is the number of refused requests
+	// within Ban after which a client is banned
+	// for Ban. Zero disables banning.
+	Strikes int      `json:"strikes"`
+	Ban     duration `json:"ban"`
+}
+
+// validate returns an error if the rate limit configuration is not valid.
+func (c rateLimitConfig) validate() error {
+	if math.IsNaN(c.Rate) || c.Rate < 0 || c.Rate > 100 {
+		return errors.New("rate limit out of range")
+	}
+	if c.Rate == 0 {
+		return nil
+	}
+	if c.Burst < 1 || c.Burst > 100 {
+		return errors.New("rate limit burst out of range")
+	}
+	if c.Strikes < 0 {
+		return errors.New("negative rate limit strikes")
+	}
+	if c.Strikes != 0 && (c.Ban < duration(time.Second) || c.Ban > duration(24*time.Hour)) {
+		return errors.New("rate limit ban out of range")
+	}
+	return nil
+}
+
+// rateLimiter is a table of per-client token buckets.
+type rateLimiter struct {
+	mu      sync.Mutex
+	clients [rateClients]rateClient
+}
+
+// rateClient is the rate limit state of a client address.
+type rateClient struct {
+	addr   netip.Addr
+	tokens float64
+	last   time.Time // Time of the last request.
+
+	strikes int       // Refused requests since struck.
+	struck  time.Time // Time of the first counted refusal.
+	banned  time.Time // End of the current ban.
+}
+
+// allow returns whether a request from addr at now is permitted under cfg.
+// If it is not, retry is the time until a request will be accepted, and
+// ban is true if the request caused the client to be banned.
+func (l *rateLimiter) allow(addr netip.Addr, cfg rateLimitConfig, now time.Time) (ok bool, retry time.Duration, ban bool) {
+	if cfg.Rate == 0 {
+		return true, 0, false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	c := l.client(addr, cfg, now)
+	if now.Before(c.banned) {
+		return false, c.banned.Sub(now), false
+	}
+	c.tokens = math.Min(float64(cfg.Burst), c.tokens+cfg.Rate*now.Sub(c.last).Seconds())
+	c.last = now
+	if c.tokens >= 1 {
+		c.tokens--
+		return true, 0, false
+	}
+	retry = time.Duration((1 - c.tokens) / cfg.Rate * float64(time.Second))
+	if cfg.Strikes == 0 {
+		return false, retry, false
+	}
+	if now.Sub(c.struck) > time.Duration(cfg.Ban) {
+		c.strikes = 0
+		c.struck = now
+	}
+	c.strikes++
+	if c.strikes < cfg.Strikes {
+		return false, retry, false
+	}
+	c.strikes = 0
+	c.banned = now.Add(time.Duration(cfg.Ban))
+	return false, time.Duration(cfg.Ban), true
+}
+
+// client returns the entry for addr, replacing the least recently seen
+// client that is not banned if addr is not in the table. The caller must
+// hold l.mu.
+func (l *rateLimiter) client(addr netip.Addr, cfg rateLimitConfig, now time.Time) *rateClient {
+	var victim *rateClient
+	for i := range l.clients {
+		c := &l.clients[i]
+		if c.addr == addr {
+			return c
+		}
+		switch {
+		case !c.addr.IsValid():
+			if victim == nil || victim.addr.IsValid() {
+				victim = c
+			}
+		case now.Before(c.banned):
+		case victim == nil || (victim.addr.IsValid() && c.last.Before(victim.last)):
+			victim = c
+		}
+	}
+	if victim == nil {
+		// Every client is banned, so forget the
+		// one whose ban ends soonest.
+		victim = &l.clients[0]
+		for i := range l.clients[1:] {
+			if c := &l.clients[i+1]; c.banned.Before(victim.banned) {
+				victim = c
+			}
+		}
+	}
+	*victim = rateClient{addr: addr, tokens: float64(cfg.Burst), last: now}
+	return victim
+}
+
+// ban is a banned client address.
+type ban struct {
+	Addr      string  `json:"addr"`
+	Remaining float64 `json:"remaining_seconds"`
+}
+
+// bans returns the clients banned at now.
+func (l *rateLimiter) bans(now time.Time) []ban {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var b []ban
+	for _, c := range l.clients {
+		if c.addr.IsValid() && now.Before(c.banned) {
+			b = append(b, ban{Addr: c.addr.String(), Remaining: math.Ceil(c.banned.Sub(now).Seconds())})
+		}
+	}
+	return b
+}
+
+// unban lifts all bans.
+func (l *rateLimiter) unban() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i := range l.clients {
+		l.clients[i].banned = time.Time{}
+		l.clients[i].strikes = 0
+	}
+}
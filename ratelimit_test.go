@@ -0,0 +1,137 @@
+// Copyright ©2025 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterAllow(t *testing.T) {
+	t0 := time.Unix(1735689600, 0)
+	a := netip.MustParseAddr("192.168.1.5")
+	b := netip.MustParseAddr("192.168.1.6")
+	type request struct {
+		addr      netip.Addr
+		at        time.Duration // Since t0.
+		wantOK    bool
+		wantRetry time.Duration
+		wantBan   bool
+	}
+	for _, test := range []struct {
+		name     string
+		cfg      rateLimitConfig
+		requests []request
+	}{
+		{
+			name: "disabled",
+			cfg:  rateLimitConfig{},
+			requests: []request{
+				{addr: a, wantOK: true},
+				{addr: a, wantOK: true},
+				{addr: a, wantOK: true},
+			},
+		},
+		{
+			name: "burst",
+			cfg:  rateLimitConfig{Rate: 1, Burst: 2},
+			requests: []request{
+				{addr: a, wantOK: true},
+				{addr: a, wantOK: true},
+				{addr: a, wantOK: false, wantRetry: time.Second},
+				{addr: a, at: 500 * time.Millisecond, wantOK: false, wantRetry: 500 * time.Millisecond},
+				{addr: a, at: time.Second, wantOK: true},
+				// Other clients have their own bucket.
+				{addr: b, at: time.Second, wantOK: true},
+			},
+		},
+		{
+			name: "refill capped at burst",
+			cfg:  rateLimitConfig{Rate: 10, Burst: 2},
+			requests: []request{
+				{addr: a, wantOK: true},
+				{addr: a, at: time.Hour, wantOK: true},
+				{addr: a, at: time.Hour, wantOK: true},
+				{addr: a, at: time.Hour, wantOK: false, wantRetry: 100 * time.Millisecond},
+			},
+		},
+		{
+			name: "ban",
+			cfg:  rateLimitConfig{Rate: 1, Burst: 1, Strikes: 2, Ban: duration(time.Minute)},
+			requests: []request{
+				{addr: a, wantOK: true},
+				{addr: a, wantOK: false, wantRetry: time.Second},
+				{addr: a, wantOK: false, wantRetry: time.Minute, wantBan: true},
+				{addr: a, at: 30 * time.Second, wantOK: false, wantRetry: 30 * time.Second},
+				{addr: b, at: 30 * time.Second, wantOK: true},
+				{addr: a, at: time.Minute, wantOK: true},
+			},
+		},
+		{
+			name: "strikes expire",
+			cfg:  rateLimitConfig{Rate: 1, Burst: 1, Strikes: 2, Ban: duration(time.Minute)},
+			requests: []request{
+				{addr: a, wantOK: true},
+				{addr: a, wantOK: false, wantRetry: time.Second},
+				{addr: a, at: 2 * time.Minute, wantOK: true},
+				{addr: a, at: 2 * time.Minute, wantOK: false, wantRetry: time.Second},
+				{addr: a, at: 2 * time.Minute, wantOK: false, wantRetry: time.Minute, wantBan: true},
+			},
+		},
+	} {
+		var l rateLimiter
+		for i, r := range test.requests {
+			ok, retry, ban := l.allow(r.addr, test.cfg, t0.Add(r.at))
+			if ok != r.wantOK || retry != r.wantRetry || ban != r.wantBan {
+				t.Errorf("unexpected result for %s request %d from %s at %v: got:%t %v %t want:%t %v %t",
+					test.name, i, r.addr, r.at, ok, retry, ban, r.wantOK, r.wantRetry, r.wantBan)
+			}
+		}
+	}
+}
+
+func TestRateLimiterTable(t *testing.T) {
+	t0 := time.Unix(1735689600, 0)
+	cfg := rateLimitConfig{Rate: 1, Burst: 1, Strikes: 1, Ban: duration(time.Hour)}
+	addr := func(i int) netip.Addr {
+		return netip.MustParseAddr(fmt.Sprint("10.0.0.", i))
+	}
+	var l rateLimiter
+
+	// Ban the first client.
+	l.allow(addr(0), cfg, t0)
+	_, _, ban := l.allow(addr(0), cfg, t0)
+	if !ban {
+		t.Fatal("expected ban")
+	}
+	// Fill the table with other clients, and then
+	// more, so that the least recently seen are
+	// forgotten.
+	for i := 1; i < 2*rateClients; i++ {
+		ok, _, _ := l.allow(addr(i), cfg, t0.Add(time.Duration(i)*time.Second))
+		if !ok {
+			t.Errorf("unexpected refusal of new client %s", addr(i))
+		}
+	}
+	bans := l.bans(t0.Add(time.Minute))
+	if len(bans) != 1 || bans[0].Addr != addr(0).String() || bans[0].Remaining != 3540 {
+		t.Errorf("unexpected bans: got:%+v want:[{Addr:%s Remaining:3540}]", bans, addr(0))
+	}
+	ok, _, _ := l.allow(addr(0), cfg, t0.Add(time.Minute))
+	if ok {
+		t.Error("banned client forgotten when the table filled")
+	}
+
+	l.unban()
+	if bans := l.bans(t0.Add(time.Minute)); len(bans) != 0 {
+		t.Errorf("unexpected bans after unban: %+v", bans)
+	}
+	ok, _, _ = l.allow(addr(0), cfg, t0.Add(time.Minute))
+	if !ok {
+		t.Error("unexpected refusal after unban")
+	}
+}
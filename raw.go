@@ -0,0 +1,105 @@
+// Copyright ©2025 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"machine"
+	"slices"
+	"sync"
+	"time"
+)
+
+// rawConfirmTimeout is the time a raw frame confirmation token
+// remains valid.
+const rawConfirmTimeout = 30 * time.Second
+
+// rawConfig is the configuration of raw frame injection.
+type rawConfig struct {
+	// Enabled is whether raw frames may be
+	// sent to the controller.
+	Enabled bool `json:"enabled"`
+	// Starts is the set of frame start bytes
+	// that raw frames may use.
+	Starts []int `json:"starts,omitempty"`
+}
+
+// validate returns an error if the raw injection configuration is not valid.
+func (c rawConfig) validate() error {
+	for _, b := range c.Starts {
+		if b < 0 || 0xff < b {
+			return fmt.Errorf("invalid raw start byte: %d", b)
+		}
+	}
+	return nil
+}
+
+var (
+	errRawDisabled = errors.New("raw frames disabled")
+	errRawToken    = errors.New("invalid or expired confirmation token")
+)
+
+// rawGuard holds the confirmation token for the pending raw frame. A token
+// may only be used once and only for the frame it was issued for.
+type rawGuard struct {
+	mu      sync.Mutex
+	token   string
+	frame   []byte
+	expires time.Time
+}
+
+// issue returns a new confirmation token for frame, replacing any pending
+// token.
+func (g *rawGuard) issue(frame []byte) string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var tok [8]byte
+	for i := 0; i < len(tok); i += 4 {
+		r, _ := machine.GetRNG()
+		binary.LittleEndian.PutUint32(tok[i:], r)
+	}
+	g.token = hex.EncodeToString(tok[:])
+	g.frame = slices.Clone(frame)
+	g.expires = time.Now().Add(rawConfirmTimeout)
+	return g.token
+}
+
+// redeem consumes the pending token and returns whether it matches token
+// and was issued for frame.
+func (g *rawGuard) redeem(token string, frame []byte) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	pending, pendingFrame, expires := g.token, g.frame, g.expires
+	g.token, g.frame = "", nil
+	if pending == "" || time.Now().After(expires) {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(pending)) == 1 && bytes.Equal(frame, pendingFrame)
+}
+
+// checkRaw returns an error if frame may not be sent to the controller.
+// Frames must be handset frames of the configured length with an allowed
+// start byte and a valid checksum.
+func (m *mitm) checkRaw(frame []byte) error {
+	cfg := m.config().Raw
+	if !cfg.Enabled {
+		return errRawDisabled
+	}
+	if len(frame) != m.line.handset.len {
+		return fmt.Errorf("invalid raw frame length: %d", len(frame))
+	}
+	if !slices.Contains(cfg.Starts, int(frame[0])) {
+		return fmt.Errorf("raw start byte not allowed: %#02x", frame[0])
+	}
+	if checksum(frame[1:len(frame)-1]) != frame[len(frame)-1] {
+		return errChecksumMismatch
+	}
+	return nil
+}
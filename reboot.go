@@ -0,0 +1,101 @@
+// Copyright ©2025 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"machine"
+	"time"
+)
+
+// Before the device is restarted, the HTTP server is drained so that a
+// restart does not cut off a request or a move part way through. New
+// connections are refused, in-flight requests and moves are given time
+// to complete, and connections still open after that are closed.
+
+const (
+	// drainTimeout is the longest time a restart
+	// waits for in-flight requests and moves.
+	drainTimeout = 10 * time.Second
+
+	// drainPoll is the interval at which the
+	// drain checks for completion.
+	drainPoll = 100 * time.Millisecond
+)
+
+var errDraining = errors.New("device is restarting")
+
+// restarting is flashed before the device restarts.
+var restarting = ledSequence{
+	{on: true, duration: 500 * time.Millisecond},
+	{on: false, duration: 100 * time.Millisecond},
+	{on: true, duration: 500 * time.Millisecond},
+	{on: false, duration: 100 * time.Millisecond},
+	{on: true, duration: 500 * time.Millisecond},
+	{on: false, duration: 500 * time.Millisecond},
+}
+
+// drain marks the device as draining before a restart, after which new
+// HTTP connections are refused. It returns errDraining if the device is
+// already draining.
+func (m *mitm) drain() error {
+	if m.draining.Swap(true) {
+		return errDraining
+	}
+	return nil
+}
+
+// reboot restarts the device after draining in-flight requests and moves
+// for up to drainTimeout. The TCP connection keep is not waited for, so
+// that the connection requesting the restart does not delay it. drain
+// must have been called before reboot.
+func (m *mitm) reboot(ctx context.Context, log *slog.Logger, reason string, keep uint32) {
+	start := time.Now()
+	deadline := start.Add(drainTimeout)
+	log.LogAttrs(ctx, slog.LevelWarn, "draining for restart", slog.String("reason", reason))
+
+	// Hold the move lock so that no move can
+	// start once the current one completes.
+	locked := m.mu.TryLock()
+	for !locked && time.Now().Before(deadline) {
+		time.Sleep(drainPoll)
+		locked = m.mu.TryLock()
+	}
+	if !locked {
+		log.LogAttrs(ctx, slog.LevelWarn, "restart during move")
+	}
+	for time.Now().Before(deadline) && (m.moving() || m.conns.active(connTCP, keep)) {
+		time.Sleep(drainPoll)
+	}
+	closed := m.conns.closeAll(connTCP, keep)
+
+	// This is the last record logged before the
+	// restart, so it records how the drain went.
+	log.LogAttrs(ctx, slog.LevelWarn, "restart",
+		slog.String("reason", reason),
+		slog.Duration("drain", time.Since(start)),
+		slog.Int("closed", closed),
+		slog.Bool("moving", m.moving()),
+	)
+
+	// Let the heartbeat pick up the sequence, after
+	// any that is already queued, and flash it in
+	// full before resetting.
+	var d time.Duration
+	for _, s := range restarting {
+		d += s.duration
+	}
+	queueBy := time.Now().Add(2 * time.Second)
+	for queued := false; !queued && time.Now().Before(queueBy); {
+		queued = m.flashOnce(restarting)
+		if !queued {
+			time.Sleep(drainPoll)
+		}
+	}
+	time.Sleep(d + 2*time.Second)
+	machine.CPUReset()
+}
@@ -0,0 +1,194 @@
+// Copyright ©2025 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"machine"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// relayCooldown is the minimum time between automatic power cycles. It
+// prevents a controller that fails again immediately after power-up
+// from being cycled continuously.
+const relayCooldown = 10 * time.Minute
+
+var (
+	errNoRelay    = errors.New("no power relay configured")
+	errRelayBusy  = errors.New("power cycle in progress")
+	errRelayEarly = errors.New("power cycled too recently")
+)
+
+// relayConfig is the configuration for an optional relay that interrupts
+// the power supply to the desk controller.
+type relayConfig struct {
+	// Pin is the GPIO number driving the relay. The
+	// controller is unpowered while the pin is high.
+	// Zero indicates that no relay is fitted.
+	Pin int `json:"pin,omitempty"`
+	// Off is the time the controller is held
+	// unpowered during a power cycle.
+	Off duration `json:"off"`
+	// Errors is the set of controller error codes
+	// that cause an automatic power cycle.
+	Errors []int `json:"errors,omitempty"`
+}
+
+// reservedPins are the GPIO numbers that are used by the device and so
+// may not be used to drive the relay.
+var reservedPins = []int{
+	0, 1, // Handset UART.
+	8, 9, // Controller UART.
+	15, // Handset button.
+	16, // Controller act line.
+}
+
+// validate returns an error if the relay configuration is not valid.
+func (c relayConfig) validate() error {
+	if c.Pin == 0 {
+		return nil
+	}
+	if c.Pin < 0 || int(machine.GPIO22) < c.Pin || slices.Contains(reservedPins, c.Pin) {
+		return fmt.Errorf("invalid relay pin: %d", c.Pin)
+	}
+	if c.Off < duration(time.Second) || c.Off > duration(time.Minute) {
+		return errors.New("relay off time out of range")
+	}
+	return nil
+}
+
+// relay is a power relay for the desk controller.
+type relay struct {
+	mu   sync.Mutex // Held for the duration of a power cycle.
+	pin  machine.Pin
+	last time.Time
+
+	// faulted is set when an error reported by
+	// the controller has been acted on, and is
+	// cleared by a frame without an error.
+	faulted atomic.Bool
+}
+
+// setPin configures the relay to be driven by GPIO n, releasing any
+// previously configured pin. If n is zero, the relay is disabled.
+func (r *relay) setPin(n int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	pin := machine.NoPin
+	if n != 0 {
+		pin = machine.Pin(n)
+	}
+	if pin == r.pin {
+		return
+	}
+	if r.pin != machine.NoPin {
+		r.pin.Configure(machine.PinConfig{Mode: machine.PinInput})
+	}
+	r.pin = pin
+	if r.pin != machine.NoPin {
+		r.pin.Configure(machine.PinConfig{Mode: machine.PinOutput})
+		r.pin.Low()
+	}
+}
+
+// powerCycle removes power from the controller for the configured off
+// time. If auto is true, the power cycle is refused if the previous
+// power cycle was within relayCooldown.
+func (m *mitm) powerCycle(ctx context.Context, reason string, auto bool) error {
+	if !m.relay.mu.TryLock() {
+		return errRelayBusy
+	}
+	defer m.relay.mu.Unlock()
+	if m.relay.pin == machine.NoPin {
+		return errNoRelay
+	}
+	if auto && time.Since(m.relay.last) < relayCooldown {
+		return errRelayEarly
+	}
+	off := time.Duration(m.config().Relay.Off)
+	m.log.LogAttrs(ctx, slog.LevelWarn, "power cycle controller", slog.String("reason", reason), slog.Duration("off", off))
+	m.powerLost.Store(true)
+	m.relay.pin.High()
+	time.Sleep(off)
+	m.relay.pin.Low()
+	m.relay.last = time.Now()
+	m.metrics.powerCycles.Add(1)
+	m.raise(ctx, alert{Name: eventPower, State: "cycled", Detail: reason, Message: m.text(msgPowerCycled, reason)})
+	return nil
+}
+
+// controllerError handles an error code reported by the controller,
+// power cycling the controller if a relay is fitted and the code is
+// configured as unrecoverable. The controller repeats the error frame for
+// as long as the error persists, so only the first error of an episode is
+// acted on; the episode ends when the controller sends a frame without an
+// error.
+func (m *mitm) controllerError(ctx context.Context, code contErr) {
+	cfg := m.cfg.Load().Relay
+	if cfg.Pin == 0 || !slices.Contains(cfg.Errors, int(code)) {
+		return
+	}
+	if m.relay.faulted.Swap(true) {
+		return
+	}
+	go func() {
+		err := m.powerCycle(ctx, code.Error(), true)
+		switch err {
+		case nil:
+		case errRelayBusy, errRelayEarly, errNoRelay:
+			m.log.LogAttrs(ctx, slog.LevelDebug, "power cycle skipped", slog.Any("code", code), slog.Any("err", err))
+		default:
+			m.log.LogAttrs(ctx, slog.LevelError, "power cycle", slog.Any("code", code), slog.Any("err", err))
+		}
+	}()
+}
+
+// controllerRecovered ends an episode of controller errors.
+func (m *mitm) controllerRecovered() {
+	m.relay.faulted.Store(false)
+}
+
+// handshakeLead is the time the act line is held high before the
+// handshake chirp is sent, matching the handset's start-up sequence.
+const handshakeLead = 16 * time.Millisecond
+
+// powerRestored brings the device state back into line with the controller
+// after its power has been restored, detected by a silence followed by
+// reset frames. Moves in progress are abandoned since the controller has
+// forgotten them, the height is marked unknown until the controller
+// reports one, and the handset start-up handshake and a keep-alive are
+// replayed so that the controller's watchdog is restarted. The act line is
+// returned to the state required by the route.
+func (m *mitm) powerRestored(ctx context.Context) {
+	log := m.logFor("uart")
+	log.LogAttrs(ctx, slog.LevelWarn, "controller power restored")
+	m.releaseMotion()
+	m.presetCancelled()
+	m.desk.clearTarget()
+	m.heightKnown.Store(false)
+	m.raise(ctx, alert{Name: eventPower, State: "restored", Message: m.text(msgPowerRestored)})
+
+	if !m.idleLock(ctx) {
+		return
+	}
+	defer m.mu.Unlock()
+	m.act.High()
+	time.Sleep(handshakeLead)
+	err := m.command(ctx, log, sourceDevice, actionHandshake)
+	if err != nil {
+		log.LogAttrs(ctx, slog.LevelError, "replay handshake", slog.Any("err", err))
+		return
+	}
+	err = m.command(ctx, log, sourceDevice, actionKeepAlive)
+	if err != nil {
+		log.LogAttrs(ctx, slog.LevelError, "replay keep-alive", slog.Any("err", err))
+	}
+}
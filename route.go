@@ -0,0 +1,90 @@
+// Copyright ©2025 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// route is the state of the pass-through route from the handset button
+// to the controller act line.
+type route int32
+
+const (
+	routePass route = iota // The act line follows the handset button.
+	routeOn                // The act line is held high.
+	routeOff               // The act line is held low and the button is ignored.
+)
+
+const (
+	// defaultRouteHold is the time a route override is held
+	// for when no duration is specified.
+	defaultRouteHold = 10 * time.Minute
+	// maxRouteHold is the longest time a route override may
+	// be held for.
+	maxRouteHold = time.Hour
+)
+
+func parseRoute(s string) (route, error) {
+	switch s {
+	case "pass":
+		return routePass, nil
+	case "on":
+		return routeOn, nil
+	case "off":
+		return routeOff, nil
+	default:
+		return routePass, fmt.Errorf("unknown route: %q", s)
+	}
+}
+
+func (r route) String() string {
+	switch r {
+	case routePass:
+		return "pass"
+	case routeOn:
+		return "on"
+	case routeOff:
+		return "off"
+	default:
+		return fmt.Sprintf("route(%d)", r)
+	}
+}
+
+// setRoute sets the pass-through route to r. If r is not routePass, the
+// route reverts to pass-through after d.
+func (m *mitm) setRoute(ctx context.Context, r route, d time.Duration) {
+	m.routeMu.Lock()
+	defer m.routeMu.Unlock()
+	if m.routeTimer != nil {
+		m.routeTimer.Stop()
+		m.routeTimer = nil
+	}
+	m.log.LogAttrs(ctx, slog.LevelInfo, "set route", slog.Any("route", r), slog.Duration("hold", d))
+	m.route.Store(int32(r))
+	m.actIdle()
+	if r != routePass {
+		m.routeTimer = time.AfterFunc(d, func() {
+			m.log.LogAttrs(ctx, slog.LevelInfo, "route override expired", slog.Any("route", r))
+			m.setRoute(ctx, routePass, 0)
+		})
+	}
+}
+
+// actIdle sets the act line to its state when no remote command is being
+// sent to the controller.
+func (m *mitm) actIdle() {
+	switch route(m.route.Load()) {
+	case routeOn:
+		m.act.High()
+	case routeOff:
+		m.act.Low()
+	default:
+		m.act.Set(m.debounce.state.Load())
+	}
+}
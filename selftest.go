@@ -0,0 +1,171 @@
+// Copyright ©2025 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"machine"
+	"time"
+)
+
+// selftest is the result of a wiring self-test. Each path is a connection
+// from an output to an input that is expected to be looped back.
+type selftest []loopResult
+
+// Wiring self-test fixtures.
+const (
+	// fixtureLoopback is a loopback plug fitted to
+	// each RJ45 socket, connecting the tx and rx
+	// lines of each UART to each other.
+	fixtureLoopback = "loopback"
+
+	// fixtureCable is a straight-through cable
+	// connecting the two RJ45 sockets, connecting
+	// the tx line of each UART to the rx line of
+	// the other and the action line to the button.
+	fixtureCable = "cable"
+)
+
+// fixtures are the valid self-test fixtures.
+var fixtures = []string{fixtureLoopback, fixtureCable}
+
+// fixturePath is a path provided by a self-test fixture.
+type fixturePath struct {
+	from, to int // Indexes into the UARTs under test.
+}
+
+// fixturePaths returns the UART paths provided by fixture and whether the
+// fixture connects the action line to the button line.
+func fixturePaths(fixture string) (paths []fixturePath, pin bool, err error) {
+	const handset, controller = 0, 1
+	switch fixture {
+	case fixtureLoopback:
+		return []fixturePath{{handset, handset}, {controller, controller}}, false, nil
+	case fixtureCable:
+		return []fixturePath{{handset, controller}, {controller, handset}}, true, nil
+	default:
+		return nil, false, fmt.Errorf("invalid fixture: %q", fixture)
+	}
+}
+
+// loopResult is the result of a single self-test path.
+type loopResult struct {
+	from, to string
+	ok       bool
+}
+
+// code returns the failure code for the self-test. Each failed path sets
+// the bit corresponding to its index in the test. A zero code indicates
+// that all paths provided by the fixture passed.
+func (t selftest) code() byte {
+	var c byte
+	for i, r := range t {
+		if !r.ok {
+			c |= 1 << i
+		}
+	}
+	return c
+}
+
+// WriteTo writes a human readable report of the test to dst.
+func (t selftest) WriteTo(dst io.Writer) (int64, error) {
+	var n int64
+	for _, r := range t {
+		state := "fail"
+		if r.ok {
+			state = "ok"
+		}
+		c, err := fmt.Fprintf(dst, "%s->%s %s\n", r.from, r.to, state)
+		n += int64(c)
+		if err != nil {
+			return n, err
+		}
+	}
+	c, err := fmt.Fprintf(dst, "code=%d\n", t.code())
+	return n + int64(c), err
+}
+
+// selftest checks the wiring of the UART headers and the action line
+// by sending test patterns from each output and checking that they are
+// received on the input that fixture loops it back to. Only the paths
+// that the fixture provides are tested. It must only be run with the
+// desk disconnected and the fixture fitted. The result is flashed on the
+// LED as an error sequence of the failure code.
+func (m *mitm) selftest(ctx context.Context, fixture string) (selftest, error) {
+	paths, pin, err := fixturePaths(fixture)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.diag.Store(true)
+	defer m.diag.Store(false)
+
+	m.log.LogAttrs(ctx, slog.LevelInfo, "start self-test", slog.String("fixture", fixture))
+	uarts := []struct {
+		name string
+		uart *machine.UART
+	}{
+		{name: "handset", uart: m.handset},
+		{name: "controller", uart: m.controller},
+	}
+	var res selftest
+	for _, p := range paths {
+		tx, rx := uarts[p.from], uarts[p.to]
+		pattern := []byte{0x55, 0xaa, byte(p.from), byte(p.to), 0xff}
+		ok := loopback(tx.uart, rx.uart, pattern, m.line.gap())
+		res = append(res, loopResult{from: tx.name + ".tx", to: rx.name + ".rx", ok: ok})
+	}
+	if pin {
+		res = append(res, loopResult{from: "act", to: "button", ok: m.pinLoopback()})
+	}
+	m.log.LogAttrs(ctx, slog.LevelInfo, "self-test complete", slog.Int("code", int(res.code())))
+
+	m.flashOnce(errorSequence(res.code()))
+	return res, nil
+}
+
+// loopback writes pattern to tx and reports whether it is read back
+// from rx after waiting for wait.
+func loopback(tx, rx *machine.UART, pattern []byte, wait time.Duration) bool {
+	drain(rx)
+	_, err := tx.Write(pattern)
+	if err != nil {
+		return false
+	}
+	time.Sleep(wait)
+	var buf [16]byte
+	n, _ := rx.Read(buf[:])
+	return bytes.Equal(buf[:n], pattern)
+}
+
+// drain discards any buffered input in u.
+func drain(u *machine.UART) {
+	var buf [16]byte
+	for u.Buffered() != 0 {
+		_, err := u.Read(buf[:])
+		if err != nil {
+			return
+		}
+	}
+}
+
+// pinLoopback reports whether the state of the act line is reflected
+// on the button line.
+func (m *mitm) pinLoopback() bool {
+	defer m.actIdle()
+	for _, high := range []bool{true, false} {
+		m.act.Set(high)
+		time.Sleep(time.Millisecond)
+		if m.button.Get() != high {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,128 @@
+// Copyright ©2025 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"machine"
+	"sync"
+	"time"
+)
+
+// The web dashboard may be protected with a single password. A browser
+// that logs in with the password is given a session cookie that is
+// accepted in place of a bearer token.
+
+const (
+	// sessionCookie is the name of the session
+	// cookie.
+	sessionCookie = "desk_session"
+
+	// sessionLifetime is the time a session is
+	// valid for after login.
+	sessionLifetime = 12 * time.Hour
+
+	// maxSessions is the number of concurrent
+	// sessions. When a new session is opened with
+	// all in use, the oldest is closed.
+	maxSessions = 4
+
+	// minUIPassword is the length of the shortest
+	// dashboard password that may be set.
+	minUIPassword = 8
+)
+
+var (
+	errShortPassword = errors.New("password too short")
+	errNoUIPassword  = errors.New("no dashboard password set")
+)
+
+// sessionTable holds the open dashboard sessions.
+type sessionTable struct {
+	mu       sync.Mutex
+	sessions [maxSessions]struct {
+		id      [16]byte
+		expires time.Time
+	}
+}
+
+// open opens a new session at now lasting for lifetime and returns its
+// identifier.
+func (t *sessionTable) open(now time.Time, lifetime time.Duration) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := &t.sessions[0]
+	for i := range t.sessions[1:] {
+		if c := &t.sessions[i+1]; c.expires.Before(s.expires) {
+			s = c
+		}
+	}
+	for i := 0; i < len(s.id); i += 4 {
+		r, _ := machine.GetRNG()
+		binary.LittleEndian.PutUint32(s.id[i:], r)
+	}
+	s.expires = now.Add(lifetime)
+	return hex.EncodeToString(s.id[:])
+}
+
+// valid returns whether id identifies a session that is open at now.
+func (t *sessionTable) valid(id string, now time.Time) bool {
+	b, err := hex.DecodeString(id)
+	if err != nil || len(b) != 16 {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	ok := false
+	for _, s := range t.sessions {
+		if now.Before(s.expires) && subtle.ConstantTimeCompare(s.id[:], b) == 1 {
+			ok = true
+		}
+	}
+	return ok
+}
+
+// close closes the session identified by id.
+func (t *sessionTable) close(id string) {
+	b, err := hex.DecodeString(id)
+	if err != nil || len(b) != 16 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i, s := range t.sessions {
+		if subtle.ConstantTimeCompare(s.id[:], b) == 1 {
+			t.sessions[i].expires = time.Time{}
+		}
+	}
+}
+
+// clear closes all sessions.
+func (t *sessionTable) clear() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i := range t.sessions {
+		t.sessions[i].expires = time.Time{}
+	}
+}
+
+// setUIPassword stores the dashboard password, closing any open sessions.
+// If password is empty, the stored password is removed.
+func (m *mitm) setUIPassword(password string) error {
+	var cred *credential
+	if password != "" {
+		if len(password) < minUIPassword {
+			return errShortPassword
+		}
+		c := newCredential("", password)
+		cred = &c
+	}
+	err := m.store.update(func(p *persistent) { p.UIPassword = cred })
+	m.sessions.clear()
+	return err
+}
@@ -0,0 +1,51 @@
+// Copyright ©2025 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build http || !bluetooth
+
+package main
+
+import (
+	"net/http"
+	"slices"
+	"time"
+)
+
+// A read-only share token gives someone helping to debug the device
+// temporary access to its diagnostic endpoints without giving them
+// control of the desk or its configuration. The token is passed in the
+// share query parameter so that it can be sent as a link.
+
+const (
+	// shareParam is the name of the query
+	// parameter holding a share token.
+	shareParam = "share"
+
+	// defaultShareLifetime and maxShareLifetime
+	// are the default and longest times a share
+	// token is valid for.
+	defaultShareLifetime = time.Hour
+	maxShareLifetime     = 24 * time.Hour
+)
+
+// sharePaths are the paths that may be read with a share token.
+var sharePaths = []string{
+	"/api/v1/health",
+	"/api/v1/log",
+	"/api/v1/log/page",
+	"/api/v1/uart",
+}
+
+// shared returns whether r is a read of a shared path carrying a share
+// token, and whether the token is valid.
+func (m *mitm) shared(r *http.Request) (shared, ok bool) {
+	token := r.URL.Query().Get(shareParam)
+	if token == "" {
+		return false, false
+	}
+	if !safeMethod(r.Method) || !slices.Contains(sharePaths, r.URL.Path) {
+		return true, false
+	}
+	return true, m.shares.valid(token, time.Now())
+}
@@ -0,0 +1,90 @@
+// Copyright ©2025 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Requests may be signed with an HMAC-SHA256 of their timestamp, method,
+// request URI and body using a key shared with the device, so that scripted
+// clients can authenticate without sending a secret over the network.
+
+const (
+	// signatureSkew is the largest difference
+	// between the timestamp of a signed request
+	// and the device clock.
+	signatureSkew = 30 * time.Second
+
+	// minSigningKey is the length in bytes of
+	// the shortest signing key that may be set.
+	minSigningKey = 16
+
+	// maxSignedBody is the length of the longest
+	// body of a signed request.
+	maxSignedBody = 4096
+
+	// replayLen is the number of signatures of
+	// recently accepted requests remembered to
+	// detect replays.
+	replayLen = 32
+)
+
+var (
+	errShortKey  = errors.New("signing key too short")
+	errReplay    = errors.New("replayed request")
+	errReplayCap = errors.New("too many signed requests")
+)
+
+// requestMAC returns the HMAC-SHA256 of a request with key.
+func requestMAC(key []byte, timestamp, method, uri string, body []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte{'\n'})
+	mac.Write([]byte(method))
+	mac.Write([]byte{'\n'})
+	mac.Write([]byte(uri))
+	mac.Write([]byte{'\n'})
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+// replayCache holds the signatures of signed requests accepted within the
+// last two signatureSkew periods, the time for which their timestamps are
+// valid.
+type replayCache struct {
+	mu   sync.Mutex
+	sigs [replayLen]struct {
+		sum [sha256.Size]byte
+		at  time.Time
+	}
+	next int
+}
+
+// add records the signature sum of a request accepted at now. It returns
+// errReplay if sum has already been accepted, and errReplayCap if every
+// remembered signature is still valid, since forgetting one would allow
+// it to be replayed.
+func (c *replayCache) add(sum []byte, now time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, s := range c.sigs {
+		if now.Sub(s.at) < 2*signatureSkew && hmac.Equal(s.sum[:], sum) {
+			return errReplay
+		}
+	}
+	s := &c.sigs[c.next]
+	if !s.at.IsZero() && now.Sub(s.at) < 2*signatureSkew {
+		return errReplayCap
+	}
+	copy(s.sum[:], sum)
+	s.at = now
+	c.next = (c.next + 1) % len(c.sigs)
+	return nil
+}
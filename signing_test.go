@@ -0,0 +1,75 @@
+// Copyright ©2025 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestReplayCache(t *testing.T) {
+	t0 := time.Unix(1735689600, 0)
+	sum := func(i int) []byte {
+		s := sha256.Sum256([]byte(fmt.Sprint(i)))
+		return s[:]
+	}
+	type add struct {
+		sig  int
+		at   time.Duration // Since t0.
+		want error
+	}
+	for _, test := range []struct {
+		name string
+		adds []add
+	}{
+		{
+			name: "replay",
+			adds: []add{
+				{sig: 0, at: 0, want: nil},
+				{sig: 1, at: time.Second, want: nil},
+				{sig: 0, at: 2 * time.Second, want: errReplay},
+				{sig: 1, at: 2*signatureSkew - time.Second, want: errReplay},
+			},
+		},
+		{
+			name: "expired",
+			adds: []add{
+				{sig: 0, at: 0, want: nil},
+				{sig: 0, at: 2 * signatureSkew, want: nil},
+				{sig: 0, at: 2*signatureSkew + time.Second, want: errReplay},
+			},
+		},
+		{
+			name: "capacity",
+			adds: func() []add {
+				var adds []add
+				for i := range replayLen {
+					adds = append(adds, add{sig: i, at: time.Duration(i) * time.Millisecond, want: nil})
+				}
+				return append(adds,
+					// Every remembered signature is valid.
+					add{sig: replayLen, at: time.Second, want: errReplayCap},
+					// The refused request is not remembered.
+					add{sig: replayLen, at: 2 * time.Second, want: errReplayCap},
+					// The oldest signature has expired.
+					add{sig: replayLen, at: 2 * signatureSkew, want: nil},
+					add{sig: replayLen, at: 2*signatureSkew + time.Millisecond, want: errReplay},
+					// The second oldest has not expired.
+					add{sig: replayLen + 1, at: 2 * signatureSkew, want: errReplayCap},
+				)
+			}(),
+		},
+	} {
+		var c replayCache
+		for i, a := range test.adds {
+			got := c.add(sum(a.sig), t0.Add(a.at))
+			if got != a.want {
+				t.Errorf("unexpected result for %s add %d of signature %d at %v: got:%v want:%v", test.name, i, a.sig, a.at, got, a.want)
+			}
+		}
+	}
+}
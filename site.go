@@ -0,0 +1,15 @@
+// Copyright ©2025 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build site
+
+package main
+
+import _ "embed"
+
+// siteConfig is the site configuration overlay, a JSON object holding
+// the configuration fields that differ from the built-in defaults.
+//
+//go:embed site.json
+var siteConfig []byte
@@ -0,0 +1,92 @@
+// Copyright ©2025 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build http || !bluetooth
+
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/soypat/seqs/eth/ntp"
+	"github.com/soypat/seqs/stacks"
+)
+
+const (
+	// ntpPort is the local UDP port used for
+	// time server requests.
+	ntpPort = 49101
+
+	// ntpTimeout is the time allowed for a
+	// time server to respond.
+	ntpTimeout = 5 * time.Second
+)
+
+var errNTPTimeout = errors.New("time server request timed out")
+
+// runSNTP periodically syncs the device clock with the configured time
+// server until ctx is cancelled.
+func (m *mitm) runSNTP(ctx context.Context, n *netStack) {
+	log := m.logFor("wifi")
+	client := stacks.NewNTPClient(n.stack, ntpPort)
+	wait := time.Duration(0)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+		cfg := m.config().NTP
+		wait = time.Duration(cfg.Interval)
+		if cfg.Server == "" {
+			continue
+		}
+		wall, local, err := n.queryNTP(ctx, client, cfg.Server)
+		if err != nil {
+			log.LogAttrs(ctx, slog.LevelError, "sntp", slog.String("server", cfg.Server), slog.Any("err", err))
+			// Retry sooner than the configured
+			// interval, but not aggressively.
+			wait = min(wait, time.Minute)
+			continue
+		}
+		step := m.clock.sync(wall, local)
+		log.LogAttrs(ctx, slog.LevelInfo, "sntp", slog.Time("time", wall), slog.Duration("step", step))
+	}
+}
+
+// queryNTP requests the time from the time server at host and returns the
+// server's time and the local time at which it applied.
+func (n *netStack) queryNTP(ctx context.Context, client *stacks.NTPClient, host string) (wall, local time.Time, err error) {
+	addr, mac, err := n.resolve(host)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	start := time.Now()
+	err = client.BeginDefaultRequest(mac, addr)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	defer n.stack.CloseUDP(ntpPort)
+	for !client.IsDone() {
+		if ctx.Err() != nil || time.Since(start) > ntpTimeout {
+			client.Abort()
+			if ctx.Err() != nil {
+				return time.Time{}, time.Time{}, ctx.Err()
+			}
+			return time.Time{}, time.Time{}, errNTPTimeout
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	local = time.Now()
+	// The client's request clock starts at the NTP
+	// base time when the request is sent, so the
+	// offset it reports is relative to the base time
+	// and the server time on receipt of the response
+	// is the offset plus the round trip time.
+	wall = ntp.BaseTime().Add(client.Offset() + local.Sub(start))
+	return wall, local, nil
+}
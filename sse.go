@@ -0,0 +1,83 @@
+// Copyright ©2025 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build http || !bluetooth
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// faultRepeat is the interval at which a persisting controller
+// error is repeated in an event stream.
+const faultRepeat = time.Minute
+
+// streamEvents writes the current height and then height changes, key
+// presses and controller errors from sub to w as server-sent events until
+// the client goes away, ctx is cancelled or maxStream has elapsed. The
+// controller repeats its error in every frame, so an error is only sent
+// when it changes or every faultRepeat while it persists.
+func (m *mitm) streamEvents(ctx context.Context, w http.ResponseWriter, r *http.Request, sub *subscription) error {
+	ctx, cancel := context.WithTimeout(ctx, maxStream)
+	defer cancel()
+	stop := context.AfterFunc(r.Context(), cancel)
+	defer stop()
+	flusher, _ := w.(http.Flusher)
+	var (
+		lastFault contErr
+		faultSent time.Time
+		buf       []byte
+	)
+	current := m.heightKnown.Load()
+	for {
+		var (
+			e       event
+			dropped int
+			err     error
+		)
+		if current {
+			e = event{kind: heightChanged, time: time.Now(), pos: m.position.Load().(position)}
+			current = false
+		} else {
+			e, dropped, err = sub.next(ctx)
+			if err != nil {
+				return nil
+			}
+		}
+		buf = buf[:0]
+		if dropped != 0 {
+			buf = fmt.Appendf(buf, ": lost %d events\n\n", dropped)
+		}
+		wall := m.clock.at(e.time).Format(time.RFC3339Nano)
+		switch e.kind {
+		case heightChanged:
+			buf = append(buf, "event: height\ndata: {\"height\":"...)
+			buf = strconv.AppendFloat(buf, e.pos.units(), 'f', -1, 64)
+			buf = fmt.Appendf(buf, ",\"time\":%q}\n\n", wall)
+		case keyPressed:
+			buf = fmt.Appendf(buf, "event: key\ndata: {\"keys\":%q,\"time\":%q}\n\n", e.keys, wall)
+		case fault:
+			if e.code == lastFault && e.time.Sub(faultSent) < faultRepeat {
+				break
+			}
+			lastFault, faultSent = e.code, e.time
+			buf = fmt.Appendf(buf, "event: fault\ndata: {\"code\":%q,\"time\":%q}\n\n", e.code.Error(), wall)
+		}
+		if len(buf) == 0 {
+			continue
+		}
+		_, err = w.Write(buf)
+		if err != nil {
+			return err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
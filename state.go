@@ -0,0 +1,203 @@
+// Copyright ©2025 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Directions of desk movement.
+const (
+	directionIdle = "idle"
+	directionUp   = "up"
+	directionDown = "down"
+)
+
+// deskState tracks the movement of the desk from consecutive reported
+// heights, along with the target of the current move and the most recent
+// handset key press and controller error.
+//
+// The direction of movement is idle until the reported height changes,
+// then up or down following the sign of each change, returning to idle
+// once the height has not changed for motionSettle.
+type deskState struct {
+	mu        sync.Mutex
+	dir       string
+	changed   time.Time // Time of the last change in reported height.
+	target    target
+	targetSet time.Time
+	key       string
+	keyAt     time.Time // Wall clock time.
+	err       contErr
+	errAt     time.Time // Wall clock time.
+}
+
+// target is the destination of a move.
+type target struct {
+	Preset int      `json:"preset,omitempty"` // Zero if the move is not to a preset.
+	Height *float64 `json:"height"`           // nil if the height is not known.
+}
+
+// targetHeight returns a target that is not a preset at height h.
+func targetHeight(h float64) target {
+	return target{Height: &h}
+}
+
+// observe records a change in reported height from old to p at now.
+func (s *deskState) observe(old, p position, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch d := p.units() - old.units(); {
+	case d > 0:
+		s.dir = directionUp
+	case d < 0:
+		s.dir = directionDown
+	}
+	s.changed = now
+}
+
+// setTarget records t as the target of the move that is starting.
+func (s *deskState) setTarget(t target) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.target = t
+	s.targetSet = time.Now()
+}
+
+// clearTarget removes the target of the current move.
+func (s *deskState) clearTarget() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.target = target{}
+}
+
+// keyPressed records a handset key press at the wall clock time t.
+func (s *deskState) keyPressed(keys string, t time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.key, s.keyAt = keys, t
+}
+
+// controllerError records a controller error at the wall clock time t.
+func (s *deskState) controllerError(code contErr, t time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err, s.errAt = code, t
+}
+
+// stateSnapshot is the JSON form of the device state.
+type stateSnapshot struct {
+	Height    *float64    `json:"height"`
+	Unit      string      `json:"unit"`
+	Percent   *float64    `json:"position_pct"` // Height in the learned range, nil if not known.
+	Moving    bool        `json:"moving"`
+	Direction string      `json:"direction"`
+	Target    *target     `json:"target"`
+	Lock      string      `json:"lock,omitempty"` // Owner of the motion lease.
+	LastKey   *keyEvent   `json:"last_key"`
+	LastError *errorEvent `json:"last_error"`
+
+	Display          string `json:"display"`
+	Network          string `json:"network"`
+	Route            string `json:"route"`
+	BluetoothBlocked bool   `json:"bluetooth_blocked"`
+	Kiosk            bool   `json:"kiosk"`
+	Profile          string `json:"profile"` // Scheduled motion profile.
+
+	Cycle   cycleSnapshot   `json:"cycle"`
+	Meeting meetingSnapshot `json:"meeting"`
+
+	// Features is the availability of optional
+	// features, as reported by the API index.
+	Features map[string]bool `json:"features,omitempty"`
+}
+
+type cycleSnapshot struct {
+	Running         bool    `json:"running"`
+	Phase           string  `json:"phase,omitempty"`
+	Remaining       float64 `json:"remaining_seconds,omitempty"`
+	ReminderPending bool    `json:"reminder_pending"`
+}
+
+type meetingSnapshot struct {
+	Active    bool    `json:"active"`
+	Remaining float64 `json:"remaining_seconds,omitempty"`
+}
+
+type keyEvent struct {
+	Keys string    `json:"keys"`
+	Time time.Time `json:"time"`
+}
+
+type errorEvent struct {
+	Code string    `json:"code"`
+	Time time.Time `json:"time"`
+}
+
+// state returns a snapshot of the device state.
+func (m *mitm) state() stateSnapshot {
+	snap := stateSnapshot{
+		Unit:             m.config().Unit,
+		Moving:           m.moving(),
+		Lock:             m.motionOwner(),
+		Display:          m.displayStatus(),
+		Network:          m.networkStatus(),
+		Route:            route(m.route.Load()).String(),
+		BluetoothBlocked: m.bluetoothBlocked.Load(),
+		Kiosk:            m.kiosk.Load(),
+		Profile:          m.profile(),
+	}
+	if m.heightKnown.Load() {
+		p := m.position.Load().(position)
+		h := p.units()
+		snap.Height = &h
+		if pct, ok := m.percent(p); ok {
+			snap.Percent = &pct
+		}
+	}
+
+	m.cycle.mu.Lock()
+	snap.Cycle = cycleSnapshot{
+		Running:         m.cycle.state.Running,
+		Phase:           m.cycle.state.Phase,
+		ReminderPending: m.reminderPending(),
+	}
+	if snap.Cycle.Running {
+		snap.Cycle.Remaining = time.Until(m.cycle.until).Round(time.Second).Seconds()
+	}
+	m.cycle.mu.Unlock()
+	if m.inMeeting() {
+		snap.Meeting = meetingSnapshot{
+			Active:    true,
+			Remaining: time.Until(time.Unix(0, m.meetingUntil.Load())).Round(time.Second).Seconds(),
+		}
+	}
+
+	s := &m.desk
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if now.Sub(s.changed) >= motionSettle {
+		s.dir = directionIdle
+		// Allow time for the desk to start moving
+		// before the target is considered reached.
+		if now.Sub(s.targetSet) >= leaseGrace {
+			s.target = target{}
+		}
+	}
+	snap.Direction = s.dir
+	if s.target != (target{}) {
+		t := s.target
+		snap.Target = &t
+	}
+	if s.key != "" {
+		snap.LastKey = &keyEvent{Keys: s.key, Time: s.keyAt}
+	}
+	if !s.errAt.IsZero() {
+		snap.LastError = &errorEvent{Code: s.err.Error(), Time: s.errAt}
+	}
+	return snap
+}
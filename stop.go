@@ -0,0 +1,35 @@
+// Copyright ©2025 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math"
+	"time"
+)
+
+var errStopped = errors.New("move stopped")
+
+// stop interrupts any move in progress and sends the stop command to the
+// controller on behalf of src. Command sequences in progress are abandoned
+// at the next frame, the motion lease is released and the target of the
+// move is discarded.
+func (m *mitm) stop(ctx context.Context, log *slog.Logger, src string) error {
+	// Ask the holder of m.mu to give it up before
+	// waiting for it.
+	m.stopping.Store(true)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.stopping.Store(false)
+	m.stops.Add(1)
+	m.releaseMotion()
+	m.presetCancelled()
+	m.desk.clearTarget()
+	m.events.publish(event{kind: targetChanged, time: time.Now(), height: math.NaN()})
+	log.LogAttrs(ctx, slog.LevelWarn, "stop", slog.String("src", src))
+	return m.command(ctx, log, src, actionStop)
+}
@@ -0,0 +1,387 @@
+// Copyright ©2025 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"slices"
+	"sync"
+	"time"
+)
+
+// persistent is the device state that is retained across restarts.
+type persistent struct {
+	// Version is the version of the layout of
+	// the stored state.
+	Version int `json:"version"`
+
+	Cycle cycleState `json:"cycle"`
+
+	// Presets is the learned height of each
+	// controller memory preset. A zero mantissa
+	// indicates the height is not known.
+	Presets [4]savedPosition `json:"presets"`
+
+	// UniqueName is whether the device's host
+	// and Bluetooth names have the device
+	// identifier suffix appended because of a
+	// name conflict.
+	UniqueName bool `json:"unique_name,omitempty"`
+
+	// LastHeight is the height of the desk when
+	// it last settled, nil if not yet recorded.
+	LastHeight *lastHeight `json:"last_height,omitempty"`
+
+	// Range is the range of heights the desk
+	// has settled at, nil if not yet recorded.
+	Range *heightRange `json:"range,omitempty"`
+
+	// Token is the salted hash of the bearer
+	// token required for HTTP requests that
+	// change state, with an empty user. A token
+	// is not required if nil.
+	Token *credential `json:"token,omitempty"`
+
+	// SigningKey is the key for HMAC-SHA256
+	// signed HTTP requests. Signed requests
+	// are not accepted if nil.
+	SigningKey []byte `json:"signing_key,omitempty"`
+
+	// Kiosk is whether the device is in
+	// read-only kiosk mode.
+	Kiosk bool `json:"kiosk,omitempty"`
+
+	// Config is the configuration changes made
+	// at run time, as a JSON object that is
+	// applied over the build-time defaults at
+	// startup. No changes have been made if nil.
+	Config json.RawMessage `json:"config,omitempty"`
+
+	// TOTPSecret is the secret shared with an
+	// authenticator app for one-time codes
+	// protecting disruptive endpoints. Codes
+	// are not required if nil.
+	TOTPSecret []byte `json:"totp_secret,omitempty"`
+
+	// UIPassword is the salted hash of the
+	// dashboard password, with an empty user.
+	// A session is not required if nil.
+	UIPassword *credential `json:"ui_password,omitempty"`
+
+	// LastUsagePing is the wall clock time the
+	// last usage ping was sent.
+	LastUsagePing time.Time `json:"last_usage_ping,omitempty"`
+
+	// Auth is the HTTP Basic auth credential.
+	// Authentication is not required if nil.
+	Auth *credential `json:"auth,omitempty"`
+
+	// Positions is the user-defined named
+	// positions.
+	Positions []namedPosition `json:"positions,omitempty"`
+
+	// WiFi is the provisioned WiFi network. The
+	// network built in to the firmware is used
+	// if nil.
+	WiFi *wifiCredentials `json:"wifi,omitempty"`
+
+	// Hostname is the provisioned network host
+	// name. baseHostname is used if empty.
+	Hostname string `json:"hostname,omitempty"`
+}
+
+// The persistent state is written as a log of records across a ring of
+// flash erase blocks. Each record is appended after the last, and a block
+// is only erased when the log wraps around to it, spreading wear across
+// the ring. Records carry a sequence number and a CRC of their body; the
+// valid record with the highest sequence number is the current state.
+
+// storeBlocks is the number of erase blocks in the ring.
+const storeBlocks = 8
+
+// recordMagic marks the start of a record in flash.
+var recordMagic = [4]byte{'d', 's', 'k', 'r'}
+
+// recordHeaderLen is the length of the record header; the magic followed
+// by the little-endian uint32 sequence number, body length and IEEE CRC-32
+// of the body.
+const recordHeaderLen = len(recordMagic) + 3*4
+
+// legacyMagic marks the single store record written at the start of flash
+// by firmware before the log was used. Its header is the magic followed by
+// the little-endian uint32 length of the JSON body.
+var legacyMagic = [4]byte{'d', 'e', 's', 'k'}
+
+const legacyHeaderLen = len(legacyMagic) + 4
+
+var errNoStore = errors.New("no stored state")
+
+// blockDevice is a region of flash memory. The flash data region of the
+// device, machine.Flash, is a blockDevice.
+type blockDevice interface {
+	ReadAt(p []byte, off int64) (int, error)
+	WriteAt(p []byte, off int64) (int, error)
+	Size() int64
+	WriteBlockSize() int64
+	EraseBlockSize() int64
+	EraseBlocks(start, len int64) error
+}
+
+// store holds the persistent state of the device and mirrors it to the
+// log of records in flash.
+type store struct {
+	mu    sync.Mutex
+	state persistent
+
+	flash blockDevice // Flash holding the log of records.
+
+	blocks int64  // Number of erase blocks in the ring.
+	block  int64  // Erase block holding the next record.
+	off    int64  // Offset of the next record in block.
+	seq    uint32 // Sequence number of the last record.
+
+	health storeHealth
+}
+
+// storeHealth is the result of recovering the persistent state at startup.
+type storeHealth struct {
+	// Corrupt is the number of records that
+	// failed their CRC check.
+	Corrupt int `json:"corrupt_records"`
+
+	// Fallback is whether the most recent record
+	// could not be used and an earlier one was.
+	Fallback bool `json:"fallback"`
+
+	// Reset is whether no record could be used
+	// and the defaults were used instead.
+	Reset bool `json:"reset"`
+
+	// Errors holds the problems found.
+	Errors []string `json:"errors,omitempty"`
+}
+
+// ok returns whether the state was recovered without problems.
+func (h storeHealth) ok() bool {
+	return h.Corrupt == 0 && !h.Fallback && !h.Reset && len(h.Errors) == 0
+}
+
+// recordLoc is the location of a record in flash.
+type recordLoc struct {
+	seq    uint32
+	addr   int64 // Address of the record body.
+	n      int64 // Length of the record body.
+	legacy bool  // The record was written by older firmware.
+}
+
+// load reads the persistent state from the most recent valid record in
+// flash, migrating it to the current layout. Records that fail their CRC
+// check are skipped, and if the most recent valid record cannot be
+// decoded, earlier records are tried in turn. If no valid state is found,
+// the zero state is used and an error is returned. If parts of the state
+// could not be recovered, the remainder is used and an error is returned.
+// The problems found are recorded in the store health.
+func (s *store) load() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	blockLen := s.flash.EraseBlockSize()
+	s.blocks = min(storeBlocks, s.flash.Size()/blockLen)
+	buf := make([]byte, blockLen)
+	var (
+		recs []recordLoc
+		ends = make([]int64, s.blocks) // End of the written part of each block.
+	)
+	for b := int64(0); b < s.blocks; b++ {
+		_, err := s.flash.ReadAt(buf, b*blockLen)
+		if err != nil {
+			return err
+		}
+		if b == 0 && [4]byte(buf[:len(legacyMagic)]) == legacyMagic {
+			// Recover the state written by older firmware
+			// and start the log after it.
+			n := int64(binary.LittleEndian.Uint32(buf[len(legacyMagic):]))
+			if n <= blockLen-int64(legacyHeaderLen) {
+				recs = append(recs, recordLoc{addr: int64(legacyHeaderLen), n: n, legacy: true})
+			}
+			ends[b] = blockLen
+			continue
+		}
+		for off := int64(0); off+int64(recordHeaderLen) <= blockLen; {
+			hdr := buf[off : off+int64(recordHeaderLen)]
+			if [4]byte(hdr[:len(recordMagic)]) != recordMagic {
+				if !erased(buf[off:]) {
+					// The rest of the block cannot be
+					// written without an erase.
+					ends[b] = blockLen
+				}
+				break
+			}
+			seq := binary.LittleEndian.Uint32(hdr[4:])
+			n := int64(binary.LittleEndian.Uint32(hdr[8:]))
+			sum := binary.LittleEndian.Uint32(hdr[12:])
+			if off+int64(recordHeaderLen)+n > blockLen {
+				s.health.Corrupt++
+				ends[b] = blockLen
+				break
+			}
+			body := off + int64(recordHeaderLen)
+			if crc32.ChecksumIEEE(buf[body:body+n]) == sum {
+				recs = append(recs, recordLoc{seq: seq, addr: b*blockLen + body, n: n})
+			} else {
+				s.health.Corrupt++
+			}
+			off = s.recordEnd(off, n)
+			ends[b] = off
+		}
+	}
+	if s.health.Corrupt != 0 {
+		s.health.Errors = append(s.health.Errors, fmt.Sprintf("%d corrupt records", s.health.Corrupt))
+	}
+
+	// Try the records from the most recent.
+	slices.SortFunc(recs, func(a, b recordLoc) int {
+		switch {
+		case a.legacy != b.legacy:
+			if a.legacy {
+				return 1
+			}
+			return -1
+		case a.seq == b.seq:
+			return 0
+		case int32(a.seq-b.seq) > 0:
+			return -1
+		default:
+			return 1
+		}
+	})
+	if len(recs) != 0 && !recs[0].legacy {
+		s.seq = recs[0].seq
+		s.block = recs[0].addr / blockLen
+		s.off = ends[s.block]
+	} else {
+		s.block = 0
+		s.off = ends[0]
+	}
+	var errs []error
+	for i, rec := range recs {
+		body := make([]byte, rec.n)
+		_, err := s.flash.ReadAt(body, rec.addr)
+		if err == nil {
+			var state persistent
+			state, err = decodeStore(body)
+			if state.Version != 0 {
+				s.state = state
+				s.health.Fallback = i != 0
+				if err != nil {
+					s.health.Errors = append(s.health.Errors, err.Error())
+				}
+				return errors.Join(append(errs, err)...)
+			}
+		}
+		// The record could not be decoded at all.
+		err = fmt.Errorf("record %d: %w", rec.seq, err)
+		s.health.Errors = append(s.health.Errors, err.Error())
+		errs = append(errs, err)
+	}
+	if len(recs) == 0 && s.health.Corrupt == 0 {
+		return errNoStore
+	}
+	s.health.Reset = true
+	return errors.Join(append(errs, errNoStore)...)
+}
+
+// status returns the result of recovering the persistent state.
+func (s *store) status() storeHealth {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h := s.health
+	h.Errors = slices.Clone(h.Errors)
+	return h
+}
+
+// erased returns whether b is in the erased state.
+func erased(b []byte) bool {
+	for _, v := range b {
+		if v != 0xff {
+			return false
+		}
+	}
+	return true
+}
+
+// recordEnd returns the offset following a record with an n byte body
+// written at off, aligned to the flash write block size.
+func (s *store) recordEnd(off, n int64) int64 {
+	wbs := s.flash.WriteBlockSize()
+	return off + (int64(recordHeaderLen)+n+wbs-1)/wbs*wbs
+}
+
+// get returns a copy of the persistent state.
+func (s *store) get() persistent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state
+}
+
+// update applies fn to the persistent state and appends the result to the
+// log in flash. Writes wear the flash, so update should not be called
+// frequently.
+func (s *store) update(fn func(*persistent)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fn(&s.state)
+	s.state.Version = storeVersion
+	body, err := json.Marshal(s.state)
+	if err != nil {
+		return err
+	}
+	blockLen := s.flash.EraseBlockSize()
+	if int64(recordHeaderLen+len(body)) > blockLen {
+		return errors.New("persistent state too large")
+	}
+	if s.blocks == 0 {
+		s.blocks = min(storeBlocks, s.flash.Size()/blockLen)
+	}
+	end := s.recordEnd(s.off, int64(len(body)))
+	if end > blockLen {
+		s.block = (s.block + 1) % s.blocks
+		s.off = 0
+		end = s.recordEnd(0, int64(len(body)))
+	}
+	err = faults.flashWrite()
+	if err != nil {
+		return err
+	}
+	if s.off == 0 {
+		err = s.flash.EraseBlocks(s.block, 1)
+		if err != nil {
+			return err
+		}
+	}
+	// Flash writes must be a multiple of the write block size,
+	// and the padding is left erased.
+	buf := make([]byte, end-s.off)
+	for i := range buf {
+		buf[i] = 0xff
+	}
+	copy(buf, recordMagic[:])
+	binary.LittleEndian.PutUint32(buf[4:], s.seq+1)
+	binary.LittleEndian.PutUint32(buf[8:], uint32(len(body)))
+	binary.LittleEndian.PutUint32(buf[12:], crc32.ChecksumIEEE(body))
+	copy(buf[recordHeaderLen:], body)
+	_, err = s.flash.WriteAt(buf, s.block*blockLen+s.off)
+	// The space is consumed even if the write failed
+	// part way, since it can no longer be written.
+	s.off = end
+	if err != nil {
+		return err
+	}
+	s.seq++
+	return nil
+}
@@ -0,0 +1,335 @@
+// Copyright ©2025 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"testing"
+)
+
+var errTorn = errors.New("torn write")
+
+// fakeFlash is an in-memory blockDevice. Like flash, writes can only clear
+// bits and erasing sets a block to 0xff.
+type fakeFlash struct {
+	mem        []byte
+	writeBlock int64
+	eraseBlock int64
+
+	// tear, if positive, is the number of bytes
+	// written by the next write before it fails.
+	tear int
+}
+
+func newFakeFlash(blocks int, eraseBlock, writeBlock int64) *fakeFlash {
+	f := &fakeFlash{
+		mem:        make([]byte, int64(blocks)*eraseBlock),
+		writeBlock: writeBlock,
+		eraseBlock: eraseBlock,
+	}
+	for i := range f.mem {
+		f.mem[i] = 0xff
+	}
+	return f
+}
+
+func (f *fakeFlash) ReadAt(p []byte, off int64) (int, error) {
+	return copy(p, f.mem[off:]), nil
+}
+
+func (f *fakeFlash) WriteAt(p []byte, off int64) (int, error) {
+	if int64(len(p))%f.writeBlock != 0 || off%f.writeBlock != 0 {
+		return 0, fmt.Errorf("unaligned write of %d bytes at %d", len(p), off)
+	}
+	n := len(p)
+	var err error
+	if f.tear > 0 {
+		n, err = min(f.tear, n), errTorn
+		f.tear = 0
+	}
+	for i, b := range p[:n] {
+		f.mem[off+int64(i)] &= b
+	}
+	return n, err
+}
+
+func (f *fakeFlash) Size() int64           { return int64(len(f.mem)) }
+func (f *fakeFlash) WriteBlockSize() int64 { return f.writeBlock }
+func (f *fakeFlash) EraseBlockSize() int64 { return f.eraseBlock }
+
+func (f *fakeFlash) EraseBlocks(start, n int64) error {
+	for i := start * f.eraseBlock; i < (start+n)*f.eraseBlock; i++ {
+		f.mem[i] = 0xff
+	}
+	return nil
+}
+
+// setHostname returns an update function setting the host name to name.
+func setHostname(name string) func(*persistent) {
+	return func(p *persistent) { p.Hostname = name }
+}
+
+// reload returns a new store loaded from flash.
+func reload(t *testing.T, flash *fakeFlash) *store {
+	t.Helper()
+	s := &store{flash: flash}
+	err := s.load()
+	if err != nil {
+		t.Fatalf("unexpected error loading store: %v", err)
+	}
+	return s
+}
+
+func TestStoreEmpty(t *testing.T) {
+	s := &store{flash: newFakeFlash(storeBlocks, 1024, 256)}
+	err := s.load()
+	if err != errNoStore {
+		t.Errorf("unexpected error loading empty store: got:%v want:%v", err, errNoStore)
+	}
+	if h := s.status(); !h.ok() {
+		t.Errorf("unexpected health of empty store: %+v", h)
+	}
+}
+
+func TestStoreRingWrap(t *testing.T) {
+	flash := newFakeFlash(storeBlocks, 1024, 256)
+	s := &store{flash: flash}
+	// Enough records to wrap around the ring
+	// several times.
+	const updates = 100
+	for i := range updates {
+		err := s.update(setHostname(fmt.Sprint("desk-", i)))
+		if err != nil {
+			t.Fatalf("unexpected error on update %d: %v", i, err)
+		}
+		if i%7 != 0 && i != updates-1 {
+			continue
+		}
+		got := reload(t, flash)
+		want := fmt.Sprint("desk-", i)
+		if got.state.Hostname != want {
+			t.Errorf("unexpected host name after update %d: got:%q want:%q", i, got.state.Hostname, want)
+		}
+		if got.seq != s.seq {
+			t.Errorf("unexpected sequence number after update %d: got:%d want:%d", i, got.seq, s.seq)
+		}
+		if got.block != s.block || got.off != s.off {
+			t.Errorf("unexpected next record location after update %d: got:%d+%d want:%d+%d", i, got.block, got.off, s.block, s.off)
+		}
+		if h := got.status(); !h.ok() {
+			t.Errorf("unexpected health after update %d: %+v", i, h)
+		}
+	}
+	if s.seq != updates {
+		t.Errorf("unexpected sequence number: got:%d want:%d", s.seq, updates)
+	}
+
+	// Continue the log from the loaded store.
+	s = reload(t, flash)
+	err := s.update(setHostname("continued"))
+	if err != nil {
+		t.Fatalf("unexpected error on update: %v", err)
+	}
+	got := reload(t, flash)
+	if got.state.Hostname != "continued" {
+		t.Errorf("unexpected host name after continued update: got:%q want:%q", got.state.Hostname, "continued")
+	}
+}
+
+func TestStoreTornWrite(t *testing.T) {
+	for _, tear := range []int{
+		1,                   // Part of the magic.
+		recordHeaderLen,     // The header alone.
+		recordHeaderLen + 8, // Part of the body.
+	} {
+		t.Run(fmt.Sprint(tear), func(t *testing.T) {
+			flash := newFakeFlash(storeBlocks, 1024, 256)
+			s := &store{flash: flash}
+			for i := range 3 {
+				err := s.update(setHostname(fmt.Sprint("desk-", i)))
+				if err != nil {
+					t.Fatalf("unexpected error on update %d: %v", i, err)
+				}
+			}
+			flash.tear = tear
+			err := s.update(setHostname("torn"))
+			if err != errTorn {
+				t.Fatalf("unexpected error for torn write: got:%v want:%v", err, errTorn)
+			}
+
+			got := &store{flash: flash}
+			err = got.load()
+			if err != nil {
+				t.Errorf("unexpected error loading store: %v", err)
+			}
+			if got.state.Hostname != "desk-2" {
+				t.Errorf("unexpected host name after torn write: got:%q want:%q", got.state.Hostname, "desk-2")
+			}
+			h := got.status()
+			wantCorrupt := 0
+			if tear >= recordHeaderLen {
+				wantCorrupt = 1
+			}
+			if h.Corrupt != wantCorrupt || h.Fallback || h.Reset {
+				t.Errorf("unexpected health after torn write: got:%+v want corrupt:%d", h, wantCorrupt)
+			}
+			// The space of the torn record must not
+			// be reused, since it cannot be written
+			// without an erase.
+			if got.block != s.block || got.off != s.off {
+				t.Errorf("unexpected next record location: got:%d+%d want:%d+%d", got.block, got.off, s.block, s.off)
+			}
+
+			err = got.update(setHostname("after"))
+			if err != nil {
+				t.Fatalf("unexpected error on update after torn write: %v", err)
+			}
+			after := &store{flash: flash}
+			after.load()
+			if after.state.Hostname != "after" {
+				t.Errorf("unexpected host name after recovery: got:%q want:%q", after.state.Hostname, "after")
+			}
+		})
+	}
+}
+
+func TestStoreLegacy(t *testing.T) {
+	flash := newFakeFlash(storeBlocks, 1024, 256)
+	body := []byte(`{"hostname":"legacy","kiosk":true}`)
+	copy(flash.mem, legacyMagic[:])
+	binary.LittleEndian.PutUint32(flash.mem[len(legacyMagic):], uint32(len(body)))
+	copy(flash.mem[legacyHeaderLen:], body)
+
+	s := reload(t, flash)
+	if s.state.Hostname != "legacy" || !s.state.Kiosk {
+		t.Errorf("unexpected legacy state: got:%+v", s.state)
+	}
+	if s.state.Version != storeVersion {
+		t.Errorf("unexpected version of legacy state: got:%d want:%d", s.state.Version, storeVersion)
+	}
+
+	// The log starts after the legacy record.
+	err := s.update(setHostname("current"))
+	if err != nil {
+		t.Fatalf("unexpected error on update: %v", err)
+	}
+	if [4]byte(flash.mem[:len(legacyMagic)]) != legacyMagic {
+		t.Error("legacy record overwritten by first update")
+	}
+	got := reload(t, flash)
+	if got.state.Hostname != "current" || !got.state.Kiosk {
+		t.Errorf("unexpected state after update: got:%+v", got.state)
+	}
+}
+
+func TestStoreSeqWrap(t *testing.T) {
+	flash := newFakeFlash(storeBlocks, 1024, 256)
+	s := &store{flash: flash, seq: math.MaxUint32 - 1}
+	for i := range 4 {
+		err := s.update(setHostname(fmt.Sprint("desk-", i)))
+		if err != nil {
+			t.Fatalf("unexpected error on update %d: %v", i, err)
+		}
+		got := reload(t, flash)
+		want := fmt.Sprint("desk-", i)
+		if got.state.Hostname != want {
+			t.Errorf("unexpected host name after update %d with sequence %d: got:%q want:%q", i, s.seq, got.state.Hostname, want)
+		}
+		if got.seq != s.seq {
+			t.Errorf("unexpected sequence number after update %d: got:%d want:%d", i, got.seq, s.seq)
+		}
+	}
+}
+
+// writeRecord writes a record of body with the sequence number seq at the
+// start of the erase block, block, of flash.
+func writeRecord(t *testing.T, flash *fakeFlash, block int64, seq uint32, body []byte) {
+	t.Helper()
+	n := int64(recordHeaderLen + len(body))
+	n = (n + flash.writeBlock - 1) / flash.writeBlock * flash.writeBlock
+	buf := make([]byte, n)
+	for i := range buf {
+		buf[i] = 0xff
+	}
+	copy(buf, recordMagic[:])
+	binary.LittleEndian.PutUint32(buf[4:], seq)
+	binary.LittleEndian.PutUint32(buf[8:], uint32(len(body)))
+	binary.LittleEndian.PutUint32(buf[12:], crc32.ChecksumIEEE(body))
+	copy(buf[recordHeaderLen:], body)
+	err := flash.EraseBlocks(block, 1)
+	if err != nil {
+		t.Fatalf("unexpected error erasing block %d: %v", block, err)
+	}
+	_, err = flash.WriteAt(buf, block*flash.eraseBlock)
+	if err != nil {
+		t.Fatalf("unexpected error writing record: %v", err)
+	}
+}
+
+func TestStoreFallback(t *testing.T) {
+	for _, body := range []string{
+		`["desk-bad"]`,
+		`{"version":"one","hostname":"desk-bad"}`,
+		`not json`,
+	} {
+		flash := newFakeFlash(storeBlocks, 1024, 256)
+		s := &store{flash: flash}
+		for i := range 2 {
+			err := s.update(setHostname(fmt.Sprint("desk-", i)))
+			if err != nil {
+				t.Fatalf("unexpected error on update %d: %v", i, err)
+			}
+		}
+		// The most recent record has a valid checksum,
+		// but cannot be decoded.
+		writeRecord(t, flash, s.block+1, s.seq+1, []byte(body))
+
+		got := &store{flash: flash}
+		err := got.load()
+		if err == nil {
+			t.Errorf("expected error loading store with undecodable record %s", body)
+		}
+		if got.state.Hostname != "desk-1" {
+			t.Errorf("unexpected host name after fallback from %s: got:%q want:%q", body, got.state.Hostname, "desk-1")
+		}
+		h := got.status()
+		if !h.Fallback || h.Reset || h.Corrupt != 0 || len(h.Errors) == 0 {
+			t.Errorf("unexpected health after fallback from %s: %+v", body, h)
+		}
+		// The next record must supersede the
+		// undecodable record.
+		if got.seq != s.seq+1 {
+			t.Errorf("unexpected sequence number after fallback from %s: got:%d want:%d", body, got.seq, s.seq+1)
+		}
+		err = got.update(setHostname("after"))
+		if err != nil {
+			t.Fatalf("unexpected error on update after fallback: %v", err)
+		}
+		after := reload(t, flash)
+		if after.state.Hostname != "after" {
+			t.Errorf("unexpected host name after update following fallback from %s: got:%q want:%q", body, after.state.Hostname, "after")
+		}
+		if h := after.status(); !h.ok() {
+			t.Errorf("unexpected health after update following fallback from %s: %+v", body, h)
+		}
+	}
+}
+
+func TestStoreReset(t *testing.T) {
+	flash := newFakeFlash(storeBlocks, 1024, 256)
+	writeRecord(t, flash, 0, 1, []byte(`["desk-bad"]`))
+	s := &store{flash: flash}
+	err := s.load()
+	if !errors.Is(err, errNoStore) {
+		t.Errorf("unexpected error loading store with no decodable record: got:%v want:%v", err, errNoStore)
+	}
+	if h := s.status(); !h.Reset || h.Fallback {
+		t.Errorf("unexpected health with no decodable record: %+v", h)
+	}
+}
@@ -0,0 +1,176 @@
+// Copyright ©2025 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"machine"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// watchdogFeed is the interval between feeds
+	// of the hardware watchdog.
+	watchdogFeed = time.Second
+
+	// taskStall is the longest time a supervised
+	// task may go without progress before it is
+	// considered stalled. It must be longer than
+	// the longest LED state, which is 2s.
+	taskStall = 5 * time.Second
+)
+
+// Supervised tasks.
+const (
+	taskHeartbeat  = "heartbeat"  // LED heartbeat engine.
+	taskHandset    = "handset"    // Handset UART reader.
+	taskController = "controller" // Controller UART reader.
+)
+
+// watchdogConfig is the configuration of the hardware watchdog and the
+// tasks the supervisor requires progress from before feeding it.
+type watchdogConfig struct {
+	// Timeout is the time without a feed after
+	// which the device is reset.
+	Timeout duration `json:"timeout"`
+
+	// Tasks is the set of supervised tasks that
+	// must be making progress for the watchdog
+	// to be fed.
+	Tasks []string `json:"tasks"`
+}
+
+// validate returns an error if the watchdog configuration is not valid.
+func (c watchdogConfig) validate() error {
+	if c.Timeout < duration(2*watchdogFeed) || c.Timeout > duration(time.Minute) {
+		return errors.New("watchdog timeout out of range")
+	}
+	for _, t := range c.Tasks {
+		switch t {
+		case taskHeartbeat, taskHandset, taskController:
+		default:
+			return fmt.Errorf("unknown watchdog task: %q", t)
+		}
+	}
+	return nil
+}
+
+// supervisor feeds the hardware watchdog while all its monitored tasks
+// are making progress, so that a stalled task resets the device.
+type supervisor struct {
+	mu    sync.Mutex
+	tasks []*task
+}
+
+// task is a long-running task that is supervised.
+type task struct {
+	name  string
+	limit time.Duration
+	last  atomic.Int64 // Time of the last beat in Unix nanoseconds.
+}
+
+// register adds a supervised task that is considered stalled if it does
+// not beat for longer than limit.
+func (s *supervisor) register(name string, limit time.Duration) *task {
+	t := &task{name: name, limit: limit}
+	t.beat()
+	s.mu.Lock()
+	s.tasks = append(s.tasks, t)
+	s.mu.Unlock()
+	return t
+}
+
+// beat records that the task has made progress.
+func (t *task) beat() {
+	t.last.Store(time.Now().UnixNano())
+}
+
+// stalled returns the first registered task named in monitored that has
+// not beaten within its limit, or nil if all those tasks are making
+// progress.
+func (s *supervisor) stalled(monitored []string) *task {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range s.tasks {
+		if !slices.Contains(monitored, t.name) {
+			continue
+		}
+		if time.Since(time.Unix(0, t.last.Load())) > t.limit {
+			return t
+		}
+	}
+	return nil
+}
+
+// superviseWatchdog feeds the hardware watchdog until ctx is cancelled,
+// applying changes to the configured timeout. Feeding stops while a
+// monitored task is stalled. timeout is the timeout the watchdog was
+// started with.
+func (m *mitm) superviseWatchdog(ctx context.Context, timeout duration) {
+	ticker := time.NewTicker(watchdogFeed)
+	defer ticker.Stop()
+	var stalled *task
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		cfg := m.config().Watchdog
+		if cfg.Timeout != timeout {
+			m.log.LogAttrs(ctx, slog.LevelInfo, "set watchdog timeout", slog.Duration("timeout", time.Duration(cfg.Timeout)))
+			timeout = cfg.Timeout
+			machine.Watchdog.Configure(machine.WatchdogConfig{
+				TimeoutMillis: uint32(time.Duration(timeout) / time.Millisecond),
+			})
+		}
+		t := m.tasks.stalled(cfg.Tasks)
+		if t != nil {
+			if t != stalled {
+				m.log.LogAttrs(ctx, slog.LevelError, "task stalled", slog.String("task", t.name), slog.Duration("limit", t.limit))
+			}
+			stalled = t
+			continue
+		}
+		stalled = nil
+		machine.Watchdog.Update()
+	}
+}
+
+// heartbeat flashes the LED heartbeat, or a queued LED sequence in its
+// place, until ctx is cancelled. The period of the heartbeat is set by
+// its LED sequence and is independent of watchdog feeding.
+func (m *mitm) heartbeat(ctx context.Context) {
+	t := m.tasks.register(taskHeartbeat, taskStall)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+		seq := normalOperation
+		if m.controllerLost.Load() {
+			seq = controllerLost
+		}
+		select {
+		case seq = <-m.leds:
+		default:
+		}
+		for i := range seq {
+			t.beat()
+			err := flash(m.dev, seq[i:i+1])
+			if err != nil {
+				m.log.LogAttrs(ctx, slog.LevelError, "heartbeat", slog.Any("err", err))
+				break
+			}
+		}
+	}
+}
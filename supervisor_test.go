@@ -0,0 +1,50 @@
+// Copyright ©2025 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+var stalledTests = []struct {
+	name      string
+	monitored []string
+	want      string // Empty for no stalled task.
+}{
+	{name: "none monitored", monitored: nil, want: ""},
+	{name: "progressing", monitored: []string{taskHeartbeat, taskController}, want: ""},
+	{name: "stalled", monitored: []string{taskHeartbeat, taskHandset}, want: taskHandset},
+	{name: "stalled only", monitored: []string{taskHandset}, want: taskHandset},
+	{name: "unregistered", monitored: []string{"unknown"}, want: ""},
+}
+
+func TestSupervisorStalled(t *testing.T) {
+	var s supervisor
+	s.register(taskHeartbeat, taskStall)
+	handset := s.register(taskHandset, taskStall)
+	controller := s.register(taskController, taskStall)
+
+	// The handset has not beaten for longer than its limit
+	// and the controller last beat just within its limit.
+	now := time.Now()
+	handset.last.Store(now.Add(-taskStall - time.Second).UnixNano())
+	controller.last.Store(now.Add(-taskStall + time.Second).UnixNano())
+
+	for _, test := range stalledTests {
+		var got string
+		if t := s.stalled(test.monitored); t != nil {
+			got = t.name
+		}
+		if got != test.want {
+			t.Errorf("unexpected stalled task for %s: got:%q want:%q", test.name, got, test.want)
+		}
+	}
+
+	handset.beat()
+	if task := s.stalled([]string{taskHandset}); task != nil {
+		t.Errorf("unexpected stalled task after beat: got:%q", task.name)
+	}
+}
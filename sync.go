@@ -0,0 +1,310 @@
+// Copyright ©2025 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build bluetooth
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"slices"
+	"strconv"
+	"time"
+
+	"tinygo.org/x/bluetooth"
+)
+
+// Desks placed side by side to form one surface can be kept at the same
+// height by making one unit the leader of the others. The leader connects
+// to each follower as a Bluetooth central, in the same way as a unit
+// connects to the desk that follows its moves, and sends commands to the
+// follower's named position characteristic. When the leader starts a move
+// to a target of known height, the target is sent with the "to <height>"
+// command as soon as it is set, and when a move is stopped the "stop"
+// command is sent, so that the followers start and stop with the leader.
+// While a follower is connected, the leader holds back the start of its
+// own moves by half of the longest round trip time measured on the links,
+// to allow for the latency of the link, plus the configured lead time, to
+// allow for the follower starting its move. The round trip time of each
+// link is measured by reading the model number from the follower's device
+// information service, which has no side effects unlike reading the named
+// position characteristic, when it is connected and then periodically
+// while the desk is not moving. When the leader settles,
+// its height is sent so that the followers correct for moves without a
+// known target, such as holding the handset keys. Followers are sent
+// heights in the leader's display unit.
+//
+// Commands are sent as write requests so that the leader learns whether
+// each follower received them; a follower that refuses a command stays
+// connected, but one that does not respond is disconnected and connected
+// to again later.
+//
+// Each command carries the leader's device ID and a sequence number that
+// starts at one on each connection, so that a follower can drop commands
+// from the leader that arrive out of order or are repeated, and can log
+// commands that were lost. The sequence is kept for the leader's ID
+// rather than for the connection since the follower's connection handles
+// are reused when a leader reconnects.
+//
+// Commands are sent over the Bluetooth link rather than as UDP datagrams
+// on the network. Builds with only Bluetooth control have no network, the
+// network stack has no UDP receive socket, and while the radio is in
+// power save mode, broadcast and multicast datagrams are held by the WiFi
+// access point until the next DTIM beacon, typically 100ms to 300ms
+// later, which is more latency than the Bluetooth link adds.
+
+const (
+	// syncRetry is the time between attempts to connect
+	// to a follower that could not be reached.
+	syncRetry = time.Minute
+
+	// syncProbe is the time between measurements of
+	// the round trip time of a link to a follower.
+	syncProbe = 30 * time.Second
+)
+
+// syncLink is the leader's connection to a sync follower.
+type syncLink struct {
+	f      *follower                      // nil if not connected.
+	model  bluetooth.DeviceCharacteristic // Read to measure the round trip time.
+	tried  time.Time                      // Time of the last connection attempt.
+	seq    uint32                         // Sequence number of the last command sent.
+	rtt    time.Duration                  // Smoothed round trip time, zero until measured.
+	probed time.Time                      // Time of the last round trip measurement.
+}
+
+// probe measures the round trip time of the link by reading the
+// follower's model number characteristic, and updates the smoothed
+// round trip time of the link with the measurement.
+func (l *syncLink) probe() (time.Duration, error) {
+	var buf [32]byte
+	start := time.Now()
+	_, err := l.model.Read(buf[:])
+	l.probed = time.Now()
+	if err != nil {
+		return 0, err
+	}
+	rtt := l.probed.Sub(start)
+	if l.rtt == 0 {
+		l.rtt = rtt
+	} else {
+		// Smooth as for TCP round trip times.
+		l.rtt += (rtt - l.rtt) / 8
+	}
+	return rtt, nil
+}
+
+// discoverModel returns the model number characteristic of the device
+// information service of the follower connected as dev.
+func discoverModel(dev bluetooth.Device) (bluetooth.DeviceCharacteristic, error) {
+	services, err := dev.DiscoverServices([]bluetooth.UUID{bluetooth.ServiceUUIDDeviceInformation})
+	if err != nil {
+		return bluetooth.DeviceCharacteristic{}, err
+	}
+	if len(services) == 0 {
+		return bluetooth.DeviceCharacteristic{}, errNoFollower
+	}
+	chars, err := services[0].DiscoverCharacteristics([]bluetooth.UUID{bluetooth.CharacteristicUUIDModelNumberString})
+	if err != nil {
+		return bluetooth.DeviceCharacteristic{}, err
+	}
+	if len(chars) == 0 {
+		return bluetooth.DeviceCharacteristic{}, errNoFollower
+	}
+	return chars[0], nil
+}
+
+// runSync sends the height targets and stops of the desk received on sub
+// to the configured sync followers until ctx is cancelled.
+func (m *mitm) runSync(ctx context.Context, log *slog.Logger, adapter *bluetooth.Adapter, uuids followUUIDs, sub *subscription) {
+	defer m.events.unsubscribe(sub)
+	ticker := time.NewTicker(motionPoll)
+	defer ticker.Stop()
+	links := make(map[string]*syncLink)
+	id := deviceID()
+	defer func() {
+		m.syncLead.Store(0)
+		for _, l := range links {
+			if l.f != nil {
+				l.f.dev.Disconnect()
+			}
+		}
+	}()
+	// send writes cmd to each connected follower
+	// with the link's next sequence number. A
+	// follower that does not acknowledge the
+	// write is disconnected.
+	send := func(cmd string) {
+		for name, l := range links {
+			if l.f == nil {
+				continue
+			}
+			l.seq++
+			_, err := l.f.positions.Write([]byte(cmd + " " + id + " " + strconv.FormatUint(uint64(l.seq), 10)))
+			if errors.Is(err, bluetooth.ErrATTOp) {
+				// The follower answered with an error
+				// response, so the link is still up.
+				log.LogAttrs(ctx, slog.LevelWarn, "sync command refused", slog.String("name", name), slog.String("cmd", cmd), slog.Uint64("seq", uint64(l.seq)))
+				continue
+			}
+			if err != nil {
+				log.LogAttrs(ctx, slog.LevelWarn, "sync command", slog.String("name", name), slog.String("cmd", cmd), slog.Any("err", err))
+				l.f.dev.Disconnect()
+				l.f = nil
+				continue
+			}
+			log.LogAttrs(ctx, slog.LevelDebug, "sync command", slog.String("name", name), slog.String("cmd", cmd), slog.Uint64("seq", uint64(l.seq)))
+		}
+	}
+	sent := math.NaN() // Last height sent.
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-sub.ready:
+		}
+		cfg := m.cfg.Load().Sync
+		for name, l := range links {
+			if !slices.Contains(cfg.Followers, name) {
+				if l.f != nil {
+					l.f.dev.Disconnect()
+				}
+				delete(links, name)
+			}
+		}
+		active := len(cfg.Followers) != 0 && !m.bluetoothBlocked.Load() && m.heightKnown.Load()
+		if active {
+			for _, name := range cfg.Followers {
+				l, ok := links[name]
+				if !ok {
+					l = &syncLink{}
+					links[name] = l
+				}
+				if l.f != nil || time.Since(l.tried) < syncRetry {
+					continue
+				}
+				l.tried = time.Now()
+				f, err := connectFollower(adapter, name, uuids)
+				if err != nil {
+					log.LogAttrs(ctx, slog.LevelWarn, "sync follower connect", slog.String("name", name), slog.Any("err", err))
+					continue
+				}
+				model, err := discoverModel(f.dev)
+				if err != nil {
+					log.LogAttrs(ctx, slog.LevelWarn, "sync follower connect", slog.String("name", name), slog.Any("err", err))
+					f.dev.Disconnect()
+					continue
+				}
+				log.LogAttrs(ctx, slog.LevelInfo, "sync follower connected", slog.String("name", name), slog.String("peer", f.dev.Address.String()))
+				l.f = f
+				l.model = model
+				l.seq = 0
+				l.rtt = 0
+				l.probed = time.Time{}
+			}
+		}
+		var lead time.Duration
+		if active {
+			// Measure the links while the desk is
+			// still so that commands are not held up.
+			still := !m.moving()
+			connected := false
+			for _, name := range cfg.Followers {
+				l := links[name]
+				if still && l.f != nil && time.Since(l.probed) >= syncProbe {
+					rtt, err := l.probe()
+					if err != nil {
+						log.LogAttrs(ctx, slog.LevelWarn, "sync probe", slog.String("name", name), slog.Any("err", err))
+						l.f.dev.Disconnect()
+						l.f = nil
+					} else {
+						log.LogAttrs(ctx, slog.LevelDebug, "sync probe", slog.String("name", name), slog.Duration("rtt", rtt), slog.Duration("srtt", l.rtt))
+					}
+				}
+				if l.f == nil {
+					continue
+				}
+				connected = true
+				lead = max(lead, l.rtt/2)
+			}
+			if connected {
+				lead = min(lead+time.Duration(cfg.Lead), maxSyncLead)
+			} else {
+				lead = 0
+			}
+		}
+		m.syncLead.Store(int64(lead))
+
+		for {
+			e, _, ok, _ := sub.poll()
+			if !ok {
+				break
+			}
+			if !active {
+				continue
+			}
+			if math.IsNaN(e.height) {
+				send("stop")
+				continue
+			}
+			sent = e.height
+			send("to " + strconv.FormatFloat(e.height, 'f', 2, 64))
+		}
+		if !active || m.moving() {
+			continue
+		}
+		h := m.position.Load().(position).units()
+		if math.IsNaN(sent) {
+			// Don't move the followers to the
+			// height of the leader on start.
+			sent = h
+			continue
+		}
+		if h == sent {
+			continue
+		}
+		sent = h
+		send("to " + strconv.FormatFloat(h, 'f', 2, 64))
+	}
+}
+
+// syncSequence holds the sequence number of the last command accepted
+// from a sync leader.
+type syncSequence struct {
+	leader string // ID of the leader.
+	last   uint32 // Zero if no command has been accepted.
+}
+
+// accept returns whether the command with the sequence number in seq from
+// the leader with the ID in id is newer than the last accepted, recording
+// it if it is. A leader numbers commands from one on each connection, so
+// the sequence restarts on a command numbered one or from a different
+// leader.
+func (s *syncSequence) accept(ctx context.Context, log *slog.Logger, id, seq string) (bool, error) {
+	v, err := strconv.ParseUint(seq, 10, 32)
+	if err != nil || v == 0 {
+		return false, fmt.Errorf("invalid sequence number: %q", seq)
+	}
+	n := uint32(v)
+	if n != 1 && id == s.leader && s.last != 0 {
+		// Compare serial numbers so that the
+		// sequence may wrap.
+		d := int32(n - s.last)
+		if d <= 0 {
+			log.LogAttrs(ctx, slog.LevelDebug, "drop stale sync command", slog.String("leader", id), slog.Uint64("seq", v), slog.Uint64("last", uint64(s.last)))
+			return false, nil
+		}
+		if d > 1 {
+			log.LogAttrs(ctx, slog.LevelWarn, "missed sync commands", slog.String("leader", id), slog.Int("missed", int(d-1)))
+		}
+	}
+	s.leader = id
+	s.last = n
+	return true, nil
+}
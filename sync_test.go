@@ -0,0 +1,55 @@
+// Copyright ©2025 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build bluetooth
+
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"testing"
+)
+
+var syncSequenceTests = []struct {
+	name    string
+	leader  string
+	seq     string
+	want    bool
+	wantErr bool
+}{
+	{name: "first", leader: "a", seq: "1", want: true},
+	{name: "next", leader: "a", seq: "2", want: true},
+	{name: "repeat", leader: "a", seq: "2", want: false},
+	{name: "restart", leader: "a", seq: "1", want: true},
+	{name: "gap", leader: "a", seq: "4", want: true},
+	{name: "old", leader: "a", seq: "3", want: false},
+	{name: "other leader", leader: "b", seq: "2", want: true},
+	{name: "back to first", leader: "a", seq: "3", want: true},
+	{name: "after other", leader: "a", seq: "3", want: false},
+	{name: "zero", leader: "a", seq: "0", want: false, wantErr: true},
+	{name: "invalid", leader: "a", seq: "x", want: false, wantErr: true},
+	{name: "unchanged by invalid", leader: "a", seq: "4", want: true},
+	{name: "high", leader: "c", seq: "4294967295", want: true},
+	{name: "wrap", leader: "c", seq: "2", want: true},
+	{name: "before wrap", leader: "c", seq: "4294967295", want: false},
+}
+
+// TestSyncSequence checks that the commands from a sync leader are
+// accepted in order according to the leader's ID.
+func TestSyncSequence(t *testing.T) {
+	ctx := context.Background()
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	var s syncSequence
+	for _, test := range syncSequenceTests {
+		got, err := s.accept(ctx, log, test.leader, test.seq)
+		if (err != nil) != test.wantErr {
+			t.Errorf("unexpected error for %s: got:%v want error:%t", test.name, err, test.wantErr)
+		}
+		if got != test.want {
+			t.Errorf("unexpected acceptance for %s: got:%t want:%t", test.name, got, test.want)
+		}
+	}
+}
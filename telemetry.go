@@ -0,0 +1,121 @@
+// Copyright ©2025 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build http || !bluetooth
+
+package main
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"net/netip"
+	"time"
+)
+
+// telemetryPort is the local UDP port that telemetry is sent from.
+const telemetryPort = 49100
+
+// runTelemetry periodically sends the state of the desk to the configured
+// telemetry collector as a CBOR-encoded UDP datagram until ctx is
+// cancelled.
+func (m *mitm) runTelemetry(ctx context.Context, n *netStack) {
+	log := m.logFor("wifi")
+	start := time.Now()
+	var buf []byte
+	for {
+		cfg := m.config().Telemetry
+		wait := time.Duration(cfg.Interval)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+		if cfg.Collector == "" {
+			continue
+		}
+		dst, err := netip.ParseAddrPort(cfg.Collector)
+		if err != nil {
+			log.LogAttrs(ctx, slog.LevelError, "telemetry collector", slog.Any("err", err))
+			continue
+		}
+		buf = m.telemetry(buf[:0], time.Since(start))
+		err = n.sendUDP(dst, telemetryPort, buf)
+		if err != nil {
+			log.LogAttrs(ctx, slog.LevelError, "send telemetry", slog.Any("err", err))
+		}
+	}
+}
+
+// telemetry appends the CBOR encoding of the desk state to dst. The state
+// is a map with the keys:
+//
+//   - "id": device identifier (text)
+//   - "up": uptime in seconds (uint)
+//   - "h": height mantissa (int)
+//   - "e": height exponent (int)
+//   - "ctl": whether the controller is responding (bool)
+func (m *mitm) telemetry(dst []byte, uptime time.Duration) []byte {
+	p := m.position.Load().(position)
+	dst = appendCBORHead(dst, cborMap, 5)
+	dst = appendCBORText(dst, "id")
+	dst = appendCBORText(dst, deviceID())
+	dst = appendCBORText(dst, "up")
+	dst = appendCBORHead(dst, cborUint, uint64(uptime/time.Second))
+	dst = appendCBORText(dst, "h")
+	dst = appendCBORInt(dst, int64(p.mantissa))
+	dst = appendCBORText(dst, "e")
+	dst = appendCBORInt(dst, int64(p.exponent))
+	dst = appendCBORText(dst, "ctl")
+	return appendCBORBool(dst, !m.controllerLost.Load())
+}
+
+// CBOR major types.
+const (
+	cborUint   = 0 << 5
+	cborNegInt = 1 << 5
+	cborText   = 3 << 5
+	cborMap    = 5 << 5
+	cborSimple = 7 << 5
+)
+
+// appendCBORHead appends a CBOR data item head with the given major type
+// and argument to dst.
+func appendCBORHead(dst []byte, major byte, arg uint64) []byte {
+	switch {
+	case arg < 24:
+		return append(dst, major|byte(arg))
+	case arg <= math.MaxUint8:
+		return append(dst, major|24, byte(arg))
+	case arg <= math.MaxUint16:
+		return append(dst, major|25, byte(arg>>8), byte(arg))
+	case arg <= math.MaxUint32:
+		return append(dst, major|26, byte(arg>>24), byte(arg>>16), byte(arg>>8), byte(arg))
+	default:
+		dst = append(dst, major|27)
+		for i := 56; i >= 0; i -= 8 {
+			dst = append(dst, byte(arg>>i))
+		}
+		return dst
+	}
+}
+
+func appendCBORInt(dst []byte, v int64) []byte {
+	if v < 0 {
+		return appendCBORHead(dst, cborNegInt, uint64(-1-v))
+	}
+	return appendCBORHead(dst, cborUint, uint64(v))
+}
+
+func appendCBORText(dst []byte, s string) []byte {
+	dst = appendCBORHead(dst, cborText, uint64(len(s)))
+	return append(dst, s...)
+}
+
+func appendCBORBool(dst []byte, v bool) []byte {
+	if v {
+		return append(dst, cborSimple|21)
+	}
+	return append(dst, cborSimple|20)
+}
@@ -0,0 +1,111 @@
+// Copyright ©2025 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"machine"
+	"strings"
+	"time"
+)
+
+// minTokenLen is the shortest bearer token that may be set.
+const minTokenLen = 16
+
+var (
+	errShortToken = errors.New("token too short")
+	errTokenSet   = errors.New("token already set")
+)
+
+// setToken stores the bearer token required for HTTP requests that change
+// device or desk state. If replace is false and a token is already stored,
+// errTokenSet is returned.
+func (m *mitm) setToken(token string, replace bool) error {
+	if len(token) < minTokenLen {
+		return errShortToken
+	}
+	if !replace && m.store.get().Token != nil {
+		return errTokenSet
+	}
+	tok := newCredential("", token)
+	return m.store.update(func(p *persistent) { p.Token = &tok })
+}
+
+const (
+	// consolePoll is the interval at which the
+	// serial console is checked for input.
+	consolePoll = 100 * time.Millisecond
+
+	// maxConsoleLine is the longest line accepted
+	// by the serial console. Longer lines are
+	// truncated.
+	maxConsoleLine = 128
+)
+
+// serialConsole reads newline-terminated commands from the USB serial
+// console until ctx is cancelled.
+func (m *mitm) serialConsole(ctx context.Context) {
+	var line []byte
+	for {
+		if ctx.Err() != nil {
+			return
+		}
+		if machine.Serial.Buffered() == 0 {
+			time.Sleep(consolePoll)
+			continue
+		}
+		b, err := machine.Serial.ReadByte()
+		if err != nil {
+			continue
+		}
+		switch b {
+		case '\r', '\n':
+			if len(line) != 0 {
+				m.consoleCommand(ctx, string(line))
+			}
+			line = line[:0]
+		default:
+			if len(line) < maxConsoleLine {
+				line = append(line, b)
+			}
+		}
+	}
+}
+
+// consoleCommand executes a serial console command. The commands are
+// "token <token>", which sets the HTTP bearer token if none is stored,
+// "reset-config", which discards configuration changes, and "faults
+// <spec>", which sets the injected faults in builds with fault injection.
+// Once stored, the token can only be changed over HTTP using the token.
+func (m *mitm) consoleCommand(ctx context.Context, cmd string) {
+	name, arg, _ := strings.Cut(strings.TrimSpace(cmd), " ")
+	switch name {
+	case "token":
+		err := m.setToken(strings.TrimSpace(arg), false)
+		if err != nil {
+			m.log.LogAttrs(ctx, slog.LevelError, "set token", slog.Any("err", err))
+			return
+		}
+		m.log.LogAttrs(ctx, slog.LevelInfo, "token set")
+	case "faults":
+		err := faults.set(arg)
+		if err != nil {
+			m.log.LogAttrs(ctx, slog.LevelError, "set faults", slog.Any("err", err))
+			return
+		}
+		m.log.LogAttrs(ctx, slog.LevelWarn, "faults set", slog.String("faults", faults.String()))
+	case "reset-config":
+		err := m.resetConfig()
+		if err != nil {
+			m.log.LogAttrs(ctx, slog.LevelError, "reset config", slog.Any("err", err))
+			return
+		}
+		m.log.LogAttrs(ctx, slog.LevelInfo, "config reset")
+	default:
+		m.log.LogAttrs(ctx, slog.LevelWarn, "unknown console command", slog.String("command", name))
+	}
+}
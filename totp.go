@@ -0,0 +1,115 @@
+// Copyright ©2025 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"machine"
+	"net/url"
+	"time"
+)
+
+// Endpoints that could disrupt or reconfigure the device may be protected
+// with time-based one-time codes (RFC 6238) generated from a secret shared
+// with an authenticator app, so that access to the LAN alone is not enough
+// to use them.
+
+const (
+	// totpStep is the time for which each code
+	// is valid.
+	totpStep = 30 * time.Second
+
+	// totpSkew is the number of steps either side
+	// of the current step for which codes are
+	// accepted to allow for clock differences.
+	totpSkew = 1
+
+	// totpDigits is the number of digits in
+	// each code.
+	totpDigits = 6
+
+	// totpSecretLen is the length in bytes of
+	// the shared secret.
+	totpSecretLen = 20
+)
+
+var (
+	errNoCode    = errors.New("one-time code required")
+	errBadCode   = errors.New("invalid one-time code")
+	errCodeClock = errors.New("one-time code not checked: clock not synced")
+)
+
+// newTOTPSecret returns a random shared secret.
+func newTOTPSecret() []byte {
+	secret := make([]byte, totpSecretLen)
+	for i := 0; i < len(secret); i += 4 {
+		r, _ := machine.GetRNG()
+		binary.LittleEndian.PutUint32(secret[i:], r)
+	}
+	return secret
+}
+
+// totpURI returns the key URI for provisioning an authenticator app with
+// secret for the device named name.
+func totpURI(name string, secret []byte) string {
+	q := url.Values{
+		"secret": {base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(secret)},
+		"issuer": {"desk"},
+	}
+	return "otpauth://totp/desk:" + url.PathEscape(name) + "?" + q.Encode()
+}
+
+// hotp returns the HOTP code (RFC 4226) for secret at counter.
+func hotp(secret []byte, counter uint64) string {
+	mac := hmac.New(sha1.New, secret)
+	binary.Write(mac, binary.BigEndian, counter)
+	sum := mac.Sum(nil)
+	off := sum[len(sum)-1] & 0xf
+	v := binary.BigEndian.Uint32(sum[off:]) & 0x7fffffff
+	mod := uint32(1)
+	for range totpDigits {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, v%mod)
+}
+
+// checkCode returns whether code is a valid one-time code for the stored
+// TOTP secret. Any code is accepted if no secret is stored. A code may
+// only be used once, and codes from steps before the last accepted code
+// are refused.
+func (m *mitm) checkCode(code string) error {
+	secret := m.store.get().TOTPSecret
+	if secret == nil {
+		return nil
+	}
+	if code == "" {
+		return errNoCode
+	}
+	if !m.clock.isSynced() {
+		return errCodeClock
+	}
+	now := uint64(m.clock.now().Unix() / int64(totpStep/time.Second))
+	for c := now - totpSkew; c <= now+totpSkew; c++ {
+		if subtle.ConstantTimeCompare([]byte(hotp(secret, c)), []byte(code)) != 1 {
+			continue
+		}
+		for {
+			last := m.totpUsed.Load()
+			if c <= last {
+				return errBadCode
+			}
+			if m.totpUsed.CompareAndSwap(last, c) {
+				return nil
+			}
+		}
+	}
+	return errBadCode
+}
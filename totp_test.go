@@ -0,0 +1,36 @@
+// Copyright ©2025 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// hotpTests are the SHA-1 test vectors of RFC 6238 appendix B, truncated
+// to totpDigits digits.
+var hotpTests = []struct {
+	time int64
+	want string
+}{
+	{time: 59, want: "94287082"},
+	{time: 1111111109, want: "07081804"},
+	{time: 1111111111, want: "14050471"},
+	{time: 1234567890, want: "89005924"},
+	{time: 2000000000, want: "69279037"},
+	{time: 20000000000, want: "65353130"},
+}
+
+func TestHOTP(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	for _, test := range hotpTests {
+		counter := uint64(test.time / int64(totpStep/time.Second))
+		got := hotp(secret, counter)
+		want := test.want[len(test.want)-totpDigits:]
+		if got != want {
+			t.Errorf("unexpected code for time %d: got:%s want:%s", test.time, got, want)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright ©2025 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// levelTrace is the level of UART trace records. Trace records are not
+// subject to the log level.
+const levelTrace = slog.LevelDebug - 4
+
+// defaultTraceRate is the default maximum number of trace records
+// written per second.
+const defaultTraceRate = 20
+
+// tracer is a rate-limited trace of raw UART frames. Runs of identical
+// frames on a port are collapsed into a single record with a repeat
+// count.
+type tracer struct {
+	on   atomic.Bool
+	rate atomic.Int64 // Maximum records per second.
+
+	mu         sync.Mutex
+	window     time.Time // Start of the current rate window.
+	written    int64     // Records written in the current window.
+	suppressed int       // Records dropped since the last written record.
+	ports      map[string]*tracePort
+}
+
+// tracePort is the trace state of a single UART.
+type tracePort struct {
+	last    []byte
+	repeats int
+}
+
+// setTrace turns UART tracing on or off and sets the maximum trace rate.
+func (m *mitm) setTrace(on bool, rate int64) {
+	m.trace.rate.Store(rate)
+	m.trace.on.Store(on)
+}
+
+// traceFrame records a frame read from the named port if tracing is on.
+func (m *mitm) traceFrame(ctx context.Context, port string, pkt []byte) {
+	t := &m.trace
+	if !t.on.Load() {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.ports == nil {
+		t.ports = make(map[string]*tracePort)
+	}
+	p, ok := t.ports[port]
+	if !ok {
+		p = &tracePort{}
+		t.ports[port] = p
+	}
+	if bytes.Equal(pkt, p.last) {
+		p.repeats++
+		return
+	}
+	now := time.Now()
+	if now.Sub(t.window) >= time.Second {
+		t.window = now
+		t.written = 0
+	}
+	if t.written >= t.rate.Load() {
+		t.suppressed++
+		return
+	}
+	t.written++
+	attrs := []slog.Attr{slog.String("port", port), slog.Any("pkt", bytesAttr(pkt))}
+	if p.repeats != 0 {
+		attrs = append(attrs, slog.Any("prev", bytesAttr(p.last)), slog.Int("repeats", p.repeats))
+	}
+	if t.suppressed != 0 {
+		attrs = append(attrs, slog.Int("suppressed", t.suppressed))
+	}
+	r := slog.NewRecord(now, levelTrace, "trace", 0)
+	r.AddAttrs(attrs...)
+	m.handler.Handle(ctx, r)
+	p.last = append(p.last[:0], pkt...)
+	p.repeats = 0
+	t.suppressed = 0
+}
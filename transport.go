@@ -0,0 +1,221 @@
+// Copyright ©2025 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+)
+
+// Remote control is provided by transports, such as the HTTP and Bluetooth
+// servers. A transport handles its clients' requests and passes commands
+// describing the operations that drive the desk, such as a move to a
+// preset or a stop, to the device on a command channel. The device
+// interprets the commands, running moves one at a time holding the move
+// lock and stops as they arrive, so that a transport does not need to know
+// how moves are made or how they are serialised with the handset and with
+// other transports.
+
+// commandQueueLen is the number of commands that may be waiting to run.
+const commandQueueLen = 4
+
+var (
+	errHandsetBusy    = errors.New("handset in use")
+	errCommandsQueued = errors.New("too many commands waiting")
+)
+
+// transport is a remote control transport.
+type transport interface {
+	// name returns the name of the transport
+	// for logging.
+	name() string
+
+	// start starts the transport, which sends
+	// commands to drive the desk on commands. It
+	// may return once the transport has started
+	// or serve until ctx is cancelled.
+	start(ctx context.Context, commands chan<- command) error
+}
+
+// transports returns the transports built into the firmware.
+func (m *mitm) transports() []transport {
+	var t []transport
+	if useHTTP {
+		t = append(t, httpTransport{m})
+	}
+	if useBluetooth {
+		t = append(t, bluetoothTransport{m})
+	}
+	return t
+}
+
+// op is an operation on the desk requested by a transport.
+type op int
+
+// Desk operations.
+const (
+	opPreset  op = iota + 1 // Move to a memory preset.
+	opPercent               // Move to a percentage of the learned range.
+	opHeight                // Move to a height.
+	opNamed                 // Move to a named position.
+	opBy                    // Move by a relative offset.
+	opRestore               // Restore the learned height of a preset.
+	opStop                  // Stop the desk.
+)
+
+// command is a request from a transport to drive the desk. The device
+// interprets the command, so a transport only describes what it wants
+// done.
+type command struct {
+	// holder is the holder of the motion
+	// claim for the command, e.g.
+	// "http 192.0.2.1".
+	holder string
+
+	// src is the source of the command,
+	// e.g. sourceHTTP.
+	src string
+
+	// log is the logger of the transport.
+	log *slog.Logger
+
+	op      op
+	preset  int     // Preset number for opPreset and opRestore.
+	value   float64 // Height, percentage or offset for opHeight, opPercent and opBy.
+	name    string  // Position name for opNamed.
+	profile string  // Motion profile for opPreset and opPercent, empty for the scheduled profile.
+
+	// done receives the result of the command.
+	// It is set by submit.
+	done chan<- commandResult
+}
+
+// commandResult is the result of a command.
+type commandResult struct {
+	// pos is the height the desk was moved
+	// to by opBy, or the restored height of
+	// the preset for opRestore.
+	pos position
+	err error
+}
+
+// submit sends c to commands and waits for its result. It returns
+// errHandsetBusy without running c if the handset button is held, and the
+// error from claiming the motion if the motion is held by another source.
+// Stop commands are run without waiting for commands in progress.
+func submit(ctx context.Context, commands chan<- command, c command) (position, error) {
+	done, err := post(ctx, commands, c)
+	if err != nil {
+		return position{}, err
+	}
+	select {
+	case r := <-done:
+		return r.pos, r.err
+	case <-ctx.Done():
+		return position{}, ctx.Err()
+	}
+}
+
+// post sends c to commands without waiting for it to run, returning the
+// channel that its result is sent on. Commands posted by a client are run
+// in the order they are posted.
+func post(ctx context.Context, commands chan<- command, c command) (<-chan commandResult, error) {
+	done := make(chan commandResult, 1)
+	c.done = done
+	select {
+	case commands <- c:
+		return done, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// runCommands runs the commands received on commands until ctx is
+// cancelled. Stop commands are run as they are received so that they
+// interrupt a move in progress and cancel the moves waiting to run, and
+// other commands are run in turn.
+func (m *mitm) runCommands(ctx context.Context, commands <-chan command) {
+	log := m.logFor("uart")
+	moves := make(chan command, commandQueueLen)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case c := <-moves:
+				pos, err := m.runCommand(ctx, c)
+				if err != nil {
+					log.LogAttrs(ctx, slog.LevelDebug, "command", slog.String("src", c.holder), slog.Any("err", err))
+				}
+				c.done <- commandResult{pos: pos, err: err}
+			}
+		}
+	}()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case c := <-commands:
+			if c.op == opStop {
+				// Drop the moves waiting to run
+				// so that they do not undo the stop.
+			drain:
+				for {
+					select {
+					case q := <-moves:
+						q.done <- commandResult{err: errStopped}
+					default:
+						break drain
+					}
+				}
+				c.done <- commandResult{err: m.stop(ctx, c.log, c.src)}
+				continue
+			}
+			select {
+			case moves <- c:
+			default:
+				c.done <- commandResult{err: errCommandsQueued}
+			}
+		}
+	}
+}
+
+// runCommand runs c holding m.mu.
+func (m *mitm) runCommand(ctx context.Context, c command) (position, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.handsetBusy() {
+		return position{}, errHandsetBusy
+	}
+	err := m.claimMotion(c.holder)
+	if err != nil {
+		return position{}, err
+	}
+	switch c.op {
+	case opPreset:
+		return position{}, m.moveToPreset(ctx, c.log, c.src, c.preset, c.profile)
+	case opPercent:
+		return position{}, m.moveToPercent(ctx, c.log, c.src, c.value, c.profile)
+	case opHeight:
+		return position{}, m.moveToHeight(ctx, c.log, c.src, c.value)
+	case opNamed:
+		return position{}, m.moveToNamed(ctx, c.log, c.src, c.name)
+	case opBy:
+		return m.moveBy(ctx, c.log, c.src, c.value)
+	case opRestore:
+		return m.restorePreset(ctx, c.log, c.src, c.preset)
+	default:
+		return position{}, fmt.Errorf("invalid command operation: %d", c.op)
+	}
+}
+
+// refused returns whether err is the refusal of a command because the
+// handset or another source is driving the desk.
+func refused(err error) bool {
+	var held leaseError
+	return err == errHandsetBusy || err == errCommandsQueued || errors.As(err, &held)
+}
@@ -0,0 +1,85 @@
+// Copyright ©2025 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build http || !bluetooth
+
+package main
+
+import (
+	"errors"
+	"net/netip"
+	"sync"
+
+	"github.com/soypat/seqs/eth"
+	"github.com/soypat/seqs/stacks"
+)
+
+// udpHeadersLen is the total length of the Ethernet, IPv4 and UDP headers
+// of a datagram frame.
+const udpHeadersLen = eth.SizeEthernetHeader + eth.SizeIPv4Header + eth.SizeUDPHeader
+
+// udpSender sends UDP datagrams by writing Ethernet frames directly to the
+// network device. The seqs stack does not expose UDP sockets outside the
+// stacks package, so datagrams bypass the stack and replies cannot be
+// received.
+type udpSender struct {
+	mu  sync.Mutex
+	pkt stacks.UDPPacket
+	buf [1500 + eth.SizeEthernetHeader]byte
+}
+
+// sendUDP sends payload from the local port lport to dst.
+func (n *netStack) sendUDP(dst netip.AddrPort, lport uint16, payload []byte) error {
+	if !dst.Addr().Is4() {
+		return errors.New("only IPv4 destinations are supported")
+	}
+	ttl := uint8(64)
+	var mac [6]byte
+	if dst.Addr().IsMulticast() {
+		// Multicast groups map to Ethernet addresses
+		// and are sent with the TTL required for
+		// link-local multicast DNS.
+		a := dst.Addr().As4()
+		mac = [6]byte{0x01, 0x00, 0x5e, a[1] & 0x7f, a[2], a[3]}
+		ttl = 255
+	} else {
+		var err error
+		_, mac, err = n.resolve(dst.Addr().String())
+		if err != nil {
+			return err
+		}
+	}
+	s := &n.udp
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if udpHeadersLen+len(payload) > len(s.buf) {
+		return errors.New("udp payload too large")
+	}
+	const ipLenInWords = 5
+	s.pkt.Eth = eth.EthernetHeader{
+		Destination:     mac,
+		Source:          n.stack.HardwareAddr6(),
+		SizeOrEtherType: uint16(eth.EtherTypeIPv4),
+	}
+	s.pkt.IP = eth.IPv4Header{
+		Source:        n.stack.Addr().As4(),
+		Destination:   dst.Addr().As4(),
+		VersionAndIHL: ipLenInWords,
+		TotalLength:   4*ipLenInWords + eth.SizeUDPHeader + uint16(len(payload)),
+		Protocol:      17, // UDP
+		TTL:           ttl,
+		ID:            s.pkt.IP.ID + 1,
+		Flags:         0x40 << 8, // Don't fragment.
+	}
+	s.pkt.IP.Checksum = s.pkt.IP.CalculateChecksum()
+	s.pkt.UDP = eth.UDPHeader{
+		SourcePort:      lport,
+		DestinationPort: dst.Port(),
+		Length:          eth.SizeUDPHeader + uint16(len(payload)),
+	}
+	s.pkt.UDP.Checksum = s.pkt.UDP.CalculateChecksumIPv4(&s.pkt.IP, payload)
+	s.pkt.PutHeaders(s.buf[:])
+	k := copy(s.buf[udpHeadersLen:], payload)
+	return n.dev.SendEth(s.buf[:udpHeadersLen+k])
+}
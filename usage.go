@@ -0,0 +1,68 @@
+// Copyright ©2025 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build http || !bluetooth
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"time"
+)
+
+const (
+	// usagePingInterval is the time between
+	// usage pings.
+	usagePingInterval = 7 * 24 * time.Hour
+
+	// usagePingPoll is the time between checks
+	// for whether a usage ping is due.
+	usagePingPoll = time.Hour
+)
+
+// usagePing is the body of a usage ping. It holds nothing that identifies
+// the device or its user.
+type usagePing struct {
+	Version  string          `json:"version"`
+	Features map[string]bool `json:"features"`
+}
+
+// runUsagePing posts a usage ping to the configured URL once a week until
+// ctx is cancelled. Pings are only sent once the clock has been synced so
+// that the time of the last ping can be persisted across restarts.
+func (m *mitm) runUsagePing(ctx context.Context, n *netStack) {
+	log := m.logFor("wifi")
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(usagePingPoll):
+		}
+		u := m.config().UsagePing.URL
+		if u == "" || !m.clock.isSynced() {
+			continue
+		}
+		now := m.clock.now()
+		if now.Sub(m.store.get().LastUsagePing) < usagePingInterval {
+			continue
+		}
+		body, err := json.Marshal(usagePing{Version: firmwareVersion(), Features: m.features()})
+		if err != nil {
+			log.LogAttrs(ctx, slog.LevelError, "marshal usage ping", slog.Any("err", err))
+			continue
+		}
+		log.LogAttrs(ctx, slog.LevelInfo, "send usage ping", slog.String("url", u))
+		err = n.hook.post(ctx, n, u, "", body)
+		if err != nil {
+			log.LogAttrs(ctx, slog.LevelWarn, "send usage ping", slog.Any("err", err))
+			continue
+		}
+		err = m.store.update(func(p *persistent) { p.LastUsagePing = now })
+		if err != nil {
+			log.LogAttrs(ctx, slog.LevelError, "persist usage ping time", slog.Any("err", err))
+		}
+	}
+}
@@ -0,0 +1,42 @@
+// Copyright ©2025 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import "runtime/debug"
+
+// version is the firmware version. It is set at build time with
+// -ldflags "-X main.version=<version>".
+var version = "devel"
+
+// firmwareVersion returns the firmware version. If no version was set at
+// build time, the VCS revision recorded in the build information is used
+// when it is available.
+func firmwareVersion() string {
+	if version != "devel" {
+		return version
+	}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return version
+	}
+	var rev string
+	var modified bool
+	for _, s := range info.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			rev = s.Value
+		case "vcs.modified":
+			modified = s.Value == "true"
+		}
+	}
+	if rev == "" {
+		return version
+	}
+	rev = version + "-" + rev[:min(len(rev), 12)]
+	if modified {
+		rev += "+dirty"
+	}
+	return rev
+}
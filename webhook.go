@@ -0,0 +1,134 @@
+// Copyright ©2025 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build http || !bluetooth
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/soypat/seqs/stacks"
+)
+
+// webhook is a client for posting JSON documents to an HTTP endpoint.
+type webhook struct {
+	mu   sync.Mutex
+	conn *stacks.TCPConn
+}
+
+// post sends body to the http URL u as an application/json POST request
+// and returns an error if the request fails or the response status is
+// not 2xx. If secret is not empty, the request carries an
+// X-Hub-Signature-256 header holding the hex-encoded HMAC-SHA256 of
+// body keyed with secret.
+func (h *webhook) post(ctx context.Context, n *netStack, u, secret string, body []byte) error {
+	_, err := h.do(ctx, n, "POST", u, secret, body, nil)
+	return err
+}
+
+// get sends a GET request to the http URL u and returns an error if the
+// request fails or the response status is not 2xx. The start of the
+// response body is read into resp, and the number of bytes read is
+// returned.
+func (h *webhook) get(ctx context.Context, n *netStack, u string, resp []byte) (int, error) {
+	return h.do(ctx, n, "GET", u, "", nil, resp)
+}
+
+// do implements post and get. body is only sent with a POST request.
+func (h *webhook) do(ctx context.Context, n *netStack, method, u, secret string, body, resp []byte) (int, error) {
+	dst, err := url.Parse(u)
+	if err != nil {
+		return 0, err
+	}
+	if dst.Scheme != "http" {
+		return 0, fmt.Errorf("unsupported webhook scheme: %q", dst.Scheme)
+	}
+	host := dst.Host
+	if dst.Port() == "" {
+		host += ":80"
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.conn == nil {
+		const bufLen = 1024
+		h.conn, err = stacks.NewTCPConn(n.stack, stacks.TCPConnConfig{
+			TxBufSize: bufLen,
+			RxBufSize: bufLen,
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	err = n.dial(ctx, h.conn, host)
+	if err != nil {
+		return 0, err
+	}
+	defer hangUp(h.conn)
+	h.conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	w := bufio.NewWriter(h.conn)
+	fmt.Fprintf(w, "%s %s HTTP/1.1\r\n", method, dst.RequestURI())
+	fmt.Fprintf(w, "Host: %s\r\n", dst.Host)
+	if method == "POST" {
+		fmt.Fprintf(w, "Content-Type: application/json\r\n")
+		fmt.Fprintf(w, "Content-Length: %d\r\n", len(body))
+	}
+	if secret != "" {
+		fmt.Fprintf(w, "X-Hub-Signature-256: sha256=%x\r\n", signature(secret, body))
+	}
+	fmt.Fprintf(w, "Connection: close\r\n\r\n")
+	w.Write(body)
+	err = w.Flush()
+	if err != nil {
+		return 0, err
+	}
+
+	r := bufio.NewReader(h.conn)
+	status, err := r.ReadString('\n')
+	if err != nil {
+		return 0, err
+	}
+	_, code, _ := strings.Cut(status, " ")
+	if !strings.HasPrefix(code, "2") {
+		return 0, fmt.Errorf("webhook failed: %s", strings.TrimSpace(code))
+	}
+	if len(resp) == 0 {
+		return 0, nil
+	}
+	// Skip the headers.
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return 0, err
+		}
+		if strings.TrimSpace(line) == "" {
+			break
+		}
+	}
+	// The connection is closed by the server
+	// at the end of a short body.
+	k, err := io.ReadFull(r, resp)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	return k, err
+}
+
+// signature returns the HMAC-SHA256 of body keyed with secret.
+func signature(secret string, body []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return mac.Sum(nil)
+}
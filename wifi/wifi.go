@@ -52,6 +52,9 @@ var (
 
 const mtu = cyw43439.MTU
 
+// joinRetry is the delay between attempts to join the network.
+const joinRetry = 5 * time.Second
+
 type SetupConfig struct {
 	// DHCP requested hostname.
 	Hostname string
@@ -61,6 +64,47 @@ type SetupConfig struct {
 	UDPPorts uint16
 	// Number of TCP ports to open for the stack.
 	TCPPorts uint16
+	// Associated indicates the device is already
+	// joined to the network, so only the stack is
+	// set up.
+	Associated bool
+	// Stop, if not nil, stops the stack's packet
+	// handling when closed.
+	Stop <-chan struct{}
+	// Stall, if not nil, is called before each
+	// round of packet handling, and no packets
+	// are handled while it returns true.
+	Stall func() bool
+	// JoinTimeout is the longest time to spend
+	// trying to join the network before returning
+	// ErrJoinTimeout. If zero, joining is retried
+	// indefinitely.
+	JoinTimeout time.Duration
+	// Credentials, if not nil, is called before
+	// each attempt to join the network to obtain
+	// the SSID and password. If it is nil or
+	// returns an empty SSID, the credentials built
+	// in from ssid.text and password.text are used.
+	Credentials func() (ssid, password string)
+}
+
+// ErrJoinTimeout is returned by SetupWithDHCP when the network could not
+// be joined within the configured JoinTimeout.
+var ErrJoinTimeout = errors.New("timed out joining wifi")
+
+// errNoCredentials is the failure to join when no SSID is available.
+var errNoCredentials = errors.New("no wifi credentials")
+
+// credentials returns the network credentials from fn, falling back to
+// the built-in credentials.
+func credentials(fn func() (ssid, password string)) (string, string) {
+	if fn != nil {
+		s, p := fn()
+		if s != "" {
+			return s, p
+		}
+	}
+	return ssid, pass
 }
 
 var nolog = slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{
@@ -83,18 +127,37 @@ func SetupWithDHCP(dev *cyw43439.Device, cfg SetupConfig, log *slog.Logger) (*st
 		}
 	}
 
-	if pass == "" {
-		log.Info("joining open network:", slog.String("ssid", ssid))
-	} else {
-		log.Info("joining WPA secure network", slog.String("ssid", ssid), slog.Int("passlen", len(pass)))
+	var deadline time.Time
+	if cfg.JoinTimeout > 0 {
+		deadline = time.Now().Add(cfg.JoinTimeout)
 	}
-	for {
-		err = dev.JoinWPA2(ssid, pass)
+	var last string
+	for first := true; !cfg.Associated; first = false {
+		ssid, pass := credentials(cfg.Credentials)
+		if first || ssid != last {
+			switch {
+			case ssid == "":
+				log.Warn("no wifi credentials")
+			case pass == "":
+				log.Info("joining open network:", slog.String("ssid", ssid))
+			default:
+				log.Info("joining WPA secure network", slog.String("ssid", ssid), slog.Int("passlen", len(pass)))
+			}
+			last = ssid
+		}
+		if ssid == "" {
+			err = errNoCredentials
+		} else {
+			err = dev.JoinWPA2(ssid, pass)
+		}
 		if err == nil {
 			break
 		}
 		log.Error("failed to join wifi", slog.Any("err", err))
-		time.Sleep(5 * time.Second)
+		if !deadline.IsZero() && time.Now().Add(joinRetry).After(deadline) {
+			return nil, nil, ErrJoinTimeout
+		}
+		time.Sleep(joinRetry)
 	}
 	mac, err := dev.HardwareAddr6()
 	if err != nil {
@@ -113,7 +176,7 @@ func SetupWithDHCP(dev *cyw43439.Device, cfg SetupConfig, log *slog.Logger) (*st
 	dev.RecvEthHandle(stack.RecvEth)
 
 	// Begin asynchronous packet handling.
-	go nicLoop(dev, stack)
+	go nicLoop(dev, stack, cfg.Stop, cfg.Stall)
 
 	// Perform DHCP request.
 	dhcpClient := stacks.NewDHCPClient(stack, dhcp.DefaultClientPort)
@@ -201,7 +264,10 @@ type Resolver struct {
 func NewResolver(stack *stacks.PortStack, dhcp *stacks.DHCPClient) (*Resolver, error) {
 	dnsc := stacks.NewDNSClient(stack, dns.ClientPort)
 	dnsaddrs := dhcp.DNSServers()
-	if len(dnsaddrs) > 0 && !dnsaddrs[0].IsValid() {
+	if len(dnsaddrs) == 0 {
+		return nil, errors.New("no dns addr obtained via DHCP")
+	}
+	if !dnsaddrs[0].IsValid() {
 		return nil, errors.New("dns addr obtained via DHCP not valid")
 	}
 	return &Resolver{
@@ -280,7 +346,7 @@ func (r *Resolver) dnsConfig(name dns.Name) stacks.DNSResolveConfig {
 	}
 }
 
-func nicLoop(dev *cyw43439.Device, Stack *stacks.PortStack) {
+func nicLoop(dev *cyw43439.Device, Stack *stacks.PortStack, stop <-chan struct{}, stall func() bool) {
 	// Maximum number of packets to queue before sending them.
 	const (
 		queueSize                = 3
@@ -295,6 +361,15 @@ func nicLoop(dev *cyw43439.Device, Stack *stacks.PortStack) {
 		retries[i] = 0
 	}
 	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		if stall != nil && stall() {
+			time.Sleep(51 * time.Millisecond)
+			continue
+		}
 		stallRx := true
 		// Poll for incoming packets.
 		for i := 0; i < 1; i++ {
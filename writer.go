@@ -0,0 +1,207 @@
+// Copyright ©2025 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+)
+
+var errHandsetKey = errors.New("move interrupted by handset")
+
+// Frames are written to the controller by a single writer so that frames
+// passed through from the handset and the command sequences sent for
+// remote and device commands are never interleaved. Writes are taken from
+// queues in priority order: handset frames, then stop sequences, then
+// other command sequences. A handset key press abandons a move command
+// sequence being written at its next frame, since the handset always has
+// full control, and the handset frames are then passed through. Other
+// handset frames that arrive while a sequence is being written are
+// dropped, since they would break up the key presses of the sequence.
+
+const (
+	// handsetQueueLen is the number of handset
+	// frames that may be waiting to be written.
+	handsetQueueLen = 4
+
+	// sequenceQueueLen is the number of command
+	// sequences of each priority that may be
+	// waiting to be written.
+	sequenceQueueLen = 2
+
+	// writeRetries is the number of times a
+	// failed frame write is retried.
+	writeRetries = 2
+)
+
+// writePriority is the priority of a controller write. Lower values are
+// written first.
+type writePriority int
+
+const (
+	priorityHandset writePriority = iota // Frames passed through from the handset.
+	priorityStop                         // Sequences interrupting a move.
+	priorityCommand                      // Other command sequences.
+
+	numPriorities
+)
+
+// controllerWrite is a sequence of frames to write to the controller.
+type controllerWrite struct {
+	steps []step
+
+	// abort, if not nil, is checked before each
+	// frame is written and abandons the sequence
+	// with errStopped if it returns true.
+	abort func() bool
+
+	// done, if not nil, receives the result of
+	// the write.
+	done chan<- error
+}
+
+// controllerWriter holds the queues of writes waiting to be written to the
+// controller.
+type controllerWriter struct {
+	queues [numPriorities]chan controllerWrite
+}
+
+func newControllerWriter() controllerWriter {
+	var w controllerWriter
+	for i := range w.queues {
+		n := sequenceQueueLen
+		if writePriority(i) == priorityHandset {
+			n = handsetQueueLen
+		}
+		w.queues[i] = make(chan controllerWrite, n)
+	}
+	return w
+}
+
+// next returns the highest priority waiting write, waiting for one if
+// none is queued. It returns false if ctx is cancelled.
+func (w *controllerWriter) next(ctx context.Context) (writePriority, controllerWrite, bool) {
+	for i, q := range w.queues {
+		select {
+		case c := <-q:
+			return writePriority(i), c, true
+		default:
+		}
+	}
+	select {
+	case c := <-w.queues[priorityHandset]:
+		return priorityHandset, c, true
+	case c := <-w.queues[priorityStop]:
+		return priorityStop, c, true
+	case c := <-w.queues[priorityCommand]:
+		return priorityCommand, c, true
+	case <-ctx.Done():
+		return 0, controllerWrite{}, false
+	}
+}
+
+// runWriter writes queued frames to the controller until ctx is cancelled.
+func (m *mitm) runWriter(ctx context.Context) {
+	log := m.logFor("uart")
+	for {
+		prio, c, ok := m.writer.next(ctx)
+		if !ok {
+			return
+		}
+		err := m.writeSteps(c)
+		if c.done != nil {
+			c.done <- err
+		} else if err != nil {
+			log.LogAttrs(ctx, slog.LevelError, "write to controller", slog.Any("err", err))
+		}
+		if prio == priorityHandset || err != nil {
+			// Pass through handset frames held back
+			// by an abandoned sequence.
+			continue
+		}
+		// Drop handset frames that arrived while
+		// the sequence was being written. This is
+		// the only receiver, so the queue cannot be
+		// emptied by another.
+		dropped := 0
+		for len(m.writer.queues[priorityHandset]) != 0 {
+			<-m.writer.queues[priorityHandset]
+			dropped++
+		}
+		if dropped != 0 {
+			log.LogAttrs(ctx, slog.LevelDebug, "drop handset frames", slog.Int("dropped", dropped))
+		}
+	}
+}
+
+// writeSteps writes the frames of c to the controller.
+func (m *mitm) writeSteps(c controllerWrite) error {
+	for _, s := range c.steps {
+		for range s.repeat {
+			if c.abort != nil && c.abort() {
+				return errStopped
+			}
+			err := m.writeFrame(s.frame)
+			time.Sleep(m.line.gap())
+			if err != nil {
+				return err
+			}
+		}
+		time.Sleep(s.delay)
+	}
+	return nil
+}
+
+// writeFrame writes p to the controller UART, retrying the unwritten part
+// of the frame up to writeRetries times if the write fails.
+func (m *mitm) writeFrame(p []byte) error {
+	var err error
+	for range writeRetries + 1 {
+		var n int
+		n, err = m.controller.Write(p)
+		m.metrics.controller.bytesWritten.Add(uint64(n))
+		if err == nil {
+			return nil
+		}
+		p = p[n:]
+	}
+	return err
+}
+
+// writeController queues steps to be written to the controller at prio
+// and waits until they have been written. If abort is not nil, the steps
+// are abandoned with errStopped when it returns true.
+func (m *mitm) writeController(ctx context.Context, prio writePriority, steps []step, abort func() bool) error {
+	done := make(chan error, 1)
+	select {
+	case m.writer.queues[prio] <- controllerWrite{steps: steps, abort: abort, done: done}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// passFrame queues a copy of the handset frame p to be written to the
+// controller without waiting. It returns false if the frame was dropped
+// because the queue is full or the self-test is using the UARTs.
+func (m *mitm) passFrame(p []byte) bool {
+	if m.diag.Load() {
+		return false
+	}
+	select {
+	case m.writer.queues[priorityHandset] <- controllerWrite{steps: []step{{frame: bytes.Clone(p), repeat: 1}}}:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,222 @@
+// Copyright ©2025 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build http || !bluetooth
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A minimal RFC 6455 WebSocket server sufficient for pushing short
+// text messages to a browser.
+
+// wsGUID is the key suffix used to compute the handshake accept key.
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WebSocket frame opcodes.
+const (
+	wsText  = 0x1
+	wsClose = 0x8
+	wsPing  = 0x9
+	wsPong  = 0xa
+)
+
+// maxWSRead is the largest client frame payload that is accepted. Clients
+// are only expected to send control frames.
+const maxWSRead = 125
+
+var (
+	errNotWebSocket = errors.New("not a websocket upgrade request")
+	errWSFrame      = errors.New("invalid websocket frame")
+)
+
+// wsConn is a server WebSocket connection.
+type wsConn struct {
+	rw  *bufio.ReadWriter
+	c   io.Closer
+	buf [maxWSRead]byte
+}
+
+// upgradeWS completes the WebSocket handshake for r and returns the
+// hijacked connection.
+func upgradeWS(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	if !headerContains(r.Header, "Connection", "upgrade") || !headerContains(r.Header, "Upgrade", "websocket") {
+		return nil, errNotWebSocket
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		return nil, errors.New("unsupported websocket version")
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		return nil, errors.New("missing websocket key")
+	}
+	h, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, errors.New("connection cannot be hijacked")
+	}
+	c, rw, err := h.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	sum := sha1.Sum([]byte(key + wsGUID))
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	rw.WriteString("Upgrade: websocket\r\n")
+	rw.WriteString("Connection: Upgrade\r\n")
+	rw.WriteString("Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n\r\n")
+	err = rw.Flush()
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return &wsConn{rw: rw, c: c}, nil
+}
+
+// headerContains returns whether the comma-separated header values for key
+// contain tok, ignoring case.
+func headerContains(h http.Header, key, tok string) bool {
+	for _, v := range h.Values(key) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), tok) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// write sends an unfragmented frame with the opcode and payload.
+func (c *wsConn) write(op byte, payload []byte) error {
+	var hdr [4]byte
+	hdr[0] = 0x80 | op // FIN.
+	n := 2
+	switch {
+	case len(payload) < 126:
+		hdr[1] = byte(len(payload))
+	case len(payload) <= 0xffff:
+		hdr[1] = 126
+		binary.BigEndian.PutUint16(hdr[2:], uint16(len(payload)))
+		n = 4
+	default:
+		return errors.New("websocket message too long")
+	}
+	c.rw.Write(hdr[:n])
+	c.rw.Write(payload)
+	return c.rw.Flush()
+}
+
+// read returns the opcode and payload of the next frame from the client.
+// The payload is only valid until the next call to read.
+func (c *wsConn) read() (op byte, payload []byte, err error) {
+	var hdr [2]byte
+	_, err = io.ReadFull(c.rw, hdr[:])
+	if err != nil {
+		return 0, nil, err
+	}
+	op = hdr[0] & 0x0f
+	n := int(hdr[1] & 0x7f)
+	if hdr[1]&0x80 == 0 || n > maxWSRead {
+		// Client frames must be masked, and
+		// long payloads are not expected.
+		return 0, nil, errWSFrame
+	}
+	var mask [4]byte
+	_, err = io.ReadFull(c.rw, mask[:])
+	if err != nil {
+		return 0, nil, err
+	}
+	payload = c.buf[:n]
+	_, err = io.ReadFull(c.rw, payload)
+	if err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return op, payload, nil
+}
+
+// Close closes the underlying connection.
+func (c *wsConn) Close() error {
+	return c.c.Close()
+}
+
+// maxStream is the longest time a client may stream events.
+const maxStream = 10 * time.Minute
+
+// streamHeight sends the current height and then each height change from
+// sub to the client as JSON text messages, until the client closes the
+// connection, ctx is cancelled or maxStream has elapsed.
+func (m *mitm) streamHeight(ctx context.Context, ws *wsConn, sub *subscription) error {
+	ctx, cancel := context.WithTimeout(ctx, maxStream)
+	defer cancel()
+
+	// Handle control frames from the client, ending the
+	// stream when it closes the connection.
+	var mu sync.Mutex // Guards writes to ws.
+	go func() {
+		defer cancel()
+		for {
+			op, payload, err := ws.read()
+			if err != nil {
+				return
+			}
+			switch op {
+			case wsPing:
+				mu.Lock()
+				err = ws.write(wsPong, payload)
+				mu.Unlock()
+				if err != nil {
+					return
+				}
+			case wsClose:
+				return
+			}
+		}
+	}()
+
+	var buf []byte
+	send := func(p position) error {
+		buf = append(buf[:0], `{"height":`...)
+		buf = strconv.AppendFloat(buf, p.units(), 'f', -1, 64)
+		buf = append(buf, '}')
+		mu.Lock()
+		defer mu.Unlock()
+		return ws.write(wsText, buf)
+	}
+	if m.heightKnown.Load() {
+		err := send(m.position.Load().(position))
+		if err != nil {
+			return err
+		}
+	}
+	for {
+		e, _, err := sub.next(ctx)
+		if err != nil {
+			mu.Lock()
+			ws.write(wsClose, []byte{0x03, 0xe8}) // Normal closure.
+			mu.Unlock()
+			if err == context.DeadlineExceeded || err == context.Canceled {
+				return nil
+			}
+			return err
+		}
+		err = send(e.pos)
+		if err != nil {
+			return err
+		}
+	}
+}